@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
-	"reflect"
 
 	"gopkg.in/ldap.v2"
 )
@@ -27,24 +27,10 @@ type Account struct {
 	Descriptions   []string `json:"descriptions"`
 }
 
-// Convert ldapsearchの結果をAccount型に変換します。
+// Convert ldapsearchの結果を標準の属性名でAccount型に変換します。
 func (a Account) ConvertFromLdap(entries []*ldap.Entry) *[]Account {
-	accounts := []Account{}
-	for _, entry := range entries {
-		var account = Account{}
-		account.Dn = entry.DN
-		account.UID = entry.GetAttributeValue("uid")
-		account.Email = entry.GetAttributeValue("email")
-		account.EmployeeNumber = entry.GetAttributeValue("employeeNumber")
-
-		descriptions := entry.GetAttributeValues("description")
-		for _, desc := range descriptions {
-			account.Descriptions = append(account.Descriptions, desc)
-		}
-		accounts = append(accounts, account)
-	}
+	accounts := ConvertEntries(entries, defaultAttributes)
 	return &accounts
-
 }
 
 // OutJSON jsonファイルに吐き出します
@@ -55,58 +41,71 @@ func (a Account) OutJSON(fileNm string, accounts *[]Account) (err error) {
 		return err
 	}
 
-	return ioutil.WriteFile(fileNm, jsonBytes, 0644)
+	return atomicWriteFile(fileNm, jsonBytes, 0644)
 
 }
 
-// LoadJSON JSONから読み込みます
+// LoadJSON JSONから読み込みます（ファイルが存在しない場合は空）
 func (a Account) LoadJSON(fileNm string) (accouts *[]Account, err error) {
-
-	file, err := os.OpenFile(fileNm, os.O_RDONLY|os.O_CREATE, 0644) // 存在しなければ作成
-	if err != nil {
-		return
+	var accounts []Account
+	data, err := ioutil.ReadFile(fileNm)
+	if os.IsNotExist(err) {
+		return &accounts, nil
+	} else if err != nil {
+		return nil, err
 	}
-	defer file.Close()
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
-		return
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("invalid json file %s: %v", fileNm, err)
 	}
-	var accounts []Account
-	json.Unmarshal(data, &accounts)
 	return &accounts, nil
 }
 
+// FieldChange 項目ごとの差分
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// AccountDiff 差分のあるアカウント
+type AccountDiff struct {
+	Account               // 新しい値（DELETEの場合は削除される値）
+	Changes []FieldChange `json:"changes,omitempty"` // UPDATEの変更項目
+}
+
+// DiffResult CreateKey、UpdateKey、DeleteKey毎の差分
+type DiffResult map[string][]AccountDiff
+
+// Accounts keyの差分のAccountだけを返します
+func (d DiffResult) Accounts(key string) []Account {
+	var accounts []Account
+	for _, data := range d[key] {
+		accounts = append(accounts, data.Account)
+	}
+	return accounts
+}
+
 // Diff 差分をチェックして作成、修正、削除が必要なLdapAccountを返します。
 func (a Account) Diff(old, new *[]Account) (result map[string][]Account, err error) {
 
-	result = make(map[string][]Account)
-	commonData := make(map[string]Account)
-
-	// oldとnewで同一DNの更新をチェック、差分がある場合は更新リストに追加
-	for _, oldData := range *old {
-		for _, newData := range *new {
-			if oldData.Dn != newData.Dn {
-				continue
-			}
-			commonData[newData.Dn] = newData
-			if !reflect.DeepEqual(oldData, newData) {
-				result[UpdateKey] = append(result[UpdateKey], newData)
-			}
-			break
-		}
-	}
-	// old側にしか存在しないデータは削除リストに追加
-	for _, data := range *old {
-		if _, ok := commonData[data.Dn]; !ok {
-			result[DeleteKey] = append(result[DeleteKey], data)
-		}
+	detail, err := a.DiffDetail(old, new)
+	if err != nil {
+		return nil, err
 	}
-	// new側にしか存在しないデータは新規作成リストに追加
-	for _, data := range *new {
-		if _, ok := commonData[data.Dn]; !ok {
-			result[CreateKey] = append(result[CreateKey], data)
-		}
+	result = make(map[string][]Account)
+	for key := range detail {
+		result[key] = detail.Accounts(key)
 	}
-
 	return result, nil
 }
+
+// DiffDetail DNをキーに差分をチェックして、作成、修正（変更項目付き）、削除が必要なLdapAccountを返します。
+// 項目の比較はDefaultMappingのルールで行います。
+func (a Account) DiffDetail(old, new *[]Account) (result DiffResult, err error) {
+	return DefaultMapping().Diff(old, new)
+}
+
+// Changes newとの項目ごとの差分を返します
+func (a Account) Changes(new Account) []FieldChange {
+	return DefaultMapping().Changes(a, new)
+}
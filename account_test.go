@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"testing"
 
 	ldap "gopkg.in/ldap.v2"
@@ -169,3 +170,51 @@ func TestDiff(t *testing.T) {
 	}
 
 }
+
+func TestDiffDetail(t *testing.T) {
+	var account = Account{}
+
+	testOld := []Account{testAccounts[0], testAccounts[1]}
+	testNew := []Account{
+		testAccounts[0],
+		{
+			Dn:             "uid=bbb_user,dc=example,dc=com",
+			UID:            "bbb_user",
+			Email:          "bbb_new@example.com", // mod
+			EmployeeNumber: "EMP_NO002",
+			Descriptions:   []string{"desc bbb", "desc bbb2"}, // mod
+		},
+	}
+	result, err := account.DiffDetail(&testOld, &testNew)
+	if err != nil {
+		t.Fatalf("account.DiffDetail exec fatal:%v", err)
+	}
+	if len(result[UpdateKey]) != 1 {
+		t.Fatalf("account.DiffDetail update list count wrong: %d", len(result[UpdateKey]))
+	}
+	changes := result[UpdateKey][0].Changes
+	if len(changes) != 2 ||
+		changes[0].Field != "email" || changes[0].Old != "bbb_user@example.com" || changes[0].New != "bbb_new@example.com" ||
+		changes[1].Field != "description" || changes[1].Old != "desc bbb" || changes[1].New != "desc bbb, desc bbb2" {
+		t.Errorf("account.DiffDetail changes wrong: %v", changes)
+	}
+
+	// Pattern: [Large] 件数が多くても差分を取れること
+	testOld, testNew = nil, nil
+	for i := 0; i < 40000; i++ {
+		data := Account{Dn: fmt.Sprintf("uid=user%05d,dc=example,dc=com", i), UID: fmt.Sprintf("user%05d", i)}
+		testOld = append(testOld, data)
+		if i%100 == 0 {
+			data.Email = "mod@example.com"
+		}
+		testNew = append(testNew, data)
+	}
+	result, err = account.DiffDetail(&testOld, &testNew)
+	if err != nil {
+		t.Fatalf("account.DiffDetail [Large]exec fatal:%v", err)
+	}
+	if len(result[UpdateKey]) != 400 || len(result[CreateKey]) != 0 || len(result[DeleteKey]) != 0 {
+		t.Errorf("account.DiffDetail [Large]count wrong: update %d, create %d, delete %d",
+			len(result[UpdateKey]), len(result[CreateKey]), len(result[DeleteKey]))
+	}
+}
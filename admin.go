@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// admin lookups アカウントの検索（子プロセス）の同時実行数とタイムアウト
+const (
+	adminLookupLimit   = 4
+	adminLookupTimeout = 30 * time.Second
+)
+
+// adminLookupPath LookupTokenで許可するパス
+const adminLookupPath = "/api/accounts"
+
+// AdminServer serveの管理API（Authorization: Bearer <token>）。
+// ヘルプデスクがシェルを使わずに実行、plan、アカウントを確認できるようにします。
+type AdminServer struct {
+	Daemon *Daemon
+	Token  string
+	// LookupToken GET /api/accountsだけを許可するトークン（空の場合は使えません）
+	LookupToken string
+	// Lookup アカウントを検索します（lookup -format jsonの出力と終了コード、ctxが終了したら中断します）
+	Lookup func(ctx context.Context, query string) ([]byte, int)
+	// LookupTimeout 1回の検索のタイムアウト（0の場合はadminLookupTimeout）
+	LookupTimeout time.Duration
+
+	lookups chan struct{} // 実行中の検索（adminLookupLimitまで）
+}
+
+// Handler 管理APIのhttp.Handler
+func (a *AdminServer) Handler() http.Handler {
+	a.lookups = make(chan struct{}, adminLookupLimit)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", a.method(http.MethodGet, a.status))
+	mux.HandleFunc("/api/sync", a.method(http.MethodPost, a.sync))
+	mux.HandleFunc("/api/plan", a.method(http.MethodGet, a.plan))
+	mux.HandleFunc("/api/runs/last", a.method(http.MethodGet, a.lastRun))
+	mux.HandleFunc(adminLookupPath, a.method(http.MethodGet, a.account))
+	mux.HandleFunc("/api/pause", a.method(http.MethodPost, a.pause))
+	mux.HandleFunc("/api/resume", a.method(http.MethodPost, a.resume))
+	return a.auth(mux)
+}
+
+func (a *AdminServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		switch {
+		case tokenEqual(token, a.Token):
+		case tokenEqual(token, a.LookupToken):
+			if r.URL.Path != adminLookupPath {
+				writeError(w, http.StatusForbidden, "the lookup token only allows GET "+adminLookupPath)
+				return
+			}
+		default:
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		slog.Debug("admin: request", logAttrs(logOpServe, "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)...)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenEqual tokenが空でないexpectedと一致する場合はtrue
+func tokenEqual(token, expected string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func (a *AdminServer) method(method string, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// status 一時停止、実行中、最後の実行
+func (a *AdminServer) status(w http.ResponseWriter, r *http.Request) {
+	pause, err := a.Daemon.Paused()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	running, last := a.Daemon.Status()
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"paused": pause, "running": running, "last": last})
+}
+
+// sync planとapplyをすぐに開始します（一時停止中はplanだけ）
+func (a *AdminServer) sync(w http.ResponseWriter, r *http.Request) {
+	status, ok := a.Daemon.Trigger("api")
+	if !ok {
+		writeJSONResponse(w, http.StatusConflict, map[string]interface{}{"error": "a run is in progress", "running": status})
+		return
+	}
+	writeJSONResponse(w, http.StatusAccepted, status)
+}
+
+// plan 最後に保存したplan
+func (a *AdminServer) plan(w http.ResponseWriter, r *http.Request) {
+	plan, err := LoadPlan(a.Daemon.PlanPath, a.Daemon.Key)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "no plan yet")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, plan)
+}
+
+// lastRun 最後の実行とその同期履歴
+func (a *AdminServer) lastRun(w http.ResponseWriter, r *http.Request) {
+	_, last := a.Daemon.Status()
+	if last == nil {
+		writeError(w, http.StatusNotFound, "no run yet")
+		return
+	}
+	var entries []JournalEntry
+	if last.RunID != "" {
+		var err error
+		if entries, err = ReadJournal(a.Daemon.JournalPath, last.RunID); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"run": last, "journal": entries})
+}
+
+// account ?q=のアカウント（DN、uid、email、employeeNumber）のLDAP、状態、Okta、同期されていない理由
+func (a *AdminServer) account(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, "q (dn, uid, email or employeeNumber) is required")
+		return
+	}
+	select {
+	case a.lookups <- struct{}{}:
+		defer func() { <-a.lookups }()
+	default:
+		writeError(w, http.StatusTooManyRequests, "too many lookups in progress, try again later")
+		return
+	}
+	timeout := a.LookupTimeout
+	if timeout <= 0 {
+		timeout = adminLookupTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	output, code := a.Lookup(ctx, query)
+	if ctx.Err() == context.DeadlineExceeded {
+		writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("lookup timed out after %s", timeout))
+		return
+	}
+	if code != exitOK {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("lookup failed with exit code %d, see the serve log", code))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(output)
+}
+
+// pause 自動反映を一時停止します（body: {"by": "...", "reason": "..."}）
+func (a *AdminServer) pause(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		By     string `json:"by"`
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if request.By == "" {
+		request.By = r.RemoteAddr
+	}
+	pause, err := a.Daemon.Pause(request.By, request.Reason)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"paused": pause})
+}
+
+// resume 自動反映を再開します
+func (a *AdminServer) resume(w http.ResponseWriter, r *http.Request) {
+	if err := a.Daemon.Resume(r.RemoteAddr); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"paused": nil})
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSONResponse(w, status, map[string]string{"error": message})
+}
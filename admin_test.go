@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdminServer(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var calls []string
+	release := make(chan struct{})
+	daemon := &Daemon{
+		Run: func(name string, args ...string) int {
+			mu.Lock()
+			calls = append(calls, name)
+			mu.Unlock()
+			if name == "plan" {
+				<-release
+				plan, _ := NewPlan(State{}, DiffResult{CreateKey: {{Account: testAccounts[0]}}})
+				plan.Save(args[1], nil)
+			}
+			return exitOK
+		},
+		PlanPath:    filepath.Join(dir, "state.json.plan.json"),
+		PausePath:   filepath.Join(dir, "state.json.paused"),
+		JournalPath: filepath.Join(dir, "journal.jsonl"),
+	}
+	held := make(chan struct{})
+	unhold := make(chan struct{})
+	admin := &AdminServer{Daemon: daemon, Token: "secret", LookupToken: "helpdesk", LookupTimeout: 100 * time.Millisecond,
+		Lookup: func(ctx context.Context, query string) ([]byte, int) {
+			switch query {
+			case "broken":
+				return nil, exitError
+			case "slow":
+				<-ctx.Done()
+				return nil, exitError
+			case "hold":
+				held <- struct{}{}
+				<-unhold
+			}
+			return []byte(`{"query":"` + query + `"}`), exitOK
+		}}
+	server := httptest.NewServer(admin.Handler())
+	defer server.Close()
+
+	request := func(method, path, token, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var result map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&result)
+		return res.StatusCode, result
+	}
+
+	// Pattern: [Auth] トークンがない、誤っている場合は401
+	if code, _ := request("GET", "/api/status", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("AdminServer [Auth]no token wrong: %d", code)
+	}
+	if code, _ := request("GET", "/api/status", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("AdminServer [Auth]wrong token wrong: %d", code)
+	}
+	if code, _ := request("GET", "/api/sync", "secret", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("AdminServer [Method]wrong: %d", code)
+	}
+	if code, _ := request("GET", "/api/plan", "secret", ""); code != http.StatusNotFound {
+		t.Errorf("AdminServer [Plan]no plan wrong: %d", code)
+	}
+
+	// Pattern: [Sync] 開始して、実行中の場合は409
+	if code, result := request("POST", "/api/sync", "secret", ""); code != http.StatusAccepted || result["result"] != runRunning {
+		t.Errorf("AdminServer [Sync]wrong: %d, %v", code, result)
+	}
+	if code, _ := request("POST", "/api/sync", "secret", ""); code != http.StatusConflict {
+		t.Errorf("AdminServer [Sync]running wrong: %d", code)
+	}
+	close(release)
+	daemon.Wait()
+	code, result := request("GET", "/api/runs/last", "secret", "")
+	if run, _ := result["run"].(map[string]interface{}); code != http.StatusOK || run["result"] != runOK || run["applied"] != true {
+		t.Errorf("AdminServer [Sync]last run wrong: %d, %v", code, result)
+	}
+	if code, result := request("GET", "/api/plan", "secret", ""); code != http.StatusOK || result["diff"] == nil {
+		t.Errorf("AdminServer [Plan]wrong: %d, %v", code, result)
+	}
+
+	// Pattern: [Pause] 一時停止中はplanだけ実行する
+	if code, result := request("POST", "/api/pause", "secret", `{"by":"helpdesk","reason":"incident"}`); code != http.StatusOK || result["paused"] == nil {
+		t.Errorf("AdminServer [Pause]wrong: %d, %v", code, result)
+	}
+	calls = nil
+	if !daemon.RunSync("schedule") {
+		t.Fatal("Daemon.RunSync [Pause]not started")
+	}
+	if _, last := daemon.Status(); len(calls) != 1 || last.Result != runPlanned || last.Applied {
+		t.Errorf("Daemon.RunSync [Pause]wrong: %v, %+v", calls, last)
+	}
+	if code, result := request("GET", "/api/status", "secret", ""); code != http.StatusOK || result["paused"] == nil {
+		t.Errorf("AdminServer [Pause]status wrong: %d, %v", code, result)
+	}
+	if code, _ := request("POST", "/api/resume", "secret", ""); code != http.StatusOK {
+		t.Errorf("AdminServer [Resume]wrong: %d", code)
+	}
+	if pause, _ := daemon.Paused(); pause != nil {
+		t.Errorf("Daemon.Paused [Resume]still paused: %+v", pause)
+	}
+
+	// Pattern: [Account] lookupの出力を返す（失敗した場合は502）
+	if code, result := request("GET", "/api/accounts?q=aaa_user", "secret", ""); code != http.StatusOK || result["query"] != "aaa_user" {
+		t.Errorf("AdminServer [Account]wrong: %d, %v", code, result)
+	}
+	if code, _ := request("GET", "/api/accounts", "secret", ""); code != http.StatusBadRequest {
+		t.Errorf("AdminServer [Account]no query wrong: %d", code)
+	}
+	if code, _ := request("GET", "/api/accounts?q=broken", "secret", ""); code != http.StatusBadGateway {
+		t.Errorf("AdminServer [Account]failed wrong: %d", code)
+	}
+
+	// Pattern: [Lookup Token] /api/accountsだけ許可する（それ以外は403）
+	if code, result := request("GET", "/api/accounts?q=aaa_user", "helpdesk", ""); code != http.StatusOK || result["query"] != "aaa_user" {
+		t.Errorf("AdminServer [Lookup Token]wrong: %d, %v", code, result)
+	}
+	for _, path := range []string{"/api/status", "/api/plan", "/api/runs/last"} {
+		if code, _ := request("GET", path, "helpdesk", ""); code != http.StatusForbidden {
+			t.Errorf("AdminServer [Lookup Token]%s wrong: %d", path, code)
+		}
+	}
+	if code, _ := request("POST", "/api/sync", "helpdesk", ""); code != http.StatusForbidden {
+		t.Errorf("AdminServer [Lookup Token]sync wrong: %d", code)
+	}
+
+	// Pattern: [Timeout] タイムアウトした場合は504
+	if code, _ := request("GET", "/api/accounts?q=slow", "secret", ""); code != http.StatusGatewayTimeout {
+		t.Errorf("AdminServer [Timeout]wrong: %d", code)
+	}
+
+	// Pattern: [Busy] 同時実行数を超えた場合は429
+	var wg sync.WaitGroup
+	for i := 0; i < adminLookupLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request("GET", "/api/accounts?q=hold", "secret", "")
+		}()
+		<-held
+	}
+	if code, _ := request("GET", "/api/accounts?q=aaa_user", "secret", ""); code != http.StatusTooManyRequests {
+		t.Errorf("AdminServer [Busy]wrong: %d", code)
+	}
+	close(unhold)
+	wg.Wait()
+	if code, _ := request("GET", "/api/accounts?q=aaa_user", "secret", ""); code != http.StatusOK {
+		t.Errorf("AdminServer [Busy]after wrong: %d", code)
+	}
+}
+
+func TestLastJournalRun(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.jsonl")
+	since := time.Now().UTC()
+	for i, command := range []string{"apply -plan old.json", "apply -plan plan.json", "rollback"} {
+		journal, err := OpenJournal(path, fmt.Sprintf("run-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal.Record(JournalEntry{Type: journalRunStart, Command: command})
+		journal.Close()
+	}
+	if runID := lastJournalRun(path, "apply -plan plan.json", since); runID != "run-1" {
+		t.Errorf("lastJournalRun wrong: %s", runID)
+	}
+	// Pattern: [Before] 開始前の実行は返さない
+	if runID := lastJournalRun(path, "apply -plan plan.json", since.Add(time.Hour)); runID != "" {
+		t.Errorf("lastJournalRun [Before]wrong: %s", runID)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// adopt match keys
+const (
+	matchKeyLogin          = "login"
+	matchKeyEmail          = "email"
+	matchKeyEmployeeNumber = "employeeNumber"
+)
+
+// AdoptResult 既存Oktaユーザーの取り込み結果
+type AdoptResult struct {
+	Linked            []AccountState    // 新たに紐付けたアカウント
+	MatchedBy         map[string]string // DN毎に一致したkey
+	UnmatchedAccounts []Account         // 対応するOktaユーザーが見つからないLDAPアカウント
+	UnmatchedUsers    []OktaUser        // 対応するLDAPアカウントが見つからないOktaユーザー
+	Ambiguous         []Account         // 複数のOktaユーザーに一致したLDAPアカウント
+	// Deprovisioned DEPROVISIONEDのOktaユーザーにだけ一致したLDAPアカウント（同期は再有効化しないので紐付けません）
+	Deprovisioned []Account
+}
+
+// Adopt 作成済みのOktaユーザーをkeysの順にLDAPアカウントと突き合わせ、紐付けを状態に記録します。
+// Oktaには何も作成しません。既に紐付いているアカウントはそのままにします。
+// 紐付けた状態にはOktaの現在の値を記録し、Reconcileを付けて次の同期で更新させます（ReconcileDiff）。
+// DEPROVISIONEDのOktaユーザーには紐付けません。
+func Adopt(state State, accounts []Account, users []OktaUser, keys []string) (State, AdoptResult, error) {
+	result := AdoptResult{MatchedBy: make(map[string]string)}
+	for _, key := range keys {
+		if _, ok := matchValue(key, &UserProfile{}); !ok {
+			return state, result, fmt.Errorf("unknown match key: %s", key)
+		}
+	}
+
+	// 既に紐付いているOktaユーザーは突き合わせ対象外
+	linkedUsers := make(map[string]bool)
+	linkedDns := make(map[string]bool)
+	for _, data := range state {
+		if data.OktaUserID != "" {
+			linkedUsers[data.OktaUserID] = true
+			linkedDns[dnKey(data.Dn)] = true
+		}
+	}
+
+	// key毎にOktaユーザーのindexを作成（DEPROVISIONEDのユーザーは別のindex）
+	indexes := make(map[string]map[string][]OktaUser)
+	deprovisioned := make(map[string]map[string][]OktaUser)
+	for _, key := range keys {
+		indexes[key] = make(map[string][]OktaUser)
+		deprovisioned[key] = make(map[string][]OktaUser)
+		for _, user := range users {
+			if linkedUsers[user.ID] {
+				continue
+			}
+			profile := user.UserProfile
+			if value, _ := matchValue(key, &profile); value == "" {
+				continue
+			} else if user.Status == oktaStatusDeprovisioned {
+				deprovisioned[key][value] = append(deprovisioned[key][value], user)
+			} else {
+				indexes[key][value] = append(indexes[key][value], user)
+			}
+		}
+	}
+
+	adopted := make(map[string]bool)
+	index := state.Index()
+	for _, account := range accounts {
+		if linkedDns[dnKey(account.Dn)] {
+			continue
+		}
+		user, key, ambiguous := findUser(account, keys, indexes, adopted)
+		switch {
+		case ambiguous:
+			result.Ambiguous = append(result.Ambiguous, account)
+		case user == nil:
+			if user, _, ambiguous := findUser(account, keys, deprovisioned, adopted); user != nil || ambiguous {
+				result.Deprovisioned = append(result.Deprovisioned, account)
+				continue
+			}
+			result.UnmatchedAccounts = append(result.UnmatchedAccounts, account)
+		default:
+			adopted[user.ID] = true
+			linked := AccountState{
+				Account:     adoptedAccount(account, user.UserProfile),
+				OktaUserID:  user.ID,
+				ProfileHash: user.UserProfile.Hash(),
+				Reconcile:   true,
+			}
+			index[dnKey(account.Dn)] = linked
+			result.Linked = append(result.Linked, linked)
+			result.MatchedBy[account.Dn] = key
+		}
+	}
+	for _, user := range users {
+		if !linkedUsers[user.ID] && !adopted[user.ID] && user.Status != oktaStatusDeprovisioned {
+			result.UnmatchedUsers = append(result.UnmatchedUsers, user)
+		}
+	}
+
+	// 既存の状態を保ったまま紐付けたアカウントを追加
+	next := State{}
+	for _, data := range state {
+		next = append(next, index[dnKey(data.Dn)])
+		delete(index, dnKey(data.Dn))
+	}
+	for _, data := range result.Linked {
+		if _, ok := index[dnKey(data.Dn)]; ok {
+			next = append(next, data)
+		}
+	}
+	return next, result, nil
+}
+
+// adoptedAccount Oktaユーザーの現在のprofileをLDAPアカウントの項目で表したもの（DescriptionsはOktaにないのでLDAPの値）
+func adoptedAccount(account Account, profile UserProfile) Account {
+	return Account{
+		Dn:             account.Dn,
+		UID:            profile.LastName,
+		Email:          profile.Email,
+		EmployeeNumber: profile.EmployeeNumber,
+		Descriptions:   account.Descriptions,
+	}
+}
+
+// ReconcileDiff Reconcileの付いたアカウントを、比較ルールで差分がなくてもUPDATEに加えます
+func ReconcileDiff(diff DiffResult, state State, accounts *[]Account) DiffResult {
+	updated := make(map[string]bool)
+	for _, data := range diff[UpdateKey] {
+		updated[dnKey(data.Dn)] = true
+	}
+	index := state.Index()
+	for _, account := range *accounts {
+		if data, ok := index[dnKey(account.Dn)]; ok && data.Reconcile && !updated[dnKey(account.Dn)] {
+			diff[UpdateKey] = append(diff[UpdateKey], AccountDiff{Account: account})
+		}
+	}
+	return diff
+}
+
+// findUser keysの順に一意に一致するOktaユーザーを探します
+func findUser(account Account, keys []string, indexes map[string]map[string][]OktaUser, adopted map[string]bool) (user *OktaUser, key string, ambiguous bool) {
+	for _, key := range keys {
+		value, _ := matchValue(key, account.OktaProfile())
+		if value == "" {
+			continue
+		}
+		var candidates []OktaUser
+		for _, candidate := range indexes[key][value] {
+			if !adopted[candidate.ID] {
+				candidates = append(candidates, candidate)
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return &candidates[0], key, false
+		default:
+			return nil, key, true
+		}
+	}
+	return nil, "", false
+}
+
+// matchValue 突き合わせに使う値を返します（未知のkeyはfalse）
+func matchValue(key string, profile *UserProfile) (string, bool) {
+	switch key {
+	case matchKeyLogin:
+		return strings.ToLower(strings.TrimSpace(profile.Login)), true
+	case matchKeyEmail:
+		return strings.ToLower(strings.TrimSpace(profile.Email)), true
+	case matchKeyEmployeeNumber:
+		return strings.TrimSpace(profile.EmployeeNumber), true
+	}
+	return "", false
+}
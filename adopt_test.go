@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAdopt(t *testing.T) {
+	users := []OktaUser{
+		// aaa: loginが大文字小文字違いで一致
+		{ID: "00u_aaa", UserProfile: UserProfile{Login: "AAA_user@example.com", Email: "aaa_user@example.com"}},
+		// bbb: loginは異なるがemployeeNumberで一致
+		{ID: "00u_bbb", UserProfile: UserProfile{Login: "bbb.old@example.com", Email: "bbb.old@example.com", EmployeeNumber: "EMP_NO002"}},
+		// LDAPに存在しない
+		{ID: "00u_zzz", UserProfile: UserProfile{Login: "zzz_user@example.com", Email: "zzz_user@example.com"}},
+	}
+
+	state, result, err := Adopt(State{}, testAccounts, users, []string{matchKeyLogin, matchKeyEmail, matchKeyEmployeeNumber})
+	if err != nil {
+		t.Fatalf("Adopt exec failed: %v", err)
+	}
+	if len(result.Linked) != 2 || len(state) != 2 {
+		t.Fatalf("Adopt linked count wrong: %d, state: %d", len(result.Linked), len(state))
+	}
+	index := state.Index()
+	if index[testAccounts[0].Dn].OktaUserID != "00u_aaa" || result.MatchedBy[testAccounts[0].Dn] != matchKeyLogin {
+		t.Errorf("Adopt aaa link wrong: %v", index[testAccounts[0].Dn])
+	}
+	if index[testAccounts[1].Dn].OktaUserID != "00u_bbb" || result.MatchedBy[testAccounts[1].Dn] != matchKeyEmployeeNumber {
+		t.Errorf("Adopt bbb link wrong: %v", index[testAccounts[1].Dn])
+	}
+	// Oktaの現在の値を記録し、次の同期で更新させる
+	if data := index[testAccounts[1].Dn]; data.Email != "bbb.old@example.com" || !data.Reconcile {
+		t.Errorf("Adopt bbb state wrong: %v", data)
+	}
+	if len(result.UnmatchedAccounts) != 1 || result.UnmatchedAccounts[0].Dn != testAccounts[2].Dn {
+		t.Errorf("Adopt unmatched ldap wrong: %v", result.UnmatchedAccounts)
+	}
+	if len(result.UnmatchedUsers) != 1 || result.UnmatchedUsers[0].ID != "00u_zzz" {
+		t.Errorf("Adopt unmatched okta wrong: %v", result.UnmatchedUsers)
+	}
+
+	// 既に紐付いているアカウントはそのまま
+	state, result, err = Adopt(state, testAccounts, users, []string{matchKeyLogin})
+	if err != nil {
+		t.Fatalf("Adopt [again]exec failed: %v", err)
+	}
+	if len(result.Linked) != 0 || len(state) != 2 {
+		t.Errorf("Adopt [again]linked count wrong: %d, state: %d", len(result.Linked), len(state))
+	}
+
+	// Pattern: [Ambiguous]
+	users = append(users, OktaUser{ID: "00u_ccc1", UserProfile: UserProfile{EmployeeNumber: "EMP_NO003"}})
+	users = append(users, OktaUser{ID: "00u_ccc2", UserProfile: UserProfile{EmployeeNumber: "EMP_NO003"}})
+	_, result, err = Adopt(State{}, testAccounts, users, []string{matchKeyEmployeeNumber})
+	if err != nil {
+		t.Fatalf("Adopt [Ambiguous]exec failed: %v", err)
+	}
+	if len(result.Ambiguous) != 1 || result.Ambiguous[0].Dn != testAccounts[2].Dn {
+		t.Errorf("Adopt [Ambiguous]wrong: %v", result.Ambiguous)
+	}
+
+	// Pattern: [Deprovisioned] DEPROVISIONEDのOktaユーザーには紐付けず、衝突として返す
+	users = []OktaUser{{ID: "00u_aaa", Status: oktaStatusDeprovisioned, UserProfile: UserProfile{Login: "aaa_user@example.com"}}}
+	state, result, err = Adopt(State{}, testAccounts, users, []string{matchKeyLogin})
+	if err != nil {
+		t.Fatalf("Adopt [Deprovisioned]exec failed: %v", err)
+	}
+	if len(state) != 0 || len(result.Deprovisioned) != 1 || result.Deprovisioned[0].Dn != testAccounts[0].Dn ||
+		len(result.UnmatchedUsers) != 0 || len(result.UnmatchedAccounts) != 2 {
+		t.Errorf("Adopt [Deprovisioned]wrong: %v, %+v", state, result)
+	}
+
+	// Pattern: [Unknown Key]
+	if _, _, err := Adopt(State{}, testAccounts, users, []string{"uid"}); err == nil {
+		t.Error("Adopt [Unknown Key]error not returned")
+	}
+}
+
+func TestAdoptReconcile(t *testing.T) {
+	okta := newFakeOkta()
+	srv, oktaClient := okta.start()
+	defer srv.Close()
+	okta.users["00u_aaa"] = OktaUser{ID: "00u_aaa", UserProfile: UserProfile{
+		Login: testAccounts[0].Email, Email: testAccounts[0].Email, FirstName: "Taro", LastName: testAccounts[0].UID}}
+	okta.users["00u_bbb"] = OktaUser{ID: "00u_bbb", UserProfile: UserProfile{
+		Login: "bbb.old@example.com", Email: "bbb.old@example.com", EmployeeNumber: testAccounts[1].EmployeeNumber}}
+	var users []OktaUser
+	for _, user := range okta.users {
+		users = append(users, user)
+	}
+	accounts := testAccounts[:2]
+	state, _, err := Adopt(State{}, accounts, users, []string{matchKeyLogin, matchKeyEmployeeNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pattern: [Diff] profileが同じアカウントもUPDATEになる
+	diff, _ := DefaultMapping().Diff(state.Accounts(), &accounts)
+	diff = ReconcileDiff(diff, state, &accounts)
+	if len(diff[UpdateKey]) != 2 || len(diff[CreateKey]) != 0 {
+		t.Fatalf("ReconcileDiff wrong: %v", diff)
+	}
+
+	// Pattern: [Apply] profileとグループを反映し、Reconcileを外す
+	state, failures, err := Syncer{Okta: oktaClient, Groups: []string{"everyone"}}.Apply(state, diff)
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Syncer.Apply [Reconcile]failed: %v, %v", err, failures)
+	}
+	if okta.users["00u_aaa"].FirstName != testAccounts[0].UID || okta.users["00u_bbb"].Login != testAccounts[1].Email {
+		t.Errorf("Syncer.Apply [Reconcile]profile not updated: %v", okta.users)
+	}
+	if !contains(okta.groups["00g_everyone"], "00u_aaa") || !contains(okta.groups["00g_everyone"], "00u_bbb") {
+		t.Errorf("Syncer.Apply [Reconcile]group member not added: %v", okta.groups)
+	}
+	for _, data := range state {
+		if data.Reconcile || len(data.OktaGroupIDs) != 1 {
+			t.Errorf("Syncer.Apply [Reconcile]state wrong: %v", data)
+		}
+	}
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &accounts)
+	if diff = ReconcileDiff(diff, state, &accounts); len(diff[UpdateKey]) != 0 {
+		t.Errorf("ReconcileDiff [Reconciled]wrong: %v", diff)
+	}
+}
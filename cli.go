@@ -0,0 +1,276 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// exit codes
+const (
+	exitOK      = 0
+	exitError   = 1 // 続行できないエラー（fatal）
+	exitUsage   = 2 // コマンド、フラグの誤り
+	exitPartial = 3 // 一部のアカウントの反映に失敗（次回の実行で再度反映されます）
+	exitLocked  = 4 // 他の実行が状態を更新中（何もせずに終了）
+)
+
+// options 全コマンド共通とコマンド毎のフラグ
+type options struct {
+	envFile    string
+	configFile string
+	cfg        *Config // 読み込んで検証した設定
+	verbose    bool
+	dryRun     bool
+	init       bool
+	force      bool
+	format     string
+	output     string
+	match      string
+	fix        bool
+	planFnm    string
+	runID      string
+	full       bool
+	started    time.Time       // 実行の開始（メトリクス用）
+	notifier   *RunNotifier    // 実行の通知（notifyを付けたコマンドだけ）
+	stop       <-chan struct{} // 閉じた場合は実行中のアカウントの反映後に中断します（sync、applyだけ）
+}
+
+// command サブコマンド
+type command struct {
+	name    string
+	args    string // 位置引数の説明
+	summary string
+	needs   []string // 必須の設定（configLDAP, configOkta）
+	// required 必須のフラグ（設定の検証より先にチェックします）
+	required []string
+	// noConfig 実行前に設定を検証しません（keygen、config）
+	noConfig bool
+	// lock 状態を更新するコマンド（実行中はロックファイルを取得します）
+	lock bool
+	// notify 続行できないエラーで終了した場合にfailedを通知するコマンド（notify.webhooks）
+	notify bool
+	flags  func(fs *flag.FlagSet, opts *options)
+	run    func(opts *options, args []string) int
+}
+
+var commands = []command{
+	{name: "sync", summary: "plan and apply the LDAP changes to Okta (default command)", needs: []string{configLDAP, configOkta}, lock: true, notify: true,
+		flags: func(fs *flag.FlagSet, opts *options) { dryRunFlag(fs, opts); initFlag(fs, opts); fullFlag(fs, opts) },
+		run:   runSync},
+	{name: "plan", summary: "show the changes sync would apply, optionally save them for apply", needs: []string{configLDAP}, notify: true,
+		flags: func(fs *flag.FlagSet, opts *options) {
+			initFlag(fs, opts)
+			fullFlag(fs, opts)
+			fs.StringVar(&opts.planFnm, "out", "", "save the plan to this file")
+		},
+		run: runPlan},
+	{name: "apply", summary: "apply a saved plan (or plan and apply like sync)", needs: []string{configLDAP, configOkta}, lock: true, notify: true,
+		flags: func(fs *flag.FlagSet, opts *options) {
+			dryRunFlag(fs, opts)
+			initFlag(fs, opts)
+			fullFlag(fs, opts)
+			fs.StringVar(&opts.planFnm, "plan", "", "plan file saved by plan -out")
+		},
+		run: runApply},
+	{name: "diff", summary: "print field-level differences between LDAP and the state", needs: []string{configLDAP},
+		flags: func(fs *flag.FlagSet, opts *options) { initFlag(fs, opts); fullFlag(fs, opts); outputFlags(fs, opts) },
+		run:   runDiff},
+	{name: "watch", summary: "apply the LDAP changes to Okta as they happen (OpenLDAP syncrepl)", needs: []string{configLDAP, configOkta}, notify: true,
+		run: runWatch},
+	{name: "serve", summary: "run sync on a cron schedule until stopped", needs: []string{configLDAP, configOkta}, notify: true,
+		run: runServe},
+	{name: "export", summary: "export the LDAP accounts", needs: []string{configLDAP},
+		flags: outputFlags, run: runExport},
+	{name: "lookup", args: "<dn | uid | email | employeeNumber>", summary: "show one account in LDAP, the state and Okta, and why it is not in sync",
+		needs: []string{configLDAP, configOkta}, flags: outputFlags, run: runLookup},
+	{name: "users", summary: "list the Okta users", needs: []string{configOkta},
+		flags: outputFlags, run: runUsers},
+	{name: "groups", summary: "list the Okta groups", needs: []string{configOkta},
+		flags: outputFlags, run: runGroups},
+	{name: "state", args: "list | get <dn> | rm <dn> | migrate <json | bolt> [<path>]", summary: "inspect, edit or copy the sync state", lock: true,
+		flags: outputFlags, run: runState},
+	{name: "drift", summary: "compare the state with the live Okta users", needs: []string{configOkta}, lock: true, notify: true,
+		flags: func(fs *flag.FlagSet, opts *options) {
+			fs.BoolVar(&opts.fix, "fix", false, "overwrite Okta with the LDAP values")
+		},
+		run: runDrift},
+	{name: "adopt", summary: "link existing Okta users to LDAP accounts", needs: []string{configLDAP, configOkta}, lock: true, notify: true,
+		flags: func(fs *flag.FlagSet, opts *options) { initFlag(fs, opts); matchFlag(fs, opts) },
+		run:   runAdopt},
+	{name: "orphans", summary: "list Okta users without an LDAP account", needs: []string{configLDAP, configOkta},
+		flags: func(fs *flag.FlagSet, opts *options) { matchFlag(fs, opts); outputFlags(fs, opts) },
+		run:   runOrphans},
+	{name: "rollback", summary: "undo a run recorded in the journal", needs: []string{configOkta}, notify: true, required: []string{"run"}, lock: true,
+		flags: func(fs *flag.FlagSet, opts *options) {
+			dryRunFlag(fs, opts)
+			fs.StringVar(&opts.runID, "run", "", "run ID to roll back (see the journal)")
+		},
+		run: runRollback},
+	{name: "report", summary: "write the report of a run recorded in the journal (markdown, html, csv)",
+		flags: func(fs *flag.FlagSet, opts *options) {
+			fs.StringVar(&opts.runID, "run", "", "run ID (default: the last run in the journal)")
+			fs.StringVar(&opts.format, "format", formatMarkdown, "report format (markdown, html, csv)")
+			fs.StringVar(&opts.output, "output", "", "output file (default: stdout)")
+		},
+		run: runReport},
+	{name: "keygen", summary: "generate a state encryption key", noConfig: true, run: runKeygen},
+	{name: "rotate-key", summary: "re-encrypt the state with STATE_NEW_KEY", lock: true, run: runRotateKey},
+	{name: "config", args: "validate | show", summary: "check the configuration or print it with the secrets masked",
+		noConfig: true, run: runConfig},
+}
+
+func dryRunFlag(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "print the plan without changing Okta or the state")
+}
+
+func initFlag(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.init, "init", false, "start from an empty state (the current state is backed up on save)")
+	fs.BoolVar(&opts.force, "force", false, "with -init, discard a state that is not empty (its accounts are created again in Okta)")
+}
+
+func fullFlag(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.full, "full", false, "search all LDAP accounts even if ldap.incremental is set (deletes are applied)")
+}
+
+func matchFlag(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.match, "match", "login,email,employeeNumber", "keys to match Okta users with LDAP accounts (in order)")
+}
+
+func outputFlags(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.format, "format", formatText, "output format (text, csv, json)")
+	fs.StringVar(&opts.output, "output", "", "output file (default: stdout)")
+}
+
+// runCommand サブコマンドを実行して終了コードを返します（サブコマンドを省略した場合はsync）
+func runCommand(args []string, stderr io.Writer) int {
+	name := "sync"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(stderr)
+		return exitOK
+	}
+	cmd, ok := findCommand(name)
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command: %s\n\n", name)
+		usage(stderr)
+		return exitUsage
+	}
+
+	opts := &options{}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.envFile, "env-file", "", "env file to load (default: .env if it exists)")
+	fs.StringVar(&opts.configFile, "config", "", "config file (default: CONFIG_FILE or "+defaultConfigFile+" if it exists)")
+	fs.BoolVar(&opts.verbose, "v", false, "verbose log")
+	if cmd.flags != nil {
+		cmd.flags(fs, opts)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: perman-okta %s [flags] %s\n  %s\n\nflags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	for _, name := range cmd.required {
+		if fs.Lookup(name).Value.String() == "" {
+			fmt.Fprintf(stderr, "%s: -%s is required\n", cmd.name, name)
+			return exitUsage
+		}
+	}
+
+	verbose = opts.verbose
+	if opts.envFile != "" {
+		if err := EnvLoad(opts.envFile); err != nil {
+			fatal(err)
+		}
+	} else if err := EnvLoad(); err != nil {
+		fatal(err)
+	}
+	if !cmd.noConfig {
+		cfg, problems := LoadConfig(configFile(opts.configFile))
+		if problems = append(problems, cfg.Validate(cmd.needs...)...); len(problems) > 0 {
+			printProblems(stderr, problems)
+			return exitError
+		}
+		opts.cfg = cfg
+		if err := setupLogging(cfg.Log, os.Stderr); err != nil {
+			fatal(err)
+		}
+		beginLogRun(cmd.name)
+		if cmd.notify {
+			opts.notifier = &RunNotifier{Notifier: NewNotifier(cfg.Notify), Command: cmd.name}
+			fatalHook = opts.notifier.Fatal
+		}
+	}
+	if cmd.lock {
+		lock, ok, err := AcquireLock(lockPath(opts.cfg))
+		if err != nil {
+			fatal(err)
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "%s: another run holds %s (%s), try again later\n", cmd.name, lockPath(opts.cfg), lockHolder(lockPath(opts.cfg)))
+			return exitLocked
+		}
+		defer lock.Release()
+	}
+	opts.started = time.Now()
+	return cmd.run(opts, fs.Args())
+}
+
+// printProblems 設定の問題を全て出力します
+func printProblems(w io.Writer, problems []error) {
+	fmt.Fprintf(w, "invalid configuration (%d problems):\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  - %v\n", problem)
+	}
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: perman-okta <command> [flags]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-11s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nrun 'perman-okta <command> -h' for the flags of each command")
+	fmt.Fprintf(w, "\nexit codes: %d ok, %d error, %d usage, %d some accounts failed, %d another run in progress\n", exitOK, exitError, exitUsage, exitPartial, exitLocked)
+}
+
+// verbose -vの場合は詳細なログを出力します
+var verbose bool
+
+// EnvLoad .env load
+// envFilesを省略した場合はカレントディレクトリの.envを読み込みます（存在しなければ何もしません）。
+// 既に設定されている環境変数は上書きしません。
+func EnvLoad(envFiles ...string) error {
+	if len(envFiles) == 0 {
+		if _, err := os.Stat(".env"); os.IsNotExist(err) {
+			return nil
+		}
+		envFiles = []string{".env"} // default
+	}
+	if err := godotenv.Load(envFiles...); err != nil {
+		return fmt.Errorf("Error loading %s file: %v", strings.Join(envFiles, ", "), err)
+	}
+	return nil
+}
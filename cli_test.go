@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Pattern: [Usage] 不明なコマンド、フラグは exitUsage
+	var stderr bytes.Buffer
+	if code := runCommand([]string{"unknown"}, &stderr); code != exitUsage || !strings.Contains(stderr.String(), "unknown command") {
+		t.Errorf("runCommand [Usage]unknown command wrong: %d, %s", code, stderr.String())
+	}
+	if code := runCommand([]string{"sync", "-unknown"}, &stderr); code != exitUsage {
+		t.Errorf("runCommand [Usage]unknown flag wrong: %d", code)
+	}
+	if code := runCommand([]string{"help"}, &stderr); code != exitOK {
+		t.Errorf("runCommand [Usage]help wrong: %d", code)
+	}
+	if code := runCommand([]string{"rollback"}, &stderr); code != exitUsage {
+		t.Errorf("runCommand [Usage]rollback without -run wrong: %d", code)
+	}
+
+	// Pattern: [State] -env-fileの設定で状態を出力、削除する
+	statePath := filepath.Join(dir, "state.json")
+	envFile := filepath.Join(dir, "test.env")
+	if err := ioutil.WriteFile(envFile, []byte("STATE_PATH="+statePath+"\nSTATE_BACKUPS=0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("STATE_PATH")
+	defer os.Unsetenv("STATE_BACKUPS")
+	state := State{{Account: testAccounts[0], OktaUserID: "00u_aaa"}, {Account: testAccounts[1], OktaUserID: "00u_bbb"}}
+	if err := (StateFile{Path: statePath}).Commit(state); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "state.csv")
+	if code := runCommand([]string{"state", "-env-file", envFile, "-format", "csv", "-output", output, "list"}, &stderr); code != exitOK {
+		t.Fatalf("runCommand [State]list wrong: %d, %s", code, stderr.String())
+	}
+	data, _ := ioutil.ReadFile(output)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 3 || !strings.Contains(lines[1], "00u_aaa") {
+		t.Errorf("runCommand [State]list output wrong: %s", data)
+	}
+	if code := runCommand([]string{"state", "rm", testAccounts[0].Dn}, &stderr); code != exitOK {
+		t.Errorf("runCommand [State]rm wrong: %d", code)
+	}
+	if loaded, _ := (StateFile{Path: statePath}).Load(); len(loaded) != 1 || loaded[0].Dn != testAccounts[1].Dn {
+		t.Errorf("runCommand [State]rm not removed: %v", loaded)
+	}
+	if code := runCommand([]string{"state", "move"}, &stderr); code != exitUsage {
+		t.Errorf("runCommand [State]unknown subcommand wrong: %d", code)
+	}
+
+	// Pattern: [Lock] 他の実行が状態を更新中の場合は exitLocked
+	lock, ok, err := AcquireLock(statePath + ".lock")
+	if err != nil || !ok {
+		t.Fatalf("AcquireLock failed: %v, %v", ok, err)
+	}
+	stderr.Reset()
+	if code := runCommand([]string{"state", "rm", testAccounts[1].Dn}, &stderr); code != exitLocked || !strings.Contains(stderr.String(), "another run") {
+		t.Errorf("runCommand [Lock]wrong: %d, %s", code, stderr.String())
+	}
+	lock.Release()
+	if code := runCommand([]string{"state", "list"}, &stderr); code != exitOK {
+		t.Errorf("runCommand [Lock]after release wrong: %d", code)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := State{{Account: testAccounts[0], OktaUserID: "00u_aaa"}}
+	diff, _ := DefaultMapping().Diff(state.Accounts(), &testAccounts)
+	plan, err := NewPlan(state, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "plan.json")
+	if err := plan.Save(path, nil); err != nil {
+		t.Fatalf("Plan.Save failed: %v", err)
+	}
+	loaded, err := LoadPlan(path, nil)
+	if err != nil {
+		t.Fatalf("LoadPlan failed: %v", err)
+	}
+	if creates, updates, deletes := loaded.Counts(); creates != 2 || updates != 0 || deletes != 0 {
+		t.Errorf("LoadPlan counts wrong: %d, %d, %d", creates, updates, deletes)
+	}
+	if err := loaded.Check(state); err != nil {
+		t.Errorf("Plan.Check wrong: %v", err)
+	}
+
+	// Pattern: [Changed] plan作成後に状態が変わった場合はエラー
+	state[0].OktaUserID = "00u_other"
+	if err := loaded.Check(state); err == nil {
+		t.Error("Plan.Check [Changed]error not returned")
+	}
+	ioutil.WriteFile(path, []byte("{}"), 0600)
+	if _, err := LoadPlan(path, nil); err == nil {
+		t.Error("LoadPlan [Invalid]error not returned")
+	}
+
+	// Pattern: [Sealed] キーを指定した場合は差分を暗号化して保存する
+	value, _ := GenerateStateKey()
+	key, err := LoadStateKey(value, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.Save(path, key); err != nil {
+		t.Fatalf("Plan.Save [Sealed]failed: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(path); bytes.Contains(data, []byte(testAccounts[1].Dn)) {
+		t.Errorf("Plan.Save [Sealed]plaintext value written: %s", data)
+	}
+	if _, err := LoadPlan(path, nil); err == nil {
+		t.Error("LoadPlan [Sealed]error not returned without the key")
+	}
+	if loaded, err := LoadPlan(path, key); err != nil || loaded.Sealed != nil {
+		t.Errorf("LoadPlan [Sealed]failed: %v", err)
+	} else if creates, _, _ := loaded.Counts(); creates != 2 {
+		t.Errorf("LoadPlan [Sealed]counts wrong: %d", creates)
+	}
+}
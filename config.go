@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// config sections（コマンド毎に必須の設定）
+const (
+	configLDAP = "ldap"
+	configOkta = "okta"
+)
+
+// defaultConfigFile -config、CONFIG_FILEを省略した場合に存在すれば読み込む設定ファイル
+const defaultConfigFile = "perman-okta.yaml"
+
+// Config 設定ファイル（YAML）。環境変数が設定されている場合は環境変数の値で上書きします
+type Config struct {
+	LDAP    LDAPConfig    `yaml:"ldap"`
+	Okta    OktaConfig    `yaml:"okta"`
+	Mapping MappingConfig `yaml:"mapping"`
+	Safety  SafetyConfig  `yaml:"safety"`
+	State   StateConfig   `yaml:"state"`
+	Journal JournalConfig `yaml:"journal"`
+	Serve   ServeConfig   `yaml:"serve"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Log     LogConfig     `yaml:"log"`
+	Report  ReportConfig  `yaml:"report"`
+	Notify  NotifyConfig  `yaml:"notify"`
+}
+
+// LDAPConfig LDAPの接続と検索条件
+type LDAPConfig struct {
+	Host string `yaml:"host,omitempty"`
+	Port int    `yaml:"port"`
+	// URLs 複数のサーバー（ldap://host:port, ldaps://host:port）。先頭から順に接続し、失敗した場合は次のサーバーに切り替えます
+	URLs         []string      `yaml:"urls,omitempty"`
+	Timeout      time.Duration `yaml:"timeout"` // 接続、検索毎のタイムアウト
+	BaseDn       string        `yaml:"baseDn"`
+	Filter       string        `yaml:"filter"`
+	BindDn       string        `yaml:"bindDn,omitempty"`
+	BindPassword Secret        `yaml:"bindPassword,omitempty"`
+	// Searches 複数の検索条件（結果はDNで重複を除いてまとめます）。省略した場合はbaseDn、filterで1回検索します
+	Searches []LdapSearch `yaml:"searches,omitempty"`
+	// Incremental 前回の実行から変更されたエントリだけを取得します
+	Incremental IncrementalConfig `yaml:"incremental"`
+	// Watch watchコマンド（syncrepl）
+	Watch WatchConfig `yaml:"watch"`
+}
+
+// IncrementalConfig LDAPの差分取得（attributeを省略した場合は毎回全件取得します）
+type IncrementalConfig struct {
+	Attribute    string        `yaml:"attribute,omitempty"` // modifyTimestamp, uSNChanged
+	FullInterval time.Duration `yaml:"fullInterval"`        // 全件取得して削除を反映する間隔
+}
+
+// WatchConfig watchコマンドで変更を反映する間隔
+type WatchConfig struct {
+	BatchDelay   time.Duration `yaml:"batchDelay"`   // 最初の変更から反映するまでの待ち時間（その間の変更はまとめて反映します）
+	FullInterval time.Duration `yaml:"fullInterval"` // 全件取得して突き合わせる間隔
+}
+
+// URLList 接続するサーバー（urlsを省略した場合はhost、port）
+func (c LDAPConfig) URLList() []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	return []string{fmt.Sprintf("ldap://%s", net.JoinHostPort(c.Host, strconv.Itoa(c.Port)))}
+}
+
+// SearchList 実行する検索条件
+func (c LDAPConfig) SearchList() []LdapSearch {
+	if len(c.Searches) > 0 {
+		return c.Searches
+	}
+	return []LdapSearch{{BaseDn: c.BaseDn, Scope: scopeSub, Filter: c.Filter}}
+}
+
+// OktaConfig Okta org
+type OktaConfig struct {
+	FQDN   string   `yaml:"fqdn"`
+	APIKey Secret   `yaml:"apiKey"`
+	Groups []string `yaml:"groups,omitempty"` // 全アカウントを所属させるグループ名
+}
+
+// MappingConfig 項目の比較ルール（fileの後にrulesを上書きします）
+type MappingConfig struct {
+	File  string                 `yaml:"file,omitempty"`
+	Rules map[string]CompareRule `yaml:"rules,omitempty"`
+}
+
+// SafetyConfig 1回の実行で反映する件数の上限（0の場合は無制限）
+type SafetyConfig struct {
+	MaxCreates int `yaml:"maxCreates"`
+	MaxUpdates int `yaml:"maxUpdates"`
+	MaxDeletes int `yaml:"maxDeletes"`
+}
+
+// Check diffが上限を超えていないことを確認します
+func (s SafetyConfig) Check(diff DiffResult) error {
+	limits := []struct {
+		key   string
+		limit int
+	}{{CreateKey, s.MaxCreates}, {UpdateKey, s.MaxUpdates}, {DeleteKey, s.MaxDeletes}}
+	var exceeded []string
+	for _, l := range limits {
+		if l.limit > 0 && len(diff[l.key]) > l.limit {
+			exceeded = append(exceeded, fmt.Sprintf("%s %d > %d", l.key, len(diff[l.key]), l.limit))
+		}
+	}
+	if len(exceeded) > 0 {
+		return fmt.Errorf("safety limit exceeded (%s), check the LDAP data or raise the limit", strings.Join(exceeded, ", "))
+	}
+	return nil
+}
+
+// StateConfig 状態の保存先
+type StateConfig struct {
+	Backend string `yaml:"backend"`
+	Path    string `yaml:"path,omitempty"` // 省略した場合はbackend毎の標準のパス
+	Backups int    `yaml:"backups"`
+	Key     Secret `yaml:"key,omitempty"`
+	KeyFile string `yaml:"keyFile,omitempty"`
+}
+
+// JournalConfig 同期履歴
+type JournalConfig struct {
+	Path string `yaml:"path"`
+}
+
+// ServeConfig serveコマンドの定期実行
+type ServeConfig struct {
+	Schedule string        `yaml:"schedule"` // cron式（分 時 日 月 曜日）、@hourly、@every 30mなど
+	Jitter   time.Duration `yaml:"jitter"`   // 実行時刻を0〜jitterの範囲でランダムに遅らせます
+	Admin    AdminConfig   `yaml:"admin"`
+}
+
+// MetricsConfig Prometheusのメトリクス
+type MetricsConfig struct {
+	File   string `yaml:"file,omitempty"`   // 実行毎にtextfile形式で書き出します（node_exporterのtextfile collector）
+	Listen string `yaml:"listen,omitempty"` // serve、watchの/metrics（127.0.0.1:9100など）
+}
+
+// LogConfig ログの形式とレベル
+type LogConfig struct {
+	Format string `yaml:"format"` // text（標準）、logfmt、json
+	Level  string `yaml:"level"`  // debug、info（標準）、warn、error
+}
+
+// SlogLevel levelのslog.Level（省略した場合はinfo）
+func (c LogConfig) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	if c.Level == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+		return level, err
+	}
+	return level, nil
+}
+
+// ReportConfig 実行毎のレポート（dirを省略した場合は書き出しません）
+type ReportConfig struct {
+	Dir     string   `yaml:"dir,omitempty"`
+	Formats []string `yaml:"formats,omitempty"` // markdown（標準）、html、csv
+}
+
+// webhook 環境変数で設定するwebhook（最初のwebhook、なければ追加します）
+func (c *NotifyConfig) webhook() *WebhookConfig {
+	if len(c.Webhooks) == 0 {
+		c.Webhooks = append(c.Webhooks, WebhookConfig{})
+	}
+	return &c.Webhooks[0]
+}
+
+// FormatList 書き出す形式（省略した場合はmarkdown）
+func (c ReportConfig) FormatList() []string {
+	if len(c.Formats) == 0 {
+		return []string{formatMarkdown}
+	}
+	return c.Formats
+}
+
+// NotifyConfig 実行の結果のwebhook
+type NotifyConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks,omitempty"`
+	Timeout  time.Duration   `yaml:"timeout"`
+}
+
+// WebhookConfig 通知を送るwebhook
+type WebhookConfig struct {
+	URL      Secret   `yaml:"url"`                // URLにトークンを含むのでSecret（env:、file:）
+	Format   string   `yaml:"format,omitempty"`   // json（標準）、slack、teams
+	Template string   `yaml:"template,omitempty"` // リクエストボディのtext/template（formatより優先）
+	Events   []string `yaml:"events,omitempty"`   // completed, failed, aborted（標準）, deleted
+}
+
+// AdminConfig serveの管理API（listenを省略した場合は起動しません）
+type AdminConfig struct {
+	Listen string `yaml:"listen,omitempty"` // 127.0.0.1:8080など
+	Token  Secret `yaml:"token,omitempty"`  // Authorization: Bearer <token>
+	// LookupToken GET /api/accountsだけを許可するトークン（ヘルプデスク用、省略した場合はtokenだけ）
+	LookupToken Secret `yaml:"lookupToken,omitempty"`
+	TLSCert     string `yaml:"tlsCert,omitempty"` // 証明書のファイル（tlsKeyと一緒に指定した場合はHTTPS）
+	TLSKey      string `yaml:"tlsKey,omitempty"`
+}
+
+// Secret 秘密情報。"env:NAME"は環境変数、"file:/path"はファイルの内容を参照し、それ以外は値そのものです
+type Secret string
+
+// Value 参照を解決した値を返します
+func (s Secret) Value() (string, error) {
+	value := string(s)
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return value, nil
+}
+
+// MarshalYAML 参照はそのまま、値そのものは伏せて出力します
+func (s Secret) MarshalYAML() (interface{}, error) {
+	value := string(s)
+	if value == "" || strings.HasPrefix(value, "env:") || strings.HasPrefix(value, "file:") {
+		return value, nil
+	}
+	return "********", nil
+}
+
+// DefaultConfig 標準の設定
+func DefaultConfig() *Config {
+	return &Config{
+		LDAP: LDAPConfig{
+			Port:        389,
+			Timeout:     defaultLdapTimeout,
+			Incremental: IncrementalConfig{FullInterval: defaultFullInterval},
+			Watch:       WatchConfig{BatchDelay: defaultWatchBatchDelay, FullInterval: defaultFullInterval},
+		},
+		State:   StateConfig{Backend: stateBackendJSON, Backups: defaultStateBackups},
+		Journal: JournalConfig{Path: journalNm},
+		Serve:   ServeConfig{Schedule: defaultServeSchedule},
+		Log:     LogConfig{Format: logFormatText},
+		Notify:  NotifyConfig{Timeout: defaultNotifyTimeout},
+	}
+}
+
+// LoadConfig 設定ファイル（fileNmが空の場合は環境変数だけ）を読み込み、環境変数で上書きします。
+// 読み込めない項目は全てまとめて返します（Validateと合わせて全ての問題を報告するため）。
+func LoadConfig(fileNm string) (*Config, []error) {
+	cfg := DefaultConfig()
+	var problems []error
+	if fileNm != "" {
+		data, err := ioutil.ReadFile(fileNm)
+		if err != nil {
+			return cfg, []error{err}
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			problems = append(problems, fmt.Errorf("config file %s: %v", fileNm, err))
+		}
+	}
+	return cfg, append(problems, cfg.applyEnv()...)
+}
+
+// configEnv 設定を上書きする環境変数
+type configEnv struct {
+	name string
+	set  func(cfg *Config, value string) error
+}
+
+var configEnvs = []configEnv{
+	{"LDAP_HOST", func(cfg *Config, v string) error { cfg.LDAP.Host = v; return nil }},
+	{"LDAP_PORT", func(cfg *Config, v string) error { return setInt(&cfg.LDAP.Port, v) }},
+	{"LDAP_URLS", func(cfg *Config, v string) error { cfg.LDAP.URLs = splitList(v); return nil }},
+	{"LDAP_TIMEOUT", func(cfg *Config, v string) error { return setDuration(&cfg.LDAP.Timeout, v) }},
+	{"LDAP_INCREMENTAL", func(cfg *Config, v string) error { cfg.LDAP.Incremental.Attribute = v; return nil }},
+	{"LDAP_FULL_INTERVAL", func(cfg *Config, v string) error { return setDuration(&cfg.LDAP.Incremental.FullInterval, v) }},
+	{"LDAP_WATCH_BATCH_DELAY", func(cfg *Config, v string) error { return setDuration(&cfg.LDAP.Watch.BatchDelay, v) }},
+	{"LDAP_WATCH_FULL_INTERVAL", func(cfg *Config, v string) error { return setDuration(&cfg.LDAP.Watch.FullInterval, v) }},
+	{"BASE_DN", func(cfg *Config, v string) error { cfg.LDAP.BaseDn = v; return nil }},
+	{"FILTER_STRING", func(cfg *Config, v string) error { cfg.LDAP.Filter = v; return nil }},
+	{"LDAP_BIND_DN", func(cfg *Config, v string) error { cfg.LDAP.BindDn = v; return nil }},
+	{"LDAP_BIND_PASSWORD", func(cfg *Config, v string) error { cfg.LDAP.BindPassword = Secret(v); return nil }},
+	{"OKTA_FQDN", func(cfg *Config, v string) error { cfg.Okta.FQDN = v; return nil }},
+	{"OKTA_APIKEY", func(cfg *Config, v string) error { cfg.Okta.APIKey = Secret(v); return nil }},
+	{"OKTA_GROUPS", func(cfg *Config, v string) error { cfg.Okta.Groups = splitList(v); return nil }},
+	{"MAPPING_FILE", func(cfg *Config, v string) error { cfg.Mapping.File = v; return nil }},
+	{"SAFETY_MAX_CREATES", func(cfg *Config, v string) error { return setInt(&cfg.Safety.MaxCreates, v) }},
+	{"SAFETY_MAX_UPDATES", func(cfg *Config, v string) error { return setInt(&cfg.Safety.MaxUpdates, v) }},
+	{"SAFETY_MAX_DELETES", func(cfg *Config, v string) error { return setInt(&cfg.Safety.MaxDeletes, v) }},
+	{"STATE_BACKEND", func(cfg *Config, v string) error { cfg.State.Backend = v; return nil }},
+	{"STATE_PATH", func(cfg *Config, v string) error { cfg.State.Path = v; return nil }},
+	{"STATE_BACKUPS", func(cfg *Config, v string) error { return setInt(&cfg.State.Backups, v) }},
+	{"STATE_KEY", func(cfg *Config, v string) error { cfg.State.Key = Secret(v); return nil }},
+	{"STATE_KEY_FILE", func(cfg *Config, v string) error { cfg.State.KeyFile = v; return nil }},
+	{"JOURNAL_FILE", func(cfg *Config, v string) error { cfg.Journal.Path = v; return nil }},
+	{"SERVE_SCHEDULE", func(cfg *Config, v string) error { cfg.Serve.Schedule = v; return nil }},
+	{"SERVE_JITTER", func(cfg *Config, v string) error { return setDuration(&cfg.Serve.Jitter, v) }},
+	{"SERVE_ADMIN_LISTEN", func(cfg *Config, v string) error { cfg.Serve.Admin.Listen = v; return nil }},
+	{"SERVE_ADMIN_TOKEN", func(cfg *Config, v string) error { cfg.Serve.Admin.Token = Secret(v); return nil }},
+	{"SERVE_ADMIN_LOOKUP_TOKEN", func(cfg *Config, v string) error { cfg.Serve.Admin.LookupToken = Secret(v); return nil }},
+	{"SERVE_ADMIN_TLS_CERT", func(cfg *Config, v string) error { cfg.Serve.Admin.TLSCert = v; return nil }},
+	{"SERVE_ADMIN_TLS_KEY", func(cfg *Config, v string) error { cfg.Serve.Admin.TLSKey = v; return nil }},
+	{"METRICS_FILE", func(cfg *Config, v string) error { cfg.Metrics.File = v; return nil }},
+	{"METRICS_LISTEN", func(cfg *Config, v string) error { cfg.Metrics.Listen = v; return nil }},
+	{"LOG_FORMAT", func(cfg *Config, v string) error { cfg.Log.Format = v; return nil }},
+	{"LOG_LEVEL", func(cfg *Config, v string) error { cfg.Log.Level = v; return nil }},
+	{"REPORT_DIR", func(cfg *Config, v string) error { cfg.Report.Dir = v; return nil }},
+	{"REPORT_FORMATS", func(cfg *Config, v string) error { cfg.Report.Formats = splitList(v); return nil }},
+	{"NOTIFY_WEBHOOK_URL", func(cfg *Config, v string) error { cfg.Notify.webhook().URL = Secret(v); return nil }},
+	{"NOTIFY_WEBHOOK_FORMAT", func(cfg *Config, v string) error { cfg.Notify.webhook().Format = v; return nil }},
+	{"NOTIFY_WEBHOOK_EVENTS", func(cfg *Config, v string) error { cfg.Notify.webhook().Events = splitList(v); return nil }},
+	{"NOTIFY_TIMEOUT", func(cfg *Config, v string) error { return setDuration(&cfg.Notify.Timeout, v) }},
+}
+
+func setInt(field *int, value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("not a number: %q", value)
+	}
+	*field = n
+	return nil
+}
+
+func setDuration(field *time.Duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("not a duration: %q", value)
+	}
+	*field = d
+	return nil
+}
+
+// applyEnv 設定されている環境変数で上書きします
+func (cfg *Config) applyEnv() []error {
+	var problems []error
+	for _, env := range configEnvs {
+		value, ok := os.LookupEnv(env.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := env.set(cfg, value); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", env.name, err))
+		}
+	}
+	return problems
+}
+
+// Validate 設定をチェックして全ての問題を返します。sectionsの設定は必須としてチェックします
+func (cfg *Config) Validate(sections ...string) []error {
+	var problems []error
+	add := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, v...))
+	}
+	required := func(section string) bool {
+		return contains(sections, section)
+	}
+
+	// ldap
+	if required(configLDAP) {
+		if cfg.LDAP.Host == "" && len(cfg.LDAP.URLs) == 0 {
+			add("ldap.host (LDAP_HOST) or ldap.urls (LDAP_URLS) is required")
+		}
+		if len(cfg.LDAP.Searches) == 0 && cfg.LDAP.BaseDn == "" {
+			add("ldap.baseDn (BASE_DN) or ldap.searches is required")
+		}
+		if len(cfg.LDAP.Searches) == 0 && cfg.LDAP.Filter == "" {
+			add("ldap.filter (FILTER_STRING) or ldap.searches is required")
+		}
+	}
+	if len(cfg.LDAP.Searches) > 0 && (cfg.LDAP.BaseDn != "" || cfg.LDAP.Filter != "") {
+		add("ldap: baseDn/filter (BASE_DN/FILTER_STRING) and searches cannot be used together")
+	}
+	for i, search := range cfg.LDAP.Searches {
+		if err := search.Validate(); err != nil {
+			add("ldap.searches[%d]: %v", i, err)
+		}
+	}
+	if cfg.LDAP.Port <= 0 || cfg.LDAP.Port > 65535 {
+		add("ldap.port: invalid port %d", cfg.LDAP.Port)
+	}
+	if len(cfg.LDAP.URLs) > 0 && cfg.LDAP.Host != "" {
+		add("ldap: host (LDAP_HOST) and urls (LDAP_URLS) cannot be used together")
+	}
+	for i, rawURL := range cfg.LDAP.URLs {
+		if _, err := parseLdapURL(rawURL); err != nil {
+			add("ldap.urls[%d]: %v", i, err)
+		}
+	}
+	if cfg.LDAP.Timeout < time.Second {
+		add("ldap.timeout: must be 1s or more")
+	}
+	switch cfg.LDAP.Incremental.Attribute {
+	case "", incrementalModifyTimestamp, incrementalUSNChanged:
+	default:
+		add("ldap.incremental.attribute: unknown attribute %q (%s, %s)", cfg.LDAP.Incremental.Attribute, incrementalModifyTimestamp, incrementalUSNChanged)
+	}
+	if cfg.LDAP.Incremental.Attribute != "" && cfg.LDAP.Incremental.FullInterval <= 0 {
+		add("ldap.incremental.fullInterval: must be more than 0")
+	}
+	if cfg.LDAP.Watch.BatchDelay < 0 {
+		add("ldap.watch.batchDelay: must be 0 or more")
+	}
+	if cfg.LDAP.Watch.FullInterval <= 0 {
+		add("ldap.watch.fullInterval: must be more than 0")
+	}
+	if _, err := cfg.LDAP.BindPassword.Value(); err != nil {
+		add("ldap.bindPassword: %v", err)
+	}
+
+	// okta
+	if required(configOkta) {
+		if cfg.Okta.FQDN == "" {
+			add("okta.fqdn (OKTA_FQDN) is required")
+		}
+		if cfg.Okta.APIKey == "" {
+			add("okta.apiKey (OKTA_APIKEY) is required")
+		}
+	}
+	if strings.Contains(cfg.Okta.FQDN, "/") {
+		add("okta.fqdn: %q must be a host name without scheme or path", cfg.Okta.FQDN)
+	}
+	if _, err := cfg.Okta.APIKey.Value(); err != nil {
+		add("okta.apiKey: %v", err)
+	}
+
+	// mapping
+	if _, err := cfg.MappingRules(); err != nil {
+		add("mapping: %v", err)
+	}
+
+	// safety
+	if cfg.Safety.MaxCreates < 0 || cfg.Safety.MaxUpdates < 0 || cfg.Safety.MaxDeletes < 0 {
+		add("safety: limits must be 0 (unlimited) or more")
+	}
+
+	// state
+	switch cfg.State.Backend {
+	case stateBackendJSON, stateBackendBolt:
+	default:
+		add("state.backend: unknown backend %q (json, bolt)", cfg.State.Backend)
+	}
+	if cfg.State.Backups < 0 {
+		add("state.backups: must be 0 or more")
+	}
+	if _, err := cfg.StateKey(); err != nil {
+		add("state.key: %v", err)
+	}
+
+	// journal
+	if cfg.Journal.Path == "" {
+		add("journal.path is required")
+	}
+
+	// serve
+	if _, err := cron.ParseStandard(cfg.Serve.Schedule); err != nil {
+		add("serve.schedule: %v", err)
+	}
+	if cfg.Serve.Jitter < 0 {
+		add("serve.jitter: must be 0 or more")
+	}
+	if token, err := cfg.Serve.Admin.Token.Value(); err != nil {
+		add("serve.admin.token: %v", err)
+	} else if cfg.Serve.Admin.Listen != "" && token == "" {
+		add("serve.admin.token (SERVE_ADMIN_TOKEN) is required with serve.admin.listen")
+	} else if lookupToken, err := cfg.Serve.Admin.LookupToken.Value(); err != nil {
+		add("serve.admin.lookupToken: %v", err)
+	} else if lookupToken != "" && lookupToken == token {
+		add("serve.admin.lookupToken: must differ from serve.admin.token")
+	}
+	if (cfg.Serve.Admin.TLSCert == "") != (cfg.Serve.Admin.TLSKey == "") {
+		add("serve.admin.tlsCert and serve.admin.tlsKey must be set together")
+	}
+
+	// log
+	switch cfg.Log.Format {
+	case "", logFormatText, logFormatLogfmt, logFormatJSON:
+	default:
+		add("log.format: unknown format %q (text, logfmt or json)", cfg.Log.Format)
+	}
+	if _, err := cfg.Log.SlogLevel(); err != nil {
+		add("log.level: %v", err)
+	}
+
+	// report
+	for _, format := range cfg.Report.FormatList() {
+		if reportExtensions[format] == "" {
+			add("report.formats: unknown format %q (markdown, html or csv)", format)
+		}
+	}
+
+	// notify
+	if cfg.Notify.Timeout <= 0 {
+		add("notify.timeout: must be more than 0")
+	}
+	for i, webhook := range cfg.Notify.Webhooks {
+		if url, err := webhook.URL.Value(); err != nil {
+			add("notify.webhooks[%d].url: %v", i, err)
+		} else if !strings.HasPrefix(url, "https://") && !strings.HasPrefix(url, "http://") {
+			add("notify.webhooks[%d].url (NOTIFY_WEBHOOK_URL) must be an http(s) URL", i)
+		}
+		switch webhook.FormatName() {
+		case webhookJSON, webhookSlack, webhookTeams:
+		default:
+			add("notify.webhooks[%d].format: unknown format %q (json, slack or teams)", i, webhook.Format)
+		}
+		if _, err := webhook.parseTemplate(); err != nil {
+			add("notify.webhooks[%d].template: %v", i, err)
+		}
+		for _, event := range webhook.Events {
+			if !contains(notifyEvents, event) {
+				add("notify.webhooks[%d].events: unknown event %q (%s)", i, event, strings.Join(notifyEvents, ", "))
+			}
+		}
+	}
+	return problems
+}
+
+// MappingRules mapping.fileとmapping.rulesを標準の比較ルールに上書きして返します
+func (cfg *Config) MappingRules() (Mapping, error) {
+	mapping, err := LoadMapping(cfg.Mapping.File)
+	if err != nil {
+		return mapping, err
+	}
+	for field, rule := range cfg.Mapping.Rules {
+		mapping.Rules[field] = rule
+	}
+	return mapping, mapping.Validate()
+}
+
+// StatePath 状態の保存先（省略した場合はbackend毎の標準のパス）
+func (cfg *Config) StatePath() string {
+	if cfg.State.Path != "" {
+		return cfg.State.Path
+	}
+	if cfg.State.Backend == stateBackendBolt {
+		return dbFileNm
+	}
+	return fileNm
+}
+
+// StateKey 状態の暗号化キー（設定されていない場合はnil）
+func (cfg *Config) StateKey() (*StateKey, error) {
+	value, err := cfg.State.Key.Value()
+	if err != nil {
+		return nil, err
+	}
+	return LoadStateKey(value, cfg.State.KeyFile)
+}
+
+// Hash 秘密情報を除いた設定とマッピングファイルのハッシュ（同期履歴に記録します）
+func (cfg *Config) Hash() string {
+	data, _ := yaml.Marshal(cfg)
+	if cfg.Mapping.File != "" {
+		mapping, _ := ioutil.ReadFile(cfg.Mapping.File)
+		data = append(data, mapping...)
+	}
+	return checksum(data)
+}
+
+// configFile 設定ファイルのパス（-config、CONFIG_FILE、存在すればperman-okta.yamlの順）
+func configFile(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if value := os.Getenv("CONFIG_FILE"); value != "" {
+		return value
+	}
+	if _, err := os.Stat(defaultConfigFile); err == nil {
+		return defaultConfigFile
+	}
+	return ""
+}
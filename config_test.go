@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "okta.key")
+	if err := ioutil.WriteFile(keyFile, []byte("okta-api-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileNm := filepath.Join(dir, "perman-okta.yaml")
+	if err := ioutil.WriteFile(fileNm, []byte(`
+ldap:
+  host: ldap.example.com
+  baseDn: dc=example,dc=com
+  filter: (objectClass=person)
+  bindDn: cn=reader,dc=example,dc=com
+  bindPassword: env:TEST_LDAP_PASSWORD
+okta:
+  fqdn: example.okta.com
+  apiKey: file:`+keyFile+`
+  groups: [everyone]
+mapping:
+  rules:
+    description: {trimSpace: true}
+safety:
+  maxDeletes: 10
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("TEST_LDAP_PASSWORD", "secret")
+	os.Setenv("BASE_DN", "dc=example,dc=org")
+	defer os.Unsetenv("TEST_LDAP_PASSWORD")
+	defer os.Unsetenv("BASE_DN")
+
+	cfg, problems := LoadConfig(fileNm)
+	if len(problems) != 0 {
+		t.Fatalf("LoadConfig exec failed: %v", problems)
+	}
+	if problems := cfg.Validate(configLDAP, configOkta); len(problems) != 0 {
+		t.Errorf("Config.Validate problems exist: %v", problems)
+	}
+
+	// Pattern: [Env] 環境変数は設定ファイルの値を上書きする
+	if cfg.LDAP.BaseDn != "dc=example,dc=org" || cfg.LDAP.Host != "ldap.example.com" || cfg.LDAP.Port != 389 {
+		t.Errorf("LoadConfig [Env]ldap wrong: %+v", cfg.LDAP)
+	}
+
+	// Pattern: [Secret] env:、file:の参照を解決し、showでは値を伏せる
+	if password, _ := cfg.LDAP.BindPassword.Value(); password != "secret" {
+		t.Errorf("Secret.Value [Secret]env wrong: %s", password)
+	}
+	if apiKey, _ := cfg.Okta.APIKey.Value(); apiKey != "okta-api-key" {
+		t.Errorf("Secret.Value [Secret]file wrong: %s", apiKey)
+	}
+	cfg.State.Key = "c2VjcmV0"
+	data, _ := yaml.Marshal(cfg)
+	if strings.Contains(string(data), "c2VjcmV0") || !strings.Contains(string(data), "env:TEST_LDAP_PASSWORD") {
+		t.Errorf("Config marshal [Secret]not masked: %s", data)
+	}
+
+	// Pattern: [Mapping] mapping.rulesで指定した項目だけ緩める（標準は完全一致）
+	mapping, err := cfg.MappingRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mapping.Rules[fieldDescription].TrimSpace || mapping.Rules[fieldEmail].IgnoreCase {
+		t.Errorf("Config.MappingRules [Mapping]rules wrong: %v", mapping.Rules)
+	}
+
+	// Pattern: [Unknown] 不明な項目はエラー
+	ioutil.WriteFile(fileNm, []byte("ldap:\n  hots: ldap.example.com\n"), 0600)
+	if _, problems := LoadConfig(fileNm); len(problems) != 1 || !strings.Contains(problems[0].Error(), "hots") {
+		t.Errorf("LoadConfig [Unknown]problems wrong: %v", problems)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	// Pattern: [Problems] 全ての問題をまとめて返す
+	cfg := DefaultConfig()
+	cfg.Okta.FQDN = "https://example.okta.com/"
+	cfg.Okta.APIKey = "env:TEST_UNSET_APIKEY"
+	cfg.State.Backend = "s3"
+	problems := cfg.Validate(configLDAP, configOkta)
+	if len(problems) != 6 {
+		t.Errorf("Config.Validate [Problems]count wrong: %d, %v", len(problems), problems)
+	}
+
+	// Pattern: [Sections] 必須でないsectionはチェックしない
+	if problems := DefaultConfig().Validate(); len(problems) != 0 {
+		t.Errorf("Config.Validate [Sections]problems exist: %v", problems)
+	}
+
+	// Pattern: [Searches] searchesを指定した場合はbaseDn、filterは不要（併用はエラー）
+	cfg = DefaultConfig()
+	cfg.LDAP.Host = "ldap.example.com"
+	cfg.LDAP.Searches = []LdapSearch{{BaseDn: "ou=people,dc=example,dc=com", Filter: "(uid=*)"}, {BaseDn: "ou=interns,dc=example,dc=com"}}
+	if problems := cfg.Validate(configLDAP); len(problems) != 1 {
+		t.Errorf("Config.Validate [Searches]problems wrong: %v", problems)
+	}
+	cfg.LDAP.Searches = cfg.LDAP.Searches[:1]
+	cfg.LDAP.BaseDn = "dc=example,dc=com"
+	if problems := cfg.Validate(configLDAP); len(problems) != 1 {
+		t.Errorf("Config.Validate [Searches]baseDn with searches problems wrong: %v", problems)
+	}
+
+	// Pattern: [Serve] cron式の誤り
+	cfg = DefaultConfig()
+	cfg.Serve.Schedule = "0 25 * * *"
+	if problems := cfg.Validate(); len(problems) != 1 || !strings.Contains(problems[0].Error(), "serve.schedule") {
+		t.Errorf("Config.Validate [Serve]problems wrong: %v", problems)
+	}
+
+	// Pattern: [Admin] lookupTokenとtokenが同じ、tlsCertだけの場合はエラー
+	cfg = DefaultConfig()
+	cfg.Serve.Admin = AdminConfig{Listen: "127.0.0.1:8080", Token: "secret", LookupToken: "secret", TLSCert: "admin.crt"}
+	if problems := cfg.Validate(); len(problems) != 2 || !strings.Contains(problems[0].Error(), "lookupToken") || !strings.Contains(problems[1].Error(), "tlsKey") {
+		t.Errorf("Config.Validate [Admin]problems wrong: %v", problems)
+	}
+
+	// Pattern: [Log] 形式とレベルの誤り
+	cfg = DefaultConfig()
+	cfg.Log = LogConfig{Format: "xml", Level: "verbose"}
+	if problems := cfg.Validate(); len(problems) != 2 || !strings.Contains(problems[0].Error(), "log.format") || !strings.Contains(problems[1].Error(), "log.level") {
+		t.Errorf("Config.Validate [Log]problems wrong: %v", problems)
+	}
+
+	// Pattern: [Safety] 上限を超えた場合はエラー（0は無制限）
+	diff := DiffResult{DeleteKey: make([]AccountDiff, 3), CreateKey: make([]AccountDiff, 100)}
+	if err := (SafetyConfig{MaxDeletes: 2}).Check(diff); err == nil || !strings.Contains(err.Error(), "DELETE 3 > 2") {
+		t.Errorf("SafetyConfig.Check [Safety]error wrong: %v", err)
+	}
+	if err := (SafetyConfig{MaxDeletes: 3}).Check(diff); err != nil {
+		t.Errorf("SafetyConfig.Check [Safety]limit error: %v", err)
+	}
+}
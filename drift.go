@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// Okta user status
+const (
+	oktaStatusSuspended     = "SUSPENDED"
+	oktaStatusDeprovisioned = "DEPROVISIONED"
+)
+
+// Drift 最後に同期した状態とOktaの実データとの差分
+// （FieldChangeのOldはLDAP側の値、NewはOkta側の値）
+type Drift struct {
+	Dn              string        `json:"dn"`
+	Login           string        `json:"login,omitempty"`
+	OktaUserID      string        `json:"oktaUserId"`
+	NotFound        bool          `json:"notFound,omitempty"`
+	Status          string        `json:"status,omitempty"`
+	Changes         []FieldChange `json:"changes,omitempty"`
+	MissingGroupIDs []string      `json:"missingGroupIds,omitempty"`
+	Reconcile       bool          `json:"reconcile,omitempty"` // adoptで紐付けて、まだ同期していない
+}
+
+// logAttrs ログの項目
+func (d Drift) logAttrs() []any {
+	return logAttrs(logOpDrift, logKeyDn, d.Dn, logKeyLogin, d.Login, logKeyOktaUserID, d.OktaUserID)
+}
+
+// HasDrift 差分があるかどうか
+func (d Drift) HasDrift() bool {
+	return d.NotFound || d.Status != "" || len(d.Changes) > 0 || len(d.MissingGroupIDs) > 0 || d.Reconcile
+}
+
+// DetectDrift 状態とOktaユーザー、所属グループを比較します
+func DetectDrift(state AccountState, user *OktaUser, groups []OktaGroup) Drift {
+	drift := Drift{Dn: state.Dn, Login: state.OktaProfile().Login, OktaUserID: state.OktaUserID, Reconcile: state.Reconcile}
+	if user == nil || user.ID == "" {
+		drift.NotFound = true
+		return drift
+	}
+	if user.Status == oktaStatusSuspended || user.Status == oktaStatusDeprovisioned {
+		drift.Status = user.Status
+	}
+	drift.Changes = profileChanges(state.OktaProfile(), &user.UserProfile)
+
+	live := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		live[group.ID] = true
+	}
+	for _, gid := range state.OktaGroupIDs {
+		if !live[gid] {
+			drift.MissingGroupIDs = append(drift.MissingGroupIDs, gid)
+		}
+	}
+	return drift
+}
+
+// profileChanges 同期対象のprofile属性を比較します（FieldChangeのFieldはOktaの属性名）
+func profileChanges(old, new *UserProfile) []FieldChange {
+	var changes []FieldChange
+	fields := []struct {
+		name string
+		old  string
+		new  string
+	}{
+		{"login", old.Login, new.Login},
+		{"email", old.Email, new.Email},
+		{"firstName", old.FirstName, new.FirstName},
+		{"lastName", old.LastName, new.LastName},
+		{"employeeNumber", old.EmployeeNumber, new.EmployeeNumber},
+	}
+	for _, field := range fields {
+		if field.old != field.new {
+			changes = append(changes, FieldChange{Field: field.name, Old: field.old, New: field.new})
+		}
+	}
+	return changes
+}
+
+// DriftChecker 管理対象アカウントのOkta上の変更を検出します
+type DriftChecker struct {
+	Okta OktaClient
+}
+
+// Check 状態に記録された各アカウントについてOktaの実データと比較し、差分があるものを返します
+func (c DriftChecker) Check(state State) ([]Drift, error) {
+	var drifts []Drift
+	for _, data := range state {
+		if data.OktaUserID == "" {
+			slog.Info("okta user is not linked, skip", accountLogAttrs(logOpDrift, data.Account)...)
+			continue
+		}
+		// /api/v1/users/{id} はloginの代わりにIDでも取得できる
+		user, err := c.Okta.GetUserWithLogin(data.OktaUserID)
+		if err != nil {
+			return drifts, err
+		}
+		var groups []OktaGroup
+		if user.ID != "" {
+			if groups, err = c.Okta.ListUserGroups(user.ID); err != nil {
+				return drifts, err
+			}
+		}
+		if drift := DetectDrift(data, user, groups); drift.HasDrift() {
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+// Fix Oktaの値をLDAP側（状態ファイル）の値で上書きします（差分の項目だけを部分更新）
+func (c DriftChecker) Fix(drifts []Drift) error {
+	for _, drift := range drifts {
+		if drift.NotFound {
+			slog.Warn("okta user not found, run sync after removing the link", drift.logAttrs()...)
+			continue
+		}
+		switch drift.Status {
+		case oktaStatusDeprovisioned:
+			if err := c.Okta.ActivateUser(drift.OktaUserID); err != nil {
+				return err
+			}
+		case oktaStatusSuspended:
+			if err := c.Okta.UnsuspendUser(drift.OktaUserID); err != nil {
+				return err
+			}
+		}
+		if len(drift.Changes) > 0 {
+			// LDAP側の値（Old）で上書き
+			attributes := make(map[string]string)
+			for _, change := range drift.Changes {
+				attributes[change.Field] = change.Old
+			}
+			if _, err := c.Okta.UpdateUser(drift.OktaUserID, attributes); err != nil {
+				return err
+			}
+		}
+		for _, gid := range drift.MissingGroupIDs {
+			if err := c.Okta.AddUserToGroup(gid, drift.OktaUserID); err != nil {
+				return err
+			}
+		}
+		slog.Info("okta user overwritten with LDAP values", drift.logAttrs()...)
+	}
+	return nil
+}
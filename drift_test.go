@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectDrift(t *testing.T) {
+	state := AccountState{
+		Account:      testAccounts[0],
+		OktaUserID:   "00u_aaa",
+		OktaGroupIDs: []string{"00g_001", "00g_002"},
+	}
+	user := OktaUser{ID: "00u_aaa", Status: "ACTIVE", UserProfile: *testAccounts[0].OktaProfile()}
+	groups := []OktaGroup{{ID: "00g_001"}, {ID: "00g_002"}, {ID: "00g_everyone"}}
+
+	// Pattern: [No Drift]
+	if drift := DetectDrift(state, &user, groups); drift.HasDrift() {
+		t.Errorf("DetectDrift [No Drift]drift exists: %v", drift)
+	}
+
+	// Pattern: [Modify]
+	user.Email = "changed@example.com"
+	user.Status = oktaStatusSuspended
+	drift := DetectDrift(state, &user, groups[1:])
+	if !drift.HasDrift() {
+		t.Fatal("DetectDrift [Modify]drift not detected")
+	}
+	if len(drift.Changes) != 1 || drift.Changes[0].Field != "email" ||
+		drift.Changes[0].Old != testAccounts[0].Email || drift.Changes[0].New != "changed@example.com" {
+		t.Errorf("DetectDrift [Modify]changes wrong: %v", drift.Changes)
+	}
+	if drift.Status != oktaStatusSuspended {
+		t.Errorf("DetectDrift [Modify]status wrong: %s", drift.Status)
+	}
+	if len(drift.MissingGroupIDs) != 1 || drift.MissingGroupIDs[0] != "00g_001" {
+		t.Errorf("DetectDrift [Modify]missing groups wrong: %v", drift.MissingGroupIDs)
+	}
+
+	// Pattern: [Not Found]
+	if drift := DetectDrift(state, &OktaUser{}, nil); !drift.NotFound {
+		t.Errorf("DetectDrift [Not Found]not detected: %v", drift)
+	}
+}
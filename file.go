@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000000000"
+
+// atomicWriteFile 一時ファイルに書き込んでfsyncした後にrenameで置き換えます。
+// 途中でクラッシュしても元のファイルか新しいファイルのどちらかが残ります。
+func atomicWriteFile(fileNm string, data []byte, perm os.FileMode) (err error) {
+	dir, base := filepath.Split(fileNm)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), fileNm); err != nil {
+		return err
+	}
+	// renameを永続化するためにディレクトリもfsyncする（未対応の環境ではエラーを無視）
+	if d, derr := os.Open(dir); derr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// backupFile fileNmを日時付きのバックアップファイルにコピーし、新しいものからkeep件だけ残します。
+// fileNmが存在しない場合は何もしません。
+func backupFile(fileNm string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileNm)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	info, err := os.Stat(fileNm)
+	if err != nil {
+		return err
+	}
+	backupNm := fmt.Sprintf("%s.%s.bak", fileNm, time.Now().UTC().Format(backupTimeFormat))
+	if err := atomicWriteFile(backupNm, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return pruneBackups(fileNm, keep)
+}
+
+// pruneBackups fileNmのバックアップファイルを新しいものからkeep件だけ残して削除します
+func pruneBackups(fileNm string, keep int) error {
+	backups, err := listBackups(fileNm)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// listBackups fileNmのバックアップファイルを古い順に返します
+func listBackups(fileNm string) ([]string, error) {
+	backups, err := filepath.Glob(fileNm + ".*.bak")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
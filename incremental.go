@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// incremental attributes（ldap.incremental.attribute）
+const (
+	incrementalModifyTimestamp = "modifyTimestamp" // 全サーバー共通の値
+	incrementalUSNChanged      = "uSNChanged"      // Active Directory、サーバー毎の値
+)
+
+// defaultFullInterval 差分取得の場合に全件取得して削除を反映する間隔
+const defaultFullInterval = 24 * time.Hour
+
+// metaWatermark 差分取得の位置を保存するStateMetaのキー
+const metaWatermark = "ldap.watermark"
+
+// generalizedTimeFormat modifyTimestampの形式（小数秒は省略可）
+const generalizedTimeFormat = "20060102150405Z0700"
+
+// Watermark LDAPの差分取得の位置。
+// 取得したエントリの属性の最大値を保存し、次回はこの値以降に変更されたエントリだけを取得します。
+type Watermark struct {
+	Attribute  string    `json:"attribute"`
+	Value      string    `json:"value,omitempty"`
+	Server     string    `json:"server,omitempty"` // uSNChangedの場合は値を取得したサーバー
+	FullSyncAt time.Time `json:"fullSyncAt"`       // 最後に全件取得した日時
+}
+
+// LoadWatermark 状態に保存した差分取得の位置（保存されていない場合はnil）
+func LoadWatermark(state StateReader) (*Watermark, error) {
+	value, err := state.Meta(metaWatermark)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var mark Watermark
+	if err := json.Unmarshal([]byte(value), &mark); err != nil {
+		return nil, fmt.Errorf("invalid %s in the state: %v", metaWatermark, err)
+	}
+	return &mark, nil
+}
+
+// SaveWatermark 差分取得の位置を状態に保存します
+func SaveWatermark(tx StateTx, mark *Watermark) error {
+	value, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+	return tx.SetMeta(metaWatermark, string(value))
+}
+
+// FullSyncReason 全件取得が必要な理由（差分取得できる場合は空）
+func (w *Watermark) FullSyncReason(attribute string, interval time.Duration, now time.Time) string {
+	switch {
+	case w == nil || w.Value == "":
+		return "no watermark in the state"
+	case w.Attribute != attribute:
+		return fmt.Sprintf("attribute changed from %s to %s", w.Attribute, attribute)
+	case now.Sub(w.FullSyncAt) >= interval:
+		return fmt.Sprintf("last full sync at %s", w.FullSyncAt.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// Filter filterに前回の位置以降に変更されたエントリの条件を加えます（位置がない場合はfilterのまま）
+func (w *Watermark) Filter(filter string) string {
+	if w == nil || w.Value == "" {
+		return filter
+	}
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	return fmt.Sprintf("(&%s(%s>=%s))", filter, w.Attribute, ldap.EscapeFilter(w.Value))
+}
+
+// Advance エントリの属性の値で位置を進めます（読めない値は無視します）
+func (w *Watermark) Advance(entries []*ldap.Entry) {
+	for _, entry := range entries {
+		value := entry.GetAttributeValue(w.Attribute)
+		if value == "" {
+			continue
+		}
+		if cmp, ok := compareMarks(w.Attribute, value, w.Value); ok && cmp > 0 {
+			w.Value = value
+		}
+	}
+}
+
+// compareMarks 属性の値を比較します（aが大きい場合は1）。bが空の場合はaが大きいとします
+func compareMarks(attribute, a, b string) (int, bool) {
+	switch attribute {
+	case incrementalModifyTimestamp:
+		ta, err := time.Parse(generalizedTimeFormat, a)
+		if err != nil {
+			return 0, false
+		}
+		if b == "" {
+			return 1, true
+		}
+		tb, err := time.Parse(generalizedTimeFormat, b)
+		if err != nil {
+			return 1, true
+		}
+		switch {
+		case ta.After(tb):
+			return 1, true
+		case ta.Before(tb):
+			return -1, true
+		}
+		return 0, true
+	case incrementalUSNChanged:
+		na, ok := new(big.Int).SetString(a, 10)
+		if !ok {
+			return 0, false
+		}
+		if b == "" {
+			return 1, true
+		}
+		nb, ok := new(big.Int).SetString(b, 10)
+		if !ok {
+			return 1, true
+		}
+		return na.Cmp(nb), true
+	}
+	return 0, false
+}
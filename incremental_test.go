@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestWatermark(t *testing.T) {
+	entry := func(attribute, value string) *ldap.Entry {
+		return ldap.NewEntry("uid=aaa_user,dc=example,dc=com", map[string][]string{attribute: {value}})
+	}
+
+	// Pattern: [modifyTimestamp] 小数秒、タイムゾーンの違いは時刻で比較する
+	mark := &Watermark{Attribute: incrementalModifyTimestamp}
+	mark.Advance([]*ldap.Entry{
+		entry(incrementalModifyTimestamp, "20240101120000Z"),
+		entry(incrementalModifyTimestamp, "20240101123000.0Z"),
+		entry(incrementalModifyTimestamp, "20240101200000+0900"),
+		entry(incrementalModifyTimestamp, "invalid"),
+		entry("uid", "aaa_user"),
+	})
+	if mark.Value != "20240101123000.0Z" {
+		t.Errorf("Watermark.Advance [modifyTimestamp]value wrong: %s", mark.Value)
+	}
+	if filter := mark.Filter("uid=*"); filter != "(&(uid=*)(modifyTimestamp>=20240101123000.0Z))" {
+		t.Errorf("Watermark.Filter [modifyTimestamp]wrong: %s", filter)
+	}
+
+	// Pattern: [uSNChanged] 数値で比較する
+	mark = &Watermark{Attribute: incrementalUSNChanged, Value: "9"}
+	mark.Advance([]*ldap.Entry{entry(incrementalUSNChanged, "10"), entry(incrementalUSNChanged, "8")})
+	if mark.Value != "10" {
+		t.Errorf("Watermark.Advance [uSNChanged]value wrong: %s", mark.Value)
+	}
+
+	// Pattern: [Full] 位置がない、属性が変わった、fullIntervalを過ぎた場合は全件取得
+	var none *Watermark
+	if none.Filter("(uid=*)") != "(uid=*)" || none.FullSyncReason(incrementalUSNChanged, time.Hour, time.Now()) == "" {
+		t.Error("Watermark [Full]nil watermark wrong")
+	}
+	now := time.Now()
+	mark.FullSyncAt = now.Add(-30 * time.Minute)
+	if reason := mark.FullSyncReason(incrementalUSNChanged, time.Hour, now); reason != "" {
+		t.Errorf("Watermark.FullSyncReason [Incremental]wrong: %s", reason)
+	}
+	if mark.FullSyncReason(incrementalModifyTimestamp, time.Hour, now) == "" || mark.FullSyncReason(incrementalUSNChanged, 10*time.Minute, now) == "" {
+		t.Error("Watermark.FullSyncReason [Full]reason not returned")
+	}
+}
+
+func TestSaveWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "watermark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := StateFile{Path: filepath.Join(dir, "state.json")}
+	store := &JSONStateStore{File: file}
+	if mark, err := LoadWatermark(store); mark != nil || err != nil {
+		t.Errorf("LoadWatermark [Empty]wrong: %v, %v", mark, err)
+	}
+	saved := &Watermark{Attribute: incrementalUSNChanged, Value: "12345", Server: "ldap://dc1:389", FullSyncAt: time.Now().UTC().Truncate(time.Second)}
+	if err := store.Transaction(func(tx StateTx) error {
+		return SaveWatermark(tx, saved)
+	}); err != nil {
+		t.Fatalf("SaveWatermark failed: %v", err)
+	}
+	store = &JSONStateStore{File: file}
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if mark, err := LoadWatermark(store); err != nil || *mark != *saved {
+		t.Errorf("LoadWatermark wrong: %v, %v", mark, err)
+	}
+
+	// Pattern: [Modified] metaの改ざんを検出する
+	data, _ := ioutil.ReadFile(file.Path)
+	ioutil.WriteFile(file.Path, bytes.Replace(data, []byte("12345"), []byte("99999"), 1), 0600)
+	if _, err := file.Load(); err == nil {
+		t.Error("StateFile.Load [Modified]meta corruption not detected")
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// journal entry types
+const (
+	journalRunStart = "run_start" // 実行の開始（入力と実行者）
+	journalRunEnd   = "run_end"   // 実行の終了（件数と結果）
+	journalAccount  = "account"   // アカウント毎の反映結果
+	journalOkta     = "okta"      // Okta APIの更新リクエスト
+)
+
+// JournalEntry 同期履歴（JSON Lines）の1行
+type JournalEntry struct {
+	Time  time.Time `json:"time"`
+	RunID string    `json:"runId"`
+	Type  string    `json:"type"`
+
+	// run_start, run_end
+	Command    string         `json:"command,omitempty"`
+	Operator   string         `json:"operator,omitempty"`
+	Host       string         `json:"host,omitempty"`
+	ConfigHash string         `json:"configHash,omitempty"`
+	Inputs     *JournalInputs `json:"inputs,omitempty"`
+	Result     *JournalResult `json:"result,omitempty"`
+
+	// account
+	Operation  string        `json:"operation,omitempty"` // create, update, delete
+	Dn         string        `json:"dn,omitempty"`
+	OktaUserID string        `json:"oktaUserId,omitempty"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+	Previous   *AccountState `json:"previous,omitempty"` // 反映前の状態（update, delete）
+	// Sealed 状態の暗号化キーを指定した場合に暗号化したChanges、Previous（Fieldsに変更した項目名を残します）
+	Sealed []byte `json:"sealed,omitempty"`
+	KeyID  string `json:"keyId,omitempty"`
+
+	// okta
+	Method string   `json:"method,omitempty"`
+	Path   string   `json:"path,omitempty"`
+	Status int      `json:"status,omitempty"`
+	Fields []string `json:"fields,omitempty"` // リクエストで送った項目名（値は記録しない）、accountは暗号化した変更の項目名
+
+	Error string `json:"error,omitempty"`
+}
+
+// JournalInputs 実行の入力
+type JournalInputs struct {
+	LdapHost   string `json:"ldapHost,omitempty"`
+	BaseDn     string `json:"baseDn,omitempty"`
+	LdapFilter string `json:"ldapFilter,omitempty"`
+	LdapCount  int    `json:"ldapCount"`
+	Watermark  string `json:"watermark,omitempty"` // 差分取得の場合は前回の位置
+	StateCount int    `json:"stateCount"`
+	Creates    int    `json:"creates"`
+	Updates    int    `json:"updates"`
+	Deletes    int    `json:"deletes"`
+}
+
+// JournalResult 実行の結果
+type JournalResult struct {
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Journal 追記専用の同期履歴ファイル（JSON Lines）。
+// 1行書く毎にfsyncするので、途中で異常終了してもそれまでの履歴は残ります。
+// nilのJournalには何も記録しません。
+type Journal struct {
+	Path  string
+	RunID string
+	Key   *StateKey // アカウントの値を暗号化するキー（nilの場合は暗号化しない）
+	mu    sync.Mutex
+	file  *os.File
+}
+
+// journalAAD 同期履歴の暗号化の付加データ
+var journalAAD = []byte("perman-okta journal")
+
+// journalSecret 同期履歴の暗号化する項目
+type journalSecret struct {
+	Changes  []FieldChange `json:"changes,omitempty"`
+	Previous *AccountState `json:"previous,omitempty"`
+}
+
+// OpenJournal 同期履歴ファイルを追記モードで開きます
+func OpenJournal(path, runID string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{Path: path, RunID: runID, file: file}, nil
+}
+
+// NewRunID 実行IDを生成します（日時+ランダム）
+func NewRunID() string {
+	random := make([]byte, 4)
+	rand.Read(random)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random)
+}
+
+// Record entryに日時と実行IDを付けて1行追記します
+func (j *Journal) Record(entry JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.RunID = j.RunID
+	if err := entry.seal(j.Key); err != nil {
+		return err
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close 同期履歴ファイルを閉じます
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// ReadJournal 同期履歴ファイルを読み込みます（runIDを指定した場合はその実行の行だけ）
+func ReadJournal(path, runID string) ([]JournalEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		if runID == "" || entry.RunID == runID {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// seal ChangesとPreviousをkeyで暗号化します（keyがnil、暗号化する値がない場合は何もしません）
+func (e *JournalEntry) seal(key *StateKey) error {
+	if key == nil || (len(e.Changes) == 0 && e.Previous == nil) {
+		return nil
+	}
+	data, err := json.Marshal(journalSecret{Changes: e.Changes, Previous: e.Previous})
+	if err != nil {
+		return err
+	}
+	if e.Sealed, err = key.Seal(data, journalAAD); err != nil {
+		return err
+	}
+	for _, change := range e.Changes {
+		e.Fields = append(e.Fields, change.Field)
+	}
+	e.KeyID, e.Changes, e.Previous = key.ID, nil, nil
+	return nil
+}
+
+// Unseal 暗号化したChangesとPreviousをkeyで復号します（暗号化していない場合は何もしません）
+func (e *JournalEntry) Unseal(key *StateKey) error {
+	if e.Sealed == nil {
+		return nil
+	}
+	if key == nil || key.ID != e.KeyID {
+		return fmt.Errorf("journal entry of %s is encrypted (keyId %s), set the state key to STATE_KEY or STATE_KEY_FILE", e.Dn, e.KeyID)
+	}
+	data, err := key.Open(e.Sealed, journalAAD)
+	if err != nil {
+		return err
+	}
+	var secret journalSecret
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return err
+	}
+	e.Changes, e.Previous, e.Sealed, e.KeyID, e.Fields = secret.Changes, secret.Previous, nil, "", nil
+	return nil
+}
+
+// UnsealJournal entriesをkeyで復号します（復号できない行は暗号化したまま残します）
+func UnsealJournal(entries []JournalEntry, key *StateKey) []JournalEntry {
+	for i := range entries {
+		entries[i].Unseal(key)
+	}
+	return entries
+}
+
+// RekeyJournal 同期履歴のアカウントの値をkeyで暗号化し直します（oldKeyで暗号化した値、暗号化していない値）
+func RekeyJournal(path string, oldKey, key *StateKey) error {
+	entries, err := ReadJournal(path, "")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		rekeyed := entry.Sealed != nil && key != nil && entry.KeyID == key.ID
+		if entry.Type == journalAccount && !rekeyed {
+			if err := entry.Unseal(oldKey); err != nil {
+				return err
+			}
+			if err := entry.seal(key); err != nil {
+				return err
+			}
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+	return atomicWriteFile(path, buf.Bytes(), 0600)
+}
+
+// Transport Okta APIの更新リクエスト（GET以外）を記録するRoundTripperを返します
+func (j *Journal) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if j == nil {
+		return base
+	}
+	return journalTransport{base: base, journal: j}
+}
+
+type journalTransport struct {
+	base    http.RoundTripper
+	journal *Journal
+}
+
+// RoundTrip リクエストを送り、メソッド、パス、送った項目名、レスポンスのステータスを記録します
+func (t journalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "GET" {
+		return t.base.RoundTrip(req)
+	}
+	entry := JournalEntry{Type: journalOkta, Method: req.Method, Path: req.URL.Path}
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			entry.Fields = requestFields(data)
+		}
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = res.StatusCode
+	}
+	if err := t.journal.Record(entry); err != nil {
+		slog.Error("journal: record failed", logAttrs(logOpRun, "journal", t.journal.Path, "error", err)...)
+	}
+	return res, err
+}
+
+// requestFields JSONのリクエストボディの項目名を返します（profileの中は"profile.email"の形式）
+func requestFields(data []byte) []string {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil
+	}
+	var fields []string
+	for key, value := range body {
+		var nested map[string]json.RawMessage
+		if err := json.Unmarshal(value, &nested); err != nil {
+			fields = append(fields, key)
+			continue
+		}
+		for nestedKey := range nested {
+			fields = append(fields, key+"."+nestedKey)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+
+	okta := newFakeOkta()
+	srv, oktaClient := okta.start()
+	defer srv.Close()
+	okta.fail["bbb_user@example.com"] = true
+
+	// 1回目の実行
+	journal, err := OpenJournal(path, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oktaClient.HTTPClient = &http.Client{Transport: journal.Transport(srv.Client().Transport)}
+	syncer := Syncer{Okta: oktaClient, Groups: []string{"everyone"}, Journal: journal}
+	journal.Record(JournalEntry{Type: journalRunStart, Command: "sync", Inputs: &JournalInputs{LdapCount: len(testAccounts)}})
+	diff, _ := DefaultMapping().Diff(&[]Account{}, &testAccounts)
+	state, failures, err := syncer.Apply(State{}, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Record(JournalEntry{Type: journalRunEnd, Result: &JournalResult{Failures: len(failures)}})
+	journal.Close()
+
+	// 2回目の実行（追記される）
+	journal, _ = OpenJournal(path, "run2")
+	oktaClient.HTTPClient = &http.Client{Transport: journal.Transport(srv.Client().Transport)}
+	syncer = Syncer{Okta: oktaClient, Journal: journal}
+	newAccounts := []Account{testAccounts[0]}
+	newAccounts[0].Email = "aaa_new@example.com"
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &newAccounts)
+	if _, _, err := syncer.Apply(state, diff); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+
+	// Pattern: [Run1] 実行IDで絞り込む
+	entries, err := ReadJournal(path, "run1")
+	if err != nil {
+		t.Fatalf("ReadJournal failed: %v", err)
+	}
+	if len(entries) == 0 || entries[0].Type != journalRunStart || entries[len(entries)-1].Type != journalRunEnd {
+		t.Fatalf("ReadJournal [Run1]entries wrong: %v", entries)
+	}
+	var accounts, mutations int
+	for _, entry := range entries {
+		if entry.RunID != "run1" || entry.Time.IsZero() {
+			t.Errorf("ReadJournal [Run1]entry wrong: %v", entry)
+		}
+		switch entry.Type {
+		case journalAccount:
+			accounts++
+			if entry.Dn == testAccounts[1].Dn && entry.Error == "" {
+				t.Errorf("ReadJournal [Run1]failed account has no error: %v", entry)
+			}
+		case journalOkta:
+			mutations++
+			if entry.Method == "POST" && entry.Path == "/api/v1/users" {
+				if entry.Status == 0 || len(entry.Fields) == 0 || entry.Fields[0] != "profile.email" {
+					t.Errorf("ReadJournal [Run1]okta entry wrong: %v", entry)
+				}
+			}
+		}
+	}
+	// 作成3件（1件失敗）、ユーザー作成3回とグループ追加2回
+	if accounts != 3 || mutations != 5 {
+		t.Errorf("ReadJournal [Run1]count wrong: accounts=%d, okta=%d", accounts, mutations)
+	}
+
+	// Pattern: [Run2] 更新と削除は反映前の状態を記録する
+	entries, _ = ReadJournal(path, "run2")
+	var operations []string
+	for _, entry := range entries {
+		if entry.Type != journalAccount {
+			continue
+		}
+		operations = append(operations, entry.Operation)
+		if entry.Previous == nil || entry.Previous.OktaUserID == "" {
+			t.Errorf("ReadJournal [Run2]previous state not recorded: %v", entry)
+		}
+		if entry.Operation == UpdateKey && (len(entry.Changes) != 1 || entry.Changes[0].Old != testAccounts[0].Email) {
+			t.Errorf("ReadJournal [Run2]changes wrong: %v", entry.Changes)
+		}
+	}
+	if len(operations) != 2 || operations[0] != UpdateKey || operations[1] != DeleteKey {
+		t.Errorf("ReadJournal [Run2]operations wrong: %v", operations)
+	}
+
+	if all, _ := ReadJournal(path, ""); len(all) <= len(entries) {
+		t.Errorf("ReadJournal all runs wrong: %d", len(all))
+	}
+}
+
+func TestJournalSealed(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+	var keys [2]*StateKey
+	for i := range keys {
+		value, _ := GenerateStateKey()
+		if keys[i], err = LoadStateKey(value, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Pattern: [Sealed] キーを指定した場合はアカウントの値を暗号化し、項目名だけ残す
+	journal, err := OpenJournal(path, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.Key = keys[0]
+	journal.Record(JournalEntry{Type: journalAccount, Operation: UpdateKey, Dn: testAccounts[0].Dn,
+		Changes:  []FieldChange{{Field: fieldEmail, Old: testAccounts[0].Email, New: "aaa_new@example.com"}},
+		Previous: &AccountState{Account: testAccounts[0], OktaUserID: "00u_aaa"}})
+	journal.Close()
+	data, _ := ioutil.ReadFile(path)
+	if bytes.Contains(data, []byte(testAccounts[0].Email)) || bytes.Contains(data, []byte("aaa_new@example.com")) {
+		t.Errorf("Journal.Record [Sealed]plaintext value written: %s", data)
+	}
+	entries, _ := ReadJournal(path, "")
+	if len(entries) != 1 || entries[0].Sealed == nil || len(entries[0].Fields) != 1 || entries[0].Fields[0] != fieldEmail {
+		t.Fatalf("ReadJournal [Sealed]entry wrong: %v", entries)
+	}
+	if err := entries[0].Unseal(nil); err == nil {
+		t.Error("JournalEntry.Unseal [NoKey]error not returned")
+	}
+	if err := entries[0].Unseal(keys[0]); err != nil || entries[0].Previous == nil || entries[0].Changes[0].Old != testAccounts[0].Email {
+		t.Errorf("JournalEntry.Unseal [Sealed]wrong: %v, %v", entries[0], err)
+	}
+
+	// Pattern: [Rekey] 新しいキーで暗号化し直す
+	if err := RekeyJournal(path, keys[0], keys[1]); err != nil {
+		t.Fatalf("RekeyJournal failed: %v", err)
+	}
+	entries, _ = ReadJournal(path, "")
+	if err := entries[0].Unseal(keys[0]); err == nil {
+		t.Error("RekeyJournal [Rekey]old key still works")
+	}
+	if err := entries[0].Unseal(keys[1]); err != nil || entries[0].Changes[0].New != "aaa_new@example.com" {
+		t.Errorf("RekeyJournal [Rekey]wrong: %v, %v", entries[0], err)
+	}
+}
@@ -1,48 +1,46 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 
 	"gopkg.in/ldap.v2"
 )
 
 // LdapClient LDAPクライアント
 type LdapClient struct {
-	Host       string
+	Pool       *LdapPool // 接続（同じ実行の検索で使い回します）
 	BaseDn     string
+	Scope      int // ldap.ScopeBaseObject, ldap.ScopeSingleLevel, ldap.ScopeWholeSubtree
 	Filter     string
 	Attributes []string
 	SizeLimit  int
-	TimeLimit  int
+	TimeLimit  int // 秒（0の場合はPoolのタイムアウト）
 	TypeOnly   bool
 }
 
 // Search ldapsearch
 func (l LdapClient) Search() (result *ldap.SearchResult, err error) {
 
-	ldapConn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", l.Host, 389))
-	if err != nil {
-		log.Printf("connerction Error... err: %+v", err)
-		return
+	timeLimit := l.TimeLimit
+	if timeLimit == 0 {
+		timeLimit = l.Pool.TimeLimit()
 	}
-	defer ldapConn.Close()
 
 	// ldapsearch
 	searchRequest := ldap.NewSearchRequest(
 		l.BaseDn,
-		ldap.ScopeWholeSubtree,
+		l.Scope,
 		ldap.NeverDerefAliases,
 		l.SizeLimit,
-		l.TimeLimit,
+		timeLimit,
 		l.TypeOnly,
 		l.Filter,
-		[]string{"dn", "uid", "email", "employeeNumber", "description"},
+		l.Attributes,
 		nil,
 	)
-	result, err = ldapConn.Search(searchRequest)
+	result, err = l.Pool.Search(searchRequest)
 	if err != nil {
-		log.Printf("ldap search Error... err: %+v", err)
+		slog.Error("ldap search Error", logAttrs(logOpLdap, "base_dn", l.BaseDn, "filter", l.Filter, "error", err)...)
 		return
 	}
 	return
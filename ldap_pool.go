@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// defaultLdapTimeout 接続、操作毎のタイムアウト（ldap.timeout）
+const defaultLdapTimeout = 30 * time.Second
+
+// timeLimitGrace サーバーのTimeLimitの応答を待つため、クライアントのタイムアウトを長くします
+const timeLimitGrace = 5 * time.Second
+
+// LdapPool 複数のLDAPサーバー（レプリカ）への接続。
+// 接続は1回の実行中の検索で使い回し、接続、bind、ヘルスチェック、検索に失敗したサーバーから次のサーバーに切り替えます。
+type LdapPool struct {
+	URLs         []string // ldap://host:port, ldaps://host:port
+	BindDn       string   // 空の場合はbindしません（匿名）
+	BindPassword string
+	Timeout      time.Duration // 接続、操作毎のタイムアウト（0の場合はdefaultLdapTimeout）
+	TLSConfig    *tls.Config   // ldaps://の場合（nilの場合はホスト名で検証します）
+
+	conn    *ldap.Conn
+	current int // 接続中のサーバー
+}
+
+// Search 接続中のサーバーで検索します。サーバーの問題で失敗した場合は次のサーバーで検索し直します
+func (p *LdapPool) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if len(p.URLs) == 0 {
+		return nil, errors.New("ldap: no server url")
+	}
+	var lastErr error
+	for i := 0; i < len(p.URLs); i++ {
+		conn, err := p.connect()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		result, err := conn.Search(request)
+		if err == nil {
+			return result, nil
+		}
+		if !isServerError(err) {
+			return nil, err // 検索条件の誤りは他のサーバーでも失敗する
+		}
+		slog.Warn("ldap search failed, trying the next server", logAttrs(logOpLdap, "ldap", p.URLs[p.current], "error", err)...)
+		lastErr = err
+		p.failover()
+	}
+	return nil, fmt.Errorf("ldap: all servers failed, last error: %v", lastErr)
+}
+
+// Close 接続を閉じます
+func (p *LdapPool) Close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// URL 接続中（次に接続する）サーバー
+func (p *LdapPool) URL() string {
+	if len(p.URLs) == 0 {
+		return ""
+	}
+	return p.URLs[p.current]
+}
+
+// connect 接続中の接続、または現在のサーバーへの新しい接続を返します（失敗した場合は次のサーバーに切り替えます）
+func (p *LdapPool) connect() (*ldap.Conn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+	rawURL := p.URLs[p.current]
+	conn, err := p.dial(rawURL)
+	if err != nil {
+		slog.Warn("ldap connect failed", logAttrs(logOpLdap, "ldap", rawURL, "error", err)...)
+		p.failover()
+		return nil, err
+	}
+	slog.Debug("ldap connected", logAttrs(logOpLdap, "ldap", rawURL)...)
+	p.conn = conn
+	return conn, nil
+}
+
+// dial 接続、bind、ヘルスチェック（RootDSEの検索）をします
+func (p *LdapPool) dial(rawURL string) (*ldap.Conn, error) {
+	timeout := p.timeout()
+	c, isTLS, err := dialLdapURL(rawURL, timeout, p.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn := ldap.NewConn(c, isTLS)
+	conn.Start()
+	conn.SetTimeout(timeout + timeLimitGrace)
+
+	if p.BindDn != "" {
+		if err := conn.Bind(p.BindDn, p.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bind: %v", err)
+		}
+	}
+	if _, err := conn.Search(ldap.NewSearchRequest(
+		"", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, p.TimeLimit(), false,
+		"(objectClass=*)", []string{"supportedLDAPVersion"}, nil,
+	)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("health check: %v", err)
+	}
+	return conn, nil
+}
+
+// dialLdapURL LDAPサーバーにTCP（ldaps://の場合はTLS）で接続します
+func dialLdapURL(rawURL string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, bool, error) {
+	u, err := parseLdapURL(rawURL)
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	if u.Scheme != "ldaps" {
+		return c, false, nil
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	tlsConn := tls.Client(c, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		c.Close()
+		return nil, false, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, true, nil
+}
+
+// failover 接続を閉じて次のサーバーに切り替えます
+func (p *LdapPool) failover() {
+	p.Close()
+	p.current = (p.current + 1) % len(p.URLs)
+}
+
+func (p *LdapPool) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return defaultLdapTimeout
+}
+
+// TimeLimit 検索リクエストのTimeLimit（秒）
+func (p *LdapPool) TimeLimit() int {
+	limit := int(p.timeout() / time.Second)
+	if limit < 1 {
+		limit = 1
+	}
+	return limit
+}
+
+// isServerError 他のサーバーで検索し直す失敗（接続の切断、タイムアウト、サーバーの停止中など）
+func isServerError(err error) bool {
+	ldapErr, ok := err.(*ldap.Error)
+	if !ok {
+		return true // ldap: connection timed out など
+	}
+	switch ldapErr.ResultCode {
+	case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultUnwillingToPerform, ldap.LDAPResultOther:
+		return true
+	}
+	return false
+}
+
+// parseLdapURL ldap://host[:port]、ldaps://host[:port]（ポートを省略した場合は389、636）
+func parseLdapURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := ""
+	switch u.Scheme {
+	case "ldap":
+		port = "389"
+	case "ldaps":
+		port = "636"
+	default:
+		return nil, fmt.Errorf("%s: scheme must be ldap or ldaps", rawURL)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%s: host is required", rawURL)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
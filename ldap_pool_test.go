@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// fakeLdap bind、検索だけに応答するLDAPサーバー
+type fakeLdap struct {
+	listener net.Listener
+	baseDn   string
+	entries  map[string][]string // uid → email
+	dropOn   string              // この条件の検索で接続を切ります（サーバーの停止）
+
+	mu       sync.Mutex
+	conns    int
+	searches int
+}
+
+func newFakeLdap(t *testing.T, baseDn string) *fakeLdap {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeLdap{listener: listener, baseDn: baseDn, entries: map[string][]string{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeLdap) URL() string { return "ldap://" + f.listener.Addr().String() }
+
+func (f *fakeLdap) Close() { f.listener.Close() }
+
+func (f *fakeLdap) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		messageID := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			conn.Write(ldapResponse(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess).Bytes())
+		case ldap.ApplicationSearchRequest:
+			baseDn := op.Children[0].Value.(string)
+			if baseDn != "" {
+				f.mu.Lock()
+				f.searches++
+				f.mu.Unlock()
+			}
+			if f.dropOn != "" && baseDn == f.dropOn {
+				return
+			}
+			if baseDn != "" && baseDn != f.baseDn {
+				conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject).Bytes())
+				continue
+			}
+			if baseDn != "" {
+				for uid, values := range f.entries {
+					conn.Write(ldapEntry(messageID, "uid="+uid+","+f.baseDn, map[string][]string{"uid": {uid}, "email": values}).Bytes())
+				}
+			}
+			conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return // unbind
+		}
+	}
+}
+
+func ldapResponse(messageID int64, application uint8, resultCode int64) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ber.Tag(application), nil, "")
+	response.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, resultCode, ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	response.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	packet.AppendChild(response)
+	return packet
+}
+
+func ldapEntry(messageID int64, dn string, attributes map[string][]string) *ber.Packet {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, values := range attributes {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	entry.AppendChild(attrs)
+	packet.AppendChild(entry)
+	return packet
+}
+
+// closedURL 接続できないサーバー
+func closedURL(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestLdapPool(t *testing.T) {
+	primary := newFakeLdap(t, "dc=example,dc=com")
+	defer primary.Close()
+	primary.entries["aaa_user"] = []string{"aaa_user@example.com"}
+	replica := newFakeLdap(t, "dc=example,dc=com")
+	defer replica.Close()
+	replica.entries["aaa_user"] = []string{"aaa_user@example.com"}
+	replica.dropOn = "dc=example,dc=com"
+
+	search := func(pool *LdapPool, baseDn string) ([]Account, error) {
+		result, err := LdapClient{Pool: pool, BaseDn: baseDn, Scope: ldap.ScopeWholeSubtree, Filter: "(uid=*)",
+			Attributes: []string{"uid", "email"}}.Search()
+		if err != nil {
+			return nil, err
+		}
+		return ConvertEntries(result.Entries, defaultAttributes), nil
+	}
+
+	// Pattern: [Failover] 接続できないサーバー、検索中に切断したサーバーは次のサーバーに切り替える
+	pool := &LdapPool{URLs: []string{closedURL(t), replica.URL(), primary.URL()}, BindDn: "cn=reader,dc=example,dc=com", Timeout: 2 * time.Second}
+	defer pool.Close()
+	accounts, err := search(pool, "dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("LdapPool.Search [Failover]failed: %v", err)
+	}
+	if len(accounts) != 1 || accounts[0].Email != "aaa_user@example.com" || pool.URL() != primary.URL() {
+		t.Errorf("LdapPool.Search [Failover]result wrong: %v, %s", accounts, pool.URL())
+	}
+
+	// Pattern: [Reuse] 同じ実行の検索は接続を使い回す
+	if _, err := search(pool, "dc=example,dc=com"); err != nil {
+		t.Fatal(err)
+	}
+	primary.mu.Lock()
+	conns, searches := primary.conns, primary.searches
+	primary.mu.Unlock()
+	if conns != 1 || searches != 2 {
+		t.Errorf("LdapPool.Search [Reuse]conns: %d, searches: %d", conns, searches)
+	}
+
+	// Pattern: [Request] 検索条件の誤りは他のサーバーで検索し直さない
+	if _, err := search(pool, "ou=missing,dc=example,dc=com"); !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		t.Errorf("LdapPool.Search [Request]error wrong: %v", err)
+	}
+	if pool.URL() != primary.URL() {
+		t.Errorf("LdapPool.Search [Request]server changed: %s", pool.URL())
+	}
+
+	// Pattern: [AllFailed]
+	failed := &LdapPool{URLs: []string{closedURL(t), closedURL(t)}, Timeout: time.Second}
+	if _, err := search(failed, "dc=example,dc=com"); err == nil {
+		t.Error("LdapPool.Search [AllFailed]error not returned")
+	}
+}
+
+func TestParseLdapURL(t *testing.T) {
+	cases := map[string]string{
+		"ldap://ldap1.example.com":       "ldap1.example.com:389",
+		"ldaps://ldap1.example.com":      "ldap1.example.com:636",
+		"ldap://ldap1.example.com:10389": "ldap1.example.com:10389",
+	}
+	for rawURL, host := range cases {
+		if u, err := parseLdapURL(rawURL); err != nil || u.Host != host {
+			t.Errorf("parseLdapURL %s wrong: %v, %v", rawURL, u, err)
+		}
+	}
+	for _, rawURL := range []string{"ldap1.example.com", "http://ldap1.example.com", "ldap://"} {
+		if _, err := parseLdapURL(rawURL); err == nil {
+			t.Errorf("parseLdapURL [Invalid]%s error not returned", rawURL)
+		}
+	}
+}
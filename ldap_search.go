@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// search scopes
+const (
+	scopeBase = "base"
+	scopeOne  = "one"
+	scopeSub  = "sub"
+)
+
+var ldapScopes = map[string]int{
+	scopeBase: ldap.ScopeBaseObject,
+	scopeOne:  ldap.ScopeSingleLevel,
+	scopeSub:  ldap.ScopeWholeSubtree,
+}
+
+// defaultAttributes Accountの項目とLDAPの属性名
+var defaultAttributes = map[string]string{
+	fieldUID:            "uid",
+	fieldEmail:          "email",
+	fieldEmployeeNumber: "employeeNumber",
+	fieldDescription:    "description",
+}
+
+// LdapSearch 検索条件（ldap.searchesの1件）
+type LdapSearch struct {
+	Name   string `yaml:"name,omitempty"`
+	BaseDn string `yaml:"baseDn"`
+	Scope  string `yaml:"scope,omitempty"` // base, one, sub（省略した場合はsub）
+	Filter string `yaml:"filter"`
+	// Attributes Accountの項目毎にLDAPの属性名を上書きします（例: email: mail）
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+}
+
+// String ログ用の名前（nameを省略した場合はbaseDn）
+func (s LdapSearch) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.BaseDn
+}
+
+// LdapScope ldapパッケージのscope
+func (s LdapSearch) LdapScope() (int, error) {
+	if s.Scope == "" {
+		return ldap.ScopeWholeSubtree, nil
+	}
+	scope, ok := ldapScopes[s.Scope]
+	if !ok {
+		return 0, fmt.Errorf("unknown scope %q (base, one, sub)", s.Scope)
+	}
+	return scope, nil
+}
+
+// AttributeMap 上書きを反映したAccountの項目とLDAPの属性名
+func (s LdapSearch) AttributeMap() map[string]string {
+	attrs := map[string]string{}
+	for field, attr := range defaultAttributes {
+		attrs[field] = attr
+	}
+	for field, attr := range s.Attributes {
+		attrs[field] = attr
+	}
+	return attrs
+}
+
+// InScope dnが検索の範囲（baseDn、scope）に含まれる場合はtrue（filterはチェックしません）。
+// DNを解析できない場合は含まれるものとして扱います。
+func (s LdapSearch) InScope(dn string) bool {
+	base, err := ldap.ParseDN(dnKey(s.BaseDn))
+	if err != nil {
+		return true
+	}
+	entry, err := ldap.ParseDN(dnKey(dn))
+	if err != nil {
+		return true
+	}
+	switch s.Scope {
+	case scopeBase:
+		return base.Equal(entry)
+	case scopeOne:
+		return len(entry.RDNs) == len(base.RDNs)+1 && base.AncestorOf(entry)
+	default:
+		return base.Equal(entry) || base.AncestorOf(entry)
+	}
+}
+
+// LdapAttributes 検索で取得する属性名
+func (s LdapSearch) LdapAttributes() []string {
+	attributes := []string{"dn"}
+	for _, attr := range s.AttributeMap() {
+		attributes = append(attributes, attr)
+	}
+	sort.Strings(attributes[1:])
+	return attributes
+}
+
+// Validate 検索条件をチェックします
+func (s LdapSearch) Validate() error {
+	if s.BaseDn == "" {
+		return fmt.Errorf("%s: baseDn is required", s)
+	}
+	if s.Filter == "" {
+		return fmt.Errorf("%s: filter is required", s)
+	}
+	if _, err := s.LdapScope(); err != nil {
+		return fmt.Errorf("%s: %v", s, err)
+	}
+	for field, attr := range s.Attributes {
+		if _, ok := defaultAttributes[field]; !ok {
+			return fmt.Errorf("%s: unknown field %q in attributes", s, field)
+		}
+		if attr == "" {
+			return fmt.Errorf("%s: attribute for %s is empty", s, field)
+		}
+	}
+	return nil
+}
+
+// ConvertEntries ldapsearchの結果をattrsの属性名でAccount型に変換します
+func ConvertEntries(entries []*ldap.Entry, attrs map[string]string) []Account {
+	accounts := []Account{}
+	for _, entry := range entries {
+		var account = Account{}
+		account.Dn = entry.DN
+		account.UID = entry.GetAttributeValue(attrs[fieldUID])
+		account.Email = entry.GetAttributeValue(attrs[fieldEmail])
+		account.EmployeeNumber = entry.GetAttributeValue(attrs[fieldEmployeeNumber])
+		for _, desc := range entry.GetAttributeValues(attrs[fieldDescription]) {
+			account.Descriptions = append(account.Descriptions, desc)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// dnKey DNを比較するためのキー（DNは大文字小文字を区別しないので小文字にします）。
+// LDAPの結果、状態、変更通知のDNを突き合わせる場合は全てこのキーを使います。
+func dnKey(dn string) string {
+	return strings.ToLower(dn)
+}
+
+// MergeAccounts 複数の検索結果をDNで重複を除いてまとめます（先の検索結果を優先します）
+func MergeAccounts(results ...[]Account) (accounts []Account, duplicates []string) {
+	accounts = []Account{}
+	seen := map[string]bool{}
+	for _, result := range results {
+		for _, account := range result {
+			key := dnKey(account.Dn)
+			if seen[key] {
+				duplicates = append(duplicates, account.Dn)
+				continue
+			}
+			seen[key] = true
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts, duplicates
+}
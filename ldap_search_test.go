@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestLdapSearch(t *testing.T) {
+	// Pattern: [Attributes] 属性名の上書き
+	contractors := LdapSearch{
+		Name:       "contractors",
+		BaseDn:     "ou=contractors,dc=example,dc=com",
+		Scope:      scopeOne,
+		Filter:     "(&(objectClass=person)(shadowExpire>=20000))",
+		Attributes: map[string]string{fieldEmail: "mail", fieldEmployeeNumber: "contractorId"},
+	}
+	if err := contractors.Validate(); err != nil {
+		t.Fatalf("LdapSearch.Validate failed: %v", err)
+	}
+	if scope, _ := contractors.LdapScope(); scope != ldap.ScopeSingleLevel {
+		t.Errorf("LdapSearch.LdapScope wrong: %d", scope)
+	}
+	entries := []*ldap.Entry{
+		ldap.NewEntry("uid=ddd_user,ou=contractors,dc=example,dc=com", map[string][]string{
+			"uid":          {"ddd_user"},
+			"mail":         {"ddd_user@example.com"},
+			"email":        {"ignored@example.com"},
+			"contractorId": {"C001"},
+		}),
+	}
+	accounts := ConvertEntries(entries, contractors.AttributeMap())
+	if len(accounts) != 1 || accounts[0].Email != "ddd_user@example.com" || accounts[0].EmployeeNumber != "C001" || accounts[0].Descriptions != nil {
+		t.Errorf("ConvertEntries [Attributes]accounts wrong: %+v", accounts)
+	}
+	if attributes := contractors.LdapAttributes(); len(attributes) != 5 || attributes[0] != "dn" {
+		t.Errorf("LdapSearch.LdapAttributes wrong: %v", attributes)
+	}
+
+	// Pattern: [Scope] baseDnとscopeの範囲（DNの大文字小文字、空白は区別しない）
+	for _, tc := range []struct {
+		scope, dn string
+		expected  bool
+	}{
+		{scopeOne, "uid=ddd_user,ou=contractors,dc=example,dc=com", true},
+		{scopeOne, "UID=ddd_user, OU=Contractors, DC=example, DC=com", true},
+		{scopeOne, "uid=ddd_user,ou=team,ou=contractors,dc=example,dc=com", false},
+		{scopeOne, "ou=contractors,dc=example,dc=com", false},
+		{scopeSub, "uid=ddd_user,ou=team,ou=contractors,dc=example,dc=com", true},
+		{scopeSub, "uid=ddd_user,ou=people,dc=example,dc=com", false},
+		{scopeBase, "ou=contractors,dc=example,dc=com", true},
+		{scopeBase, "uid=ddd_user,ou=contractors,dc=example,dc=com", false},
+	} {
+		search := LdapSearch{BaseDn: contractors.BaseDn, Scope: tc.scope}
+		if inScope := search.InScope(tc.dn); inScope != tc.expected {
+			t.Errorf("LdapSearch.InScope [Scope]%s %s wrong: %v", tc.scope, tc.dn, inScope)
+		}
+	}
+
+	// Pattern: [Invalid]
+	for _, search := range []LdapSearch{
+		{Filter: "(uid=*)"},
+		{BaseDn: "dc=example,dc=com"},
+		{BaseDn: "dc=example,dc=com", Filter: "(uid=*)", Scope: "subtree"},
+		{BaseDn: "dc=example,dc=com", Filter: "(uid=*)", Attributes: map[string]string{"manager": "manager"}},
+	} {
+		if err := search.Validate(); err == nil {
+			t.Errorf("LdapSearch.Validate [Invalid]error not returned: %+v", search)
+		}
+	}
+}
+
+func TestMergeAccounts(t *testing.T) {
+	// Pattern: [Duplicate] 重複したDNは先の検索結果を使う（大文字小文字は区別しない）
+	employees := []Account{testAccounts[0], testAccounts[1]}
+	duplicate := testAccounts[1]
+	duplicate.Dn = "UID=bbb_user,DC=example,DC=com"
+	duplicate.Email = "other@example.com"
+	interns := []Account{duplicate, testAccounts[2]}
+
+	accounts, duplicates := MergeAccounts(employees, interns)
+	if len(accounts) != 3 || accounts[1].Email != testAccounts[1].Email || accounts[2].Dn != testAccounts[2].Dn {
+		t.Errorf("MergeAccounts [Duplicate]accounts wrong: %+v", accounts)
+	}
+	if len(duplicates) != 1 || duplicates[0] != duplicate.Dn {
+		t.Errorf("MergeAccounts [Duplicate]duplicates wrong: %v", duplicates)
+	}
+	if accounts, _ := MergeAccounts(); accounts == nil || len(accounts) != 0 {
+		t.Errorf("MergeAccounts [Empty]accounts wrong: %v", accounts)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// LDAP Content Synchronization Operation (RFC 4533)
+const (
+	controlSyncRequest = "1.3.6.1.4.1.4203.1.9.1.1"
+	controlSyncState   = "1.3.6.1.4.1.4203.1.9.1.2"
+	syncInfoOID        = "1.3.6.1.4.1.4203.1.9.1.4"
+
+	syncModeRefreshAndPersist = 3
+
+	// applicationIntermediateResponse ldap.v2に定義がないIntermediateResponse
+	applicationIntermediateResponse = 25
+
+	// resultSyncRefreshRequired cookieが古いため最初から同期し直す必要がある（e-syncRefreshRequired）
+	resultSyncRefreshRequired = 4096
+)
+
+// sync states（Sync State Controlのstate）
+const (
+	syncStateInfo    = -1 // Sync Info Message（エントリの変更ではない）
+	syncStatePresent = 0
+	syncStateAdd     = 1
+	syncStateModify  = 2
+	syncStateDelete  = 3
+)
+
+// syncInfoValue choices（Sync Info Message）
+const (
+	syncInfoNewCookie      = 0
+	syncInfoRefreshDelete  = 1
+	syncInfoRefreshPresent = 2
+	syncInfoSyncIDSet      = 3
+)
+
+// errSyncRefreshRequired cookieを破棄して最初から同期し直す必要がある
+var errSyncRefreshRequired = errors.New("syncrepl: refresh required, the cookie is too old")
+
+// SyncEvent syncreplで受け取った変更。
+// Entryはadd、modifyの場合だけ、Cookieはサーバーが位置を通知した場合だけ設定されます。
+type SyncEvent struct {
+	State  int
+	DN     string
+	UUID   string // entryUUID（エントリの変更だけ、modrdnの前後で同じ値）
+	Entry  *ldap.Entry
+	Cookie []byte
+	// RefreshDone 最初の同期（refresh）が終わり、以降は変更を随時受け取ります（persist）
+	RefreshDone bool
+	// UnknownDeletes entryUUIDだけで削除が通知されました（DNが分からないので全件取得で突き合わせます）
+	UnknownDeletes bool
+}
+
+// SyncreplConn syncrepl（refreshAndPersist）の検索を1つ実行する接続
+type SyncreplConn struct {
+	conn      net.Conn
+	messageID int64
+	timeout   time.Duration
+}
+
+// DialSyncrepl LDAPサーバーに接続してbindします
+func DialSyncrepl(rawURL, bindDn, bindPassword string, timeout time.Duration, tlsConfig *tls.Config) (*SyncreplConn, error) {
+	conn, _, err := dialLdapURL(rawURL, timeout, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := &SyncreplConn{conn: conn, timeout: timeout}
+	if bindDn != "" {
+		if err := s.bind(bindDn, bindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("bind: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// Close 接続を閉じます（Watchは接続が閉じられたエラーを返して終了します）
+func (s *SyncreplConn) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SyncreplConn) bind(bindDn, bindPassword string) error {
+	s.messageID++
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, bindDn, "User Name"))
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, bindPassword, "Password"))
+	if err := s.send(request, nil); err != nil {
+		return err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	defer s.conn.SetReadDeadline(time.Time{})
+	packet, err := ber.ReadPacket(s.conn)
+	if err != nil {
+		return err
+	}
+	if len(packet.Children) < 2 || packet.Children[1].Tag != ldap.ApplicationBindResponse {
+		return errors.New("unexpected bind response")
+	}
+	return ldapResult(packet.Children[1])
+}
+
+// Watch search（scope、filter、attributes）をrefreshAndPersistで検索し、受け取った変更をfnに渡します。
+// cookieを指定した場合はその位置から再開します。接続が閉じられるか、fnがエラーを返すまで戻りません。
+func (s *SyncreplConn) Watch(search LdapSearch, cookie []byte, fn func(event SyncEvent) error) error {
+	scope, err := search.LdapScope()
+	if err != nil {
+		return err
+	}
+	filter, err := ldap.CompileFilter(search.Filter)
+	if err != nil {
+		return err
+	}
+	s.messageID++
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, search.BaseDn, "Base DN"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(scope), "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(ldap.NeverDerefAliases), "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(filter)
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attribute := range search.LdapAttributes() {
+		attributes.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute, "Attribute"))
+	}
+	request.AppendChild(attributes)
+	if err := s.send(request, syncRequestControl(cookie)); err != nil {
+		return err
+	}
+
+	for {
+		packet, err := ber.ReadPacket(s.conn)
+		if err != nil {
+			return err
+		}
+		if len(packet.Children) < 2 {
+			return errors.New("syncrepl: invalid message")
+		}
+		event, ok, err := decodeSyncMessage(packet)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *SyncreplConn) send(request *ber.Packet, controls *ber.Packet) error {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, s.messageID, "MessageID"))
+	packet.AppendChild(request)
+	if controls != nil {
+		packet.AppendChild(controls)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	defer s.conn.SetWriteDeadline(time.Time{})
+	_, err := s.conn.Write(packet.Bytes())
+	return err
+}
+
+// syncRequestControl Sync Request Control（refreshAndPersist）
+func syncRequestControl(cookie []byte) *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sync Request Value")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, uint64(syncModeRefreshAndPersist), "Mode"))
+	if len(cookie) > 0 {
+		value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(cookie), "Cookie"))
+	}
+	controlValue := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value")
+	controlValue.AppendChild(value)
+
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlSyncRequest, "Control Type"))
+	control.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	control.AppendChild(controlValue)
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	controls.AppendChild(control)
+	return controls
+}
+
+// decodeSyncMessage 検索の応答をSyncEventにします（通知する変更がない応答はfalse）
+func decodeSyncMessage(packet *ber.Packet) (SyncEvent, bool, error) {
+	op := packet.Children[1]
+	var controls []*ber.Packet
+	if len(packet.Children) > 2 {
+		controls = packet.Children[2].Children
+	}
+
+	switch op.Tag {
+	case ldap.ApplicationSearchResultEntry:
+		if len(op.Children) < 2 {
+			return SyncEvent{}, false, errors.New("syncrepl: invalid entry")
+		}
+		dn, _ := op.Children[0].Value.(string)
+		value := findControlValue(controls, controlSyncState)
+		if value == nil || len(value.Children) < 2 {
+			return SyncEvent{}, false, fmt.Errorf("syncrepl: entry %s without sync state", dn)
+		}
+		state, _ := value.Children[0].Value.(int64)
+		event := SyncEvent{State: int(state), DN: dn, UUID: string(value.Children[1].ByteValue)}
+		if len(value.Children) > 2 {
+			event.Cookie = value.Children[2].ByteValue
+		}
+		if event.State == syncStateAdd || event.State == syncStateModify {
+			event.Entry = decodeEntry(dn, op.Children[1])
+		}
+		return event, true, nil
+
+	case applicationIntermediateResponse:
+		var name string
+		var value *ber.Packet
+		for _, child := range op.Children {
+			switch child.Tag {
+			case 0:
+				name = child.Data.String()
+			case 1:
+				value = ber.DecodePacket(child.Data.Bytes())
+			}
+		}
+		if name != syncInfoOID || value == nil {
+			return SyncEvent{}, false, nil
+		}
+		return decodeSyncInfo(value), true, nil
+
+	case ldap.ApplicationSearchResultDone:
+		if len(op.Children) > 0 {
+			if code, _ := op.Children[0].Value.(int64); code == resultSyncRefreshRequired {
+				return SyncEvent{}, false, errSyncRefreshRequired
+			}
+		}
+		if err := ldapResult(op); err != nil {
+			return SyncEvent{}, false, err
+		}
+		// refreshOnlyでないので、正常終了でも変更の通知が終わったことになる
+		return SyncEvent{}, false, errors.New("syncrepl: search finished by the server")
+	}
+	return SyncEvent{}, false, nil // SearchResultReferenceなど
+}
+
+// decodeSyncInfo Sync Info Message（cookieの更新、refreshの終了、entryUUIDだけの削除）
+func decodeSyncInfo(value *ber.Packet) SyncEvent {
+	event := SyncEvent{State: syncStateInfo}
+	switch value.Tag {
+	case syncInfoNewCookie:
+		event.Cookie = value.Data.Bytes()
+	case syncInfoRefreshDelete, syncInfoRefreshPresent, syncInfoSyncIDSet:
+		event.RefreshDone = value.Tag != syncInfoSyncIDSet // refreshDoneのDEFAULTはTRUE
+		for _, child := range value.Children {
+			switch {
+			case child.Tag == ber.TagOctetString && child.ClassType == ber.ClassUniversal:
+				event.Cookie = child.ByteValue
+			case child.Tag == ber.TagBoolean && value.Tag != syncInfoSyncIDSet:
+				event.RefreshDone = child.Value.(bool)
+			case child.Tag == ber.TagBoolean:
+				event.UnknownDeletes = child.Value.(bool) // refreshDeletes
+			}
+		}
+		// refreshPresentの後、present以外のエントリは削除されているが、DNは通知されない
+		if value.Tag == syncInfoRefreshPresent {
+			event.UnknownDeletes = true
+		}
+	}
+	return event
+}
+
+func decodeEntry(dn string, attributes *ber.Packet) *ldap.Entry {
+	values := map[string][]string{}
+	for _, attribute := range attributes.Children {
+		if len(attribute.Children) < 2 {
+			continue
+		}
+		name, _ := attribute.Children[0].Value.(string)
+		for _, value := range attribute.Children[1].Children {
+			if v, ok := value.Value.(string); ok {
+				values[name] = append(values[name], v)
+			}
+		}
+	}
+	return ldap.NewEntry(dn, values)
+}
+
+// findControlValue controlsからcontrolTypeの値（BERで読み込んだもの）を返します
+func findControlValue(controls []*ber.Packet, controlType string) *ber.Packet {
+	for _, control := range controls {
+		if len(control.Children) < 2 {
+			continue
+		}
+		if oid, _ := control.Children[0].Value.(string); oid != controlType {
+			continue
+		}
+		value := control.Children[len(control.Children)-1]
+		if value.Tag != ber.TagOctetString {
+			return nil
+		}
+		return ber.DecodePacket(value.ByteValue)
+	}
+	return nil
+}
+
+// ldapResult LDAPResultのresultCodeがsuccessでない場合はエラー
+func ldapResult(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return errors.New("invalid ldap result")
+	}
+	code, _ := op.Children[0].Value.(int64)
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+	message, _ := op.Children[2].Value.(string)
+	return ldap.NewError(uint8(code), errors.New(message))
+}
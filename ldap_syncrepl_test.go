@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	ber "gopkg.in/asn1-ber.v1"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// syncStateControl エントリに付けるSync State Control
+func syncStateControl(state int64, cookie string) *ber.Packet {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, state, ""))
+	value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "0123456789abcdef", ""))
+	if cookie != "" {
+		value.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, cookie, ""))
+	}
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlSyncState, ""))
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(value.Bytes()), ""))
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "")
+	controls.AppendChild(control)
+	return controls
+}
+
+// syncInfoMessage refreshDeleteの終了を通知するSync Info Message
+func syncInfoMessage(messageID int64, cookie string) *ber.Packet {
+	info := ber.Encode(ber.ClassContext, ber.TypeConstructed, syncInfoRefreshDelete, nil, "")
+	info.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, cookie, ""))
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	response := ber.Encode(ber.ClassApplication, ber.TypeConstructed, applicationIntermediateResponse, nil, "")
+	response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, syncInfoOID, ""))
+	response.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, string(info.Bytes()), ""))
+	packet.AppendChild(response)
+	return packet
+}
+
+func TestSyncreplConnWatch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	requestCookie := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := ber.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			messageID := packet.Children[0].Value.(int64)
+			switch packet.Children[1].Tag {
+			case ldap.ApplicationBindRequest:
+				conn.Write(ldapResponse(messageID, ldap.ApplicationBindResponse, ldap.LDAPResultSuccess).Bytes())
+			case ldap.ApplicationSearchRequest:
+				cookie := ""
+				if len(packet.Children) > 2 {
+					if value := findControlValue(packet.Children[2].Children, controlSyncRequest); value != nil && len(value.Children) > 1 {
+						cookie = value.Children[1].Value.(string)
+					}
+				}
+				requestCookie <- cookie
+				add := ldapEntry(messageID, "uid=aaa_user,dc=example,dc=com", map[string][]string{"uid": {"aaa_user"}, "email": {"aaa_user@example.com"}})
+				add.AppendChild(syncStateControl(syncStateAdd, ""))
+				conn.Write(add.Bytes())
+				conn.Write(syncInfoMessage(messageID, "cookie-1").Bytes())
+				del := ldapEntry(messageID, "uid=bbb_user,dc=example,dc=com", nil)
+				del.AppendChild(syncStateControl(syncStateDelete, "cookie-2"))
+				conn.Write(del.Bytes())
+				conn.Write(ldapResponse(messageID, ldap.ApplicationSearchResultDone, resultSyncRefreshRequired).Bytes())
+			}
+		}
+	}()
+
+	conn, err := DialSyncrepl("ldap://"+listener.Addr().String(), "cn=reader,dc=example,dc=com", "secret", 2*time.Second, nil)
+	if err != nil {
+		t.Fatalf("DialSyncrepl failed: %v", err)
+	}
+	defer conn.Close()
+	var events []SyncEvent
+	err = conn.Watch(LdapSearch{BaseDn: "dc=example,dc=com", Filter: "(uid=*)"}, []byte("cookie-0"), func(event SyncEvent) error {
+		events = append(events, event)
+		return nil
+	})
+
+	// Pattern: [Cookie] 保存したcookieから再開する
+	if cookie := <-requestCookie; cookie != "cookie-0" {
+		t.Errorf("SyncreplConn.Watch [Cookie]request cookie wrong: %q", cookie)
+	}
+	// Pattern: [RefreshRequired] cookieが古い場合はerrSyncRefreshRequired
+	if err != errSyncRefreshRequired {
+		t.Errorf("SyncreplConn.Watch [RefreshRequired]error wrong: %v", err)
+	}
+	// Pattern: [Events] add（属性付き）、refreshの終了（cookie）、delete（cookie）
+	if len(events) != 3 {
+		t.Fatalf("SyncreplConn.Watch [Events]count wrong: %+v", events)
+	}
+	if events[0].State != syncStateAdd || events[0].Entry == nil || events[0].Entry.GetAttributeValue("email") != "aaa_user@example.com" ||
+		events[0].UUID != "0123456789abcdef" {
+		t.Errorf("SyncreplConn.Watch [Events]add wrong: %+v", events[0])
+	}
+	if events[1].State != syncStateInfo || !events[1].RefreshDone || string(events[1].Cookie) != "cookie-1" {
+		t.Errorf("SyncreplConn.Watch [Events]sync info wrong: %+v", events[1])
+	}
+	if events[2].State != syncStateDelete || events[2].DN != "uid=bbb_user,dc=example,dc=com" || events[2].Entry != nil || string(events[2].Cookie) != "cookie-2" {
+		t.Errorf("SyncreplConn.Watch [Events]delete wrong: %+v", events[2])
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Lock 状態を更新する実行を同時に1つにするロックファイル（flock）。
+// プロセスが終了するとOSが解放するので、異常終了してもロックは残りません。
+type Lock struct {
+	Path string
+	file *os.File
+}
+
+// AcquireLock pathのロックを取得します（他の実行が取得している場合はfalse）
+func AcquireLock(path string) (*Lock, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("lock %s: %v", path, err)
+	}
+	// 調査用にロックを取得したプロセスを書き込む
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return &Lock{Path: path, file: file}, true, nil
+}
+
+// Release ロックを解放します
+func (l *Lock) Release() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// lockHolder ロックを取得しているプロセス（ログ用）
+func lockHolder(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "unknown"
+	}
+	if pid := strings.TrimSpace(string(data)); pid != "" {
+		return "pid " + pid
+	}
+	return "unknown"
+}
+
+// lockPath 状態の保存先毎のロックファイル
+func lockPath(cfg *Config) string {
+	return cfg.StatePath() + ".lock"
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json.lock")
+	lock, ok, err := AcquireLock(path)
+	if err != nil || !ok {
+		t.Fatalf("AcquireLock failed: %v, %v", ok, err)
+	}
+	if holder := lockHolder(path); holder != "pid "+strconv.Itoa(os.Getpid()) {
+		t.Errorf("lockHolder wrong: %s", holder)
+	}
+
+	// Pattern: [Locked] 取得中のロックは取得できない
+	if other, ok, err := AcquireLock(path); ok || err != nil {
+		other.Release()
+		t.Errorf("AcquireLock [Locked]wrong: %v, %v", ok, err)
+	}
+
+	// Pattern: [Release] 解放した後は取得できる
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	lock, ok, err = AcquireLock(path)
+	if err != nil || !ok {
+		t.Fatalf("AcquireLock [Release]wrong: %v, %v", ok, err)
+	}
+	lock.Release()
+}
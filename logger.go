@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// log formats（log.format）
+const (
+	logFormatText   = "text"   // 従来のlogパッケージの形式
+	logFormatLogfmt = "logfmt" // key=value
+	logFormatJSON   = "json"   // 1行1オブジェクト
+)
+
+// log keys 構造化ログの項目名（ログ基盤で1人のアカウントの履歴を実行をまたいで検索するため）
+const (
+	logKeyRunID         = "run_id" // 同期履歴の実行ID
+	logKeyCommand       = "command"
+	logKeyOperation     = "operation" // CREATE, UPDATE, DELETE（アカウント以外のログはlog operations）
+	logKeyDn            = "dn"
+	logKeyLogin         = "login"
+	logKeyOktaUserID    = "okta_user_id"
+	logKeyOktaRequestID = "okta_request_id" // X-Okta-Request-Id（複数の場合はカンマ区切り）
+)
+
+// log operations CREATE、UPDATE、DELETE以外のoperation（同じく大文字）
+const (
+	logOpDrift    = "DRIFT"
+	logOpAdopt    = "ADOPT"
+	logOpRollback = "ROLLBACK"
+	logOpDiff     = "DIFF"
+	logOpRun      = "RUN" // 実行の開始と終了、同期履歴、レポート、続行できないエラー
+	logOpLdap     = "LDAP"
+	logOpOkta     = "OKTA"
+	logOpState    = "STATE"
+	logOpWatch    = "WATCH"
+	logOpServe    = "SERVE"
+	logOpMetrics  = "METRICS"
+	logOpNotify   = "NOTIFY"
+)
+
+// logRun ログの全ての行に付ける実行
+var logRun struct {
+	sync.Mutex
+	id      string
+	command string
+}
+
+// beginLogRun 新しい実行IDを発行し、以降のログに付けます（同期履歴も同じ実行IDで記録します）
+func beginLogRun(command string) string {
+	id := NewRunID()
+	logRun.Lock()
+	defer logRun.Unlock()
+	logRun.id, logRun.command = id, command
+	return id
+}
+
+// currentLogRun 現在の実行IDとコマンド
+func currentLogRun() (string, string) {
+	logRun.Lock()
+	defer logRun.Unlock()
+	return logRun.id, logRun.command
+}
+
+// setupLogging ログの形式とレベルを設定します（-vの場合はdebug）。
+// 従来のlogパッケージの出力もlevel=INFOの行になり、どの形式でも全ての行に実行IDとコマンドを付けます。
+func setupLogging(cfg LogConfig, w io.Writer) error {
+	level, err := cfg.SlogLevel()
+	if err != nil {
+		return err
+	}
+	if verbose {
+		level = slog.LevelDebug
+	}
+	verbose = level <= slog.LevelDebug
+	options := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case logFormatLogfmt:
+		slog.SetDefault(slog.New(runLogHandler{slog.NewTextHandler(w, options)}))
+	case logFormatJSON:
+		slog.SetDefault(slog.New(runLogHandler{slog.NewJSONHandler(w, options)}))
+	default:
+		slog.SetDefault(slog.New(runLogHandler{newTextLogHandler(w, options, verbose)}))
+	}
+	return nil
+}
+
+// textLogHandler log.formatがtextの場合のslog.Handler。
+// 従来のlogパッケージと同じ「日時 LEVEL メッセージ」に続けて項目をkey=valueで出力します（-vの場合はファイル名と行番号も）。
+type textLogHandler struct {
+	w      io.Writer
+	source bool
+	attrs  slog.Handler // 項目だけをbufに出力するTextHandler
+	mu     *sync.Mutex
+	buf    *bytes.Buffer
+}
+
+func newTextLogHandler(w io.Writer, options *slog.HandlerOptions, source bool) *textLogHandler {
+	buf := &bytes.Buffer{}
+	attrs := slog.NewTextHandler(buf, &slog.HandlerOptions{Level: options.Level, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+			return slog.Attr{}
+		}
+		return a
+	}})
+	return &textLogHandler{w: w, source: source, attrs: attrs, mu: &sync.Mutex{}, buf: buf}
+}
+
+func (h *textLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.attrs.Enabled(ctx, level)
+}
+
+func (h *textLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	line := r.Time.Format("2006/01/02 15:04:05 ")
+	if h.source && r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		line += fmt.Sprintf("%s:%d: ", filepath.Base(frame.File), frame.Line)
+	}
+	line += r.Level.String() + " " + r.Message
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.attrs.Handle(ctx, r); err != nil {
+		return err
+	}
+	if attrs := strings.TrimSuffix(h.buf.String(), "\n"); attrs != "" {
+		line += " " + attrs
+	}
+	_, err := io.WriteString(h.w, line+"\n")
+	return err
+}
+
+func (h *textLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	copied := *h
+	copied.attrs = h.attrs.WithAttrs(attrs)
+	return &copied
+}
+
+func (h *textLogHandler) WithGroup(name string) slog.Handler {
+	copied := *h
+	copied.attrs = h.attrs.WithGroup(name)
+	return &copied
+}
+
+// runLogHandler 全ての行に実行IDとコマンドを付けるslog.Handler
+type runLogHandler struct {
+	slog.Handler
+}
+
+func (h runLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, command := currentLogRun(); id != "" {
+		r.AddAttrs(slog.String(logKeyRunID, id), slog.String(logKeyCommand, command))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h runLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return runLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h runLogHandler) WithGroup(name string) slog.Handler {
+	return runLogHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal エラーをlevel=ERRORで出力して終了します（log.Fatalと同じ）
+func fatal(v ...interface{}) {
+	logFatal(fmt.Sprint(v...))
+}
+
+// fatalf エラーを出力して終了します（log.Fatalfと同じ）
+func fatalf(format string, v ...interface{}) {
+	logFatal(fmt.Sprintf(format, v...))
+}
+
+// fatalHook 続行できないエラーで終了する前に呼びます（失敗の通知、RunNotifier.Fatal）
+var fatalHook func(message string)
+
+func logFatal(message string) {
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // fatal、fatalfの呼び出し元
+	record := slog.NewRecord(time.Now(), slog.LevelError, message, pcs[0])
+	record.Add(logAttrs(logOpRun)...)
+	slog.Default().Handler().Handle(context.Background(), record)
+	if hook := fatalHook; hook != nil {
+		fatalHook = nil // 通知の中のエラーで再び呼ばないように
+		hook(message)
+	}
+	os.Exit(exitError)
+}
+
+// accountLogAttrs アカウントのログの項目
+func accountLogAttrs(operation string, account Account) []any {
+	return []any{logKeyOperation, operation, logKeyDn, account.Dn, logKeyLogin, account.OktaProfile().Login}
+}
+
+// logAttrs operationを先頭に付けたログの項目
+func logAttrs(operation string, attrs ...any) []any {
+	return append([]any{logKeyOperation, operation}, attrs...)
+}
+
+// oktaRequests Okta APIのリクエストをアカウントの項目を付けてdebugで出力し、X-Okta-Request-Idを集めます
+type oktaRequests struct {
+	base  http.RoundTripper
+	attrs []any
+
+	mu  sync.Mutex
+	ids []string
+}
+
+// IDs 集めたX-Okta-Request-Id（カンマ区切り）
+func (o *oktaRequests) IDs() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.ids, ",")
+}
+
+// RoundTrip リクエストを送り、レスポンスのX-Okta-Request-Idを記録します（4xx、5xxはwarn）
+func (o *oktaRequests) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := o.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	attrs := append([]any{"method", req.Method, "endpoint", oktaEndpoint(req.URL.Path)}, o.attrs...)
+	if err != nil {
+		slog.Warn("okta request failed", append(attrs, "error", err)...)
+		return res, err
+	}
+	id := res.Header.Get("X-Okta-Request-Id")
+	if id != "" {
+		o.mu.Lock()
+		o.ids = append(o.ids, id)
+		o.mu.Unlock()
+	}
+	attrs = append(attrs, "status", res.StatusCode, logKeyOktaRequestID, id)
+	if res.StatusCode >= http.StatusBadRequest {
+		slog.Warn("okta request", attrs...)
+	} else {
+		slog.Debug("okta request", attrs...)
+	}
+	return res, err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog formatの構造化ログをbufに出力し、終了時に元のログに戻します
+func captureLog(t *testing.T, format string) *bytes.Buffer {
+	logger, writer, verboseWas := slog.Default(), log.Writer(), verbose
+	t.Cleanup(func() {
+		slog.SetDefault(logger)
+		log.SetOutput(writer)
+		verbose = verboseWas
+	})
+	var buf bytes.Buffer
+	verbose = false
+	if err := setupLogging(LogConfig{Format: format, Level: "debug"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// logLines JSONのログの行
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var v map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &v); err != nil {
+			t.Fatalf("not a json log line %q: %v", line, err)
+		}
+		lines = append(lines, v)
+	}
+	return lines
+}
+
+func TestSetupLogging(t *testing.T) {
+	// Pattern: [JSON] logパッケージの出力にも実行IDを付ける
+	buf := captureLog(t, logFormatJSON)
+	id := beginLogRun("sync")
+	log.Printf("state file %s not found", "tmp/state.json")
+	slog.Debug("ldap connected", logAttrs(logOpLdap, "ldap", "ldap://localhost")...)
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("log lines = %d, want 2: %s", len(lines), buf)
+	}
+	if lines[0]["level"] != "INFO" || lines[0][logKeyRunID] != id || lines[0][logKeyCommand] != "sync" {
+		t.Errorf("[JSON]log line wrong: %v", lines[0])
+	}
+	if lines[1]["level"] != "DEBUG" || lines[1][logKeyOperation] != logOpLdap || lines[1]["ldap"] != "ldap://localhost" {
+		t.Errorf("[JSON]debug line wrong: %v", lines[1])
+	}
+
+	// Pattern: [logfmt]
+	buf = captureLog(t, logFormatLogfmt)
+	slog.Info("account synced", logKeyDn, "uid=taro,dc=example,dc=com")
+	if got := buf.String(); !strings.Contains(got, `dn="uid=taro,dc=example,dc=com"`) || !strings.Contains(got, logKeyRunID+"="+id) {
+		t.Errorf("[logfmt]log line wrong: %s", got)
+	}
+
+	// Pattern: [Text] 標準の形式もlogパッケージと同じ日時とレベルに続けて実行IDを付ける
+	buf = captureLog(t, logFormatText)
+	slog.Info("account synced", logAttrs(CreateKey, logKeyDn, "uid=taro,dc=example,dc=com")...)
+	log.Printf("state file %s not found", "tmp/state.json")
+	text := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(text) != 2 {
+		t.Fatalf("[Text]log lines = %d, want 2: %s", len(text), buf)
+	}
+	for _, line := range text {
+		if _, err := time.ParseInLocation("2006/01/02 15:04:05", line[:19], time.Local); err != nil || !strings.Contains(line, logKeyRunID+"="+id) {
+			t.Errorf("[Text]log line wrong: %s", line)
+		}
+	}
+	if !strings.Contains(text[0], ` INFO account synced operation=CREATE dn="uid=taro,dc=example,dc=com" `) {
+		t.Errorf("[Text]account line wrong: %s", text[0])
+	}
+
+	// Pattern: [Level]
+	if err := setupLogging(LogConfig{Level: "trace"}, &bytes.Buffer{}); err == nil {
+		t.Errorf("[Level]unknown level is accepted")
+	}
+}
+
+func TestOktaRequestsLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Okta-Request-Id", "req-"+r.Method)
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+	buf := captureLog(t, logFormatJSON)
+	beginLogRun("sync")
+
+	account := testAccounts[0]
+	syncer, requests := Syncer{Okta: OktaClient{FQDN: "example.okta.com"}}.track(CreateKey, account)
+	client := syncer.Okta.httpClient()
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, _ := http.NewRequest(method, server.URL+"/api/v1/users/00u1", nil)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	logAccount(CreateKey, account, "", requests, errors.New("okta: 400"))
+
+	lines := logLines(t, buf)
+	if len(lines) != 3 {
+		t.Fatalf("log lines = %d, want 3: %s", len(lines), buf)
+	}
+	if lines[0]["level"] != "DEBUG" || lines[1]["level"] != "WARN" || lines[1][logKeyOktaRequestID] != "req-POST" {
+		t.Errorf("okta request lines wrong: %v", lines[:2])
+	}
+	result := lines[2]
+	if result["level"] != "ERROR" || result[logKeyOperation] != CreateKey || result[logKeyDn] != account.Dn ||
+		result[logKeyLogin] != account.OktaProfile().Login || result[logKeyOktaRequestID] != "req-GET,req-POST" {
+		t.Errorf("account line wrong: %v", result)
+	}
+}
+
+func TestDiffLog(t *testing.T) {
+	// Pattern: [Diff] 差分のアカウント毎の行にoperation、dn、loginを付ける
+	buf := captureLog(t, logFormatJSON)
+	beginLogRun("plan")
+	updated := testAccounts[0]
+	updated.Email = "aaa_new@example.com"
+	diff, _ := DefaultMapping().Diff(&[]Account{testAccounts[0], testAccounts[2]}, &[]Account{updated, testAccounts[1]})
+	logDiff(diff)
+
+	lines := logLines(t, buf)
+	if len(lines) != 5 {
+		t.Fatalf("log lines = %d, want 5: %s", len(lines), buf)
+	}
+	for _, line := range lines[:4] {
+		if line[logKeyOperation] == nil || line[logKeyDn] == nil || line[logKeyLogin] == nil {
+			t.Errorf("[Diff]account line wrong: %v", line)
+		}
+	}
+	if lines[0][logKeyOperation] != CreateKey || lines[0][logKeyDn] != testAccounts[1].Dn {
+		t.Errorf("[Diff]create line wrong: %v", lines[0])
+	}
+	if lines[2]["field"] != fieldEmail || lines[2]["new"] != "aaa_new@example.com" {
+		t.Errorf("[Diff]field line wrong: %v", lines[2])
+	}
+	if summary := lines[4]; summary[logKeyOperation] != logOpDiff || summary["create"] != 1.0 || summary["delete"] != 1.0 {
+		t.Errorf("[Diff]summary line wrong: %v", summary)
+	}
+}
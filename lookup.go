@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// lookupJournalLimit lookupで表示する反映結果の件数
+const lookupJournalLimit = 10
+
+// AccountLookup 1人のアカウントのLDAP、状態、Okta、反映結果（「なぜOktaにいないのか」の調査用）
+type AccountLookup struct {
+	Query   string         `json:"query"`
+	Ldap    []Account      `json:"ldap"`
+	State   []AccountState `json:"state"`
+	Okta    []OktaUser     `json:"okta"`
+	Journal []JournalEntry `json:"journal"` // 直近の反映結果（新しい順）
+	Notes   []string       `json:"notes"`   // 同期されていない理由など
+}
+
+// matchAccount DN、uid、email、employeeNumberのいずれかがqueryと一致するか（大文字小文字は区別しません）
+func matchAccount(account Account, query string) bool {
+	for _, value := range []string{account.Dn, account.UID, account.Email, account.EmployeeNumber} {
+		if value != "" && strings.EqualFold(value, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupSearch searchの中からqueryに一致するエントリを検索する条件（DNの場合はそのエントリだけ）
+func lookupSearch(search LdapSearch, query string) (LdapSearch, bool) {
+	if _, err := ldap.ParseDN(query); err == nil && strings.Contains(query, "=") {
+		if !strings.HasSuffix(strings.ToLower(query), strings.ToLower(search.BaseDn)) {
+			return search, false
+		}
+		search.BaseDn = query
+		search.Scope = scopeBase
+		return search, true
+	}
+	attrs := search.AttributeMap()
+	filter := search.Filter
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	value := ldap.EscapeFilter(query)
+	search.Filter = fmt.Sprintf("(&%s(|(%s=%s)(%s=%s)(%s=%s)))", filter,
+		attrs[fieldUID], value, attrs[fieldEmail], value, attrs[fieldEmployeeNumber], value)
+	return search, true
+}
+
+// lookupJournal DNの反映結果（新しい順にlimit件）
+func lookupJournal(entries []JournalEntry, dns map[string]bool, limit int) []JournalEntry {
+	var matched []JournalEntry
+	for i := len(entries) - 1; i >= 0 && len(matched) < limit; i-- {
+		if entries[i].Type == journalAccount && dns[dnKey(entries[i].Dn)] {
+			matched = append(matched, entries[i])
+		}
+	}
+	return matched
+}
+
+// Explain LDAP、状態、Okta、反映結果を突き合わせて同期されていない理由をNotesに書きます
+func (l *AccountLookup) Explain(mapping Mapping) {
+	note := func(format string, v ...interface{}) {
+		l.Notes = append(l.Notes, fmt.Sprintf(format, v...))
+	}
+	okta := map[string]OktaUser{}
+	for _, user := range l.Okta {
+		okta[user.ID] = user
+	}
+	state := map[string]AccountState{}
+	for _, data := range l.State {
+		state[dnKey(data.Dn)] = data
+	}
+	ldapDns := map[string]bool{}
+
+	if len(l.Ldap) == 0 {
+		note("not found in LDAP with the configured searches (check ldap.searches / baseDn and filter)")
+	}
+	for _, account := range l.Ldap {
+		ldapDns[dnKey(account.Dn)] = true
+		data, ok := state[dnKey(account.Dn)]
+		if !ok {
+			note("%s is in LDAP but not in the state: it is created in Okta by the next sync, unless the last sync failed for it (see journal)", account.Dn)
+			continue
+		}
+		if changes := mapping.Changes(data.Account, account); len(changes) > 0 {
+			note("%s has LDAP changes not applied yet (%d fields): they are applied by the next sync", account.Dn, len(changes))
+		}
+	}
+	for _, data := range l.State {
+		if !ldapDns[dnKey(data.Dn)] {
+			note("%s is in the state but not in LDAP: its Okta user is deleted by the next (full) sync", data.Dn)
+		}
+		if data.OktaUserID == "" {
+			continue
+		}
+		user, ok := okta[data.OktaUserID]
+		switch {
+		case !ok:
+			note("Okta user %s of %s does not exist (run drift)", data.OktaUserID, data.Dn)
+		case user.Status != "ACTIVE":
+			note("Okta user %s of %s is %s", data.OktaUserID, data.Dn, user.Status)
+		}
+	}
+	for _, entry := range l.Journal {
+		if entry.Error != "" {
+			note("last %s of %s failed at %s: %s", entry.Operation, entry.Dn, entry.Time.Format("2006-01-02 15:04:05Z07:00"), entry.Error)
+			break
+		}
+	}
+	if len(l.Notes) == 0 && len(l.Ldap) > 0 {
+		note("in sync")
+	}
+}
+
+// WriteLookup lookupの結果を書き出します（jsonの場合はAccountLookup、それ以外は項目毎の表）
+func WriteLookup(w io.Writer, lookup *AccountLookup, format string) error {
+	if format == formatJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(lookup)
+	}
+	sections := []struct {
+		title string
+		write func() error
+	}{
+		{"ldap", func() error { return WriteAccounts(w, lookup.Ldap, format) }},
+		{"state", func() error { return WriteState(w, lookup.State, format) }},
+		{"okta", func() error { return WriteUsers(w, lookup.Okta, format) }},
+	}
+	for _, section := range sections {
+		fmt.Fprintf(w, "# %s\n", section.title)
+		if err := section.write(); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "# journal")
+	for _, entry := range lookup.Journal {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", entry.Time.Format("2006-01-02 15:04:05Z07:00"), entry.RunID, entry.Operation, entry.Dn, entry.Error)
+	}
+	fmt.Fprintln(w, "\n# notes")
+	for _, note := range lookup.Notes {
+		fmt.Fprintf(w, "- %s\n", note)
+	}
+	return nil
+}
+
+// readJournalIfExists 同期履歴ファイルを読み込みます（ファイルがない場合は空）
+func readJournalIfExists(path string) ([]JournalEntry, error) {
+	entries, err := ReadJournal(path, "")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return entries, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupSearch(t *testing.T) {
+	search := LdapSearch{BaseDn: "ou=people,dc=example,dc=com", Filter: "objectClass=person", Attributes: map[string]string{fieldEmail: "mail"}}
+
+	// Pattern: [Query] uid、email（上書きした属性名）、employeeNumberのいずれかに一致
+	query, ok := lookupSearch(search, "a*a")
+	if !ok || query.Filter != `(&(objectClass=person)(|(uid=a\2aa)(mail=a\2aa)(employeeNumber=a\2aa)))` || query.BaseDn != search.BaseDn {
+		t.Errorf("lookupSearch [Query]wrong: %v, %+v", ok, query)
+	}
+	// Pattern: [DN] DNの場合はそのエントリだけ（検索の範囲外は検索しない）
+	query, ok = lookupSearch(search, "uid=aaa_user,ou=People,dc=example,dc=com")
+	if !ok || query.BaseDn != "uid=aaa_user,ou=People,dc=example,dc=com" || query.Scope != scopeBase || query.Filter != search.Filter {
+		t.Errorf("lookupSearch [DN]wrong: %v, %+v", ok, query)
+	}
+	if _, ok := lookupSearch(search, "uid=bbb_user,ou=partners,dc=example,dc=com"); ok {
+		t.Error("lookupSearch [DN]outside the search wrong")
+	}
+}
+
+func TestAccountLookupExplain(t *testing.T) {
+	notes := func(lookup *AccountLookup) string {
+		lookup.Explain(DefaultMapping())
+		return strings.Join(lookup.Notes, "\n")
+	}
+
+	// Pattern: [NotInLdap]
+	if note := notes(&AccountLookup{}); !strings.Contains(note, "not found in LDAP") {
+		t.Errorf("AccountLookup.Explain [NotInLdap]wrong: %s", note)
+	}
+	// Pattern: [NotSynced] LDAPにあって状態にない（直近の失敗を表示する）
+	entries := []JournalEntry{
+		{Type: journalAccount, Operation: "create", Dn: testAccounts[0].Dn, Error: "okta: http status 400", Time: time.Now()},
+		{Type: journalAccount, Operation: "create", Dn: testAccounts[1].Dn},
+		{Type: journalRunEnd},
+	}
+	lookup := &AccountLookup{Ldap: []Account{testAccounts[0]}, Journal: lookupJournal(entries, map[string]bool{strings.ToLower(testAccounts[0].Dn): true}, lookupJournalLimit)}
+	if note := notes(lookup); len(lookup.Journal) != 1 || !strings.Contains(note, "not in the state") || !strings.Contains(note, "http status 400") {
+		t.Errorf("AccountLookup.Explain [NotSynced]wrong: %s", note)
+	}
+	// Pattern: [Okta] 状態のOktaユーザーがない、ACTIVEでない
+	changed := testAccounts[0]
+	changed.Email = "changed@example.com"
+	lookup = &AccountLookup{
+		Ldap:  []Account{changed, testAccounts[1]},
+		State: []AccountState{{Account: testAccounts[0], OktaUserID: "00u_aaa"}, {Account: testAccounts[1], OktaUserID: "00u_bbb"}},
+		Okta:  []OktaUser{{ID: "00u_bbb", Status: "SUSPENDED"}},
+	}
+	if note := notes(lookup); !strings.Contains(note, "00u_aaa") || !strings.Contains(note, "does not exist") || !strings.Contains(note, "SUSPENDED") || !strings.Contains(note, "not applied yet") {
+		t.Errorf("AccountLookup.Explain [Okta]wrong: %s", note)
+	}
+	// Pattern: [InSync]
+	lookup = &AccountLookup{
+		Ldap:  []Account{testAccounts[1]},
+		State: []AccountState{{Account: testAccounts[1], OktaUserID: "00u_bbb"}},
+		Okta:  []OktaUser{{ID: "00u_bbb", Status: "ACTIVE"}},
+	}
+	if note := notes(lookup); note != "in sync" {
+		t.Errorf("AccountLookup.Explain [InSync]wrong: %s", note)
+	}
+}
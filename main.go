@@ -1,155 +1,1204 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"os/user"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/ldap.v2"
+	yaml "gopkg.in/yaml.v3"
 )
 
 const (
 	noSizeLimit = 0
-	noTimeLimit = 0
 	noTypeOnly  = false
 	fileNm      = "tmp/ldap_accounts.json"
+	dbFileNm    = "tmp/state.db"
+	journalNm   = "tmp/journal.jsonl"
 )
 
 func main() {
-	EnvLoad(".env")
-	// ldapsearch
-	ldapClient := LdapClient{
-		Host:       os.Getenv("LDAP_HOST"),
-		BaseDn:     os.Getenv("BASE_DN"),
-		Filter:     os.Getenv("FILTER_STRING"),
-		Attributes: []string{"dn", "uid", "email", "employeeNumber", "description"},
-		SizeLimit:  noSizeLimit,
-		TimeLimit:  noTimeLimit,
-		TypeOnly:   noTypeOnly,
+	os.Exit(runCommand(os.Args[1:], os.Stderr))
+}
+
+// runSync LDAPの差分をOktaに反映します（-dry-runの場合は差分の出力だけ）
+func runSync(opts *options, args []string) int {
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, opts.init, opts.force)
+	serverData, since, mark := searchLdapChanges(opts, store, localData)
+	diff := diffLdap(opts.cfg, localData, serverData)
+	logDiff(diff)
+	if opts.dryRun {
+		return exitOK
+	}
+	inputs := &JournalInputs{LdapCount: len(*serverData)}
+	if since != nil {
+		inputs.Watermark = since.Value
+	}
+	opts.stop = stopSignal()
+	return applyDiff(opts, "sync", store, localData, diff, mark, inputs)
+}
+
+// runPlan LDAPの差分を出力し、-outの場合はapplyで反映するplanファイルに保存します
+func runPlan(opts *options, args []string) int {
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, opts.init, opts.force)
+	serverData, _, mark := searchLdapChanges(opts, store, localData)
+	diff := diffLdap(opts.cfg, localData, serverData)
+	logDiff(diff)
+	if opts.planFnm == "" {
+		return exitOK
 	}
-	result, err := ldapClient.Search()
+	plan, err := NewPlan(localData, diff)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
 	}
-	// get ldap datas
-	var account = Account{}
-	serverData := account.ConvertFromLdap(result.Entries)
-	if len(*serverData) == 0 {
-		log.Fatal("LDAP Server Account is 0...") // LDAPサーバーのアカウント0件は異常終了にする
+	plan.Watermark = mark
+	plan.LdapCount = len(*serverData)
+	if err := plan.Save(opts.planFnm, stateKey(opts.cfg)); err != nil {
+		fatal(err)
 	}
-	localData, err := account.LoadJSON(fileNm)
+	slog.Info("plan saved, run: perman-okta apply -plan <file>", logAttrs(logOpDiff, "file", opts.planFnm)...)
+	return exitOK
+}
+
+// runApply planファイルの差分をOktaに反映します（-planを省略した場合はsyncと同じ）
+func runApply(opts *options, args []string) int {
+	if opts.planFnm == "" {
+		return runSync(opts, args)
+	}
+	plan, err := LoadPlan(opts.planFnm, stateKey(opts.cfg))
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, opts.init, opts.force)
+	if err := plan.Check(localData); err != nil {
+		fatalf("plan %s: %v", opts.planFnm, err)
 	}
+	logDiff(plan.Diff)
+	if opts.dryRun {
+		return exitOK
+	}
+	opts.stop = stopSignal()
+	return applyDiff(opts, "apply -plan "+opts.planFnm, store, localData, plan.Diff, plan.Watermark, &JournalInputs{LdapCount: plan.LdapCount})
+}
 
-	// diff
-	diff, err1 := account.Diff(localData, serverData)
-	if err1 != nil {
-		log.Fatal(err)
+// runDiff LDAPと状態の差分を1項目1行で出力します
+func runDiff(opts *options, args []string) int {
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, opts.init, opts.force)
+	serverData, _, _ := searchLdapChanges(opts, store, localData)
+	diff := diffLdap(opts.cfg, localData, serverData)
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteDiff(w, diff, opts.format)
+	})
+	return exitOK
+}
+
+// diffLdap 状態とLDAPのアカウントの差分（設定の比較ルール）
+func diffLdap(cfg *Config, localData State, serverData *[]Account) DiffResult {
+	mapping, err := cfg.MappingRules()
+	if err != nil {
+		fatal(err)
 	}
+	diff, err := mapping.Diff(localData.Accounts(), serverData)
+	if err != nil {
+		fatal(err)
+	}
+	diff = ReconcileDiff(diff, localData, serverData)
+	slog.Debug("accounts", logAttrs(logOpDiff, "ldap_accounts", len(*serverData), "state_accounts", len(localData))...)
+	return diff
+}
 
+// logDiff 反映する差分をログに出力します
+func logDiff(diff DiffResult) {
 	for _, data := range diff[CreateKey] {
-		log.Printf("[%s]%s", CreateKey, data.Dn)
+		slog.Info("account to create", accountLogAttrs(CreateKey, data.Account)...)
 	}
 	for _, data := range diff[UpdateKey] {
-		log.Printf("[%s]%s", UpdateKey, data.Dn)
+		slog.Info("account to update", accountLogAttrs(UpdateKey, data.Account)...)
+		for _, change := range data.Changes {
+			slog.Info("field to update", append(accountLogAttrs(UpdateKey, data.Account), "field", change.Field, "old", change.Old, "new", change.New)...)
+		}
 	}
 	for _, data := range diff[DeleteKey] {
-		log.Printf("[%s]%s", DeleteKey, data.Dn)
+		slog.Info("account to delete", accountLogAttrs(DeleteKey, data.Account)...)
 	}
+	slog.Info("diff", logAttrs(logOpDiff, "create", len(diff[CreateKey]), "update", len(diff[UpdateKey]), "delete", len(diff[DeleteKey]))...)
+}
 
-	// output JSON file
-	if err := account.OutJSON(fileNm, serverData); err != nil {
-		log.Fatal(err)
+// stopSignal SIGINT、SIGTERMを受け取ると閉じるチャネル。
+// sync、applyは実行中のアカウントの反映が終わってから中断します（serveの子プロセスをsystemdが停止した場合など）。
+func stopSignal() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		slog.Warn("signal received, stopping after the current account", logAttrs(logOpRun, "signal", sig.String())...)
+		close(stop)
+	}()
+	return stop
+}
+
+// applyDiff 差分をOktaに反映します。一部のアカウントが失敗した場合はexitPartialを返します
+// 件数がsafetyの上限を超えている場合は何も反映せずに終了します。
+// markは全てのアカウントを反映できた場合だけ保存します（失敗したアカウントは次回も取得するため）。
+func applyDiff(opts *options, command string, store StateStore, localData State, diff DiffResult, mark *Watermark, inputs *JournalInputs) int {
+	if err := opts.cfg.Safety.Check(diff); err != nil {
+		opts.notifier.Send(AbortedNotification(command, diff, err))
+		fatal(err)
 	}
 
 	// Okta API
-	var oktaClient = OktaClient{
-		FQDN:   os.Getenv("OKTA_FQDN"),
-		APIKEY: os.Getenv("OKTA_APIKEY"),
-	}
-
-	var jsonByte []byte
-	var oktaErr error
-	var oktaUser *OktaUser
-	var oktaGroup *OktaGroup
-
-	// Create User
-	oktaUser, oktaErr = oktaClient.CreateUser(
-		&UserProfile{
-			LastName:    "OgasawaraTest006",
-			SecondEmail: "",
-			MobilePhone: "",
-			Email:       "ogasawara_kiyoshi+006@cyberagent.co.jp",
-			Login:       "ogasawara_kiyoshi+006@cyberagent.co.jp",
-			FirstName:   "OgasawaraTest006",
+	inputs.LdapHost = strings.Join(opts.cfg.LDAP.URLList(), ", ")
+	var baseDns, filters []string
+	for _, search := range opts.cfg.LDAP.SearchList() {
+		baseDns = append(baseDns, search.BaseDn)
+		filters = append(filters, search.Filter)
+	}
+	inputs.BaseDn = strings.Join(baseDns, "; ")
+	inputs.LdapFilter = strings.Join(filters, "; ")
+	inputs.StateCount = len(localData)
+	inputs.Creates = len(diff[CreateKey])
+	inputs.Updates = len(diff[UpdateKey])
+	inputs.Deletes = len(diff[DeleteKey])
+	journal := startJournal(opts, command, inputs)
+	defer journal.Close()
+
+	// 状態はアカウント毎にOktaへの反映が成功した後で更新する
+	if err := store.Backup(); err != nil {
+		fatal(err)
+	}
+	if opts.init {
+		if err := store.Transaction(func(tx StateTx) error {
+			return ReplaceState(tx, State{})
+		}); err != nil {
+			fatal(err)
+		}
+	}
+	syncer := Syncer{
+		Okta:    newOktaClient(opts.cfg, journal),
+		Groups:  opts.cfg.Okta.Groups,
+		Store:   store,
+		Journal: journal,
+		Stop:    opts.stop,
+	}
+	_, failures, err := syncer.Apply(localData, diff)
+	endJournal(opts, journal, len(failures), err)
+	metrics.RecordRun(command, opts.started, inputs, diff, failures, err)
+	writeMetrics(opts.cfg)
+	if err != nil {
+		fatal(err)
+	}
+	if len(failures) > 0 {
+		slog.Warn("accounts failed, they will be retried on the next run", logAttrs(logOpRun, "failures", len(failures))...)
+		return exitPartial
+	}
+	if mark != nil {
+		if err := store.Transaction(func(tx StateTx) error {
+			return SaveWatermark(tx, mark)
+		}); err != nil {
+			fatal(err)
+		}
+		slog.Debug("ldap watermark", logAttrs(logOpLdap, "attribute", mark.Attribute, "value", mark.Value)...)
+	}
+	return exitOK
+}
+
+// runWatch syncreplでLDAPの変更を受け取り、batchDelay毎にまとめてOktaに反映します（SIGINT、SIGTERMで終了します）。
+// 起動時とfullInterval毎に全件取得して突き合わせます。続行できないエラーの場合は終了するので、systemdなどで再起動してください。
+func runWatch(opts *options, args []string) int {
+	cfg := opts.cfg
+	searches := cfg.LDAP.SearchList()
+	mapping, err := cfg.MappingRules()
+	if err != nil {
+		fatal(err)
+	}
+	bindPassword, err := cfg.LDAP.BindPassword.Value()
+	if err != nil {
+		fatal(err)
+	}
+	store := openStateStore(cfg)
+	cookies, err := LoadSyncreplCookies(store, searches)
+	store.Close()
+	if err != nil {
+		fatal(err)
+	}
+
+	watcher := &Watcher{
+		Searches:     searches,
+		Cookies:      cookies,
+		BatchDelay:   cfg.LDAP.Watch.BatchDelay,
+		FullInterval: cfg.LDAP.Watch.FullInterval,
+		Connect: func() (*SyncreplConn, error) {
+			var lastErr error
+			for _, rawURL := range cfg.LDAP.URLList() {
+				conn, err := DialSyncrepl(rawURL, cfg.LDAP.BindDn, bindPassword, cfg.LDAP.Timeout, nil)
+				if err == nil {
+					slog.Debug("ldap connected", logAttrs(logOpLdap, "ldap", rawURL)...)
+					return conn, nil
+				}
+				slog.Warn("ldap connect failed", logAttrs(logOpLdap, "ldap", rawURL, "error", err)...)
+				lastErr = err
+			}
+			return nil, fmt.Errorf("ldap: all servers failed, last error: %v", lastErr)
+		},
+		Reconcile: func() bool {
+			opts.started = time.Now()
+			beginLogRun("watch")
+			lock := acquireWatchLock(cfg)
+			if lock == nil {
+				return false
+			}
+			defer lock.Release()
+			store := openStateStore(cfg)
+			defer store.Close()
+			localData := loadState(store, false, false)
+			serverData := searchLdap(cfg)
+			diff := diffLdap(cfg, localData, serverData)
+			logDiff(diff)
+			return applyDiff(opts, "watch", store, localData, diff, nil, &JournalInputs{LdapCount: len(*serverData)}) == exitOK
 		},
-	)
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
-	}
-	jsonByte, _ = json.MarshalIndent(oktaUser, "", "  ")
-	log.Printf("create user:\n%s", jsonByte)
-
-	// Get User
-	oktaUser, oktaErr = oktaClient.GetUserWithLogin("ogasawara_kiyoshi+006@cyberagent.co.jp")
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
-	}
-	jsonByte, _ = json.MarshalIndent(oktaUser, "", "  ")
-	log.Printf("find user:\n%s", jsonByte)
-
-	// Create Group
-	oktaGroup, oktaErr = oktaClient.AddGroup(
-		&GroupProfile{
-			Name:        "oga-test-group-006",
-			Description: "oga-test-group-006",
+		Apply: func(events []watchEvent, cookies map[int][]byte) (bool, bool) {
+			opts.started = time.Now()
+			beginLogRun("watch")
+			lock := acquireWatchLock(cfg)
+			if lock == nil {
+				return false, false
+			}
+			defer lock.Release()
+			store := openStateStore(cfg)
+			defer store.Close()
+			localData := loadState(store, false, false)
+			pool := newLdapPool(cfg)
+			defer pool.Close()
+			diff, reconcile, err := EventsDiff(mapping, localData, searches, events, func(dn string, search LdapSearch) (*ldap.Entry, error) {
+				return lookupLdapEntry(pool, dn, search)
+			})
+			if err != nil {
+				fatal(err)
+			}
+			if len(diff[CreateKey])+len(diff[UpdateKey])+len(diff[DeleteKey]) > 0 {
+				logDiff(diff)
+				if applyDiff(opts, "watch", store, localData, diff, nil, &JournalInputs{LdapCount: len(events)}) != exitOK {
+					return false, reconcile // cookieは保存せず、全件取得で反映し直す
+				}
+			}
+			if err := store.Transaction(func(tx StateTx) error {
+				return SaveSyncreplCookies(tx, searches, cookies)
+			}); err != nil {
+				fatal(err)
+			}
+			return true, reconcile
+		},
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Metrics.Listen != "" {
+		server, err := startMetricsServer(cfg.Metrics.Listen, metrics.Registry)
+		if err != nil {
+			fatal(err)
+		}
+		defer server.Close()
+		slog.Info("watch: metrics", logAttrs(logOpMetrics, "listen", cfg.Metrics.Listen)...)
+	}
+	slog.Info("watch: started", logAttrs(logOpWatch, "searches", len(searches), "ldap", strings.Join(cfg.LDAP.URLList(), ", "))...)
+	if err := watcher.Run(ctx); err != nil {
+		fatal(err)
+	}
+	return exitOK
+}
+
+// acquireWatchLock watchの反映毎にロックを取得します（他の実行が取得している場合はnil）
+func acquireWatchLock(cfg *Config) *Lock {
+	lock, ok, err := AcquireLock(lockPath(cfg))
+	if err != nil {
+		fatal(err)
+	}
+	if !ok {
+		slog.Warn("watch: another run holds the lock", logAttrs(logOpWatch, "lock", lockPath(cfg), "holder", lockHolder(lockPath(cfg)), "retry", watchRetryDelay)...)
+		return nil
+	}
+	return lock
+}
+
+// runServe serve.scheduleの時刻にplanとapplyを子プロセスで実行します（SIGINT、SIGTERMの場合は実行中の反映が終わってから終了します）。
+// 他の実行がロックを取得している場合（手動のsyncなど）はその回を飛ばします。serve.admin.listenを設定した場合は管理APIを起動します。
+func runServe(opts *options, args []string) int {
+	cfg := opts.cfg
+	schedule, err := cron.ParseStandard(cfg.Serve.Schedule)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Metrics.Listen != "" && cfg.Metrics.File == "" {
+		// 反映の結果は子プロセスが書き出すので、metrics.fileを省略した場合も子プロセスに書き出させます
+		cfg.Metrics.File = serveMetricsPath(cfg)
+		if err := os.Setenv("METRICS_FILE", cfg.Metrics.File); err != nil {
+			fatal(err)
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	daemon := &Daemon{
+		Run: func(name string, args ...string) int {
+			return runChild(opts, name, args...)
+		},
+		PlanPath:    servePlanPath(cfg),
+		PausePath:   pausePath(cfg),
+		JournalPath: cfg.Journal.Path,
+		Key:         stateKey(cfg),
+		Runs:        newServeRuns(),
+	}
+	if pause, err := daemon.Paused(); err != nil {
+		fatal(err)
+	} else if pause != nil {
+		slog.Warn("serve: paused, only plan runs until resumed", logAttrs(logOpServe, "by", pause.By, "at", pause.At.Format(time.RFC3339), "reason", pause.Reason)...)
+	}
+
+	var server *http.Server
+	if cfg.Serve.Admin.Listen != "" {
+		token, err := cfg.Serve.Admin.Token.Value()
+		if err != nil {
+			fatal(err)
+		}
+		lookupToken, err := cfg.Serve.Admin.LookupToken.Value()
+		if err != nil {
+			fatal(err)
+		}
+		admin := &AdminServer{Daemon: daemon, Token: token, LookupToken: lookupToken, Lookup: func(ctx context.Context, query string) ([]byte, int) {
+			// "-"で始まるqueryをフラグとして解釈させないように"--"の後に渡します
+			return childOutput(ctx, opts, "lookup", "-format", formatJSON, "--", query)
+		}}
+		listener, err := net.Listen("tcp", cfg.Serve.Admin.Listen)
+		if err != nil {
+			fatal(err)
+		}
+		server = &http.Server{Handler: admin.Handler(), ReadHeaderTimeout: 10 * time.Second}
+		tls := cfg.Serve.Admin.TLSCert != ""
+		if tls {
+			go server.ServeTLS(listener, cfg.Serve.Admin.TLSCert, cfg.Serve.Admin.TLSKey)
+		} else {
+			go server.Serve(listener)
+		}
+		slog.Info("serve: admin api", logAttrs(logOpServe, "listen", listener.Addr().String(), "tls", tls)...)
+	}
+
+	if cfg.Metrics.Listen != "" {
+		// 反映の結果は子プロセスがmetrics.fileに書き出したもの
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(daemon.Runs)
+		metricsServer, err := startMetricsServer(cfg.Metrics.Listen, prometheus.Gatherers{registry, metricsFileGatherer(cfg.Metrics.File)})
+		if err != nil {
+			fatal(err)
+		}
+		defer metricsServer.Close()
+		slog.Info("serve: metrics", logAttrs(logOpMetrics, "listen", cfg.Metrics.Listen)...)
+	}
+
+	scheduler := &Scheduler{
+		Schedule: schedule,
+		Jitter:   cfg.Serve.Jitter,
+		Run: func() {
+			if !daemon.RunSync("schedule") {
+				slog.Warn("serve: scheduled run skipped, a run is in progress", logAttrs(logOpServe)...)
+			}
+			if ctx.Err() != nil {
+				slog.Info("serve: stopping after the running sync", logAttrs(logOpServe)...)
+			}
 		},
-	)
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
 	}
-	jsonByte, _ = json.MarshalIndent(oktaGroup, "", "  ")
-	log.Printf("create group:\n%s", jsonByte)
+	slog.Info("serve: started", logAttrs(logOpServe, "schedule", cfg.Serve.Schedule, "jitter", cfg.Serve.Jitter)...)
+	scheduler.Start(ctx)
+	if server != nil {
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		server.Shutdown(shutdown)
+		cancel()
+	}
+	daemon.Wait() // 管理APIから開始した実行
+	slog.Info("serve: stopped", logAttrs(logOpServe)...)
+	return exitOK
+}
 
-	// Search Group
-	oktaGroup, oktaErr = oktaClient.SearchGroups("oga-test-group-006")
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
+// runLookup 1人のアカウント（DN、uid、email、employeeNumberで指定）のLDAP、状態、Okta、反映結果と、同期されていない理由を出力します
+func runLookup(opts *options, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: perman-okta lookup <dn | uid | email | employeeNumber>")
+		return exitUsage
+	}
+	query := args[0]
+	mapping, err := opts.cfg.MappingRules()
+	if err != nil {
+		fatal(err)
+	}
+	lookup := &AccountLookup{Query: query, Ldap: lookupLdap(opts.cfg, query)}
+	dns := map[string]bool{}
+	for _, account := range lookup.Ldap {
+		dns[dnKey(account.Dn)] = true
 	}
-	jsonByte, _ = json.MarshalIndent(oktaGroup, "", "  ")
-	log.Printf("find group:\n%s", jsonByte)
 
-	// Add member to Group
-	oktaErr = oktaClient.AddUserToGroup(oktaGroup.ID, oktaUser.ID)
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
+	store := openStateStore(opts.cfg)
+	state := loadState(store, false, false)
+	store.Close()
+	for _, data := range state {
+		if matchAccount(data.Account, query) || dns[dnKey(data.Dn)] {
+			lookup.State = append(lookup.State, data)
+			dns[dnKey(data.Dn)] = true
+		}
 	}
 
-	// Remove member from Group
-	oktaErr = oktaClient.RemoveUserFromGroup(oktaGroup.ID, oktaUser.ID)
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
+	// OktaのユーザーIDまたはloginで取得する
+	okta := newOktaClient(opts.cfg, nil)
+	var keys []string
+	for _, data := range lookup.State {
+		keys = append(keys, data.OktaUserID)
+	}
+	for _, account := range lookup.Ldap {
+		keys = append(keys, account.OktaProfile().Login)
+	}
+	if strings.Contains(query, "@") {
+		keys = append(keys, query)
+	}
+	found := map[string]bool{}
+	for _, key := range keys {
+		if key == "" || found[key] {
+			continue
+		}
+		found[key] = true
+		user, err := okta.GetUserWithLogin(key)
+		if err != nil {
+			fatal(err)
+		}
+		if user.ID != "" && !found[user.ID] {
+			found[user.ID] = true
+			lookup.Okta = append(lookup.Okta, *user)
+		}
 	}
 
-	// Delete Group
-	// oktaErr = oktaClient.RemoveGroup(oktaGroup.ID)
+	entries, err := readJournalIfExists(opts.cfg.Journal.Path)
+	if err != nil {
+		fatal(err)
+	}
+	lookup.Journal = lookupJournal(UnsealJournal(entries, stateKey(opts.cfg)), dns, lookupJournalLimit)
+	lookup.Explain(mapping)
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteLookup(w, lookup, opts.format)
+	})
+	return exitOK
+}
 
-	// Delete User
-	// oktaErr = oktaClient.DeleteUser(oktaUser.ID)
-	if oktaErr != nil {
-		log.Fatal(oktaErr)
+// runReport 同期履歴の実行（-runを省略した場合は最後の実行）のレポートを出力します
+func runReport(opts *options, args []string) int {
+	entries, err := readJournalIfExists(opts.cfg.Journal.Path)
+	if err != nil {
+		fatal(err)
 	}
+	entries = UnsealJournal(entries, stateKey(opts.cfg))
+	runID := opts.runID
+	if runID == "" {
+		for _, entry := range entries {
+			if entry.Type == journalRunStart {
+				runID = entry.RunID
+			}
+		}
+	}
+	var run []JournalEntry
+	for _, entry := range entries {
+		if entry.RunID == runID {
+			run = append(run, entry)
+		}
+	}
+	report, err := NewRunReport(run)
+	if err != nil {
+		fatalf("report %s: %v", runID, err)
+	}
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteReport(w, report, opts.format)
+	})
+	return exitOK
+}
 
+// runExport LDAPのアカウントを出力します
+func runExport(opts *options, args []string) int {
+	serverData := searchLdap(opts.cfg)
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteAccounts(w, *serverData, opts.format)
+	})
+	return exitOK
 }
 
-// EnvLoad .env load
-func EnvLoad(envFile string) {
-	if envFile == "" {
-		envFile = ".env" // default
+// runUsers Oktaのユーザーを出力します
+func runUsers(opts *options, args []string) int {
+	users, err := newOktaClient(opts.cfg, nil).ListUsers()
+	if err != nil {
+		fatal(err)
 	}
-	err := godotenv.Load(envFile)
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteUsers(w, users, opts.format)
+	})
+	return exitOK
+}
+
+// runGroups Oktaのグループを出力します
+func runGroups(opts *options, args []string) int {
+	groups, err := newOktaClient(opts.cfg, nil).ListGroups()
 	if err != nil {
-		log.Fatalf("Error loading %s file", envFile)
+		fatal(err)
+	}
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteGroups(w, groups, opts.format)
+	})
+	return exitOK
+}
+
+// runState 同期状態を出力（list, get）、削除（rm）します
+func runState(opts *options, args []string) int {
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		state, err := store.List()
+		if err != nil {
+			fatal(err)
+		}
+		writeOutput(opts, func(w io.Writer) error {
+			return WriteState(w, state, opts.format)
+		})
+	case args[0] == "get" && len(args) == 2:
+		data, ok, err := store.Get(args[1])
+		if err != nil {
+			fatal(err)
+		}
+		if !ok {
+			fatalf("state: %s not found", args[1])
+		}
+		writeOutput(opts, func(w io.Writer) error {
+			return WriteState(w, State{data}, opts.format)
+		})
+	case args[0] == "rm" && len(args) == 2:
+		// 次回のsyncでは作成として扱われます
+		if _, ok, _ := store.Get(args[1]); !ok {
+			fatalf("state: %s not found", args[1])
+		}
+		if err := store.Backup(); err != nil {
+			fatal(err)
+		}
+		if err := store.Delete(args[1]); err != nil {
+			fatal(err)
+		}
+		slog.Info("state: removed", logAttrs(logOpState, logKeyDn, args[1])...)
+	case args[0] == "migrate" && (len(args) == 2 || len(args) == 3):
+		// 状態をbackend（json、bolt）に複製します。切り替えはSTATE_BACKEND、STATE_PATHで行います
+		target := *opts.cfg
+		target.State.Backend, target.State.Path = args[1], ""
+		if len(args) == 3 {
+			target.State.Path = args[2]
+		}
+		if target.StatePath() == opts.cfg.StatePath() {
+			fatalf("state: migrate to the current path %s, give another path", target.StatePath())
+		}
+		to := openStateStore(&target)
+		metaKeys := []string{metaWatermark}
+		for _, search := range opts.cfg.LDAP.SearchList() {
+			metaKeys = append(metaKeys, syncreplCookieKey(search))
+		}
+		if err := CopyState(store, to, metaKeys); err != nil {
+			fatalf("state: migrate to %s failed: %v", target.StatePath(), err)
+		}
+		if err := to.Close(); err != nil {
+			fatal(err)
+		}
+		slog.Info("state: copied, set STATE_BACKEND and STATE_PATH to the new state", logAttrs(logOpState, "backend", args[1], "path", target.StatePath())...)
+	default:
+		fmt.Fprintln(os.Stderr, "usage: perman-okta state list | get <dn> | rm <dn> | migrate <json | bolt> [<path>]")
+		return exitUsage
+	}
+	return exitOK
+}
+
+// runDrift 最後に同期した状態とOktaの実データの差分を出力します
+func runDrift(opts *options, args []string) int {
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, false, false)
+	checker := DriftChecker{Okta: newOktaClient(opts.cfg, nil)}
+	drifts, err := checker.Check(localData)
+	if err != nil {
+		fatal(err)
+	}
+	for _, drift := range drifts {
+		if drift.NotFound {
+			slog.Warn("okta user not found", drift.logAttrs()...)
+		}
+		if drift.Status != "" {
+			slog.Warn("okta user status", append(drift.logAttrs(), "status", drift.Status)...)
+		}
+		for _, change := range drift.Changes {
+			slog.Warn("field changed in okta", append(drift.logAttrs(), "field", change.Field, "ldap", change.Old, "okta", change.New)...)
+		}
+		for _, gid := range drift.MissingGroupIDs {
+			slog.Warn("removed from group", append(drift.logAttrs(), "group_id", gid)...)
+		}
+		if drift.Reconcile {
+			slog.Info("adopted, the profile and okta.groups are applied by the next sync", drift.logAttrs()...)
+		}
+	}
+	slog.Info("drift", logAttrs(logOpDrift, "drifts", len(drifts), "accounts", len(localData))...)
+	if opts.fix {
+		journal := startJournal(opts, "drift -fix", nil)
+		defer journal.Close()
+		checker.Okta = newOktaClient(opts.cfg, journal)
+		err := checker.Fix(drifts)
+		endJournal(opts, journal, 0, err)
+		if err != nil {
+			fatal(err)
+		}
+	}
+	return exitOK
+}
+
+// runAdopt 作成済みのOktaユーザーをLDAPアカウントに紐付けて状態に記録します
+func runAdopt(opts *options, args []string) int {
+	serverData := searchLdap(opts.cfg)
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, opts.init, opts.force)
+	users, err := newOktaClient(opts.cfg, nil).ListUsers()
+	if err != nil {
+		fatal(err)
+	}
+	newState, result, err := Adopt(localData, *serverData, users, splitList(opts.match))
+	if err != nil {
+		fatal(err)
+	}
+	for _, data := range result.Linked {
+		slog.Info("adopted", append(accountLogAttrs(logOpAdopt, data.Account), logKeyOktaUserID, data.OktaUserID, "matched_by", result.MatchedBy[data.Dn])...)
+	}
+	for _, data := range result.Ambiguous {
+		slog.Warn("matched multiple okta users", accountLogAttrs(logOpAdopt, data)...)
+	}
+	for _, data := range result.Deprovisioned {
+		slog.Warn("matched a deprovisioned okta user, not adopted", accountLogAttrs(logOpAdopt, data)...)
+	}
+	for _, data := range result.UnmatchedAccounts {
+		slog.Info("unmatched ldap account", accountLogAttrs(logOpAdopt, data)...)
+	}
+	for _, user := range result.UnmatchedUsers {
+		slog.Info("unmatched okta user", logAttrs(logOpAdopt, logKeyLogin, user.Login, logKeyOktaUserID, user.ID)...)
+	}
+	slog.Info("adopt", logAttrs(logOpAdopt, "adopted", len(result.Linked), "ambiguous", len(result.Ambiguous),
+		"deprovisioned", len(result.Deprovisioned), "unmatched_ldap", len(result.UnmatchedAccounts), "unmatched_okta", len(result.UnmatchedUsers))...)
+
+	if err := store.Backup(); err != nil {
+		fatal(err)
+	}
+	if err := store.Transaction(func(tx StateTx) error {
+		if err := ReplaceState(tx, newState); err != nil {
+			return err
+		}
+		if len(result.Linked) == 0 {
+			return nil
+		}
+		// 紐付けたアカウントを次の同期で更新するため、差分取得の位置を捨てて全件を検索させます
+		return tx.SetMeta(metaWatermark, "")
+	}); err != nil {
+		fatal(err)
+	}
+	return exitOK
+}
+
+// runOrphans LDAPに対応するアカウントが存在しないOktaユーザーを出力します
+func runOrphans(opts *options, args []string) int {
+	serverData := searchLdap(opts.cfg)
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, false, false)
+	users, err := newOktaClient(opts.cfg, nil).ListUsers()
+	if err != nil {
+		fatal(err)
+	}
+	orphans, err := FindOrphans(localData, *serverData, users, splitList(opts.match), time.Now())
+	if err != nil {
+		fatal(err)
+	}
+	writeOutput(opts, func(w io.Writer) error {
+		return WriteOrphans(w, orphans, opts.format)
+	})
+	return exitOK
+}
+
+// runRollback 同期履歴から実行runIDの変更を取り消します（計画を出力してから反映します）
+func runRollback(opts *options, args []string) int {
+	runID := opts.runID
+	entries, err := ReadJournal(opts.cfg.Journal.Path, runID)
+	if err != nil {
+		fatal(err)
+	}
+	key := stateKey(opts.cfg)
+	for i := range entries {
+		if err := entries[i].Unseal(key); err != nil {
+			fatalf("rollback %s: %v", runID, err)
+		}
+	}
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	localData := loadState(store, false, false)
+	actions, err := PlanRollback(entries, localData)
+	if err != nil {
+		fatalf("rollback %s: %v", runID, err)
+	}
+	for _, action := range actions {
+		slog.Info("rollback plan", append(action.logAttrs(), "action", action.String())...)
+	}
+	slog.Info("rollback", logAttrs(logOpRollback, "rollback_run_id", runID, "actions", len(actions))...)
+	if opts.dryRun || len(actions) == 0 {
+		return exitOK
+	}
+
+	journal := startJournal(opts, "rollback "+runID, nil)
+	defer journal.Close()
+	if err := store.Backup(); err != nil {
+		fatal(err)
+	}
+	rollbacker := Rollbacker{
+		Okta:    newOktaClient(opts.cfg, journal),
+		Store:   store,
+		Journal: journal,
+	}
+	failures, err := rollbacker.Apply(actions)
+	for _, failure := range failures {
+		slog.Error("rollback action failed", logAttrs(logOpRollback, logKeyDn, failure.Dn, "action", failure.Key, "error", failure.Err)...)
+	}
+	endJournal(opts, journal, len(failures), err)
+	if err != nil {
+		fatal(err)
+	}
+	// 状態を戻したアカウントはLDAPで変更されていないので、次回は全件取得する
+	if err := store.SetMeta(metaWatermark, ""); err != nil {
+		fatal(err)
+	}
+	if len(failures) > 0 {
+		slog.Warn("rollback actions failed", logAttrs(logOpRollback, "failures", len(failures))...)
+		return exitPartial
+	}
+	slog.Info("rolled back, fix the LDAP data before the next sync or the changes are applied again", logAttrs(logOpRollback, "rollback_run_id", runID)...)
+	return exitOK
+}
+
+// runKeygen 状態の暗号化キーを生成して出力します
+func runKeygen(opts *options, args []string) int {
+	key, err := GenerateStateKey()
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println(key)
+	return exitOK
+}
+
+// runRotateKey 状態をSTATE_KEYで復号し、STATE_NEW_KEYで暗号化し直します
+func runRotateKey(opts *options, args []string) int {
+	newKey, err := LoadStateKey(os.Getenv("STATE_NEW_KEY"), os.Getenv("STATE_NEW_KEY_FILE"))
+	if err != nil {
+		fatal(err)
+	}
+	if newKey == nil {
+		fatal("rotate-key: STATE_NEW_KEY or STATE_NEW_KEY_FILE is required")
+	}
+	store := openStateStore(opts.cfg)
+	defer store.Close()
+	if err := store.Backup(); err != nil {
+		fatal(err)
+	}
+	if err := store.RotateKey(newKey); err != nil {
+		fatal(err)
+	}
+	// バックアップと同期履歴も新しいキーで暗号化し直し、前のキーで読めるものを残しません
+	oldKey := stateKey(opts.cfg)
+	if err := rekeyBackups(opts.cfg.State.Backend, opts.cfg.StatePath(), oldKey, newKey); err != nil {
+		fatal(err)
+	}
+	if err := RekeyJournal(opts.cfg.Journal.Path, oldKey, newKey); err != nil {
+		fatalf("rotate-key: journal %s: %v", opts.cfg.Journal.Path, err)
+	}
+	slog.Info("state, its backups and the journal encrypted with the new key, set it to STATE_KEY", logAttrs(logOpState, "key_id", newKey.ID)...)
+	return exitOK
+}
+
+// runConfig 設定の全ての問題を出力（validate）、秘密情報を伏せて設定を出力（show）します
+func runConfig(opts *options, args []string) int {
+	if len(args) != 1 || (args[0] != "validate" && args[0] != "show") {
+		fmt.Fprintln(os.Stderr, "usage: perman-okta config validate | show")
+		return exitUsage
+	}
+	fileNm := configFile(opts.configFile)
+	cfg, problems := LoadConfig(fileNm)
+	if args[0] == "show" {
+		data, err := yaml.Marshal(cfg)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Print(string(data))
+		return exitOK
+	}
+	if problems = append(problems, cfg.Validate(configLDAP, configOkta)...); len(problems) > 0 {
+		printProblems(os.Stderr, problems)
+		return exitError
+	}
+	if fileNm == "" {
+		fileNm = "environment variables only"
+	}
+	fmt.Printf("config ok (%s)\n", fileNm)
+	return exitOK
+}
+
+// searchLdap LDAPサーバーの全てのアカウントを取得します（ldap.searchesの結果はDNで重複を除いてまとめます）
+func searchLdap(cfg *Config) *[]Account {
+	serverData, _ := searchLdapAccounts(cfg, nil)
+	if len(serverData) == 0 {
+		fatal("LDAP Server Account is 0...") // LDAPサーバーのアカウント0件は異常終了にする
+	}
+	return &serverData
+}
+
+// searchLdapChanges ldap.incrementalを設定した場合は前回の位置から変更されたアカウントだけを取得し、状態のアカウントに重ねます。
+// 変更されていないアカウントは状態の値を使うので、LDAPからの削除は全件取得（fullInterval毎、-full、-init）の時だけ反映されます。
+// 前回の位置（全件取得の場合はnil）と、反映後に保存する位置を返します。
+func searchLdapChanges(opts *options, store StateStore, localData State) (*[]Account, *Watermark, *Watermark) {
+	incremental := opts.cfg.LDAP.Incremental
+	if incremental.Attribute == "" {
+		return searchLdap(opts.cfg), nil, nil
+	}
+	since, err := LoadWatermark(store)
+	if err != nil {
+		fatal(err)
+	}
+	now := time.Now().UTC()
+	reason := since.FullSyncReason(incremental.Attribute, incremental.FullInterval, now)
+	switch {
+	case opts.init:
+		reason = "-init"
+	case opts.full:
+		reason = "-full"
+	}
+	if reason == "" {
+		changed, mark := searchLdapAccounts(opts.cfg, since)
+		if mark.Server == since.Server {
+			serverData, _ := MergeAccounts(changed, *localData.Accounts())
+			slog.Info("incremental sync", logAttrs(logOpLdap, "changed", len(changed), "since_attribute", since.Attribute, "since", since.Value)...)
+			return &serverData, since, mark
+		}
+		reason = fmt.Sprintf("%s is per server, connected to %s instead of %s", since.Attribute, mark.Server, since.Server)
+	}
+
+	slog.Info("full sync", logAttrs(logOpLdap, "reason", reason)...)
+	serverData, mark := searchLdapAccounts(opts.cfg, &Watermark{Attribute: incremental.Attribute, FullSyncAt: now})
+	if len(serverData) == 0 {
+		fatal("LDAP Server Account is 0...") // LDAPサーバーのアカウント0件は異常終了にする
+	}
+	if mark.Value == "" {
+		slog.Warn("ldap: the watermark attribute is not returned, check the attribute and the read permission", logAttrs(logOpLdap, "attribute", mark.Attribute)...)
+	}
+	return &serverData, nil, mark
+}
+
+// lookupLdapEntry dnのエントリがsearchのfilterに一致する場合はエントリを返します（一致しない、存在しない場合はnil）
+func lookupLdapEntry(pool *LdapPool, dn string, search LdapSearch) (*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, noSizeLimit, pool.TimeLimit(), noTypeOnly,
+		search.Filter, search.LdapAttributes(), nil)
+	result, err := pool.Search(request)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, nil
+	}
+	return result.Entries[0], nil
+}
+
+// searchLdapAccounts ldap.searchesの結果をDNで重複を除いてまとめます。
+// sinceを指定した場合はsinceの位置以降に変更されたエントリだけを取得し、取得したエントリで進めた位置を返します。
+func searchLdapAccounts(cfg *Config, since *Watermark) ([]Account, *Watermark) {
+	pool := newLdapPool(cfg)
+	defer pool.Close()
+	var mark *Watermark
+	if since != nil {
+		next := *since
+		mark = &next
+	}
+	var results [][]Account
+	for _, search := range cfg.LDAP.SearchList() {
+		scope, err := search.LdapScope()
+		if err != nil {
+			fatal(err)
+		}
+		attributes := search.LdapAttributes()
+		if mark != nil {
+			attributes = append(attributes, mark.Attribute)
+		}
+		// ldapsearch
+		ldapClient := LdapClient{
+			Pool:       pool,
+			BaseDn:     search.BaseDn,
+			Scope:      scope,
+			Filter:     since.Filter(search.Filter),
+			Attributes: attributes,
+			SizeLimit:  noSizeLimit,
+			TypeOnly:   noTypeOnly,
+		}
+		start := time.Now()
+		result, err := ldapClient.Search()
+		metrics.LdapSearchDuration.WithLabelValues(search.String()).Observe(time.Since(start).Seconds())
+		if err != nil {
+			fatal(err)
+		}
+		if mark != nil {
+			mark.Advance(result.Entries)
+		}
+		// get ldap datas
+		accounts := ConvertEntries(result.Entries, search.AttributeMap())
+		slog.Debug("ldap search", logAttrs(logOpLdap, "search", search.String(), "ldap", pool.URL(), "accounts", len(accounts))...)
+		results = append(results, accounts)
+	}
+	if mark != nil && mark.Attribute == incrementalUSNChanged {
+		mark.Server = pool.URL()
+	}
+	serverData, duplicates := MergeAccounts(results...)
+	for _, dn := range duplicates {
+		slog.Debug("ldap search: matched more than one search, the first one is used", logAttrs(logOpLdap, logKeyDn, dn)...)
+	}
+	return serverData, mark
+}
+
+// lookupLdap ldap.searchesの中からqueryに一致するアカウントを検索します
+func lookupLdap(cfg *Config, query string) []Account {
+	pool := newLdapPool(cfg)
+	defer pool.Close()
+	var results [][]Account
+	for _, search := range cfg.LDAP.SearchList() {
+		search, ok := lookupSearch(search, query)
+		if !ok {
+			continue
+		}
+		scope, err := search.LdapScope()
+		if err != nil {
+			fatal(err)
+		}
+		result, err := LdapClient{
+			Pool:       pool,
+			BaseDn:     search.BaseDn,
+			Scope:      scope,
+			Filter:     search.Filter,
+			Attributes: search.LdapAttributes(),
+			SizeLimit:  noSizeLimit,
+			TypeOnly:   noTypeOnly,
+		}.Search()
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			continue // DNで指定したエントリがない
+		}
+		if err != nil {
+			fatal(err)
+		}
+		results = append(results, ConvertEntries(result.Entries, search.AttributeMap()))
+	}
+	accounts, _ := MergeAccounts(results...)
+	return accounts
+}
+
+// newLdapPool 設定のLDAPサーバーへの接続
+func newLdapPool(cfg *Config) *LdapPool {
+	bindPassword, err := cfg.LDAP.BindPassword.Value()
+	if err != nil {
+		fatal(err)
+	}
+	return &LdapPool{
+		URLs:         cfg.LDAP.URLList(),
+		BindDn:       cfg.LDAP.BindDn,
+		BindPassword: bindPassword,
+		Timeout:      cfg.LDAP.Timeout,
+	}
+}
+
+// loadState 状態を読み込みます（-initの場合は空の状態から始めます）
+func loadState(store StateStore, init, force bool) State {
+	state, err := store.List()
+	if err != nil {
+		fatal(err)
+	}
+	if init {
+		// 状態を捨てるとOktaユーザーIDも失われ、全てのアカウントが作成（重複）になります
+		if len(state) > 0 && !force {
+			fatalf("-init: the state has %d accounts linked to Okta users, starting from an empty state creates them again; "+
+				"use adopt to link the existing users, or add -force to discard the state", len(state))
+		}
+		slog.Warn("-init: start from an empty state", logAttrs(logOpState, "discarded", len(state))...)
+		return State{}
+	}
+	return state
+}
+
+// openStateStore 状態の保存先（state）を開きます
+func openStateStore(cfg *Config) StateStore {
+	store, err := NewStateStore(cfg.State.Backend, cfg.StatePath(), cfg.State.Backups, stateKey(cfg))
+	if err != nil {
+		fatal(err)
+	}
+	if err := store.Load(); err != nil {
+		fatal(err)
+	}
+	return store
+}
+
+// stateKey 状態の暗号化キー（planと同期履歴のアカウントの値もこのキーで暗号化します）
+func stateKey(cfg *Config) *StateKey {
+	key, err := cfg.StateKey()
+	if err != nil {
+		fatal(err)
+	}
+	return key
+}
+
+// newOktaClient 設定からOktaClientを生成します（journalを指定した場合は更新リクエストを記録します）
+func newOktaClient(cfg *Config, journal *Journal) OktaClient {
+	apiKey, err := cfg.Okta.APIKey.Value()
+	if err != nil {
+		fatal(err)
+	}
+	return OktaClient{
+		FQDN:       cfg.Okta.FQDN,
+		APIKEY:     apiKey,
+		HTTPClient: &http.Client{Transport: journal.Transport(RateLimitTransport(metrics.Transport(nil)))},
+	}
+}
+
+// writeMetrics metrics.fileにメトリクスを書き出します（書き出せない場合は反映の結果に影響しないのでログだけ）
+func writeMetrics(cfg *Config) {
+	if cfg.Metrics.File == "" {
+		return
+	}
+	if err := metrics.WriteFile(cfg.Metrics.File); err != nil {
+		slog.Warn("metrics: write failed", logAttrs(logOpMetrics, "file", cfg.Metrics.File, "error", err)...)
+	}
+}
+
+// startJournal 同期履歴ファイル（journal.path）を開いて実行の開始を記録します
+func startJournal(opts *options, command string, inputs *JournalInputs) *Journal {
+	cfg := opts.cfg
+	path := cfg.Journal.Path
+	runID, _ := currentLogRun()
+	if runID == "" {
+		runID = NewRunID()
+	}
+	journal, err := OpenJournal(path, runID)
+	if err != nil {
+		fatal(err)
+	}
+	journal.Key = stateKey(cfg)
+	host, _ := os.Hostname()
+	if err := journal.Record(JournalEntry{
+		Type:       journalRunStart,
+		Command:    command,
+		Operator:   operator(),
+		Host:       host,
+		ConfigHash: cfg.Hash(),
+		Inputs:     inputs,
+	}); err != nil {
+		fatal(err)
+	}
+	slog.Info("run started", logAttrs(logOpRun, "journal", path, "journal_run_id", journal.RunID)...)
+	if opts.notifier != nil {
+		// 続行できないエラーで終了する場合も実行の終了を記録し、レポートから通知します
+		opts.notifier.End = func(err error) {
+			endJournal(opts, journal, 0, err)
+		}
+	}
+	return journal
+}
+
+// endJournal 実行の終了を記録し、実行のレポートを書き出して（report.dir）webhookに通知します（notify.webhooks）
+func endJournal(opts *options, journal *Journal, failures int, err error) {
+	cfg := opts.cfg
+	result := &JournalResult{Failures: failures}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if opts.notifier != nil {
+		opts.notifier.End = nil
+	}
+	if err := journal.Record(JournalEntry{Type: journalRunEnd, Result: result}); err != nil {
+		slog.Error("journal: record failed", logAttrs(logOpRun, "journal", journal.Path, "error", err)...)
+		_, command := currentLogRun()
+		opts.notifier.Send(FatalNotification(command, fmt.Sprintf("journal %s: %v", journal.Path, err)))
+		return
+	}
+	if cfg.Report.Dir == "" && len(cfg.Notify.Webhooks) == 0 {
+		return
+	}
+	report, err := loadRunReport(journal.Path, journal.RunID, journal.Key)
+	if err != nil {
+		slog.Error("report: load failed", logAttrs(logOpRun, "journal", journal.Path, "error", err)...)
+		return
+	}
+	if err := writeReports(cfg.Report, report); err != nil {
+		slog.Error("report: write failed", logAttrs(logOpRun, "dir", cfg.Report.Dir, "error", err)...)
+	}
+	for _, notification := range RunNotifications(report) {
+		opts.notifier.Send(notification)
+	}
+}
+
+// operator 実行者（sudoの場合は元のユーザー）
+func operator() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+// writeOutput -outputのファイル（省略した場合は標準出力）にfnで書き出します
+func writeOutput(opts *options, fn func(w io.Writer) error) {
+	w, err := createOutput(opts.output)
+	if err != nil {
+		fatal(err)
+	}
+	defer w.Close()
+	if err := fn(w); err != nil {
+		fatal(err)
+	}
+}
+
+// splitList カンマ区切りの文字列をsliceにします
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
 	}
+	return list
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Account field names
+const (
+	fieldUID            = "uid"
+	fieldEmail          = "email"
+	fieldEmployeeNumber = "employeeNumber"
+	fieldDescription    = "description"
+)
+
+// CompareRule 項目の比較ルール
+type CompareRule struct {
+	TrimSpace  bool   `json:"trimSpace" yaml:"trimSpace"`   // 前後の空白を無視
+	IgnoreCase bool   `json:"ignoreCase" yaml:"ignoreCase"` // 大文字小文字を無視
+	Normalize  string `json:"normalize" yaml:"normalize"`   // Unicode正規化形式（NFC, NFD, NFKC, NFKD）
+	Unordered  bool   `json:"unordered" yaml:"unordered"`   // 複数値を集合として比較（順序と重複を無視）
+}
+
+// Mapping LDAPアカウントとOktaの対応付けと、項目の比較ルール
+type Mapping struct {
+	Rules map[string]CompareRule `json:"rules"` // key: Accountの項目名（uid, email, employeeNumber, description）
+}
+
+// DefaultMapping 標準の比較ルール（全項目を完全一致で比較します。緩めるルールはmappingの設定で指定します）
+func DefaultMapping() Mapping {
+	return Mapping{Rules: map[string]CompareRule{}}
+}
+
+// LoadMapping jsonファイルの比較ルールをDefaultMappingに上書きして返します
+func LoadMapping(fileNm string) (Mapping, error) {
+	mapping := DefaultMapping()
+	if fileNm == "" {
+		return mapping, nil
+	}
+	data, err := ioutil.ReadFile(fileNm)
+	if err != nil {
+		return mapping, err
+	}
+	var custom Mapping
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return mapping, fmt.Errorf("invalid mapping file %s: %v", fileNm, err)
+	}
+	for field, rule := range custom.Rules {
+		mapping.Rules[field] = rule
+	}
+	return mapping, mapping.Validate()
+}
+
+// Validate 比較ルールをチェックします
+func (m Mapping) Validate() error {
+	for field, rule := range m.Rules {
+		switch field {
+		case fieldUID, fieldEmail, fieldEmployeeNumber, fieldDescription:
+		default:
+			return fmt.Errorf("unknown mapping field: %s", field)
+		}
+		if _, err := normForm(rule.Normalize); err != nil {
+			return fmt.Errorf("mapping field %s: %v", field, err)
+		}
+	}
+	return nil
+}
+
+// Diff DNをキーに差分をチェックして、作成、修正（変更項目付き）、削除が必要なLdapAccountを返します。
+func (m Mapping) Diff(old, new *[]Account) (result DiffResult, err error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	result = make(DiffResult)
+	oldData := make(map[string]Account, len(*old))
+	for _, data := range *old {
+		oldData[dnKey(data.Dn)] = data
+	}
+	newData := make(map[string]bool, len(*new))
+
+	for _, data := range *new {
+		newData[dnKey(data.Dn)] = true
+		current, ok := oldData[dnKey(data.Dn)]
+		if !ok {
+			// new側にしか存在しないデータは新規作成リストに追加
+			result[CreateKey] = append(result[CreateKey], AccountDiff{Account: data})
+			continue
+		}
+		// oldとnewで同一DNの更新をチェック、差分がある場合は更新リストに追加
+		if changes := m.Changes(current, data); len(changes) > 0 {
+			result[UpdateKey] = append(result[UpdateKey], AccountDiff{Account: data, Changes: changes})
+		}
+	}
+	// old側にしか存在しないデータは削除リストに追加
+	for _, data := range *old {
+		if !newData[dnKey(data.Dn)] {
+			result[DeleteKey] = append(result[DeleteKey], AccountDiff{Account: data})
+		}
+	}
+
+	return result, nil
+}
+
+// Changes 比較ルールに従って項目ごとの差分を返します
+func (m Mapping) Changes(old, new Account) []FieldChange {
+	var changes []FieldChange
+	fields := []struct {
+		name string
+		old  []string
+		new  []string
+	}{
+		{fieldUID, []string{old.UID}, []string{new.UID}},
+		{fieldEmail, []string{old.Email}, []string{new.Email}},
+		{fieldEmployeeNumber, []string{old.EmployeeNumber}, []string{new.EmployeeNumber}},
+		{fieldDescription, old.Descriptions, new.Descriptions},
+	}
+	for _, field := range fields {
+		if !m.Equal(field.name, field.old, field.new) {
+			changes = append(changes, FieldChange{
+				Field: field.name,
+				Old:   strings.Join(field.old, ", "),
+				New:   strings.Join(field.new, ", "),
+			})
+		}
+	}
+	return changes
+}
+
+// Equal fieldの比較ルールで値を比較します
+func (m Mapping) Equal(field string, a, b []string) bool {
+	rule := m.Rules[field]
+	a, b = rule.normalize(a), rule.normalize(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// normalize 比較用に値を正規化します
+func (r CompareRule) normalize(values []string) []string {
+	form, _ := normForm(r.Normalize)
+	result := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if r.TrimSpace {
+			value = strings.TrimSpace(value)
+		}
+		if form != nil {
+			value = form.String(value)
+		}
+		if r.IgnoreCase {
+			value = strings.ToLower(value)
+		}
+		if r.Unordered {
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+		}
+		result = append(result, value)
+	}
+	if r.Unordered {
+		sort.Strings(result)
+	}
+	return result
+}
+
+// normForm 正規化形式の名前からnorm.Formを返します（空文字は正規化なし）
+func normForm(name string) (*norm.Form, error) {
+	var form norm.Form
+	switch strings.ToUpper(name) {
+	case "":
+		return nil, nil
+	case "NFC":
+		form = norm.NFC
+	case "NFD":
+		form = norm.NFD
+	case "NFKC":
+		form = norm.NFKC
+	case "NFKD":
+		form = norm.NFKD
+	default:
+		return nil, fmt.Errorf("unknown unicode normalization form: %s", name)
+	}
+	return &form, nil
+}
+
+// OktaProfile AccountからOktaへ登録するUserProfileを生成します
+func (a Account) OktaProfile() *UserProfile {
+	return &UserProfile{
+		LastName:       a.UID,
+		FirstName:      a.UID,
+		Email:          a.Email,
+		Login:          a.Email,
+		EmployeeNumber: a.EmployeeNumber,
+	}
+}
+
+// Hash UserProfileのハッシュ値（sha256）を返します
+func (p UserProfile) Hash() string {
+	jsonBytes, _ := json.Marshal(p)
+	sum := sha256.Sum256(jsonBytes)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMappingChanges(t *testing.T) {
+	mapping := Mapping{
+		Rules: map[string]CompareRule{
+			fieldUID:            {TrimSpace: true, Normalize: "NFC"},
+			fieldEmail:          {TrimSpace: true, IgnoreCase: true, Normalize: "NFC"},
+			fieldEmployeeNumber: {TrimSpace: true, Normalize: "NFC"},
+			fieldDescription:    {TrimSpace: true, Normalize: "NFC", Unordered: true},
+		},
+	}
+
+	old := Account{
+		Dn:             "uid=aaa_user,dc=example,dc=com",
+		UID:            "aaa_user",
+		Email:          "aaa_user@example.com",
+		EmployeeNumber: "EMP_NO001",
+		Descriptions:   []string{"desc 0001", "desc 0002", "café"},
+	}
+
+	// Pattern: [Normalized] 順序、大文字小文字、前後の空白、Unicode正規化の違いは差分にしない
+	new := Account{
+		Dn:             old.Dn,
+		UID:            " aaa_user",
+		Email:          "AAA_User@Example.com ",
+		EmployeeNumber: "EMP_NO001\t",
+		Descriptions:   []string{"café", "desc 0002 ", "desc 0001", "desc 0001"},
+	}
+	if changes := mapping.Changes(old, new); len(changes) != 0 {
+		t.Errorf("Mapping.Changes [Normalized]changes exist: %v", changes)
+	}
+
+	// Pattern: [Default] 標準のルールは正規化しない
+	if changes := DefaultMapping().Changes(old, new); len(changes) != 4 {
+		t.Errorf("Mapping.Changes [Default]changes wrong: %v", changes)
+	}
+
+	// Pattern: [Modify]
+	new.Email = "bbb_user@example.com"
+	new.Descriptions = []string{"desc 0001"}
+	changes := mapping.Changes(old, new)
+	if len(changes) != 2 || changes[0].Field != fieldEmail || changes[1].Field != fieldDescription {
+		t.Errorf("Mapping.Changes [Modify]changes wrong: %v", changes)
+	}
+
+	// Pattern: [Strict] ルールなしの場合は完全一致で比較
+	strict := Mapping{}
+	new = old
+	new.Descriptions = []string{"desc 0002", "desc 0001", "café"}
+	changes = strict.Changes(old, new)
+	if len(changes) != 1 || changes[0].Field != fieldDescription {
+		t.Errorf("Mapping.Changes [Strict]changes wrong: %v", changes)
+	}
+}
+
+func TestLoadMapping(t *testing.T) {
+	fileNm := "tmp/test_mapping.json"
+	if err := ioutil.WriteFile(fileNm, []byte(`{"rules": {"description": {"trimSpace": true}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mapping, err := LoadMapping(fileNm)
+	if err != nil {
+		t.Fatalf("LoadMapping exec failed: %v", err)
+	}
+	if !mapping.Rules[fieldDescription].TrimSpace {
+		t.Errorf("LoadMapping description rule not loaded: %v", mapping.Rules[fieldDescription])
+	}
+	if mapping.Rules[fieldEmail] != (CompareRule{}) {
+		t.Errorf("LoadMapping default email rule not strict: %v", mapping.Rules[fieldEmail])
+	}
+
+	if err := ioutil.WriteFile(fileNm, []byte(`{"rules": {"email": {"normalize": "NFX"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadMapping(fileNm); err == nil {
+		t.Error("LoadMapping invalid normalize form not detected")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+)
+
+// metricsNamespace メトリクス名の接頭辞
+const metricsNamespace = "perman_okta"
+
+// account phases（perman_okta_accountsのphase）
+const (
+	phasePlanned = "planned"
+	phaseApplied = "applied"
+	phaseFailed  = "failed"
+)
+
+// metrics この実行のメトリクス
+var metrics = NewMetrics()
+
+// Metrics 同期の実行のメトリクス（Prometheus）。
+// 実行毎にmetrics.fileへtextfile形式で書き出し、常駐するコマンド（serve、watch）はmetrics.listenの/metricsで公開します。
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	RunDuration        *prometheus.GaugeVec
+	LastRun            *prometheus.GaugeVec
+	LastSuccess        prometheus.Gauge
+	LdapAccounts       prometheus.Gauge
+	Accounts           *prometheus.GaugeVec
+	LdapSearchDuration *prometheus.HistogramVec
+	OktaRequests       *prometheus.HistogramVec
+	OktaRateLimit      *prometheus.GaugeVec
+}
+
+// NewMetrics メトリクスを作成して新しいRegistryに登録します
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		RunDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "run_duration_seconds",
+			Help: "Duration of the last run (a batch for watch)."}, []string{"command"}),
+		LastRun: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "last_run_timestamp_seconds",
+			Help: "Time the last run finished."}, []string{"command"}),
+		LastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "last_success_timestamp_seconds",
+			Help: "Time the last run applying every account finished."}),
+		LdapAccounts: prometheus.NewGauge(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "ldap_accounts",
+			Help: "Accounts seen in LDAP by the last run."}),
+		Accounts: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "accounts",
+			Help: "Accounts planned, applied and failed by the last run per operation."}, []string{"operation", "phase"}),
+		LdapSearchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: metricsNamespace, Name: "ldap_search_duration_seconds",
+			Help: "Duration of the LDAP searches.", Buckets: []float64{.1, .5, 1, 5, 10, 30, 60, 120}}, []string{"search"}),
+		OktaRequests: prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: metricsNamespace, Name: "okta_request_duration_seconds",
+			Help: "Duration of the Okta API requests.", Buckets: prometheus.DefBuckets}, []string{"method", "endpoint", "status"}),
+		OktaRateLimit: prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: metricsNamespace, Name: "okta_rate_limit_remaining",
+			Help: "X-Rate-Limit-Remaining of the last Okta API response per endpoint."}, []string{"endpoint"}),
+	}
+	m.Registry.MustRegister(m.RunDuration, m.LastRun, m.LastSuccess, m.LdapAccounts, m.Accounts,
+		m.LdapSearchDuration, m.OktaRequests, m.OktaRateLimit)
+	return m
+}
+
+// RecordRun 実行の件数と結果を記録します（failuresがなくerrがnilの場合は成功）
+func (m *Metrics) RecordRun(command string, start time.Time, inputs *JournalInputs, diff DiffResult, failures []SyncError, err error) {
+	now := time.Now()
+	command = strings.Fields(command)[0] // apply -plan <file>
+	m.RunDuration.WithLabelValues(command).Set(now.Sub(start).Seconds())
+	m.LastRun.WithLabelValues(command).Set(float64(now.Unix()))
+	if inputs.LdapCount > 0 {
+		m.LdapAccounts.Set(float64(inputs.LdapCount))
+	}
+	failed := map[string]int{}
+	for _, failure := range failures {
+		failed[failure.Key]++
+	}
+	for _, key := range []string{CreateKey, UpdateKey, DeleteKey} {
+		operation := strings.ToLower(key)
+		planned := len(diff[key])
+		applied := planned - failed[key]
+		if err != nil {
+			applied = 0 // 途中で終了したので反映した件数は同期履歴で確認します
+		}
+		m.Accounts.WithLabelValues(operation, phasePlanned).Set(float64(planned))
+		m.Accounts.WithLabelValues(operation, phaseApplied).Set(float64(applied))
+		m.Accounts.WithLabelValues(operation, phaseFailed).Set(float64(failed[key]))
+	}
+	if len(failures) == 0 && err == nil {
+		m.LastSuccess.Set(float64(now.Unix()))
+	}
+}
+
+// WriteFile textfile形式で書き出します。この実行が成功していない場合は前回のファイルの最終成功日時を引き継ぎます
+func (m *Metrics) WriteFile(path string) error {
+	if gaugeValue(m.LastSuccess) == 0 {
+		if value, ok := readMetricsFile(path, metricsNamespace+"_last_success_timestamp_seconds"); ok {
+			m.LastSuccess.Set(value)
+		}
+	}
+	return prometheus.WriteToTextfile(path, m.Registry)
+}
+
+// Transport Okta APIのリクエストの時間、ステータス、レート制限の残りを記録するRoundTripperを返します
+func (m *Metrics) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return metricsTransport{base: base, metrics: m}
+}
+
+type metricsTransport struct {
+	base    http.RoundTripper
+	metrics *Metrics
+}
+
+// RoundTrip リクエストを送り、endpoint（IDを{id}にしたパス）毎に記録します
+func (t metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	endpoint := oktaEndpoint(req.URL.Path)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+		if remaining, err := strconv.ParseFloat(res.Header.Get("X-Rate-Limit-Remaining"), 64); err == nil {
+			t.metrics.OktaRateLimit.WithLabelValues(endpoint).Set(remaining)
+		}
+	}
+	t.metrics.OktaRequests.WithLabelValues(req.Method, endpoint, status).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+// oktaEndpoints パスの中でIDでない部分
+var oktaEndpoints = map[string]bool{
+	"api": true, "v1": true, "users": true, "groups": true, "lifecycle": true,
+	"activate": true, "deactivate": true, "suspend": true, "unsuspend": true,
+}
+
+// oktaEndpoint パスのユーザーID、グループID、loginを{id}にします（/api/v1/groups/{id}/users/{id}）
+func oktaEndpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if !oktaEndpoints[segment] {
+			segments[i] = "{id}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// readMetricsFile textfileのメトリクスの値（ラベルのない最初の値）
+func readMetricsFile(path, name string) (float64, bool) {
+	families, err := readMetricsFamilies(path)
+	if err != nil || families[name] == nil || len(families[name].Metric) == 0 {
+		return 0, false
+	}
+	metric := families[name].Metric[0]
+	switch {
+	case metric.Gauge != nil:
+		return metric.Gauge.GetValue(), true
+	case metric.Counter != nil:
+		return metric.Counter.GetValue(), true
+	}
+	return 0, false
+}
+
+func readMetricsFamilies(path string) (map[string]*dto.MetricFamily, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	return parser.TextToMetricFamilies(file)
+}
+
+// metricsFileGatherer metrics.fileのメトリクス（子プロセスの実行の結果をserveの/metricsで公開します）
+func metricsFileGatherer(path string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := readMetricsFamilies(path)
+		if os.IsNotExist(err) || path == "" {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var result []*dto.MetricFamily
+		for _, family := range families {
+			result = append(result, family)
+		}
+		return result, nil
+	})
+}
+
+// startMetricsServer listenの/metricsでgathererのメトリクスを公開します
+func startMetricsServer(listen string, gatherer prometheus.Gatherer) (*http.Server, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	return server, nil
+}
+
+func gaugeValue(gauge prometheus.Gauge) float64 {
+	var metric dto.Metric
+	if err := gauge.Write(&metric); err != nil {
+		return 0
+	}
+	return metric.GetGauge().GetValue()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOktaEndpoint(t *testing.T) {
+	patterns := []struct {
+		path string
+		want string
+	}{
+		// Pattern: [Users]
+		{"/api/v1/users", "/api/v1/users"},
+		// Pattern: [User ID]
+		{"/api/v1/users/00u1abc", "/api/v1/users/{id}"},
+		// Pattern: [Login]
+		{"/api/v1/users/taro@example.com", "/api/v1/users/{id}"},
+		// Pattern: [Lifecycle]
+		{"/api/v1/users/00u1abc/lifecycle/deactivate", "/api/v1/users/{id}/lifecycle/deactivate"},
+		// Pattern: [Group member]
+		{"/api/v1/groups/00g1abc/users/00u1abc", "/api/v1/groups/{id}/users/{id}"},
+	}
+	for _, p := range patterns {
+		if got := oktaEndpoint(p.path); got != p.want {
+			t.Errorf("oktaEndpoint(%q) = %q, want %q", p.path, got, p.want)
+		}
+	}
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Rate-Limit-Remaining", "42")
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	m := NewMetrics()
+	client := &http.Client{Transport: m.Transport(nil)}
+	for _, path := range []string{"/api/v1/users/00u1", "/api/v1/users/00u2", "/api/v1/users/missing"} {
+		res, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if got := testutil.CollectAndCount(m.OktaRequests); got != 2 {
+		t.Errorf("okta request series = %d, want 2 (200 and 404 of /api/v1/users/{id})", got)
+	}
+	if got := testutil.ToFloat64(m.OktaRateLimit.WithLabelValues("/api/v1/users/{id}")); got != 42 {
+		t.Errorf("rate limit remaining = %v, want 42", got)
+	}
+}
+
+func TestMetricsRecordRun(t *testing.T) {
+	diff := DiffResult{
+		CreateKey: {{Account: testAccounts[0]}, {Account: testAccounts[1]}},
+		DeleteKey: {{Account: testAccounts[2]}},
+	}
+	failures := []SyncError{{Key: CreateKey, Dn: testAccounts[1].Dn, Err: errors.New("okta: 400")}}
+
+	m := NewMetrics()
+	m.RecordRun("apply -plan tmp/plan.json", time.Now().Add(-time.Minute), &JournalInputs{LdapCount: 10}, diff, failures, nil)
+	patterns := []struct {
+		operation string
+		phase     string
+		want      float64
+	}{
+		{"create", phasePlanned, 2},
+		{"create", phaseApplied, 1},
+		{"create", phaseFailed, 1},
+		{"delete", phaseApplied, 1},
+		{"update", phasePlanned, 0},
+	}
+	for _, p := range patterns {
+		if got := testutil.ToFloat64(m.Accounts.WithLabelValues(p.operation, p.phase)); got != p.want {
+			t.Errorf("accounts{%s,%s} = %v, want %v", p.operation, p.phase, got, p.want)
+		}
+	}
+	if got := testutil.ToFloat64(m.LdapAccounts); got != 10 {
+		t.Errorf("ldap accounts = %v, want 10", got)
+	}
+	if got := testutil.ToFloat64(m.RunDuration.WithLabelValues("apply")); got < 60 {
+		t.Errorf("run duration = %v, want 60 or more", got)
+	}
+	if got := testutil.ToFloat64(m.LastSuccess); got != 0 {
+		t.Errorf("last success = %v, want 0 (a failure)", got)
+	}
+
+	m.RecordRun("sync", time.Now(), &JournalInputs{}, DiffResult{}, nil, nil)
+	if got := testutil.ToFloat64(m.LastSuccess); got == 0 {
+		t.Errorf("last success is not set")
+	}
+}
+
+func TestMetricsWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "perman_okta.prom")
+
+	// Pattern: [Success]
+	succeeded := NewMetrics()
+	succeeded.RecordRun("sync", time.Now(), &JournalInputs{LdapCount: 3}, DiffResult{}, nil, nil)
+	if err := succeeded.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	last := testutil.ToFloat64(succeeded.LastSuccess)
+
+	// Pattern: [Failure keeps the last success]
+	failed := NewMetrics()
+	failed.RecordRun("sync", time.Now(), &JournalInputs{LdapCount: 3}, DiffResult{}, nil, errors.New("okta: 500"))
+	if err := failed.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := readMetricsFile(path, "perman_okta_last_success_timestamp_seconds"); !ok || got != last {
+		t.Errorf("last success = %v (%v), want %v", got, ok, last)
+	}
+
+	// Pattern: [Gatherer]
+	families, err := metricsFileGatherer(path).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) == 0 {
+		t.Errorf("no metrics gathered from %s", path)
+	}
+	if families, err := metricsFileGatherer(filepath.Join(dir, "missing.prom")).Gather(); err != nil || len(families) != 0 {
+		t.Errorf("missing file = %v, %v, want no metrics", families, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultNotifyTimeout webhookの送信のタイムアウト
+const defaultNotifyTimeout = 10 * time.Second
+
+// notify events（notify.webhooks[].events）
+const (
+	notifyCompleted = "completed" // 全てのアカウントを反映して終了
+	notifyFailed    = "failed"    // 一部のアカウントの失敗、または続行できないエラーで終了
+	notifyAborted   = "aborted"   // safetyの上限を超えたため何も反映せずに終了
+	notifyDeleted   = "deleted"   // アカウント毎の削除（標準では送りません）
+)
+
+// notifyEvents 指定できるイベント
+var notifyEvents = []string{notifyCompleted, notifyFailed, notifyAborted, notifyDeleted}
+
+// defaultNotifyEvents eventsを省略した場合のイベント
+var defaultNotifyEvents = []string{notifyCompleted, notifyFailed, notifyAborted}
+
+// webhook formats（notify.webhooks[].format）
+const (
+	webhookJSON  = "json"  // Notificationそのもの
+	webhookSlack = "slack" // Slackのincoming webhook
+	webhookTeams = "teams" // Microsoft TeamsのMessageCard
+)
+
+// Notification webhookで送る通知（実行のレポートから作ります）
+type Notification struct {
+	Event   string         `json:"event"`
+	Time    time.Time      `json:"time"`
+	RunID   string         `json:"runId,omitempty"`
+	Command string         `json:"command"`
+	Host    string         `json:"host,omitempty"`
+	Result  string         `json:"result,omitempty"`  // completed, failed
+	Counts  map[string]int `json:"counts,omitempty"`  // completed, failed（レポートのstatus毎のアカウント数）
+	Planned map[string]int `json:"planned,omitempty"` // aborted（CREATE, UPDATE, DELETEの件数）
+	Error   string         `json:"error,omitempty"`
+	Account *ReportAccount `json:"account,omitempty"` // deleted
+}
+
+// Text Slack、Teamsに表示する1行の要約
+func (n Notification) Text() string {
+	prefix := fmt.Sprintf("perman-okta %s", n.Command)
+	if n.RunID != "" {
+		prefix += " (run " + n.RunID + ")"
+	}
+	switch n.Event {
+	case notifyAborted:
+		return fmt.Sprintf("%s aborted, nothing applied: %s", prefix, n.Error)
+	case notifyDeleted:
+		return fmt.Sprintf("%s deleted %s (okta user %s)", prefix, n.Account.Dn, n.Account.OktaUserID)
+	}
+	var counts []string
+	for _, status := range reportStatuses {
+		if n.Counts[status] > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d", status, n.Counts[status]))
+		}
+	}
+	if len(counts) == 0 && n.Error == "" {
+		counts = append(counts, "no changes")
+	}
+	text := fmt.Sprintf("%s %s: %s", prefix, n.Result, strings.Join(counts, ", "))
+	if n.Error != "" && len(counts) > 0 {
+		text += ": " + n.Error
+	} else if n.Error != "" {
+		text += n.Error
+	}
+	return text
+}
+
+// RunNotifications 実行のレポートの通知（completedまたはfailedと、削除したアカウント毎のdeleted）
+func RunNotifications(report *RunReport) []Notification {
+	run := Notification{
+		Event:   notifyCompleted,
+		Time:    report.FinishedAt,
+		RunID:   report.RunID,
+		Command: report.Command,
+		Host:    report.Host,
+		Result:  report.Result(),
+		Counts:  report.Counts,
+		Error:   report.Error,
+	}
+	if run.Result != runOK {
+		run.Event = notifyFailed
+	}
+	notifications := []Notification{run}
+	for i, account := range report.Accounts {
+		if account.Status == reportDeleted {
+			notifications = append(notifications, Notification{
+				Event: notifyDeleted, Time: report.FinishedAt, RunID: report.RunID, Command: report.Command, Host: report.Host,
+				Account: &report.Accounts[i],
+			})
+		}
+	}
+	return notifications
+}
+
+// AbortedNotification safetyの上限を超えて中断した実行の通知
+func AbortedNotification(command string, diff DiffResult, err error) Notification {
+	runID, _ := currentLogRun()
+	host, _ := os.Hostname()
+	return Notification{
+		Event:   notifyAborted,
+		Time:    time.Now().UTC(),
+		RunID:   runID,
+		Command: command,
+		Host:    host,
+		Planned: map[string]int{CreateKey: len(diff[CreateKey]), UpdateKey: len(diff[UpdateKey]), DeleteKey: len(diff[DeleteKey])},
+		Error:   err.Error(),
+	}
+}
+
+// FatalNotification 続行できないエラーで終了した実行の通知（同期履歴に実行の終了を記録できない場合も含みます）
+func FatalNotification(command, message string) Notification {
+	runID, _ := currentLogRun()
+	host, _ := os.Hostname()
+	return Notification{
+		Event:   notifyFailed,
+		Time:    time.Now().UTC(),
+		RunID:   runID,
+		Command: command,
+		Host:    host,
+		Result:  runFailed,
+		Error:   message,
+	}
+}
+
+// RunNotifier 1回の実行の通知。
+// 失敗（failed、aborted）は1回だけ送るので、失敗を通知した後の続行できないエラー（fatal）では送りません。
+type RunNotifier struct {
+	Notifier Notifier
+	Command  string
+	// End 同期履歴に実行の開始を記録した後は、続行できないエラーでも実行の終了を記録して通知します（endJournal）
+	End    func(err error)
+	failed bool
+}
+
+// Send notificationを送ります（nilのRunNotifierは何も送りません）
+func (n *RunNotifier) Send(notification Notification) {
+	if n == nil {
+		return
+	}
+	if notification.Event == notifyFailed || notification.Event == notifyAborted {
+		if n.failed {
+			return
+		}
+		n.failed = true
+	}
+	n.Notifier.Send(notification)
+}
+
+// Fatal 続行できないエラーで終了する前に失敗を通知します（fatalHook）
+func (n *RunNotifier) Fatal(message string) {
+	if n == nil || n.failed {
+		return
+	}
+	if end := n.End; end != nil {
+		n.End = nil
+		end(errors.New(message))
+		return
+	}
+	n.Send(FatalNotification(n.Command, message))
+}
+
+// Notifier 設定のwebhookに通知を送ります。送信の失敗はログに出力するだけで、実行の結果には影響しません
+type Notifier struct {
+	Webhooks []WebhookConfig
+	Client   *http.Client
+}
+
+// NewNotifier notifyの設定のNotifier
+func NewNotifier(cfg NotifyConfig) Notifier {
+	return Notifier{Webhooks: cfg.Webhooks, Client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Send イベントを指定しているwebhookにnotificationを送ります
+func (n Notifier) Send(notification Notification) {
+	for _, webhook := range n.Webhooks {
+		if !webhook.Subscribes(notification.Event) {
+			continue
+		}
+		if err := n.post(webhook, notification); err != nil {
+			slog.Warn("webhook failed", logAttrs(logOpNotify, "event", notification.Event, "format", webhook.FormatName(), "error", err)...)
+			continue
+		}
+		slog.Debug("webhook sent", logAttrs(logOpNotify, "event", notification.Event, "format", webhook.FormatName())...)
+	}
+}
+
+func (n Notifier) post(webhook WebhookConfig, notification Notification) error {
+	url, err := webhook.URL.Value()
+	if err != nil {
+		return err
+	}
+	body, err := webhook.Payload(notification)
+	if err != nil {
+		return err
+	}
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultNotifyTimeout}
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("http status %d: %s", res.StatusCode, bytes.TrimSpace(data))
+	}
+	return nil
+}
+
+// Payload webhookに送るリクエストボディ（templateを指定した場合はその結果）
+func (w WebhookConfig) Payload(notification Notification) ([]byte, error) {
+	if w.Template != "" {
+		tmpl, err := w.parseTemplate()
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, notification); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	switch w.FormatName() {
+	case webhookSlack:
+		return json.Marshal(map[string]string{"text": notification.Text()})
+	case webhookTeams:
+		color := "2EB67D"
+		if notification.Event != notifyCompleted {
+			color = "E01E5A"
+		}
+		return json.Marshal(map[string]string{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    notification.Text(),
+			"themeColor": color,
+			"title":      "perman-okta " + notification.Event,
+			"text":       notification.Text(),
+		})
+	case webhookJSON:
+		return json.Marshal(notification)
+	}
+	return nil, fmt.Errorf("unknown webhook format: %s", w.Format)
+}
+
+// parseTemplate templateをtext/templateとして読み込みます（{{json .Text}}でJSONの文字列にします）
+func (w WebhookConfig) parseTemplate() (*template.Template, error) {
+	return template.New("webhook").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(w.Template)
+}
+
+// FormatName formatの名前（省略した場合はjson）
+func (w WebhookConfig) FormatName() string {
+	if w.Format == "" {
+		return webhookJSON
+	}
+	return w.Format
+}
+
+// Subscribes eventを送るか（eventsを省略した場合はdeleted以外）
+func (w WebhookConfig) Subscribes(event string) bool {
+	events := w.Events
+	if len(events) == 0 {
+		events = defaultNotifyEvents
+	}
+	return contains(events, event)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webhookReceiver 受け取ったwebhookのリクエストボディをパス毎に記録するHTTPサーバー
+type webhookReceiver struct {
+	mu     sync.Mutex
+	bodies map[string][]string
+}
+
+func (r *webhookReceiver) start() *httptest.Server {
+	r.bodies = map[string][]string{}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], string(body))
+		r.mu.Unlock()
+		if req.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestNotifier(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := receiver.start()
+	defer server.Close()
+
+	report, _ := NewRunReport(testReportEntries())
+	notifier := Notifier{Webhooks: []WebhookConfig{
+		{URL: Secret(server.URL + "/json")},
+		{URL: Secret(server.URL + "/slack"), Format: webhookSlack, Events: []string{notifyFailed, notifyDeleted}},
+		{URL: Secret(server.URL + "/teams"), Format: webhookTeams, Events: []string{notifyAborted}},
+		{URL: Secret(server.URL + "/template"), Template: `{"summary": {{json .Text}}, "deletes": {{index .Planned "DELETE"}}}`, Events: []string{notifyAborted}},
+		{URL: Secret(server.URL + "/broken")},
+	}}
+	for _, notification := range RunNotifications(report) {
+		notifier.Send(notification)
+	}
+	aborted := DiffResult{DeleteKey: make([]AccountDiff, 30)}
+	notifier.Send(AbortedNotification("sync", aborted, errors.New("safety: DELETE 30 > 10")))
+
+	// Pattern: [JSON] 標準のイベント（completed、failed、aborted）だけ
+	if got := receiver.bodies["/json"]; len(got) != 2 {
+		t.Fatalf("[JSON]requests wrong: %v", got)
+	}
+	var run Notification
+	if err := json.Unmarshal([]byte(receiver.bodies["/json"][0]), &run); err != nil {
+		t.Fatal(err)
+	}
+	if run.Event != notifyFailed || run.Result != runPartial || run.RunID != "run1" || run.Counts[reportFailed] != 1 {
+		t.Errorf("[JSON]run notification wrong: %+v", run)
+	}
+
+	// Pattern: [Slack] 削除毎の通知
+	slack := receiver.bodies["/slack"]
+	if len(slack) != 2 || !strings.Contains(slack[0], "partial: created 1, updated 1, deleted 1, skipped 1, failed 1") ||
+		!strings.Contains(slack[1], "deleted uid=ddd,dc=example,dc=com (okta user 00u_ddd)") {
+		t.Errorf("[Slack]requests wrong: %v", slack)
+	}
+
+	// Pattern: [Teams]
+	var card map[string]string
+	if teams := receiver.bodies["/teams"]; len(teams) != 1 || json.Unmarshal([]byte(teams[0]), &card) != nil ||
+		card["@type"] != "MessageCard" || !strings.Contains(card["text"], "aborted, nothing applied: safety: DELETE 30 > 10") {
+		t.Errorf("[Teams]requests wrong: %v", receiver.bodies["/teams"])
+	}
+
+	// Pattern: [Template]
+	var custom struct {
+		Summary string `json:"summary"`
+		Deletes int    `json:"deletes"`
+	}
+	if got := receiver.bodies["/template"]; len(got) != 1 || json.Unmarshal([]byte(got[0]), &custom) != nil || custom.Deletes != 30 || !strings.Contains(custom.Summary, "aborted") {
+		t.Errorf("[Template]requests wrong: %v", got)
+	}
+
+	// Pattern: [Broken] 送信の失敗は他のwebhookに影響しない
+	if got := receiver.bodies["/broken"]; len(got) != 2 {
+		t.Errorf("[Broken]requests wrong: %v", got)
+	}
+}
+
+func TestNotifyFatal(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := receiver.start()
+	defer server.Close()
+
+	// Pattern: [Fatal] 同期履歴の記録前の続行できないエラー（LDAPの接続など）もfailedを通知する
+	cfg := DefaultConfig()
+	cfg.Notify.Webhooks = []WebhookConfig{{URL: Secret(server.URL + "/json")}}
+	beginLogRun("sync")
+	notifier := &RunNotifier{Notifier: NewNotifier(cfg.Notify), Command: "sync"}
+	notifier.Fatal("ldap: bind failed")
+	var run Notification
+	if got := receiver.bodies["/json"]; len(got) != 1 || json.Unmarshal([]byte(got[0]), &run) != nil {
+		t.Fatalf("[Fatal]requests wrong: %v", got)
+	}
+	if run.Event != notifyFailed || run.Result != runFailed || run.Command != "sync" || run.Error != "ldap: bind failed" {
+		t.Errorf("[Fatal]notification wrong: %+v", run)
+	}
+	if text := run.Text(); !strings.Contains(text, "failed: ldap: bind failed") {
+		t.Errorf("[Fatal]text wrong: %s", text)
+	}
+}
+
+func TestNotifyFailedRun(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := receiver.start()
+	defer server.Close()
+	dir, err := ioutil.TempDir("tmp", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.Notify.Webhooks = []WebhookConfig{{URL: Secret(server.URL + "/json")}}
+	cfg.Journal.Path = filepath.Join(dir, "journal.jsonl")
+	beginLogRun("sync")
+
+	// Pattern: [Failed] 失敗した実行の終了を記録した後のfatalではfailedを再び通知しない
+	opts := &options{cfg: cfg, notifier: &RunNotifier{Notifier: NewNotifier(cfg.Notify), Command: "sync"}}
+	journal := startJournal(opts, "sync", nil)
+	endJournal(opts, journal, 0, errors.New("okta: group not found"))
+	opts.notifier.Fatal("okta: group not found")
+	journal.Close()
+	if got := receiver.bodies["/json"]; len(got) != 1 || !strings.Contains(got[0], `"event":"failed"`) {
+		t.Errorf("[Failed]requests wrong: %v", got)
+	}
+
+	// Pattern: [Fatal Journal] 同期履歴の記録中のfatalは実行の終了を記録して1回だけ通知する
+	receiver.bodies = map[string][]string{}
+	beginLogRun("sync")
+	opts.notifier = &RunNotifier{Notifier: NewNotifier(cfg.Notify), Command: "sync"}
+	journal = startJournal(opts, "sync", nil)
+	opts.notifier.Fatal("state: disk full")
+	opts.notifier.Fatal("state: disk full")
+	journal.Close()
+	if got := receiver.bodies["/json"]; len(got) != 1 || !strings.Contains(got[0], "state: disk full") {
+		t.Errorf("[Fatal Journal]requests wrong: %v", got)
+	}
+	entries, err := ReadJournal(cfg.Journal.Path, journal.RunID)
+	if err != nil || len(entries) != 2 || entries[1].Type != journalRunEnd {
+		t.Errorf("[Fatal Journal]journal wrong: %v, %v", entries, err)
+	}
+}
+
+func TestNotifyConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Notify.Webhooks = []WebhookConfig{
+		{URL: "https://hooks.slack.com/services/T/B/X", Format: webhookSlack, Events: []string{notifyDeleted}},
+		{URL: "hooks.example.com", Format: "discord", Template: "{{.Text", Events: []string{"started"}},
+	}
+	problems := cfg.Validate()
+	if len(problems) != 4 {
+		t.Errorf("Config.Validate notify problems wrong: %v", problems)
+	}
+	for _, problem := range problems {
+		if !strings.Contains(problem.Error(), "notify.webhooks[1]") {
+			t.Errorf("Config.Validate notify problem wrong: %v", problem)
+		}
+	}
+}
@@ -5,15 +5,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // OktaClient OktaAPI client
 type OktaClient struct {
-	FQDN   string
-	APIKEY string
+	FQDN       string
+	APIKEY     string
+	HTTPClient *http.Client // optional (default: new http.Client)
 }
 
 // OktaUser Response
@@ -31,12 +35,13 @@ type OktaUser struct {
 
 // UserProfile OktaUser Profile
 type UserProfile struct {
-	LastName    string      `json:"lastName"`
-	SecondEmail interface{} `json:"secondEmail"`
-	MobilePhone interface{} `json:"mobilePhone"`
-	Email       string      `json:"email"`
-	Login       string      `json:"login"` // must email type format
-	FirstName   string      `json:"firstName"`
+	LastName       string      `json:"lastName"`
+	SecondEmail    interface{} `json:"secondEmail"`
+	MobilePhone    interface{} `json:"mobilePhone"`
+	Email          string      `json:"email"`
+	Login          string      `json:"login"` // must email type format
+	FirstName      string      `json:"firstName"`
+	EmployeeNumber string      `json:"employeeNumber,omitempty"`
 }
 
 // OktaGroup Response
@@ -61,6 +66,11 @@ type CreateUserRequest struct {
 	UserProfile `json:"profile"`
 }
 
+// UpdateUserRequest request body for partial update
+type UpdateUserRequest struct {
+	Profile map[string]string `json:"profile"`
+}
+
 // CreateGroupRequest request body for create
 type CreateGroupRequest struct {
 	GroupProfile `json:"profile"`
@@ -69,15 +79,15 @@ type CreateGroupRequest struct {
 // GetUserWithLogin Get User with Login API
 func (okta OktaClient) GetUserWithLogin(login string) (*OktaUser, error) {
 
-	req, _ := http.NewRequest("GET", "https://"+okta.FQDN+"/api/v1/users/"+login, nil)
+	req, _ := http.NewRequest("GET", "https://"+okta.FQDN+"/api/v1/users/"+url.PathEscape(login), nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found user: http status %d", res.StatusCode)
+		slog.Info("Not Found user", logAttrs(logOpOkta, logKeyLogin, login, "status", res.StatusCode)...)
 		return &OktaUser{}, nil
 	} else if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("Unable to get this url :http status %d", res.StatusCode)
@@ -113,7 +123,7 @@ func (okta OktaClient) CreateUser(profile *UserProfile) (*OktaUser, error) {
 	)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -140,6 +150,48 @@ func (okta OktaClient) CreateUser(profile *UserProfile) (*OktaUser, error) {
 	return &oktaUser, nil
 }
 
+// UpdateUser Partial Update User API (only given profile attributes are updated)
+func (okta OktaClient) UpdateUser(id string, attributes map[string]string) (*OktaUser, error) {
+
+	updateReq := UpdateUserRequest{Profile: attributes}
+	jsonBytes, err := json.Marshal(updateReq)
+	if err != nil {
+		return nil, err
+	}
+	req, _ := http.NewRequest(
+		"POST",
+		"https://"+okta.FQDN+"/api/v1/users/"+id,
+		bytes.NewBuffer(jsonBytes),
+	)
+	okta.setHeader(req)
+
+	client := okta.httpClient()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(
+			"Could not update user: http status %d: body %s ",
+			res.StatusCode,
+			body,
+		)
+	}
+	// 取得したjsonを構造体へデコード
+	oktaUser := OktaUser{}
+	if err := json.Unmarshal(body, &oktaUser); err != nil {
+		return nil, err
+	}
+
+	return &oktaUser, nil
+}
+
 // DeleteUser Delete User API
 func (okta OktaClient) DeleteUser(id string) error {
 
@@ -147,49 +199,108 @@ func (okta OktaClient) DeleteUser(id string) error {
 	req, _ := http.NewRequest("POST", "https://"+okta.FQDN+"/api/v1/users/"+id+"/lifecycle/deactivate", nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found user: http status %d: user id %s ", res.StatusCode, id)
+		slog.Warn("Not Found user", logAttrs(logOpOkta, logKeyOktaUserID, id, "status", res.StatusCode)...)
 		return nil
 	} else if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("Could not deactivate user :http status %d", res.StatusCode)
 	}
-	log.Printf("Deactivated user: %s", id)
+	slog.Info("Deactivated user", logAttrs(logOpOkta, logKeyOktaUserID, id)...)
 
 	// delete user
 	req, _ = http.NewRequest("DELETE", "https://"+okta.FQDN+"/api/v1/users/"+id, nil)
 	okta.setHeader(req)
 
-	client = new(http.Client)
+	client = okta.httpClient()
 	res, err = client.Do(req)
 	if err != nil {
 		return err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found user: http status %d: user id %s ", res.StatusCode, id)
+		slog.Warn("Not Found user", logAttrs(logOpOkta, logKeyOktaUserID, id, "status", res.StatusCode)...)
 		return nil
 	} else if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("Could not delete user : http status %d", res.StatusCode)
 	}
-	log.Printf("Deleted user: %s", id)
+	slog.Info("Deleted user", logAttrs(logOpOkta, logKeyOktaUserID, id)...)
+
+	return nil
+}
+
+// ActivateUser Activate User API (for DEPROVISIONED user, without sending email)
+func (okta OktaClient) ActivateUser(id string) error {
+	return okta.lifecycle(id, "activate", "?sendEmail=false")
+}
+
+// UnsuspendUser Unsuspend User API (for SUSPENDED user)
+func (okta OktaClient) UnsuspendUser(id string) error {
+	return okta.lifecycle(id, "unsuspend", "")
+}
+
+// call Lifecycle Operation API
+func (okta OktaClient) lifecycle(id, operation, query string) error {
+
+	req, _ := http.NewRequest("POST", "https://"+okta.FQDN+"/api/v1/users/"+id+"/lifecycle/"+operation+query, nil)
+	okta.setHeader(req)
+
+	client := okta.httpClient()
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Could not %s user :http status %d: user id %s", operation, res.StatusCode, id)
+	}
+	slog.Info("Lifecycle user", logAttrs(logOpOkta, logKeyOktaUserID, id, "lifecycle", operation)...)
 
 	return nil
 }
 
+// ListUserGroups Get Member Groups API
+func (okta OktaClient) ListUserGroups(id string) ([]OktaGroup, error) {
+
+	req, _ := http.NewRequest("GET", "https://"+okta.FQDN+"/api/v1/users/"+id+"/groups", nil)
+	okta.setHeader(req)
+
+	client := okta.httpClient()
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to get this url :http status %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	// 取得したjsonを構造体へデコード
+	var oktaGroups []OktaGroup
+	if err := json.Unmarshal(body, &oktaGroups); err != nil {
+		return nil, err
+	}
+
+	return oktaGroups, nil
+}
+
 // SearchGroups Search Groups API
 func (okta OktaClient) SearchGroups(name string) (*OktaGroup, error) {
 
-	req, _ := http.NewRequest("GET", "https://"+okta.FQDN+"/api/v1/groups?q="+name, nil)
+	req, _ := http.NewRequest("GET", "https://"+okta.FQDN+"/api/v1/groups?q="+url.QueryEscape(name), nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found Group: http status %d: Group is %s ", res.StatusCode, name)
+		slog.Warn("Not Found Group", logAttrs(logOpOkta, "group", name, "status", res.StatusCode)...)
 		return &OktaGroup{}, nil
 	} else if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("Unable to get this url :http status %d", res.StatusCode)
@@ -226,7 +337,7 @@ func (okta OktaClient) AddGroup(profile *GroupProfile) (*OktaGroup, error) {
 	}
 	req, _ := http.NewRequest("POST", "https://"+okta.FQDN+"/api/v1/groups", bytes.NewBuffer(jsonBytes))
 	okta.setHeader(req)
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -259,17 +370,17 @@ func (okta OktaClient) RemoveGroup(id string) error {
 	req, _ := http.NewRequest("DELETE", "https://"+okta.FQDN+"/api/v1/groups/"+id, nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found Group: http status %d: id %s ", res.StatusCode, id)
+		slog.Warn("Not Found Group", logAttrs(logOpOkta, "group_id", id, "status", res.StatusCode)...)
 		return nil
 	} else if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("Could not delete Group : http status %d", res.StatusCode)
 	}
-	log.Printf("Deleted Group: %s", id)
+	slog.Info("Deleted Group", logAttrs(logOpOkta, "group_id", id)...)
 
 	return nil
 }
@@ -280,16 +391,16 @@ func (okta OktaClient) AddUserToGroup(gid, uid string) error {
 	req, _ := http.NewRequest("PUT", "https://"+okta.FQDN+"/api/v1/groups/"+gid+"/users/"+uid, nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found Group or User: http status %d: gid=%s uid=%s", res.StatusCode, gid, uid)
+		slog.Warn("Not Found Group or User", logAttrs(logOpOkta, "group_id", gid, logKeyOktaUserID, uid, "status", res.StatusCode)...)
 	} else if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("Could not Add user to Group : http status %d", res.StatusCode)
 	}
-	log.Printf("Add User(%s) to Group(%s)", uid, gid)
+	slog.Info("Add User to Group", logAttrs(logOpOkta, "group_id", gid, logKeyOktaUserID, uid)...)
 
 	return nil
 }
@@ -300,20 +411,189 @@ func (okta OktaClient) RemoveUserFromGroup(gid, uid string) error {
 	req, _ := http.NewRequest("DELETE", "https://"+okta.FQDN+"/api/v1/groups/"+gid+"/users/"+uid, nil)
 	okta.setHeader(req)
 
-	client := new(http.Client)
+	client := okta.httpClient()
 	res, err := client.Do(req)
 	if err != nil {
 		return err
 	} else if res.StatusCode == http.StatusNotFound {
-		log.Printf("Not Found Group or User: http status %d: gid=%s uid=%s", res.StatusCode, gid, uid)
+		slog.Warn("Not Found Group or User", logAttrs(logOpOkta, "group_id", gid, logKeyOktaUserID, uid, "status", res.StatusCode)...)
 	} else if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("Could not Remove user to Group : http status %d", res.StatusCode)
 	}
-	log.Printf("Remove User(%s) to Group(%s)", uid, gid)
+	slog.Info("Remove User from Group", logAttrs(logOpOkta, "group_id", gid, logKeyOktaUserID, uid)...)
+
+	return nil
+}
+
+// ListUsers List Users API (all pages, with DEPROVISIONED users)
+func (okta OktaClient) ListUsers() ([]OktaUser, error) {
+
+	// filterなしの一覧にはDEPROVISIONEDのユーザーが含まれないので、statusで絞り込んだ一覧と合わせます
+	var oktaUsers []OktaUser
+	seen := make(map[string]bool)
+	deprovisioned := url.QueryEscape(`status eq "` + oktaStatusDeprovisioned + `"`)
+	for _, query := range []string{"limit=200", "filter=" + deprovisioned + "&limit=200"} {
+		err := okta.listPages("https://"+okta.FQDN+"/api/v1/users?"+query, func(body []byte) error {
+			var page []OktaUser
+			if err := json.Unmarshal(body, &page); err != nil {
+				return err
+			}
+			for _, user := range page {
+				if !seen[user.ID] {
+					seen[user.ID] = true
+					oktaUsers = append(oktaUsers, user)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return oktaUsers, nil
+}
+
+// ListGroups List Groups API (all pages)
+func (okta OktaClient) ListGroups() ([]OktaGroup, error) {
+
+	var oktaGroups []OktaGroup
+	err := okta.listPages("https://"+okta.FQDN+"/api/v1/groups?limit=200", func(body []byte) error {
+		var page []OktaGroup
+		if err := json.Unmarshal(body, &page); err != nil {
+			return err
+		}
+		oktaGroups = append(oktaGroups, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return oktaGroups, nil
+}
 
+// listPages call GET url and follow the next links, decode each page with fn
+func (okta OktaClient) listPages(url string, fn func(body []byte) error) error {
+	for url != "" {
+		req, _ := http.NewRequest("GET", url, nil)
+		okta.setHeader(req)
+
+		client := okta.httpClient()
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("Unable to get this url :http status %d", res.StatusCode)
+		}
+		// 取得したjsonを構造体へデコード
+		if err := fn(body); err != nil {
+			return err
+		}
+		url = nextLink(res.Header)
+	}
 	return nil
 }
 
+// nextLink return rel="next" url of Link header (pagination)
+func nextLink(header http.Header) string {
+	for _, link := range header["Link"] {
+		for _, part := range strings.Split(link, ",") {
+			segments := strings.Split(part, ";")
+			if len(segments) < 2 {
+				continue
+			}
+			for _, param := range segments[1:] {
+				if strings.TrimSpace(param) == `rel="next"` {
+					return strings.Trim(strings.TrimSpace(segments[0]), "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// return HTTPClient or default client
+func (okta OktaClient) httpClient() *http.Client {
+	if okta.HTTPClient != nil {
+		return okta.HTTPClient
+	}
+	return new(http.Client)
+}
+
+// Okta API rate limit
+const (
+	oktaRateLimitRetries = 5                // 429の場合に再試行する回数
+	oktaRateLimitMinWait = time.Second      // X-Rate-Limit-Resetがない、過ぎている場合に待つ時間
+	oktaRateLimitMaxWait = 90 * time.Second // 1回に待つ最大の時間（Oktaのレート制限は1分毎）
+)
+
+// RateLimitTransport 429（Too Many Requests）の場合にX-Rate-Limit-Resetの時刻まで待って再試行するRoundTripperを返します
+func RateLimitTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return rateLimitTransport{base: base, minWait: oktaRateLimitMinWait, maxWait: oktaRateLimitMaxWait}
+}
+
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	minWait time.Duration
+	maxWait time.Duration
+}
+
+// RoundTrip リクエストを送り、429の場合はoktaRateLimitRetries回まで再試行します
+func (t rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		res, err := t.base.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests || retry >= oktaRateLimitRetries {
+			return res, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return res, err // ボディを送り直せない
+		}
+		wait := t.wait(res.Header, retry)
+		res.Body.Close()
+		slog.Warn("okta rate limited, retry after the reset", logAttrs(logOpOkta,
+			"method", req.Method, "endpoint", oktaEndpoint(req.URL.Path), "wait", wait, "retry", retry+1)...)
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// wait X-Rate-Limit-Reset（UNIX時刻）までの時間。ない場合は再試行毎に倍にします
+func (t rateLimitTransport) wait(header http.Header, retry int) time.Duration {
+	wait := t.minWait << uint(retry)
+	if reset, err := strconv.ParseInt(header.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		if until := time.Until(time.Unix(reset, 0)) + t.minWait; until > wait {
+			wait = until
+		}
+	}
+	if wait > t.maxWait {
+		wait = t.maxWait
+	}
+	return wait
+}
+
 // set Common HTTP Header
 func (okta OktaClient) setHeader(req *http.Request) {
 	req.Header.Set("Accept", "application/json")
@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var tesUserProfile = UserProfile{
@@ -114,3 +121,108 @@ func TestOkataClientAll(t *testing.T) {
 	return
 
 }
+
+func TestListUsersPaging(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS test_apikey" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("filter") == `status eq "DEPROVISIONED"` {
+			fmt.Fprint(w, `[{"id":"00u_ddd","status":"DEPROVISIONED","profile":{"login":"ddd@example.com"}}]`)
+			return
+		}
+		switch r.URL.Query().Get("after") {
+		case "":
+			w.Header().Add("Link", fmt.Sprintf(`<%s/api/v1/users?limit=200>; rel="self"`, srv.URL))
+			w.Header().Add("Link", fmt.Sprintf(`<%s/api/v1/users?after=00u_bbb&limit=200>; rel="next"`, srv.URL))
+			fmt.Fprint(w, `[{"id":"00u_aaa","profile":{"login":"aaa@example.com"}},{"id":"00u_bbb","profile":{"login":"bbb@example.com"}}]`)
+		case "00u_bbb":
+			fmt.Fprint(w, `[{"id":"00u_ccc","profile":{"login":"ccc@example.com"}}]`)
+		}
+	}))
+	defer srv.Close()
+
+	oktaClient := OktaClient{
+		FQDN:       strings.TrimPrefix(srv.URL, "https://"),
+		APIKEY:     "test_apikey",
+		HTTPClient: srv.Client(),
+	}
+	users, err := oktaClient.ListUsers()
+	if err != nil {
+		t.Fatalf("ListUsers exec failed: %v", err)
+	}
+	if len(users) != 4 || users[2].ID != "00u_ccc" || users[2].Login != "ccc@example.com" {
+		t.Errorf("ListUsers paging wrong: %v", users)
+	}
+	// Pattern: [Deprovisioned] filterなしの一覧に含まれないDEPROVISIONEDのユーザーも取得する
+	if len(users) == 4 && (users[3].ID != "00u_ddd" || users[3].Status != oktaStatusDeprovisioned) {
+		t.Errorf("ListUsers deprovisioned user wrong: %v", users[3])
+	}
+}
+
+func TestGetUserWithLoginEscape(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Pattern: [Escape] loginの"/"、"?"はパスの区切り、クエリにしない
+		if r.URL.EscapedPath() != "/api/v1/users/a%2Fb%3Fc@example.com" || r.URL.RawQuery != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"id":"00u_aaa","profile":{"login":"a/b?c@example.com"}}`)
+	}))
+	defer srv.Close()
+
+	oktaClient := OktaClient{FQDN: strings.TrimPrefix(srv.URL, "https://"), APIKEY: "test_apikey", HTTPClient: srv.Client()}
+	user, err := oktaClient.GetUserWithLogin("a/b?c@example.com")
+	if err != nil || user.ID != "00u_aaa" {
+		t.Errorf("GetUserWithLogin escape wrong: %v, %v", user, err)
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var calls int
+	var bodies []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if calls <= 2 {
+			w.Header().Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Unix(), 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"id":"00u_aaa","profile":{"login":"aaa@example.com"}}`)
+	}))
+	defer srv.Close()
+
+	// Pattern: [Retry] 429はX-Rate-Limit-Resetまで待って同じボディで再試行する
+	transport := rateLimitTransport{base: srv.Client().Transport, minWait: time.Millisecond, maxWait: 10 * time.Millisecond}
+	oktaClient := OktaClient{FQDN: strings.TrimPrefix(srv.URL, "https://"), APIKEY: "test_apikey", HTTPClient: &http.Client{Transport: transport}}
+	user, err := oktaClient.UpdateUser("00u_aaa", map[string]string{"email": "aaa@example.com"})
+	if err != nil || user.ID != "00u_aaa" || calls != 3 {
+		t.Fatalf("RateLimitTransport [Retry]wrong: %v, %v, calls=%d", user, err, calls)
+	}
+	if bodies[0] == "" || bodies[2] != bodies[0] {
+		t.Errorf("RateLimitTransport [Retry]body not resent: %q", bodies)
+	}
+
+	// Pattern: [GiveUp] 再試行の回数を超えた場合は429を返す
+	calls = -100
+	if _, err := oktaClient.GetUserWithLogin("aaa@example.com"); err == nil {
+		t.Error("RateLimitTransport [GiveUp]error not returned")
+	}
+	if calls != -100+oktaRateLimitRetries+1 {
+		t.Errorf("RateLimitTransport [GiveUp]calls wrong: %d", calls+100)
+	}
+
+	// Pattern: [Wait] X-Rate-Limit-Resetまで待つ（最大maxWait）
+	header := http.Header{}
+	header.Set("X-Rate-Limit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	if wait := transport.wait(header, 0); wait != transport.maxWait {
+		t.Errorf("RateLimitTransport [Wait]wait wrong: %s", wait)
+	}
+	if wait := transport.wait(http.Header{}, 2); wait != 4*time.Millisecond {
+		t.Errorf("RateLimitTransport [Wait]backoff wrong: %s", wait)
+	}
+}
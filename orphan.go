@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// output formats
+const (
+	formatText = "text"
+	formatCSV  = "csv"
+	formatJSON = "json"
+)
+
+// last login buckets
+const (
+	lastLoginNever   = "never"
+	lastLoginOver90  = "over 90 days"
+	lastLoginOver30  = "30-90 days"
+	lastLoginRecent  = "within 30 days"
+	lastLoginDay     = 24 * time.Hour
+	lastLoginMonth   = 30 * lastLoginDay
+	lastLoginQuarter = 90 * lastLoginDay
+)
+
+// Orphan LDAPに対応するアカウントが存在しないOktaユーザー
+type Orphan struct {
+	ID          string    `json:"id"`
+	Login       string    `json:"login"`
+	Email       string    `json:"email"`
+	Status      string    `json:"status"`
+	Created     time.Time `json:"created"`
+	LastLogin   time.Time `json:"lastLogin"`
+	LastLoginAt string    `json:"lastLoginAt"` // 最終ログインの区分
+}
+
+// FindOrphans LDAPアカウント（状態ファイルの紐付けとkeysでの突き合わせ）に対応しないOktaユーザーを返します。
+// 結果はstatus、最終ログイン（古い順）で並べます。
+func FindOrphans(state State, accounts []Account, users []OktaUser, keys []string, now time.Time) ([]Orphan, error) {
+
+	// LDAPから消えたアカウントの紐付けは対象外にする
+	exists := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		exists[dnKey(account.Dn)] = true
+	}
+	linked := State{}
+	for _, data := range state {
+		if exists[dnKey(data.Dn)] {
+			linked = append(linked, data)
+		}
+	}
+
+	_, result, err := Adopt(linked, accounts, users, keys)
+	if err != nil {
+		return nil, err
+	}
+	orphans := []Orphan{}
+	for _, user := range result.UnmatchedUsers {
+		orphans = append(orphans, Orphan{
+			ID:          user.ID,
+			Login:       user.Login,
+			Email:       user.Email,
+			Status:      user.Status,
+			Created:     user.Created,
+			LastLogin:   user.LastLogin,
+			LastLoginAt: lastLoginBucket(user.LastLogin, now),
+		})
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		if orphans[i].Status != orphans[j].Status {
+			return orphans[i].Status < orphans[j].Status
+		}
+		if !orphans[i].LastLogin.Equal(orphans[j].LastLogin) {
+			return orphans[i].LastLogin.Before(orphans[j].LastLogin)
+		}
+		return orphans[i].Login < orphans[j].Login
+	})
+	return orphans, nil
+}
+
+// lastLoginBucket 最終ログイン日時を区分に変換します
+func lastLoginBucket(lastLogin, now time.Time) string {
+	switch {
+	case lastLogin.IsZero():
+		return lastLoginNever
+	case now.Sub(lastLogin) > lastLoginQuarter:
+		return lastLoginOver90
+	case now.Sub(lastLogin) > lastLoginMonth:
+		return lastLoginOver30
+	}
+	return lastLoginRecent
+}
+
+// WriteOrphans formatの形式で書き出します
+func WriteOrphans(w io.Writer, orphans []Orphan, format string) error {
+	switch format {
+	case formatJSON:
+		jsonBytes, err := json.MarshalIndent(orphans, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", jsonBytes)
+		return err
+
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"id", "login", "email", "status", "created", "lastLogin", "lastLoginAt"})
+		for _, orphan := range orphans {
+			writer.Write([]string{
+				orphan.ID,
+				orphan.Login,
+				orphan.Email,
+				orphan.Status,
+				formatTime(orphan.Created),
+				formatTime(orphan.LastLogin),
+				orphan.LastLoginAt,
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case formatText, "":
+		// statusと最終ログインの区分でまとめて出力
+		var status, bucket string
+		for _, orphan := range orphans {
+			if orphan.Status != status {
+				status, bucket = orphan.Status, ""
+				fmt.Fprintf(w, "[%s]\n", status)
+			}
+			if orphan.LastLoginAt != bucket {
+				bucket = orphan.LastLoginAt
+				fmt.Fprintf(w, "  last login %s:\n", bucket)
+			}
+			fmt.Fprintf(w, "    %s\t%s\t%s\n", orphan.ID, orphan.Login, formatTime(orphan.LastLogin))
+		}
+		_, err := fmt.Fprintf(w, "orphan okta users: %d\n", len(orphans))
+		return err
+	}
+	return fmt.Errorf("unknown format: %s", format)
+}
+
+// formatTime RFC3339形式（ゼロ値は空文字）
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
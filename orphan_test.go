@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	users := []OktaUser{
+		{ID: "00u_aaa", Status: "ACTIVE", UserProfile: UserProfile{Login: "aaa_user@example.com"}},
+		{ID: "00u_bbb", Status: "ACTIVE", UserProfile: UserProfile{Login: "bbb_renamed@example.com"}},
+		{ID: "00u_yyy", Status: "ACTIVE", LastLogin: now.Add(-100 * lastLoginDay), UserProfile: UserProfile{Login: "yyy@example.com"}},
+		{ID: "00u_xxx", Status: "ACTIVE", LastLogin: now.Add(-1 * lastLoginDay), UserProfile: UserProfile{Login: "xxx@example.com"}},
+		{ID: "00u_zzz", Status: "SUSPENDED", UserProfile: UserProfile{Login: "zzz@example.com"}},
+		{ID: "00u_ddd", Status: "ACTIVE", UserProfile: UserProfile{Login: "ddd_user@example.com"}},
+	}
+	// bbbはloginが変わっているが状態ファイルで紐付いている、dddは紐付いているがLDAPから削除済み
+	state := State{
+		{Account: testAccounts[1], OktaUserID: "00u_bbb"},
+		{Account: Account{Dn: "uid=ddd_user,dc=example,dc=com", Email: "ddd_user@example.com"}, OktaUserID: "00u_ddd"},
+	}
+
+	orphans, err := FindOrphans(state, testAccounts, users, []string{matchKeyLogin}, now)
+	if err != nil {
+		t.Fatalf("FindOrphans exec failed: %v", err)
+	}
+	expected := []struct {
+		id     string
+		bucket string
+	}{
+		{"00u_ddd", lastLoginNever},
+		{"00u_yyy", lastLoginOver90},
+		{"00u_xxx", lastLoginRecent},
+		{"00u_zzz", lastLoginNever},
+	}
+	if len(orphans) != len(expected) {
+		t.Fatalf("FindOrphans count wrong: %v", orphans)
+	}
+	for idx, data := range expected {
+		if orphans[idx].ID != data.id || orphans[idx].LastLoginAt != data.bucket {
+			t.Errorf("FindOrphans order or bucket wrong: %d: %v", idx, orphans[idx])
+		}
+	}
+
+	// CSV
+	var buf bytes.Buffer
+	if err := WriteOrphans(&buf, orphans, formatCSV); err != nil {
+		t.Fatalf("WriteOrphans [csv]exec failed: %v", err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("WriteOrphans [csv]invalid csv: %v", err)
+	}
+	if len(records) != len(orphans)+1 || records[2][0] != "00u_yyy" || records[2][3] != "ACTIVE" {
+		t.Errorf("WriteOrphans [csv]data wrong: %v", records)
+	}
+
+	// JSON
+	buf.Reset()
+	if err := WriteOrphans(&buf, orphans, formatJSON); err != nil {
+		t.Fatalf("WriteOrphans [json]exec failed: %v", err)
+	}
+	var decoded []Orphan
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != len(orphans) {
+		t.Errorf("WriteOrphans [json]data wrong: %v", err)
+	}
+
+	if err := WriteOrphans(&buf, orphans, "xml"); err == nil {
+		t.Error("WriteOrphans [xml]error not returned")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// table text, csv, jsonで出力する一覧
+type table struct {
+	header []string
+	rows   [][]string
+	value  interface{} // jsonで出力する値
+}
+
+// write formatの形式で書き出します（textはタブ区切りで桁を揃えます）
+func (t table) write(w io.Writer, format string) error {
+	switch format {
+	case formatJSON:
+		jsonBytes, err := json.MarshalIndent(t.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", jsonBytes)
+		return err
+
+	case formatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(t.header)
+		writer.WriteAll(t.rows)
+		return writer.Error()
+
+	case formatText, "":
+		writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		return writer.Flush()
+	}
+	return fmt.Errorf("unknown format: %s", format)
+}
+
+// WriteAccounts LDAPのアカウントを書き出します
+func WriteAccounts(w io.Writer, accounts []Account, format string) error {
+	t := table{header: []string{"dn", "uid", "email", "employeeNumber", "descriptions"}, value: accounts}
+	for _, account := range accounts {
+		t.rows = append(t.rows, []string{account.Dn, account.UID, account.Email, account.EmployeeNumber, strings.Join(account.Descriptions, ";")})
+	}
+	return t.write(w, format)
+}
+
+// WriteState 同期状態を書き出します
+func WriteState(w io.Writer, state State, format string) error {
+	t := table{header: []string{"dn", "email", "oktaUserId", "oktaGroupIds"}, value: state}
+	for _, data := range state {
+		t.rows = append(t.rows, []string{data.Dn, data.Email, data.OktaUserID, strings.Join(data.OktaGroupIDs, ";")})
+	}
+	return t.write(w, format)
+}
+
+// WriteUsers Oktaのユーザーを書き出します
+func WriteUsers(w io.Writer, users []OktaUser, format string) error {
+	t := table{header: []string{"id", "login", "email", "status", "created", "lastLogin"}, value: users}
+	for _, user := range users {
+		t.rows = append(t.rows, []string{user.ID, user.Login, user.Email, user.Status, formatTime(user.Created), formatTime(user.LastLogin)})
+	}
+	return t.write(w, format)
+}
+
+// WriteGroups Oktaのグループを書き出します
+func WriteGroups(w io.Writer, groups []OktaGroup, format string) error {
+	t := table{header: []string{"id", "name", "type", "description"}, value: groups}
+	for _, group := range groups {
+		description := ""
+		if group.Description != nil {
+			description = fmt.Sprint(group.Description)
+		}
+		t.rows = append(t.rows, []string{group.ID, group.Name, group.Type, description})
+	}
+	return t.write(w, format)
+}
+
+// WriteDiff 差分を1項目1行で書き出します（CREATE、DELETEは項目なしの1行）
+func WriteDiff(w io.Writer, diff DiffResult, format string) error {
+	t := table{header: []string{"operation", "dn", "field", "old", "new"}, value: diff}
+	for _, key := range []string{CreateKey, UpdateKey, DeleteKey} {
+		for _, data := range diff[key] {
+			if len(data.Changes) == 0 {
+				t.rows = append(t.rows, []string{key, data.Dn, "", "", ""})
+			}
+			for _, change := range data.Changes {
+				t.rows = append(t.rows, []string{key, data.Dn, change.Field, change.Old, change.New})
+			}
+		}
+	}
+	return t.write(w, format)
+}
+
+// createOutput outputのファイルを作成します（空の場合は標準出力）
+func createOutput(output string) (io.WriteCloser, error) {
+	if output == "" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(output)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Plan planで保存し、applyで反映する差分
+type Plan struct {
+	CreatedAt time.Time `json:"createdAt"`
+	// StateChecksum plan作成時の状態のチェックサム。applyまでに状態が変わっていたら反映しません
+	StateChecksum string     `json:"stateChecksum"`
+	Diff          DiffResult `json:"diff,omitempty"`
+	// Sealed 状態の暗号化キーを指定した場合に暗号化したDiff（LDAPの値を平文で残さないため）
+	Sealed []byte `json:"sealed,omitempty"`
+	KeyID  string `json:"keyId,omitempty"`
+	// Watermark applyで反映した後に保存するLDAPの差分取得の位置
+	Watermark *Watermark `json:"watermark,omitempty"`
+	// LdapCount plan作成時にLDAPから取得したアカウントの件数（同期履歴とメトリクス用）
+	LdapCount int `json:"ldapCount,omitempty"`
+}
+
+// NewPlan 現在の状態とdiffからPlanを作ります
+func NewPlan(state State, diff DiffResult) (Plan, error) {
+	sum, err := stateChecksum(state)
+	if err != nil {
+		return Plan{}, err
+	}
+	return Plan{CreatedAt: time.Now().UTC(), StateChecksum: sum, Diff: diff}, nil
+}
+
+// planAAD planファイルの暗号化の付加データ
+var planAAD = []byte("perman-okta plan")
+
+// LoadPlan planファイルを読み込みます（暗号化されている場合はkeyで復号します）
+func LoadPlan(fileNm string, key *StateKey) (Plan, error) {
+	var plan Plan
+	data, err := ioutil.ReadFile(fileNm)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(data, &plan); err != nil || plan.StateChecksum == "" {
+		return plan, fmt.Errorf("invalid plan file %s", fileNm)
+	}
+	if plan.Sealed == nil {
+		return plan, nil
+	}
+	if key == nil || key.ID != plan.KeyID {
+		return plan, fmt.Errorf("plan file %s is encrypted (keyId %s), set the state key to STATE_KEY or STATE_KEY_FILE", fileNm, plan.KeyID)
+	}
+	diff, err := key.Open(plan.Sealed, planAAD)
+	if err != nil {
+		return plan, fmt.Errorf("invalid plan file %s: %v", fileNm, err)
+	}
+	if err := json.Unmarshal(diff, &plan.Diff); err != nil {
+		return plan, fmt.Errorf("invalid plan file %s: %v", fileNm, err)
+	}
+	plan.Sealed, plan.KeyID = nil, ""
+	return plan, nil
+}
+
+// Save planファイルに書き出します（LDAPの値を含むので0600、keyを指定した場合はDiffを暗号化します）
+func (p Plan) Save(fileNm string, key *StateKey) error {
+	if key != nil {
+		diff, err := json.Marshal(p.Diff)
+		if err != nil {
+			return err
+		}
+		if p.Sealed, err = key.Seal(diff, planAAD); err != nil {
+			return err
+		}
+		p.KeyID, p.Diff = key.ID, nil
+	}
+	jsonBytes, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(fileNm, jsonBytes, 0600)
+}
+
+// Check plan作成時から状態が変わっていないことを確認します
+func (p Plan) Check(state State) error {
+	sum, err := stateChecksum(state)
+	if err != nil {
+		return err
+	}
+	if sum != p.StateChecksum {
+		return errors.New("state has changed since the plan was created, run plan again")
+	}
+	return nil
+}
+
+// Counts CREATE、UPDATE、DELETEの件数
+func (p Plan) Counts() (creates, updates, deletes int) {
+	return len(p.Diff[CreateKey]), len(p.Diff[UpdateKey]), len(p.Diff[DeleteKey])
+}
+
+func stateChecksum(state State) (string, error) {
+	if state == nil {
+		state = State{}
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	return checksum(data), nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// report formats（csvはformatCSV）
+const (
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// reportExtensions 自動で書き出すレポートのファイルの拡張子
+var reportExtensions = map[string]string{formatMarkdown: ".md", formatHTML: ".html", formatCSV: ".csv"}
+
+// report account statuses（ReportAccount.Status）
+const (
+	reportCreated   = "created"
+	reportUpdated   = "updated"
+	reportSuspended = "suspended"
+	reportDeleted   = "deleted"
+	reportSkipped   = "skipped" // Oktaを更新しなかった（削除するユーザーが既にいないなど）
+	reportFailed    = "failed"
+)
+
+// reportStatuses レポートに出力する順番
+var reportStatuses = []string{reportCreated, reportUpdated, reportSuspended, reportDeleted, reportSkipped, reportFailed}
+
+// RunReport 同期履歴の1回分の実行のまとめ（変更管理の記録に添付するレポート）
+type RunReport struct {
+	RunID      string          `json:"runId"`
+	Command    string          `json:"command"`
+	Operator   string          `json:"operator,omitempty"`
+	Host       string          `json:"host,omitempty"`
+	StartedAt  time.Time       `json:"startedAt"`
+	FinishedAt time.Time       `json:"finishedAt,omitempty"` // 途中で終了した場合は空
+	Inputs     *JournalInputs  `json:"inputs,omitempty"`
+	Error      string          `json:"error,omitempty"` // 実行を中断したエラー
+	Counts     map[string]int  `json:"counts"`          // statusごとのアカウント数
+	Accounts   []ReportAccount `json:"accounts"`
+	Groups     []ReportGroup   `json:"groups"`
+}
+
+// ReportAccount アカウント毎の反映結果
+type ReportAccount struct {
+	Status     string        `json:"status"`
+	Operation  string        `json:"operation"`
+	Dn         string        `json:"dn"`
+	OktaUserID string        `json:"oktaUserId,omitempty"`
+	Changes    []FieldChange `json:"changes,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// ReportGroup グループのメンバーの変更
+type ReportGroup struct {
+	Action     string `json:"action"` // added, removed
+	GroupID    string `json:"groupId"`
+	OktaUserID string `json:"oktaUserId"`
+	Dn         string `json:"dn,omitempty"`
+}
+
+// NewRunReport 1回分の実行の同期履歴（ReadJournalの実行IDで絞り込んだ結果）からレポートを作ります。
+// Oktaの更新リクエストは、その後に記録されたアカウントの反映結果のものとして扱います。
+func NewRunReport(entries []JournalEntry) (*RunReport, error) {
+	report := &RunReport{Counts: map[string]int{}}
+	var pending []JournalEntry // アカウントの反映結果が記録される前のOktaの更新リクエスト
+	for _, entry := range entries {
+		switch entry.Type {
+		case journalRunStart:
+			report.RunID = entry.RunID
+			report.Command = entry.Command
+			report.Operator = entry.Operator
+			report.Host = entry.Host
+			report.StartedAt = entry.Time
+			report.Inputs = entry.Inputs
+		case journalRunEnd:
+			report.FinishedAt = entry.Time
+			if entry.Result != nil {
+				report.Error = entry.Result.Error
+			}
+		case journalOkta:
+			pending = append(pending, entry)
+		case journalAccount:
+			report.addAccount(entry, pending)
+			pending = nil
+		}
+	}
+	if report.RunID == "" {
+		return nil, fmt.Errorf("run not found in the journal")
+	}
+	report.addGroups("", pending)
+	return report, nil
+}
+
+func (r *RunReport) addAccount(entry JournalEntry, requests []JournalEntry) {
+	account := ReportAccount{Operation: entry.Operation, Dn: entry.Dn, OktaUserID: entry.OktaUserID, Changes: entry.Changes, Error: entry.Error}
+	mutated, suspended := false, false
+	for _, request := range requests {
+		if request.Status/100 == 2 {
+			mutated = true
+			suspended = suspended || strings.HasSuffix(request.Path, "/lifecycle/suspend")
+		}
+	}
+	switch {
+	case entry.Error != "":
+		account.Status = reportFailed
+	case !mutated:
+		account.Status = reportSkipped
+	case suspended:
+		account.Status = reportSuspended
+	case entry.Operation == CreateKey:
+		account.Status = reportCreated
+	case entry.Operation == DeleteKey:
+		account.Status = reportDeleted
+	default:
+		account.Status = reportUpdated
+	}
+	r.Counts[account.Status]++
+	r.Accounts = append(r.Accounts, account)
+	r.addGroups(entry.Dn, requests)
+}
+
+// addGroups 成功したグループのメンバーの変更（PUT、DELETE /api/v1/groups/{gid}/users/{uid}）
+func (r *RunReport) addGroups(dn string, requests []JournalEntry) {
+	for _, request := range requests {
+		path := strings.Split(strings.TrimPrefix(request.Path, "/api/v1/"), "/")
+		if request.Status/100 != 2 || len(path) != 4 || path[0] != "groups" || path[2] != "users" {
+			continue
+		}
+		group := ReportGroup{GroupID: path[1], OktaUserID: path[3], Dn: dn}
+		switch request.Method {
+		case "PUT":
+			group.Action = "added"
+		case "DELETE":
+			group.Action = "removed"
+		default:
+			continue
+		}
+		r.Groups = append(r.Groups, group)
+	}
+}
+
+// Result 実行の結果（ok、partial、failed、running）
+func (r *RunReport) Result() string {
+	switch {
+	case r.Error != "":
+		return runFailed
+	case r.FinishedAt.IsZero():
+		return runRunning
+	case r.Counts[reportFailed] > 0:
+		return runPartial
+	}
+	return runOK
+}
+
+// WriteReport レポートをformat（markdown、html、csv）で書き出します
+func WriteReport(w io.Writer, report *RunReport, format string) error {
+	switch format {
+	case formatMarkdown:
+		return writeReportMarkdown(w, report)
+	case formatHTML:
+		return reportTemplate.Execute(w, report)
+	case formatCSV:
+		return writeReportCSV(w, report)
+	}
+	return fmt.Errorf("unknown report format: %s (markdown, html, csv)", format)
+}
+
+func writeReportMarkdown(w io.Writer, r *RunReport) error {
+	cell := func(value string) string {
+		return strings.NewReplacer("|", `\|`, "\n", " ").Replace(value)
+	}
+	fmt.Fprintf(w, "# perman-okta run %s\n\n", r.RunID)
+	fmt.Fprintf(w, "| | |\n| --- | --- |\n")
+	fmt.Fprintf(w, "| command | %s |\n| result | %s |\n| operator | %s |\n| host | %s |\n", cell(r.Command), r.Result(), cell(r.Operator), cell(r.Host))
+	fmt.Fprintf(w, "| started | %s |\n| finished | %s |\n", formatTime(r.StartedAt), formatTime(r.FinishedAt))
+	if r.Inputs != nil {
+		fmt.Fprintf(w, "| ldap accounts | %d |\n| state accounts | %d |\n", r.Inputs.LdapCount, r.Inputs.StateCount)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "| error | %s |\n", cell(r.Error))
+	}
+
+	fmt.Fprintf(w, "\n## summary\n\n| %s | groups |\n|%s --- |\n", strings.Join(reportStatuses, " | "), strings.Repeat(" --- |", len(reportStatuses)))
+	for _, status := range reportStatuses {
+		fmt.Fprintf(w, "| %d ", r.Counts[status])
+	}
+	fmt.Fprintf(w, "| %d |\n", len(r.Groups))
+
+	for _, status := range reportStatuses {
+		if r.Counts[status] == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n## %s\n\n| dn | okta user | details |\n| --- | --- | --- |\n", status)
+		for _, account := range r.Accounts {
+			if account.Status != status {
+				continue
+			}
+			details := account.Error
+			if details == "" {
+				var changes []string
+				for _, change := range account.Changes {
+					changes = append(changes, fmt.Sprintf("%s: %q → %q", change.Field, change.Old, change.New))
+				}
+				details = strings.Join(changes, "<br>")
+			}
+			fmt.Fprintf(w, "| %s | %s | %s |\n", cell(account.Dn), account.OktaUserID, cell(details))
+		}
+	}
+	if len(r.Groups) > 0 {
+		fmt.Fprintf(w, "\n## group memberships\n\n| action | group | okta user | dn |\n| --- | --- | --- | --- |\n")
+		for _, group := range r.Groups {
+			fmt.Fprintf(w, "| %s | %s | %s | %s |\n", group.Action, group.GroupID, group.OktaUserID, cell(group.Dn))
+		}
+	}
+	return nil
+}
+
+// writeReportCSV アカウントは項目の変更毎、グループはメンバーの変更毎に1行
+func writeReportCSV(w io.Writer, r *RunReport) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"runId", "type", "status", "dn", "oktaUserId", "field", "old", "new", "groupId", "error"})
+	for _, account := range r.Accounts {
+		if len(account.Changes) == 0 {
+			writer.Write([]string{r.RunID, "account", account.Status, account.Dn, account.OktaUserID, "", "", "", "", account.Error})
+		}
+		for _, change := range account.Changes {
+			writer.Write([]string{r.RunID, "account", account.Status, account.Dn, account.OktaUserID, change.Field, change.Old, change.New, "", account.Error})
+		}
+	}
+	for _, group := range r.Groups {
+		writer.Write([]string{r.RunID, "group", group.Action, group.Dn, group.OktaUserID, "", "", "", group.GroupID, ""})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"time":     formatTime,
+	"statuses": func() []string { return reportStatuses },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>perman-okta run {{.RunID}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>perman-okta run {{.RunID}}</h1>
+<table>
+<tr><th>command</th><td>{{.Command}}</td></tr>
+<tr><th>result</th><td>{{.Result}}</td></tr>
+<tr><th>operator</th><td>{{.Operator}}</td></tr>
+<tr><th>host</th><td>{{.Host}}</td></tr>
+<tr><th>started</th><td>{{time .StartedAt}}</td></tr>
+<tr><th>finished</th><td>{{time .FinishedAt}}</td></tr>
+{{- with .Inputs}}
+<tr><th>ldap accounts</th><td>{{.LdapCount}}</td></tr>
+<tr><th>state accounts</th><td>{{.StateCount}}</td></tr>
+{{- end}}
+{{- if .Error}}
+<tr><th>error</th><td class="failed">{{.Error}}</td></tr>
+{{- end}}
+</table>
+<h2>summary</h2>
+<table>
+<tr>{{range statuses}}<th>{{.}}</th>{{end}}<th>groups</th></tr>
+<tr>{{range statuses}}<td>{{index $.Counts .}}</td>{{end}}<td>{{len .Groups}}</td></tr>
+</table>
+{{- range $status := statuses}}
+{{- if index $.Counts $status}}
+<h2>{{$status}}</h2>
+<table>
+<tr><th>dn</th><th>okta user</th><th>details</th></tr>
+{{- range $.Accounts}}{{if eq .Status $status}}
+<tr><td>{{.Dn}}</td><td>{{.OktaUserID}}</td><td{{if .Error}} class="failed"{{end}}>{{if .Error}}{{.Error}}{{else}}{{range .Changes}}{{.Field}}: {{printf "%q" .Old}} → {{printf "%q" .New}}<br>{{end}}{{end}}</td></tr>
+{{- end}}{{end}}
+</table>
+{{- end}}
+{{- end}}
+{{- if .Groups}}
+<h2>group memberships</h2>
+<table>
+<tr><th>action</th><th>group</th><th>okta user</th><th>dn</th></tr>
+{{- range .Groups}}
+<tr><td>{{.Action}}</td><td>{{.GroupID}}</td><td>{{.OktaUserID}}</td><td>{{.Dn}}</td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+// loadRunReport 同期履歴ファイルから実行のレポートを作ります
+func loadRunReport(path, runID string, key *StateKey) (*RunReport, error) {
+	entries, err := ReadJournal(path, runID)
+	if err != nil {
+		return nil, err
+	}
+	return NewRunReport(UnsealJournal(entries, key))
+}
+
+// writeReports report.dirに実行のレポートをreport.formatsの形式で書き出します（<dir>/<実行ID>.md など）
+func writeReports(cfg ReportConfig, report *RunReport) error {
+	if cfg.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return err
+	}
+	for _, format := range cfg.FormatList() {
+		path := filepath.Join(cfg.Dir, report.RunID+reportExtensions[format])
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		err = WriteReport(file, report, format)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("report %s: %v", path, err)
+		}
+		slog.Debug("report written", logAttrs(logOpRun, "path", path)...)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testReportEntries 作成2件（1件失敗）、更新1件、削除1件、削除するユーザーが既にいない1件の実行
+func testReportEntries() []JournalEntry {
+	now := time.Date(2026, 10, 19, 10, 15, 0, 0, time.UTC)
+	return []JournalEntry{
+		{Time: now, RunID: "run1", Type: journalRunStart, Command: "sync", Operator: "admin", Inputs: &JournalInputs{LdapCount: 3, StateCount: 2}},
+		{RunID: "run1", Type: journalOkta, Method: "POST", Path: "/api/v1/users", Status: 200},
+		{RunID: "run1", Type: journalOkta, Method: "PUT", Path: "/api/v1/groups/00g_everyone/users/00u_aaa", Status: 204},
+		{RunID: "run1", Type: journalAccount, Operation: CreateKey, Dn: "uid=aaa,dc=example,dc=com", OktaUserID: "00u_aaa"},
+		{RunID: "run1", Type: journalOkta, Method: "POST", Path: "/api/v1/users", Status: 400},
+		{RunID: "run1", Type: journalAccount, Operation: CreateKey, Dn: "uid=b|b,dc=example,dc=com", Error: "Could not create user: http status 400"},
+		{RunID: "run1", Type: journalOkta, Method: "POST", Path: "/api/v1/users/00u_ccc", Status: 200},
+		{RunID: "run1", Type: journalAccount, Operation: UpdateKey, Dn: "uid=ccc,dc=example,dc=com", OktaUserID: "00u_ccc",
+			Changes: []FieldChange{{Field: fieldEmail, Old: "ccc@example.com", New: "<ccc>@example.com"}}},
+		{RunID: "run1", Type: journalOkta, Method: "POST", Path: "/api/v1/users/00u_ddd/lifecycle/deactivate", Status: 200},
+		{RunID: "run1", Type: journalOkta, Method: "DELETE", Path: "/api/v1/users/00u_ddd", Status: 204},
+		{RunID: "run1", Type: journalAccount, Operation: DeleteKey, Dn: "uid=ddd,dc=example,dc=com", OktaUserID: "00u_ddd"},
+		{RunID: "run1", Type: journalAccount, Operation: DeleteKey, Dn: "uid=eee,dc=example,dc=com"},
+		{Time: now.Add(time.Minute), RunID: "run1", Type: journalRunEnd, Result: &JournalResult{Failures: 1}},
+	}
+}
+
+func TestNewRunReport(t *testing.T) {
+	report, err := NewRunReport(testReportEntries())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{reportCreated: 1, reportFailed: 1, reportUpdated: 1, reportDeleted: 1, reportSkipped: 1}
+	for _, status := range reportStatuses {
+		if report.Counts[status] != want[status] {
+			t.Errorf("NewRunReport counts wrong: %v", report.Counts)
+			break
+		}
+	}
+	if len(report.Groups) != 1 || report.Groups[0].Action != "added" || report.Groups[0].Dn != "uid=aaa,dc=example,dc=com" {
+		t.Errorf("NewRunReport groups wrong: %v", report.Groups)
+	}
+	if report.Result() != runPartial || report.Command != "sync" || report.FinishedAt.IsZero() {
+		t.Errorf("NewRunReport run wrong: %s %+v", report.Result(), report)
+	}
+
+	// Pattern: [NotFound]
+	if _, err := NewRunReport(nil); err == nil {
+		t.Errorf("NewRunReport [NotFound]no error")
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	report, _ := NewRunReport(testReportEntries())
+
+	// Pattern: [Markdown] 表の区切り文字はエスケープする
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, report, formatMarkdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# perman-okta run run1", "| result | partial |", "## failed", `uid=b\|b,dc=example,dc=com`, `email: "ccc@example.com" → "<ccc>@example.com"`, "| added | 00g_everyone | 00u_aaa |"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WriteReport [Markdown]%q not found:\n%s", want, buf.String())
+		}
+	}
+
+	// Pattern: [HTML] 値はエスケープする
+	buf.Reset()
+	if err := WriteReport(&buf, report, formatHTML); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "&lt;ccc&gt;@example.com") || strings.Contains(buf.String(), "<ccc>") || !strings.Contains(buf.String(), "<h2>skipped</h2>") {
+		t.Errorf("WriteReport [HTML]wrong:\n%s", buf.String())
+	}
+
+	// Pattern: [CSV] アカウントは項目の変更毎、グループはメンバーの変更毎に1行
+	buf.Reset()
+	if err := WriteReport(&buf, report, formatCSV); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 7 || records[3][2] != reportUpdated || records[3][5] != fieldEmail || records[6][1] != "group" {
+		t.Errorf("WriteReport [CSV]records wrong: %v", records)
+	}
+
+	if err := WriteReport(&buf, report, "pdf"); err == nil {
+		t.Errorf("WriteReport unknown format no error")
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := DefaultConfig()
+	cfg.Journal.Path = filepath.Join(dir, "journal.jsonl")
+	journal, err := OpenJournal(cfg.Journal.Path, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range testReportEntries() {
+		journal.Record(entry)
+	}
+	journal.Close()
+
+	report, err := loadRunReport(cfg.Journal.Path, "run1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pattern: [Disabled] report.dirがない場合は書き出さない
+	if err := writeReports(cfg.Report, report); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Report = ReportConfig{Dir: filepath.Join(dir, "reports"), Formats: []string{formatMarkdown, formatHTML}}
+	if err := writeReports(cfg.Report, report); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"run1.md", "run1.html"} {
+		if _, err := os.Stat(filepath.Join(cfg.Report.Dir, name)); err != nil {
+			t.Errorf("writeReports %s not written: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// rollback actions
+const (
+	rollbackDeleteUser     = "delete user"     // 作成したユーザーを削除
+	rollbackRestoreProfile = "restore profile" // 更新前のprofileに戻す
+	rollbackRestoreUser    = "restore user"    // 削除したユーザーを再有効化、または作り直す
+	rollbackAddGroup       = "add group"       // 外したグループに追加し直す
+)
+
+// RollbackAction 実行を取り消すための補償操作
+type RollbackAction struct {
+	Action     string
+	Dn         string
+	OktaUserID string
+	Previous   *AccountState     // 戻す状態（restore profile, restore user）
+	Attributes map[string]string // 戻すprofile属性（restore profile）
+	GroupID    string            // add group
+}
+
+func (a RollbackAction) String() string {
+	switch a.Action {
+	case rollbackRestoreProfile:
+		var fields []string
+		for field, value := range a.Attributes {
+			fields = append(fields, fmt.Sprintf("%s=%q", field, value))
+		}
+		sort.Strings(fields)
+		return fmt.Sprintf("[%s]%s: okta user %s %s", a.Action, a.Dn, a.OktaUserID, strings.Join(fields, " "))
+	case rollbackAddGroup:
+		return fmt.Sprintf("[%s]okta user %s to group %s", a.Action, a.OktaUserID, a.GroupID)
+	}
+	return fmt.Sprintf("[%s]%s: okta user %s", a.Action, a.Dn, a.OktaUserID)
+}
+
+// logAttrs ログの項目
+func (a RollbackAction) logAttrs() []any {
+	if a.Previous != nil {
+		return append(accountLogAttrs(logOpRollback, a.Previous.Account), logKeyOktaUserID, a.OktaUserID)
+	}
+	return logAttrs(logOpRollback, logKeyDn, a.Dn, logKeyOktaUserID, a.OktaUserID)
+}
+
+// PlanRollback 同期履歴の1回分の実行（entries）を取り消す補償操作を、実行と逆の順番で返します。
+// 成功したアカウント（作成後のグループへの追加だけが失敗したアカウントを含む）とOktaの更新だけが対象で、
+// stateは現在の状態です（profileの差分の計算に使います）。
+func PlanRollback(entries []JournalEntry, state State) ([]RollbackAction, error) {
+	started := false
+	for _, entry := range entries {
+		if entry.Type == journalRunStart {
+			started = true
+		}
+	}
+	if !started {
+		return nil, fmt.Errorf("run not found in the journal")
+	}
+
+	index := state.Index()
+	var actions []RollbackAction
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		switch {
+		case entry.Type == journalAccount && (entry.Error == "" || entry.Operation == CreateKey):
+			action, ok := planAccountRollback(entry, index)
+			if ok {
+				actions = append(actions, action)
+			}
+		case entry.Type == journalOkta && entry.Method == "DELETE" && entry.Status/100 == 2:
+			// DELETE /api/v1/groups/{gid}/users/{uid}
+			path := strings.Split(strings.TrimPrefix(entry.Path, "/api/v1/"), "/")
+			if len(path) == 4 && path[0] == "groups" && path[2] == "users" {
+				actions = append(actions, RollbackAction{Action: rollbackAddGroup, GroupID: path[1], OktaUserID: path[3]})
+			}
+		}
+	}
+	return actions, nil
+}
+
+func planAccountRollback(entry JournalEntry, index map[string]AccountState) (RollbackAction, bool) {
+	action := RollbackAction{Dn: entry.Dn, OktaUserID: entry.OktaUserID, Previous: entry.Previous}
+	switch entry.Operation {
+	case CreateKey:
+		if entry.OktaUserID == "" {
+			return action, false
+		}
+		action.Action = rollbackDeleteUser
+		// 作成後の状態（取り消しを更に取り消す場合に使う）
+		if data, ok := index[dnKey(entry.Dn)]; ok && data.OktaUserID == entry.OktaUserID {
+			action.Previous = &data
+		}
+	case UpdateKey:
+		if entry.Previous == nil {
+			return action, false
+		}
+		// 現在の状態から更新前の値に戻す（既に戻っている項目は除く）
+		current := AccountState{}
+		if data, ok := index[dnKey(entry.Dn)]; ok {
+			current = data
+		}
+		action.Action = rollbackRestoreProfile
+		action.Attributes = make(map[string]string)
+		for _, change := range profileChanges(current.OktaProfile(), entry.Previous.OktaProfile()) {
+			action.Attributes[change.Field] = change.New
+		}
+		if len(action.Attributes) == 0 {
+			return action, false
+		}
+	case DeleteKey:
+		if entry.Previous == nil {
+			return action, false
+		}
+		action.Action = rollbackRestoreUser
+	default:
+		return action, false
+	}
+	return action, true
+}
+
+// Rollbacker 補償操作をOktaへ反映します
+type Rollbacker struct {
+	Okta    OktaClient
+	Store   StateStore // nilの場合は状態を更新しない
+	Journal *Journal   // 補償操作も通常の同期と同じ形式で記録します
+}
+
+// Apply 補償操作を順番に反映します。失敗した操作はSyncErrorとして返して続行します
+func (r Rollbacker) Apply(actions []RollbackAction) ([]SyncError, error) {
+	var failures []SyncError
+	for _, action := range actions {
+		previous, err := r.previous(action)
+		if err != nil {
+			return failures, err
+		}
+		operation, result, err := r.apply(action)
+		entry := JournalEntry{
+			Type:       journalAccount,
+			Operation:  operation,
+			Dn:         action.Dn,
+			OktaUserID: result.OktaUserID,
+		}
+		if operation != CreateKey {
+			entry.Previous = previous
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if action.Action != rollbackAddGroup {
+			if jerr := r.Journal.Record(entry); jerr != nil {
+				return failures, jerr
+			}
+		}
+		if err != nil {
+			failures = append(failures, SyncError{Key: action.Action, Dn: action.Dn, Err: err})
+			continue
+		}
+		if err := r.commit(operation, action.Dn, result); err != nil {
+			return failures, err
+		}
+		slog.Info("rolled back", append(action.logAttrs(), "action", action.String())...)
+	}
+	return failures, nil
+}
+
+// previous 補償操作を反映する前の状態（同期履歴に記録し、取り消しを更に取り消す場合に使います）。
+// Storeがない場合は作成後の状態（PlanRollbackで設定したもの）だけ返します
+func (r Rollbacker) previous(action RollbackAction) (*AccountState, error) {
+	if r.Store == nil {
+		if action.Action == rollbackDeleteUser {
+			return action.Previous, nil
+		}
+		return nil, nil
+	}
+	if action.Dn == "" {
+		return nil, nil
+	}
+	data, ok, err := r.Store.Get(action.Dn)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// apply 補償操作を反映し、同期と同じ操作名と反映後の状態を返します
+func (r Rollbacker) apply(action RollbackAction) (string, AccountState, error) {
+	switch action.Action {
+	case rollbackDeleteUser:
+		return DeleteKey, AccountState{OktaUserID: action.OktaUserID}, r.Okta.DeleteUser(action.OktaUserID)
+
+	case rollbackRestoreProfile:
+		result := *action.Previous
+		result.OktaUserID = action.OktaUserID
+		if _, err := r.Okta.UpdateUser(action.OktaUserID, action.Attributes); err != nil {
+			return UpdateKey, result, err
+		}
+		result.ProfileHash = result.OktaProfile().Hash()
+		return UpdateKey, result, nil
+
+	case rollbackRestoreUser:
+		result := *action.Previous
+		user := &OktaUser{}
+		if action.Previous.OktaUserID != "" {
+			var err error
+			if user, err = r.Okta.GetUserWithLogin(action.Previous.OktaUserID); err != nil {
+				return CreateKey, result, err
+			}
+		}
+		switch {
+		case user.ID == "":
+			// 削除済みなので作り直す
+			var err error
+			if user, err = r.Okta.CreateUser(action.Previous.OktaProfile()); err != nil {
+				return CreateKey, result, err
+			}
+		case user.Status == oktaStatusDeprovisioned:
+			if err := r.Okta.ActivateUser(user.ID); err != nil {
+				return CreateKey, result, err
+			}
+		}
+		result.OktaUserID = user.ID
+		for _, gid := range action.Previous.OktaGroupIDs {
+			if err := r.Okta.AddUserToGroup(gid, user.ID); err != nil {
+				return CreateKey, result, err
+			}
+		}
+		result.ProfileHash = result.OktaProfile().Hash()
+		return CreateKey, result, nil
+
+	case rollbackAddGroup:
+		return "", AccountState{OktaUserID: action.OktaUserID}, r.Okta.AddUserToGroup(action.GroupID, action.OktaUserID)
+	}
+	return "", AccountState{}, fmt.Errorf("unknown rollback action: %s", action.Action)
+}
+
+// commit 補償操作の結果を状態に反映します
+func (r Rollbacker) commit(operation, dn string, result AccountState) error {
+	if r.Store == nil {
+		return nil
+	}
+	switch operation {
+	case DeleteKey:
+		return r.Store.Delete(dn)
+	case UpdateKey, CreateKey:
+		return r.Store.Upsert(result)
+	}
+	return nil
+}
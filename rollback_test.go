@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal.jsonl")
+	store := &JSONStateStore{File: StateFile{Path: filepath.Join(dir, "state.json")}}
+
+	okta := newFakeOkta()
+	srv, oktaClient := okta.start()
+	defer srv.Close()
+	run := func(runID string, apply func(journal *Journal, client OktaClient)) {
+		journal, err := OpenJournal(path, runID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer journal.Close()
+		client := oktaClient
+		client.HTTPClient = &http.Client{Transport: journal.Transport(srv.Client().Transport)}
+		journal.Record(JournalEntry{Type: journalRunStart})
+		apply(journal, client)
+	}
+
+	// run1: 3件作成、run2: 1件更新、1件削除
+	run("run1", func(journal *Journal, client OktaClient) {
+		diff, _ := DefaultMapping().Diff(&[]Account{}, &testAccounts)
+		if _, _, err := (Syncer{Okta: client, Groups: []string{"everyone"}, Store: store, Journal: journal}).Apply(State{}, diff); err != nil {
+			t.Fatal(err)
+		}
+	})
+	newAccounts := []Account{testAccounts[0], testAccounts[1]}
+	newAccounts[0].Email = "aaa_new@example.com"
+	run("run2", func(journal *Journal, client OktaClient) {
+		state, _ := store.List()
+		diff, _ := DefaultMapping().Diff(state.Accounts(), &newAccounts)
+		if _, _, err := (Syncer{Okta: client, Groups: []string{"everyone"}, Store: store, Journal: journal}).Apply(state, diff); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Pattern: [Not Found]
+	entries, _ := ReadJournal(path, "run9")
+	if _, err := PlanRollback(entries, State{}); err == nil {
+		t.Error("PlanRollback [Not Found]error not returned")
+	}
+
+	// Pattern: [Plan] 実行と逆の順番で補償操作を作る
+	entries, _ = ReadJournal(path, "run2")
+	state, _ := store.List()
+	actions, err := PlanRollback(entries, state)
+	if err != nil {
+		t.Fatalf("PlanRollback failed: %v", err)
+	}
+	if len(actions) != 2 || actions[0].Action != rollbackRestoreUser || actions[1].Action != rollbackRestoreProfile {
+		t.Fatalf("PlanRollback [Plan]actions wrong: %v", actions)
+	}
+	if actions[1].Attributes["email"] != testAccounts[0].Email || actions[1].Attributes["login"] != testAccounts[0].Email {
+		t.Errorf("PlanRollback [Plan]attributes wrong: %v", actions[1].Attributes)
+	}
+
+	// Pattern: [Apply] Oktaと状態を実行前に戻す
+	run("rollback2", func(journal *Journal, client OktaClient) {
+		failures, err := (Rollbacker{Okta: client, Store: store, Journal: journal}).Apply(actions)
+		if err != nil || len(failures) != 0 {
+			t.Fatalf("Rollbacker.Apply failed: %v, %v", err, failures)
+		}
+	})
+	if okta.users["00u_aaa_user"].Login != testAccounts[0].Email {
+		t.Errorf("Rollbacker.Apply profile not restored: %v", okta.users["00u_aaa_user"])
+	}
+	if user, ok := okta.users["00u_ccc_user"]; !ok || user.Login != testAccounts[2].Email {
+		t.Errorf("Rollbacker.Apply user not restored: %v", okta.users)
+	}
+	if !contains(okta.groups["00g_everyone"], "00u_ccc_user") {
+		t.Errorf("Rollbacker.Apply group not restored: %v", okta.groups)
+	}
+	state, _ = store.List()
+	index := state.Index()
+	if len(state) != 3 || index[testAccounts[0].Dn].Email != testAccounts[0].Email || index[testAccounts[2].Dn].OktaUserID != "00u_ccc_user" {
+		t.Errorf("Rollbacker.Apply state not restored: %v", state)
+	}
+	// 既に戻っているので何もしない
+	if actions, _ := PlanRollback(entries, state); len(actions) != 1 || actions[0].Action != rollbackRestoreUser {
+		t.Errorf("PlanRollback [Applied]actions wrong: %v", actions)
+	}
+
+	// Pattern: [Rollback Of Rollback] 取り消しの同期履歴には取り消す前の状態を記録する
+	rollbackEntries, _ := ReadJournal(path, "rollback2")
+	for _, entry := range rollbackEntries {
+		if entry.Operation == UpdateKey && (entry.Previous == nil || entry.Previous.Email != "aaa_new@example.com") {
+			t.Errorf("Rollbacker.Apply [Rollback Of Rollback]previous wrong: %+v", entry.Previous)
+		}
+	}
+	actions, _ = PlanRollback(rollbackEntries, state)
+	if len(actions) != 2 || actions[0].Action != rollbackRestoreProfile || actions[0].Attributes["email"] != "aaa_new@example.com" ||
+		actions[1].Action != rollbackDeleteUser || actions[1].OktaUserID != "00u_ccc_user" {
+		t.Errorf("PlanRollback [Rollback Of Rollback]actions wrong: %v", actions)
+	}
+
+	// Pattern: [Create] 作成したユーザーを削除する
+	entries, _ = ReadJournal(path, "run1")
+	actions, _ = PlanRollback(entries, state)
+	if len(actions) != 3 || actions[0].Action != rollbackDeleteUser {
+		t.Fatalf("PlanRollback [Create]actions wrong: %v", actions)
+	}
+	failures, err := (Rollbacker{Okta: oktaClient, Store: store}).Apply(actions)
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Rollbacker.Apply [Create]failed: %v, %v", err, failures)
+	}
+	if state, _ := store.List(); len(state) != 0 || len(okta.users) != 0 {
+		t.Errorf("Rollbacker.Apply [Create]not deleted: %v, %v", state, okta.users)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+)
+
+// defaultServeSchedule serveの標準の実行時刻（毎時0分）
+const defaultServeSchedule = "@hourly"
+
+// Scheduler cron式の時刻にRunを実行します。
+// Runは同時に1つだけ実行し、実行中に過ぎた時刻は飛ばします。
+type Scheduler struct {
+	Schedule cron.Schedule
+	Jitter   time.Duration // 実行時刻を0〜Jitterの範囲でランダムに遅らせます（複数台で同時に実行しないため）
+	Run      func()
+}
+
+// Next nowより後の次の実行時刻
+func (s *Scheduler) Next(now time.Time) time.Time {
+	next := s.Schedule.Next(now)
+	if s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next
+}
+
+// Start ctxが終了するまで実行します（実行中にctxが終了した場合は、実行が終わってから戻ります）
+func (s *Scheduler) Start(ctx context.Context) {
+	for {
+		next := s.Next(time.Now())
+		slog.Debug("serve: next run", logAttrs(logOpServe, "at", next.Format(time.RFC3339))...)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.Run()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// servePlanPath serveが最後に保存したplan（状態の保存先毎）
+func servePlanPath(cfg *Config) string {
+	return cfg.StatePath() + ".plan.json"
+}
+
+// serveMetricsPath metrics.fileを省略した場合にserveの子プロセスが書き出すメトリクス（状態の保存先毎）
+func serveMetricsPath(cfg *Config) string {
+	return cfg.StatePath() + ".prom"
+}
+
+// pausePath serveの一時停止の状態（状態の保存先毎）
+func pausePath(cfg *Config) string {
+	return cfg.StatePath() + ".paused"
+}
+
+// run results（RunStatus.Result）
+const (
+	runRunning = "running"
+	runOK      = "ok"
+	runPartial = "partial" // 一部のアカウントが失敗
+	runFailed  = "failed"
+	runSkipped = "skipped" // 他の実行がロックを取得していた
+	runPlanned = "planned" // 一時停止中のためplanだけ
+)
+
+// RunStatus serveの1回の実行（plan -out、apply -plan）
+type RunStatus struct {
+	Trigger    string    `json:"trigger"` // schedule, api
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Result     string    `json:"result"`
+	ExitCode   int       `json:"exitCode"`
+	Applied    bool      `json:"applied"`         // apply -planを実行した
+	RunID      string    `json:"runId,omitempty"` // applyの同期履歴の実行ID
+}
+
+// Pause 自動反映の一時停止（一時停止中はplanだけ実行します）
+type Pause struct {
+	At     time.Time `json:"at"`
+	By     string    `json:"by,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Daemon serveの実行。スケジュールと管理APIから同じ手順で実行し、同時には1つだけ実行します。
+// planを保存してからapplyするので、最後のplanは一時停止中も確認できます。
+type Daemon struct {
+	Run         func(name string, args ...string) int // サブコマンドを子プロセスで実行します（runChild）
+	PlanPath    string
+	PausePath   string // 一時停止の状態（再起動しても一時停止のまま）
+	JournalPath string
+	Key         *StateKey              // planの暗号化キー（管理APIでplanを返すため）
+	Runs        *prometheus.CounterVec // 結果毎の実行回数（省略可）
+
+	mu      sync.Mutex
+	running *RunStatus
+	last    *RunStatus
+	wg      sync.WaitGroup
+}
+
+// RunSync planとapplyを実行します（実行中の場合はfalse）
+func (d *Daemon) RunSync(trigger string) bool {
+	status, _, ok := d.begin(trigger)
+	if ok {
+		d.sync(status)
+	}
+	return ok
+}
+
+// Trigger planとapplyをバックグラウンドで開始します（実行中の場合は実行中のRunStatusとfalse）
+func (d *Daemon) Trigger(trigger string) (RunStatus, bool) {
+	status, snapshot, ok := d.begin(trigger)
+	if ok {
+		go d.sync(status)
+	}
+	return snapshot, ok
+}
+
+// Wait バックグラウンドの実行が終わるまで待ちます
+func (d *Daemon) Wait() {
+	d.wg.Wait()
+}
+
+// Status 実行中と最後の実行
+func (d *Daemon) Status() (running, last *RunStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running != nil {
+		copied := *d.running
+		running = &copied
+	}
+	if d.last != nil {
+		copied := *d.last
+		last = &copied
+	}
+	return running, last
+}
+
+// begin 実行を開始します（実行中の場合はfalse）。開始した、または実行中のRunStatusのコピーも返します
+func (d *Daemon) begin(trigger string) (*RunStatus, RunStatus, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running != nil {
+		return nil, *d.running, false
+	}
+	d.running = &RunStatus{Trigger: trigger, StartedAt: time.Now().UTC(), Result: runRunning}
+	d.wg.Add(1)
+	return d.running, *d.running, true
+}
+
+func (d *Daemon) sync(status *RunStatus) {
+	defer d.wg.Done()
+	code := d.Run("plan", "-out", d.PlanPath)
+	pause, err := d.Paused()
+	if err != nil {
+		slog.Error("serve: pause state", logAttrs(logOpServe, "error", err)...) // 一時停止の状態を読めない場合は反映しない
+	}
+	applied := false
+	if code == exitOK && pause == nil && err == nil {
+		code = d.Run("apply", "-plan", d.PlanPath)
+		applied = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status.Applied = applied
+	status.ExitCode = code
+	status.FinishedAt = time.Now().UTC()
+	switch {
+	case code == exitLocked:
+		status.Result = runSkipped
+	case code == exitPartial:
+		status.Result = runPartial
+	case code != exitOK:
+		status.Result = runFailed
+	case !status.Applied:
+		status.Result = runPlanned
+	default:
+		status.Result = runOK
+	}
+	if status.Applied {
+		status.RunID = lastJournalRun(d.JournalPath, "apply -plan "+d.PlanPath, status.StartedAt)
+	}
+	slog.Info("serve: run finished", logAttrs(logOpServe, "trigger", status.Trigger, "result", status.Result, "exit_code", code,
+		"duration", status.FinishedAt.Sub(status.StartedAt).Round(time.Second))...)
+	if d.Runs != nil {
+		d.Runs.WithLabelValues(status.Result).Inc()
+	}
+	d.last = status
+	d.running = nil
+}
+
+// newServeRuns serveの結果毎の実行回数（perman_okta_serve_runs_total）
+func newServeRuns() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: metricsNamespace, Name: "serve_runs_total",
+		Help: "Runs started by serve per result."}, []string{"result"})
+}
+
+// Paused 一時停止中の場合は一時停止の状態
+func (d *Daemon) Paused() (*Pause, error) {
+	data, err := ioutil.ReadFile(d.PausePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pause Pause
+	if err := json.Unmarshal(data, &pause); err != nil {
+		return nil, err
+	}
+	return &pause, nil
+}
+
+// Pause 自動反映を一時停止します
+func (d *Daemon) Pause(by, reason string) (*Pause, error) {
+	pause := &Pause{At: time.Now().UTC(), By: by, Reason: reason}
+	data, err := json.Marshal(pause)
+	if err != nil {
+		return nil, err
+	}
+	if err := atomicWriteFile(d.PausePath, data, 0600); err != nil {
+		return nil, err
+	}
+	slog.Warn("serve: paused", logAttrs(logOpServe, "by", by, "reason", reason)...)
+	return pause, nil
+}
+
+// Resume 自動反映を再開します
+func (d *Daemon) Resume(by string) error {
+	if err := os.Remove(d.PausePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	slog.Info("serve: resumed", logAttrs(logOpServe, "by", by)...)
+	return nil
+}
+
+// lastJournalRun since以降に開始したcommandの最後の実行ID（見つからない場合は空）
+func lastJournalRun(path, command string, since time.Time) string {
+	entries, err := readJournalIfExists(path)
+	if err != nil {
+		slog.Error("serve: journal", logAttrs(logOpServe, "journal", path, "error", err)...)
+		return ""
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.Type == journalRunStart && entry.Command == command && !entry.Time.Before(since.Truncate(time.Second)) {
+			return entry.RunID
+		}
+	}
+	return ""
+}
+
+// runChild 同じ実行ファイルのサブコマンドを子プロセスで実行して終了コードを返します。
+// 子プロセスの続行できないエラー（fatal）で常駐しているプロセスは終了しません。
+func runChild(opts *options, name string, args ...string) int {
+	cmd, err := childCommand(context.Background(), opts, name, args...)
+	if err != nil {
+		slog.Error("serve: child", logAttrs(logOpServe, "child", name, "error", err)...)
+		return exitError
+	}
+	cmd.Stdout = os.Stdout
+	return waitChild(cmd)
+}
+
+// childOutput runChildと同じように実行し、標準出力を返します（ctxが終了した場合は子プロセスを終了します）
+func childOutput(ctx context.Context, opts *options, name string, args ...string) ([]byte, int) {
+	cmd, err := childCommand(ctx, opts, name, args...)
+	if err != nil {
+		slog.Error("serve: child", logAttrs(logOpServe, "child", name, "error", err)...)
+		return nil, exitError
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	code := waitChild(cmd)
+	return stdout.Bytes(), code
+}
+
+func waitChild(cmd *exec.Cmd) int {
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		slog.Error("serve: child", logAttrs(logOpServe, "child", strings.Join(cmd.Args[1:], " "), "error", err)...)
+		return exitError
+	}
+	return exitOK
+}
+
+// childCommand 同じ実行ファイルのサブコマンド（-env-file、-config、-vは引き継ぎます）
+func childCommand(ctx context.Context, opts *options, name string, args ...string) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	childArgs := []string{name}
+	if opts.envFile != "" {
+		childArgs = append(childArgs, "-env-file", opts.envFile)
+	}
+	if path := configFile(opts.configFile); path != "" {
+		childArgs = append(childArgs, "-config", path)
+	}
+	if opts.verbose {
+		childArgs = append(childArgs, "-v")
+	}
+	cmd := exec.CommandContext(ctx, exe, append(childArgs, args...)...)
+	cmd.Stderr = os.Stderr
+	// 端末のCtrl-C（プロセスグループへのSIGINT）で実行中の子プロセスを中断しない
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, nil
+}
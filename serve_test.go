@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// everySchedule 一定間隔のcron.Schedule
+type everySchedule time.Duration
+
+func (e everySchedule) Next(now time.Time) time.Time { return now.Add(time.Duration(e)) }
+
+func TestScheduler(t *testing.T) {
+	// Pattern: [Jitter] 0〜jitterの範囲で遅らせる
+	now := time.Now()
+	scheduler := &Scheduler{Schedule: everySchedule(time.Hour), Jitter: 10 * time.Minute}
+	for i := 0; i < 100; i++ {
+		if next := scheduler.Next(now); next.Before(now.Add(time.Hour)) || !next.Before(now.Add(70*time.Minute)) {
+			t.Fatalf("Scheduler.Next [Jitter]out of range: %s", next.Sub(now))
+		}
+	}
+
+	// Pattern: [Shutdown] 実行中に終了した場合は実行が終わってから戻る
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	finished := false
+	scheduler = &Scheduler{Schedule: everySchedule(10 * time.Millisecond), Run: func() {
+		runs++
+		if runs == 3 {
+			cancel()
+			time.Sleep(50 * time.Millisecond)
+			finished = true
+		}
+	}}
+	done := make(chan struct{})
+	go func() {
+		scheduler.Start(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduler.Start [Shutdown]not stopped")
+	}
+	if runs != 3 || !finished {
+		t.Errorf("Scheduler.Start [Shutdown]wrong: runs %d, finished %v", runs, finished)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+)
+
+// AccountState 同期済みアカウントの状態（LDAPの値と紐づくOktaのオブジェクト）
+type AccountState struct {
+	Account
+	OktaUserID   string   `json:"oktaUserId,omitempty"`
+	OktaGroupIDs []string `json:"oktaGroupIds,omitempty"`
+	ProfileHash  string   `json:"profileHash,omitempty"` // 最後に同期したUserProfileのハッシュ
+	// Reconcile adoptで紐付けたアカウント（次の同期で差分がなくてもprofileとグループを反映します）
+	Reconcile bool `json:"reconcile,omitempty"`
+}
+
+// State ローカルに保存する同期状態
+type State []AccountState
+
+// StateMeta アカウント以外の同期状態（LDAPの差分取得の位置など）。暗号化はしません
+type StateMeta map[string]string
+
+// defaultStateBackups 保持する状態ファイルのバックアップ数
+const defaultStateBackups = 5
+
+// StateFile 状態ファイル
+type StateFile struct {
+	Path    string
+	Backups int       // 保持するバックアップ数（0の場合はバックアップしない）
+	Key     *StateKey // 暗号化キー（nilの場合は暗号化しない）
+}
+
+// state file schema versions
+const (
+	stateVersionArray     = 1 // アカウントの配列のみ
+	stateVersionChecksum  = 2 // チェックサム付き（versionなし）
+	stateVersionVersioned = 3 // version付き
+	stateVersionEncrypted = 4 // 暗号化に対応（暗号化した場合はaccountsの代わりにciphertext）
+	stateVersionCurrent   = 5 // meta付き（metaChecksumでチェック）
+)
+
+// stateAAD 状態ファイルの暗号化の付加データ
+var stateAAD = []byte("perman-okta state")
+
+// stateEnvelope 状態ファイルの形式（accountsのチェックサム付き）
+type stateEnvelope struct {
+	Version      int             `json:"version,omitempty"`
+	Checksum     string          `json:"checksum"`
+	Accounts     json.RawMessage `json:"accounts,omitempty"`
+	Encryption   string          `json:"encryption,omitempty"`
+	KeyID        string          `json:"keyId,omitempty"`
+	Ciphertext   []byte          `json:"ciphertext,omitempty"`
+	Meta         StateMeta       `json:"meta,omitempty"`
+	MetaChecksum string          `json:"metaChecksum,omitempty"`
+}
+
+// stateMigrations versionから次のversionへの変換
+var stateMigrations = map[int]func(envelope *stateEnvelope) error{
+	// 配列をチェックサム付きの形式に包む
+	stateVersionArray: func(envelope *stateEnvelope) error {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, envelope.Accounts); err != nil {
+			return err
+		}
+		envelope.Accounts = compacted.Bytes()
+		envelope.Checksum = checksum(envelope.Accounts)
+		return nil
+	},
+	// accountsの形式は変わらないので、versionを付けるだけ
+	stateVersionChecksum: func(envelope *stateEnvelope) error {
+		return nil
+	},
+	// 暗号化していないファイルはそのまま読める
+	stateVersionVersioned: func(envelope *stateEnvelope) error {
+		return nil
+	},
+	// metaなしから始める
+	stateVersionEncrypted: func(envelope *stateEnvelope) error {
+		return nil
+	},
+}
+
+// Load 状態ファイルを読み込みます。
+// ファイルが存在しない場合は初回実行として空の状態を返します（バックアップがある場合は消えたものとしてエラー）。
+// 空のファイル、チェックサムが一致しない、JSONとして読めないなど壊れている場合はエラーにします。
+// 旧いversionのファイルは現在のversionに変換して読み込みます。
+// 暗号化されたファイルはKeyで復号します（暗号化していないファイルは次に書き出す時に暗号化されます）。
+func (f StateFile) Load() (State, error) {
+	state, _, err := f.LoadWithMeta()
+	return state, err
+}
+
+// LoadWithMeta Loadと同じく状態ファイルを読み込み、metaも返します
+func (f StateFile) LoadWithMeta() (State, StateMeta, error) {
+	state, meta, _, err := f.load()
+	return state, meta, err
+}
+
+// load 状態ファイルを読み込みます（plainは暗号化されていないファイルを読み込んだ場合にtrue）
+func (f StateFile) load() (state State, meta StateMeta, plain bool, err error) {
+
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		if err := missingState(f.Path); err != nil {
+			return nil, nil, false, err
+		}
+		slog.Info("state file not found, start as the first run", logAttrs(logOpState, "path", f.Path)...)
+		return State{}, StateMeta{}, false, nil
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+
+	envelope, err := decodeStateEnvelope(data)
+	if err != nil {
+		return nil, nil, false, f.corrupted(err)
+	}
+	if envelope.Version > stateVersionCurrent {
+		return nil, nil, false, fmt.Errorf("state file %s version %d is newer than supported version %d", f.Path, envelope.Version, stateVersionCurrent)
+	}
+	if err := f.decrypt(envelope); err != nil {
+		return nil, nil, false, err
+	}
+	plain = envelope.Encryption == ""
+	if envelope.Version >= stateVersionChecksum {
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, envelope.Accounts); err != nil {
+			return nil, nil, false, f.corrupted(err)
+		}
+		if checksum(compacted.Bytes()) != envelope.Checksum {
+			return nil, nil, false, f.corrupted(errors.New("checksum mismatch"))
+		}
+	}
+	if envelope.Version >= stateVersionCurrent && metaChecksum(envelope.Meta) != envelope.MetaChecksum {
+		return nil, nil, false, f.corrupted(errors.New("meta checksum mismatch"))
+	}
+	for version := envelope.Version; version < stateVersionCurrent; version++ {
+		if err := stateMigrations[version](envelope); err != nil {
+			return nil, nil, false, fmt.Errorf("state file %s migration from version %d failed: %v", f.Path, version, err)
+		}
+		slog.Info("state file migrated", logAttrs(logOpState, "path", f.Path, "from", version, "to", version+1)...)
+	}
+
+	state = State{}
+	if err := json.Unmarshal(envelope.Accounts, &state); err != nil {
+		return nil, nil, false, f.corrupted(err)
+	}
+	meta = envelope.Meta
+	if meta == nil {
+		meta = StateMeta{}
+	}
+	return state, meta, plain, nil
+}
+
+// decodeStateEnvelope 状態ファイルのversionを判別して読み込みます
+func decodeStateEnvelope(data []byte) (*stateEnvelope, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, errors.New("empty file")
+	}
+
+	envelope := &stateEnvelope{}
+	if data[0] == '[' {
+		if !json.Valid(data) {
+			return nil, errors.New("invalid json")
+		}
+		envelope.Version = stateVersionArray
+		envelope.Accounts = data
+		return envelope, nil
+	}
+	if err := json.Unmarshal(data, envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Accounts == nil && envelope.Encryption == "" {
+		return nil, errors.New("accounts not found")
+	}
+	if envelope.Version == 0 {
+		envelope.Version = stateVersionChecksum
+	}
+	return envelope, nil
+}
+
+// Save 現在のファイルをバックアップしてから、状態をアトミックに書き出します
+func (f StateFile) Save(state State) error {
+	if err := f.Backup(); err != nil {
+		return err
+	}
+	return f.Commit(state)
+}
+
+// Backup 現在のファイルをバックアップし、新しいものからBackups件だけ残します
+func (f StateFile) Backup() error {
+	return backupFile(f.Path, f.Backups)
+}
+
+// Commit 状態をアトミックに書き出します（バックアップはしません）
+func (f StateFile) Commit(state State) error {
+	return f.CommitWithMeta(state, nil)
+}
+
+// CommitWithMeta 状態とmetaをアトミックに書き出します（バックアップはしません）
+func (f StateFile) CommitWithMeta(state State, meta StateMeta) error {
+	if state == nil {
+		state = State{}
+	}
+	accounts, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if len(meta) == 0 {
+		meta = nil
+	}
+	envelope := stateEnvelope{
+		Version:      stateVersionCurrent,
+		Checksum:     checksum(accounts),
+		Accounts:     accounts,
+		Meta:         meta,
+		MetaChecksum: metaChecksum(meta),
+	}
+	if f.Key != nil {
+		ciphertext, err := f.Key.Seal(accounts, stateAAD)
+		if err != nil {
+			return err
+		}
+		envelope.Accounts = nil
+		envelope.Encryption = stateEncryption
+		envelope.KeyID = f.Key.ID
+		envelope.Ciphertext = ciphertext
+	}
+	jsonBytes, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicWriteFile(f.Path, jsonBytes, 0600)
+}
+
+// decrypt 暗号化されたenvelopeを復号してAccountsに戻します
+func (f StateFile) decrypt(envelope *stateEnvelope) error {
+	if envelope.Encryption == "" {
+		if f.Key != nil {
+			slog.Warn("state file is not encrypted, it will be encrypted on the next write", logAttrs(logOpState, "path", f.Path)...)
+		}
+		return nil
+	}
+	if envelope.Encryption != stateEncryption {
+		return fmt.Errorf("state file %s: unsupported encryption %s", f.Path, envelope.Encryption)
+	}
+	if f.Key == nil {
+		return fmt.Errorf("state file %s is encrypted (keyId %s), set STATE_KEY or STATE_KEY_FILE", f.Path, envelope.KeyID)
+	}
+	if envelope.KeyID != f.Key.ID {
+		return fmt.Errorf("state file %s is encrypted with another key (keyId %s, given %s)", f.Path, envelope.KeyID, f.Key.ID)
+	}
+	accounts, err := f.Key.Open(envelope.Ciphertext, stateAAD)
+	if err != nil {
+		return f.corrupted(err)
+	}
+	envelope.Accounts = accounts
+	return nil
+}
+
+func (f StateFile) corrupted(err error) error {
+	return fmt.Errorf("state file %s is corrupted (%v), restore it from a backup (%s.*.bak)", f.Path, err, f.Path)
+}
+
+// missingState 状態がないのにバックアップがある場合はエラーにします（初回実行として全員を作り直さないため）
+func missingState(path string) error {
+	backups, err := listBackups(path)
+	if err != nil || len(backups) == 0 {
+		return err
+	}
+	return fmt.Errorf("state %s not found but %d backups exist, restore the newest one (%s) or remove the backups to start as the first run",
+		path, len(backups), backups[len(backups)-1])
+}
+
+// checksum sha256のチェックサムを返します
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// metaChecksum metaのチェックサム（json.Marshalはmapのキー順に出力します）
+func metaChecksum(meta StateMeta) string {
+	if len(meta) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(meta)
+	return checksum(data)
+}
+
+// Accounts Diffの比較用にLDAPの値だけを返します
+func (s State) Accounts() *[]Account {
+	accounts := make([]Account, 0, len(s))
+	for _, data := range s {
+		accounts = append(accounts, data.Account)
+	}
+	return &accounts
+}
+
+// Index DNをキー（dnKey）にしたmapを返します
+func (s State) Index() map[string]AccountState {
+	index := make(map[string]AccountState, len(s))
+	for _, data := range s {
+		index[dnKey(data.Dn)] = data
+	}
+	return index
+}
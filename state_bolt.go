@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltAccountsBucket  = []byte("accounts")
+	boltMetaBucket      = []byte("meta")
+	boltStateMetaBucket = []byte("stateMeta") // StateMeta（metaはdb自体の情報）
+	boltVersionKey      = []byte("version")
+	boltKeyIDKey        = []byte("keyId")
+)
+
+// bolt schema versions
+const (
+	boltVersionRawDn = 1 // アカウントのキーはDNそのまま
+	boltStateVersion = 2 // アカウントのキーはdnKey（DNの大文字小文字を区別しない）
+)
+
+// BoltStateStore 組み込みのkey-value store（bbolt）を保存先にするStateStore。
+// DN（dnKey）をキーに1件ずつ保存するので、件数が多くても更新は1件分の書き込みで済みます。
+// Keyを指定した場合は各アカウントの値をキーを付加データにして暗号化します。
+// キー（小文字のDN）とmeta（watermark、syncreplのcookie）は暗号化しません。
+type BoltStateStore struct {
+	Path    string
+	Backups int       // 保持するバックアップ数（0の場合はバックアップしない）
+	Key     *StateKey // 暗号化キー（nilの場合は暗号化しない）
+	db      *bolt.DB
+}
+
+// Load dbファイルを開きます（存在しなければ作成）。
+// 暗号化していないdbをKeyを指定して開いた場合は、全ての値を暗号化します。
+func (s *BoltStateStore) Load() error {
+	if s.db != nil {
+		return nil
+	}
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		if err := missingState(s.Path); err != nil {
+			return err
+		}
+	}
+	db, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("state db %s: %v", s.Path, err)
+	}
+	encrypted := false
+	version := boltStateVersion
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltAccountsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltStateMetaBucket); err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		if value := meta.Get(boltVersionKey); value == nil {
+			if err := meta.Put(boltVersionKey, []byte(strconv.Itoa(boltStateVersion))); err != nil {
+				return err
+			}
+		} else {
+			if version, err = strconv.Atoi(string(value)); err != nil {
+				return fmt.Errorf("invalid version %q", value)
+			}
+			if version > boltStateVersion {
+				return fmt.Errorf("version %d is newer than supported version %d", version, boltStateVersion)
+			}
+		}
+
+		keyID := meta.Get(boltKeyIDKey)
+		switch {
+		case keyID == nil && s.Key != nil:
+			slog.Warn("state db is not encrypted, encrypt it", logAttrs(logOpState, "path", s.Path)...)
+			encrypted = true
+			return rekeyBolt(tx, nil, s.Key)
+		case keyID != nil && s.Key == nil:
+			return fmt.Errorf("encrypted (keyId %s), set STATE_KEY or STATE_KEY_FILE", keyID)
+		case keyID != nil && string(keyID) != s.Key.ID:
+			return fmt.Errorf("encrypted with another key (keyId %s, given %s)", keyID, s.Key.ID)
+		}
+		if version == boltVersionRawDn {
+			// アカウントをdnKeyのキーで書き直します
+			if err := rekeyBolt(tx, s.Key, s.Key); err != nil {
+				return err
+			}
+			if err := meta.Put(boltVersionKey, []byte(strconv.Itoa(boltStateVersion))); err != nil {
+				return err
+			}
+			slog.Info("state db migrated", logAttrs(logOpState, "path", s.Path, "from", version, "to", boltStateVersion)...)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("state db %s: %v", s.Path, err)
+	}
+	s.db = db
+	if !encrypted {
+		return nil
+	}
+	// 暗号化する前の値が空きページやバックアップに残らないようにします
+	if err := s.compact(); err != nil {
+		return fmt.Errorf("state db %s: %v", s.Path, err)
+	}
+	return rekeyBackups(stateBackendBolt, s.Path, nil, s.Key)
+}
+
+// Get DNのアカウントの状態を返します
+func (s *BoltStateStore) Get(dn string) (data AccountState, ok bool, err error) {
+	err = s.view(func(tx StateTx) error {
+		data, ok, err = tx.Get(dn)
+		return err
+	})
+	return
+}
+
+// List 全アカウントの状態を返します（dnKey順）
+func (s *BoltStateStore) List() (state State, err error) {
+	err = s.view(func(tx StateTx) error {
+		state, err = tx.List()
+		return err
+	})
+	return
+}
+
+// Meta アカウント以外の状態を返します
+func (s *BoltStateStore) Meta(key string) (value string, err error) {
+	err = s.view(func(tx StateTx) error {
+		value, err = tx.Meta(key)
+		return err
+	})
+	return
+}
+
+// SetMeta アカウント以外の状態を保存します
+func (s *BoltStateStore) SetMeta(key, value string) error {
+	return s.Transaction(func(tx StateTx) error {
+		return tx.SetMeta(key, value)
+	})
+}
+
+// Upsert アカウントの状態を追加、更新します
+func (s *BoltStateStore) Upsert(data AccountState) error {
+	return s.Transaction(func(tx StateTx) error {
+		return tx.Upsert(data)
+	})
+}
+
+// Delete アカウントの状態を削除します
+func (s *BoltStateStore) Delete(dn string) error {
+	return s.Transaction(func(tx StateTx) error {
+		return tx.Delete(dn)
+	})
+}
+
+// Transaction fnの中の更新を1つのトランザクションでまとめて書き込みます
+func (s *BoltStateStore) Transaction(fn func(tx StateTx) error) error {
+	if err := s.Load(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(newBoltStateTx(tx, s.Key))
+	})
+}
+
+// Backup dbファイルを日時付きのバックアップファイルにコピーし、新しいものからBackups件だけ残します
+func (s *BoltStateStore) Backup() error {
+	if s.Backups <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(s.Path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := s.Load(); err != nil {
+		return err
+	}
+	backupNm := fmt.Sprintf("%s.%s.bak", s.Path, time.Now().UTC().Format(backupTimeFormat))
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(backupNm, 0600)
+	}); err != nil {
+		return err
+	}
+	return pruneBackups(s.Path, s.Backups)
+}
+
+// RotateKey 全ての値をkeyで暗号化し直します
+func (s *BoltStateStore) RotateKey(key *StateKey) error {
+	if err := s.Load(); err != nil {
+		return err
+	}
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		return rekeyBolt(tx, s.Key, key)
+	}); err != nil {
+		return err
+	}
+	s.Key = key
+	return s.compact()
+}
+
+// compact dbファイルを使用中のページだけに詰めて書き直します。
+// bboltは更新前の値を空きページに残すため、暗号化し直した後に前の値を消すのに使います。
+func (s *BoltStateStore) compact() error {
+	dir, base := filepath.Split(s.Path)
+	tmpNm := filepath.Join(dir, "."+base+".compact.tmp")
+	os.Remove(tmpNm)
+	dst, err := bolt.Open(tmpNm, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, 0); err != nil {
+		dst.Close()
+		os.Remove(tmpNm)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpNm)
+		return err
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpNm, s.Path); err != nil {
+		return err
+	}
+	return s.Load()
+}
+
+// rekeyBolt oldKeyで暗号化された値を復号し、newKeyで暗号化し直します（nilの場合は暗号化しない）。
+// アカウントのキーもdnKeyで書き直します。
+func rekeyBolt(tx *bolt.Tx, oldKey, newKey *StateKey) error {
+	state, err := newBoltStateTx(tx, oldKey).List()
+	if err != nil {
+		return err
+	}
+	if err := tx.DeleteBucket(boltAccountsBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket(boltAccountsBucket); err != nil {
+		return err
+	}
+	newTx := newBoltStateTx(tx, newKey)
+	for _, data := range state {
+		if err := newTx.Upsert(data); err != nil {
+			return err
+		}
+	}
+	meta := tx.Bucket(boltMetaBucket)
+	if newKey == nil {
+		return meta.Delete(boltKeyIDKey)
+	}
+	return meta.Put(boltKeyIDKey, []byte(newKey.ID))
+}
+
+// Close dbファイルを閉じます
+func (s *BoltStateStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	s.db = nil
+	return err
+}
+
+func (s *BoltStateStore) view(fn func(tx StateTx) error) error {
+	if err := s.Load(); err != nil {
+		return err
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(newBoltStateTx(tx, s.Key))
+	})
+}
+
+// boltStateTx bboltのトランザクション内のStateTx
+type boltStateTx struct {
+	bucket *bolt.Bucket
+	meta   *bolt.Bucket
+	key    *StateKey
+}
+
+func newBoltStateTx(tx *bolt.Tx, key *StateKey) boltStateTx {
+	return boltStateTx{tx.Bucket(boltAccountsBucket), tx.Bucket(boltStateMetaBucket), key}
+}
+
+// Meta アカウント以外の状態を返します
+func (tx boltStateTx) Meta(key string) (string, error) {
+	return string(tx.meta.Get([]byte(key))), nil
+}
+
+// SetMeta アカウント以外の状態を保存します
+func (tx boltStateTx) SetMeta(key, value string) error {
+	if value == "" {
+		return tx.meta.Delete([]byte(key))
+	}
+	return tx.meta.Put([]byte(key), []byte(value))
+}
+
+// Get DNのアカウントの状態を返します
+func (tx boltStateTx) Get(dn string) (AccountState, bool, error) {
+	key := []byte(dnKey(dn))
+	value := tx.bucket.Get(key)
+	if value == nil {
+		return AccountState{}, false, nil
+	}
+	data, err := tx.decode(key, value)
+	return data, err == nil, err
+}
+
+// List 全アカウントの状態を返します（dnKey順）
+func (tx boltStateTx) List() (State, error) {
+	state := State{}
+	err := tx.bucket.ForEach(func(key, value []byte) error {
+		data, err := tx.decode(key, value)
+		if err != nil {
+			return err
+		}
+		state = append(state, data)
+		return nil
+	})
+	return state, err
+}
+
+// Upsert アカウントの状態を追加、更新します（値には元のDNを保存します）
+func (tx boltStateTx) Upsert(data AccountState) error {
+	key := []byte(dnKey(data.Dn))
+	value, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if tx.key != nil {
+		if value, err = tx.key.Seal(value, key); err != nil {
+			return err
+		}
+	}
+	return tx.bucket.Put(key, value)
+}
+
+// decode 値を復号して読み込みます（dnはバケットのキーで、暗号化の付加データ）
+func (tx boltStateTx) decode(dn, value []byte) (AccountState, error) {
+	var data AccountState
+	if tx.key != nil {
+		plaintext, err := tx.key.Open(value, dn)
+		if err != nil {
+			return data, fmt.Errorf("state db: invalid account %s: %v", dn, err)
+		}
+		value = plaintext
+	}
+	if err := json.Unmarshal(value, &data); err != nil {
+		return data, fmt.Errorf("state db: invalid account %s: %v", dn, err)
+	}
+	return data, nil
+}
+
+// Delete アカウントの状態を削除します
+func (tx boltStateTx) Delete(dn string) error {
+	return tx.bucket.Delete([]byte(dnKey(dn)))
+}
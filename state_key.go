@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// stateEncryption 状態の暗号化方式
+const stateEncryption = "aes-256-gcm"
+
+// stateKeySize AES-256のキー長
+const stateKeySize = 32
+
+// StateKey 状態を暗号化するキー（AES-256-GCM）
+type StateKey struct {
+	ID   string // キーの識別子（キーのsha256の先頭8byte）。どのキーで暗号化したかをファイルに記録します
+	aead cipher.AEAD
+}
+
+// NewStateKey 32byteのキーからStateKeyを生成します
+func NewStateKey(key []byte) (*StateKey, error) {
+	if len(key) != stateKeySize {
+		return nil, fmt.Errorf("state key must be %d bytes, got %d bytes", stateKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &StateKey{ID: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// LoadStateKey base64のキー（value）またはキーファイルからStateKeyを読み込みます。
+// どちらも指定されていない場合は暗号化しないのでnilを返します。
+func LoadStateKey(value, fileNm string) (*StateKey, error) {
+	if value != "" && fileNm != "" {
+		return nil, errors.New("state key: specify either the key or the key file, not both")
+	}
+	if fileNm != "" {
+		data, err := ioutil.ReadFile(fileNm)
+		if err != nil {
+			return nil, fmt.Errorf("state key file: %v", err)
+		}
+		value = string(data)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		if fileNm != "" {
+			return nil, fmt.Errorf("state key file %s is empty", fileNm)
+		}
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("state key is not base64: %v", err)
+	}
+	return NewStateKey(key)
+}
+
+// GenerateStateKey ランダムなキーをbase64で返します
+func GenerateStateKey() (string, error) {
+	key := make([]byte, stateKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Seal plaintextを暗号化してnonce+ciphertextを返します。
+// aadは暗号化しないが改ざんを検知する付加データで、Openの時に同じ値が必要です。
+func (k *StateKey) Seal(plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open Sealで暗号化したデータを復号します（改ざんされている場合はエラー）
+func (k *StateKey) Open(data, aad []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("ciphertext too short")
+	}
+	plaintext, err := k.aead.Open(nil, data[:size], data[size:], aad)
+	if err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	return plaintext, nil
+}
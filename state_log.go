@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+)
+
+// stateLogSuffix 状態ファイルの追記ログ（<state>.log）
+const stateLogSuffix = ".log"
+
+// stateLogCompactEvery 追記ログをこの件数ごとに状態ファイルへまとめます
+const stateLogCompactEvery = 500
+
+// stateLogAAD 追記ログの暗号化の付加データ
+var stateLogAAD = []byte("perman-okta state log")
+
+// state log operations
+const (
+	stateLogUpsert = "upsert"
+	stateLogDelete = "delete"
+	stateLogMeta   = "meta"
+)
+
+// stateLogRecord 追記ログの1行（1件の更新）
+type stateLogRecord struct {
+	Op    string        `json:"op"`
+	Data  *AccountState `json:"data,omitempty"`
+	Dn    string        `json:"dn,omitempty"`
+	Key   string        `json:"key,omitempty"`
+	Value string        `json:"value,omitempty"`
+}
+
+// apply 更新をtxに反映します
+func (r stateLogRecord) apply(tx StateTx) error {
+	switch r.Op {
+	case stateLogUpsert:
+		if r.Data == nil {
+			return fmt.Errorf("upsert without data")
+		}
+		return tx.Upsert(*r.Data)
+	case stateLogDelete:
+		return tx.Delete(r.Dn)
+	case stateLogMeta:
+		return tx.SetMeta(r.Key, r.Value)
+	}
+	return fmt.Errorf("unknown operation: %s", r.Op)
+}
+
+// stateLog 状態ファイルの追記ログ。
+// 1件の更新を1行追記してfsyncし、状態ファイル全体を書き出すのはまとめる時だけにします。
+// keyを指定した場合は行毎に暗号化します（base64）。
+type stateLog struct {
+	Path string
+	Key  *StateKey
+
+	file     *os.File
+	count    int   // ログの件数
+	appended int   // この実行で追記した件数
+	torn     bool  // 最後の行が書き込みの途中
+	size     int64 // 読めた行までのサイズ
+}
+
+// Append 1件の更新を追記します
+func (l *stateLog) Append(record stateLogRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if l.Key != nil {
+		sealed, err := l.Key.Seal(line, stateLogAAD)
+		if err != nil {
+			return err
+		}
+		line = []byte(base64.StdEncoding.EncodeToString(sealed))
+	}
+	if l.file == nil {
+		file, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		if l.torn {
+			// 書き込み途中の行の後ろに追記すると読めない行になるので切り詰めます
+			if err := file.Truncate(l.size); err != nil {
+				file.Close()
+				return err
+			}
+			l.torn = false
+		}
+		l.file = file
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.count++
+	l.appended++
+	return nil
+}
+
+// Replay ログの更新を順にtxに反映します（ログがない場合は何もしません）。
+// 改行のない最後の行は書き込みの途中で終了したものなので読み飛ばします。
+func (l *stateLog) Replay(tx StateTx) error {
+	data, err := ioutil.ReadFile(l.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	offset := 0
+	for i, line := range lines {
+		start := offset
+		offset += len(line) + 1
+		if len(line) == 0 {
+			continue
+		}
+		record, err := l.decode(line)
+		if err != nil && i == len(lines)-1 {
+			slog.Warn("state log: skip the incomplete last line", logAttrs(logOpState, "path", l.Path, "error", err)...)
+			l.torn, l.size = true, int64(start)
+			break
+		}
+		if err == nil {
+			err = record.apply(tx)
+		}
+		if err != nil {
+			return fmt.Errorf("state log %s is corrupted at line %d (%v), restore the state from a backup and remove the log", l.Path, i+1, err)
+		}
+		l.count++
+	}
+	return nil
+}
+
+func (l *stateLog) decode(line []byte) (stateLogRecord, error) {
+	var record stateLogRecord
+	if line[0] != '{' {
+		if l.Key == nil {
+			return record, fmt.Errorf("encrypted, set STATE_KEY or STATE_KEY_FILE")
+		}
+		sealed, err := base64.StdEncoding.DecodeString(string(line))
+		if err != nil {
+			return record, err
+		}
+		if line, err = l.Key.Open(sealed, stateLogAAD); err != nil {
+			return record, err
+		}
+	}
+	err := json.Unmarshal(line, &record)
+	return record, err
+}
+
+// Remove 状態ファイルにまとめたログを削除します
+func (l *stateLog) Remove() error {
+	if err := l.Close(); err != nil {
+		return err
+	}
+	l.count, l.appended = 0, 0
+	if err := os.Remove(l.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close ログを閉じます
+func (l *stateLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// state backends
+const (
+	stateBackendJSON = "json"
+	stateBackendBolt = "bolt"
+)
+
+// StateReader 同期状態の参照
+type StateReader interface {
+	// Get DNのアカウントの状態を返します（存在しない場合はfalse）
+	Get(dn string) (AccountState, bool, error)
+	// List 全アカウントの状態を返します
+	List() (State, error)
+	// Meta アカウント以外の状態を返します（存在しない場合は空）
+	Meta(key string) (string, error)
+}
+
+// StateTx 同期状態の参照と更新
+type StateTx interface {
+	StateReader
+	// Upsert DNをキーにアカウントの状態を追加、更新します
+	Upsert(data AccountState) error
+	// Delete DNのアカウントの状態を削除します
+	Delete(dn string) error
+	// SetMeta アカウント以外の状態を保存します（空の場合は削除）
+	SetMeta(key, value string) error
+}
+
+// StateStore 同期状態の保存先。
+// StateTxのUpsert、Deleteはそれぞれ1件ずつ永続化し、Transactionは複数件をまとめて永続化します。
+type StateStore interface {
+	StateTx
+	// Load 保存先を開いて読み込みます（壊れている場合はエラー）
+	Load() error
+	// Transaction fnがエラーを返した場合はfnの中の更新を全て破棄します
+	Transaction(fn func(tx StateTx) error) error
+	// Backup 現在の状態をバックアップします
+	Backup() error
+	// RotateKey 全ての状態をkeyで暗号化し直します
+	RotateKey(key *StateKey) error
+	Close() error
+}
+
+// NewStateStore backendの種類に応じたStateStoreを返します（keyがnilの場合は暗号化しない）
+func NewStateStore(backend, path string, backups int, key *StateKey) (StateStore, error) {
+	switch backend {
+	case stateBackendJSON, "":
+		return &JSONStateStore{File: StateFile{Path: path, Backups: backups, Key: key}}, nil
+	case stateBackendBolt:
+		return &BoltStateStore{Path: path, Backups: backups, Key: key}, nil
+	}
+	return nil, fmt.Errorf("unknown state backend: %s", backend)
+}
+
+// ReplaceState txのアカウントの状態をstateで置き換えます（metaはそのまま）
+func ReplaceState(tx StateTx, state State) error {
+	current, err := tx.List()
+	if err != nil {
+		return err
+	}
+	index := state.Index()
+	for _, data := range current {
+		// DNの大文字小文字だけが変わった場合も前のDNの状態は削除します
+		if next, ok := index[dnKey(data.Dn)]; !ok || next.Dn != data.Dn {
+			if err := tx.Delete(data.Dn); err != nil {
+				return err
+			}
+		}
+	}
+	for _, data := range state {
+		if err := tx.Upsert(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekeyBackups pathのバックアップをkeyで暗号化し直します（暗号化していない、前のキーのバックアップを残さないため）。
+// バックアップはkey、oldKeyの順に開き、どちらでも開けないものは削除します。
+func rekeyBackups(backend, path string, oldKey, key *StateKey) error {
+	backups, err := listBackups(path)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups {
+		err := rekeyBackup(backend, backup, key, key)
+		if err != nil && oldKey != nil {
+			err = rekeyBackup(backend, backup, oldKey, key)
+		}
+		if err == nil {
+			continue
+		}
+		slog.Warn("state backup cannot be re-encrypted, removed", logAttrs(logOpState, "path", backup, "error", err)...)
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rekeyBackup(backend, backup string, current, key *StateKey) error {
+	store, err := NewStateStore(backend, backup, 0, current)
+	if err != nil {
+		return err
+	}
+	err = store.Load()
+	if err == nil {
+		err = store.RotateKey(key)
+	}
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CopyState fromのアカウントの状態とmetaKeysのmetaを空のtoに書き込みます（backendの切り替え）
+func CopyState(from StateReader, to StateStore, metaKeys []string) error {
+	if current, err := to.List(); err != nil {
+		return err
+	} else if len(current) > 0 {
+		return fmt.Errorf("the destination already has %d accounts", len(current))
+	}
+	state, err := from.List()
+	if err != nil {
+		return err
+	}
+	return to.Transaction(func(tx StateTx) error {
+		if err := ReplaceState(tx, state); err != nil {
+			return err
+		}
+		for _, key := range metaKeys {
+			value, err := from.Meta(key)
+			if err != nil {
+				return err
+			}
+			if err := tx.SetMeta(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// JSONStateStore 状態ファイル（json）を保存先にするStateStore。
+// 全件をメモリに持ち、Upsert、Delete、SetMetaは追記ログ（<state>.log）に1行ずつ追記します。
+// 追記ログはstateLogCompactEvery件ごと、Transaction、Closeで状態ファイルにまとめます。
+type JSONStateStore struct {
+	File StateFile
+	data *memoryState
+	log  *stateLog
+	// encrypt 暗号化していないファイルをキーを指定して読み込んだ（書き出す時にバックアップも暗号化します）
+	encrypt bool
+}
+
+// Load 状態ファイルを読み込み、追記ログの更新を反映します
+func (s *JSONStateStore) Load() error {
+	state, meta, plain, err := s.File.load()
+	if err != nil {
+		return err
+	}
+	data := newMemoryState(state, meta)
+	if err := s.stateLog().Replay(data); err != nil {
+		return err
+	}
+	s.data = data
+	s.encrypt = plain && s.File.Key != nil
+	return nil
+}
+
+// Get DNのアカウントの状態を返します
+func (s *JSONStateStore) Get(dn string) (AccountState, bool, error) {
+	return s.memory().Get(dn)
+}
+
+// List 全アカウントの状態を返します
+func (s *JSONStateStore) List() (State, error) {
+	return s.memory().List()
+}
+
+// Meta アカウント以外の状態を返します
+func (s *JSONStateStore) Meta(key string) (string, error) {
+	return s.memory().Meta(key)
+}
+
+// SetMeta アカウント以外の状態を保存して追記します
+func (s *JSONStateStore) SetMeta(key, value string) error {
+	return s.append(stateLogRecord{Op: stateLogMeta, Key: key, Value: value})
+}
+
+// Upsert アカウントの状態を追加、更新して追記します
+func (s *JSONStateStore) Upsert(data AccountState) error {
+	return s.append(stateLogRecord{Op: stateLogUpsert, Data: &data})
+}
+
+// Delete アカウントの状態を削除して追記します
+func (s *JSONStateStore) Delete(dn string) error {
+	return s.append(stateLogRecord{Op: stateLogDelete, Dn: dn})
+}
+
+// append 1件の更新を追記ログに書いてからメモリに反映します（件数が溜まったら状態ファイルにまとめます）
+func (s *JSONStateStore) append(record stateLogRecord) error {
+	if err := s.stateLog().Append(record); err != nil {
+		return err
+	}
+	if err := record.apply(s.memory()); err != nil {
+		return err
+	}
+	if s.log.count >= stateLogCompactEvery {
+		return s.compact()
+	}
+	return nil
+}
+
+// Transaction fnの中の更新をまとめて状態ファイルに書き出します（追記ログもまとめます）
+func (s *JSONStateStore) Transaction(fn func(tx StateTx) error) error {
+	state, _ := s.memory().List()
+	tx := newMemoryState(state, s.memory().meta)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := s.File.CommitWithMeta(tx.state, tx.meta); err != nil {
+		return err
+	}
+	s.data = tx
+	return s.committed()
+}
+
+// compact メモリの状態を状態ファイルに書き出し、追記ログを削除します。
+// 書き出した後に削除できずに終了しても、次のLoadで同じ更新を反映し直すだけです。
+func (s *JSONStateStore) compact() error {
+	if err := s.File.CommitWithMeta(s.memory().state, s.memory().meta); err != nil {
+		return err
+	}
+	return s.committed()
+}
+
+// committed 状態ファイルにまとめた追記ログを削除します。
+// 初めて暗号化して書き出した場合は、暗号化していないバックアップも暗号化します。
+func (s *JSONStateStore) committed() error {
+	if err := s.stateLog().Remove(); err != nil {
+		return err
+	}
+	if !s.encrypt {
+		return nil
+	}
+	s.encrypt = false
+	return rekeyBackups(stateBackendJSON, s.File.Path, nil, s.File.Key)
+}
+
+// Backup 追記ログをまとめてから状態ファイルをバックアップします
+func (s *JSONStateStore) Backup() error {
+	if s.stateLog().count > 0 {
+		if err := s.compact(); err != nil {
+			return err
+		}
+	}
+	return s.File.Backup()
+}
+
+// RotateKey 状態ファイルをkeyで暗号化して書き出します（追記ログもまとめます）
+func (s *JSONStateStore) RotateKey(key *StateKey) error {
+	state, _ := s.memory().List()
+	file := s.File
+	file.Key = key
+	if err := file.CommitWithMeta(state, s.memory().meta); err != nil {
+		return err
+	}
+	s.File = file
+	if err := s.stateLog().Remove(); err != nil {
+		return err
+	}
+	s.log.Key = key
+	s.encrypt = false
+	return nil
+}
+
+// Close この実行で追記した場合は状態ファイルにまとめます
+func (s *JSONStateStore) Close() error {
+	if s.log == nil || s.log.appended == 0 {
+		return s.stateLog().Close()
+	}
+	return s.compact()
+}
+
+func (s *JSONStateStore) stateLog() *stateLog {
+	if s.log == nil {
+		s.log = &stateLog{Path: s.File.Path + stateLogSuffix, Key: s.File.Key}
+	}
+	return s.log
+}
+
+func (s *JSONStateStore) memory() *memoryState {
+	if s.data == nil {
+		s.data = newMemoryState(nil, nil)
+	}
+	return s.data
+}
+
+// memoryState メモリ上の同期状態（並び順を保持します）
+type memoryState struct {
+	state State
+	index map[string]int
+	meta  StateMeta
+}
+
+func newMemoryState(state State, meta StateMeta) *memoryState {
+	m := &memoryState{state: State{}, index: make(map[string]int, len(state)), meta: StateMeta{}}
+	for _, data := range state {
+		m.Upsert(data)
+	}
+	for key, value := range meta {
+		m.meta[key] = value
+	}
+	return m
+}
+
+// Meta アカウント以外の状態を返します
+func (m *memoryState) Meta(key string) (string, error) {
+	return m.meta[key], nil
+}
+
+// SetMeta アカウント以外の状態を保存します
+func (m *memoryState) SetMeta(key, value string) error {
+	if value == "" {
+		delete(m.meta, key)
+		return nil
+	}
+	m.meta[key] = value
+	return nil
+}
+
+// Get DNのアカウントの状態を返します
+func (m *memoryState) Get(dn string) (AccountState, bool, error) {
+	idx, ok := m.index[dnKey(dn)]
+	if !ok {
+		return AccountState{}, false, nil
+	}
+	return m.state[idx], true, nil
+}
+
+// List 全アカウントの状態を返します
+func (m *memoryState) List() (State, error) {
+	state := make(State, len(m.state))
+	copy(state, m.state)
+	return state, nil
+}
+
+// Upsert アカウントの状態を追加、更新します
+func (m *memoryState) Upsert(data AccountState) error {
+	if idx, ok := m.index[dnKey(data.Dn)]; ok {
+		m.state[idx] = data
+		return nil
+	}
+	m.index[dnKey(data.Dn)] = len(m.state)
+	m.state = append(m.state, data)
+	return nil
+}
+
+// Delete アカウントの状態を削除します
+func (m *memoryState) Delete(dn string) error {
+	idx, ok := m.index[dnKey(dn)]
+	if !ok {
+		return nil
+	}
+	m.state = append(m.state[:idx:idx], m.state[idx+1:]...)
+	delete(m.index, dnKey(dn))
+	for i := idx; i < len(m.state); i++ {
+		m.index[dnKey(m.state[i].Dn)] = i
+	}
+	return nil
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, backend := range []string{stateBackendJSON, stateBackendBolt} {
+		path := filepath.Join(dir, "state."+backend)
+		store, err := NewStateStore(backend, path, 2, nil)
+		if err != nil {
+			t.Fatalf("NewStateStore[%s] failed: %v", backend, err)
+		}
+		if err := store.Load(); err != nil {
+			t.Fatalf("StateStore[%s].Load failed: %v", backend, err)
+		}
+
+		// Pattern: [Upsert Get Delete]
+		for i, account := range testAccounts {
+			if err := store.Upsert(AccountState{Account: account, OktaUserID: "00u" + string('a'+rune(i))}); err != nil {
+				t.Fatalf("StateStore[%s].Upsert failed: %v", backend, err)
+			}
+		}
+		updated := AccountState{Account: testAccounts[0], OktaUserID: "00u_updated"}
+		store.Upsert(updated)
+		if data, ok, err := store.Get(testAccounts[0].Dn); err != nil || !ok || data.OktaUserID != "00u_updated" {
+			t.Errorf("StateStore[%s].Get wrong: %v, %v, %v", backend, data, ok, err)
+		}
+		if err := store.Delete(testAccounts[1].Dn); err != nil {
+			t.Fatalf("StateStore[%s].Delete failed: %v", backend, err)
+		}
+		if _, ok, _ := store.Get(testAccounts[1].Dn); ok {
+			t.Errorf("StateStore[%s].Delete not deleted", backend)
+		}
+		if state, _ := store.List(); len(state) != 2 {
+			t.Errorf("StateStore[%s].List wrong: %v", backend, state)
+		}
+
+		// Pattern: [DnCase] DNの大文字小文字を区別しない（元のDNを保存する）
+		upper := AccountState{Account: testAccounts[2], OktaUserID: "00u_upper"}
+		upper.Dn = strings.ToUpper(upper.Dn)
+		if err := store.Upsert(upper); err != nil {
+			t.Fatalf("StateStore[%s].Upsert [DnCase]failed: %v", backend, err)
+		}
+		if data, ok, err := store.Get(testAccounts[2].Dn); err != nil || !ok || data.Dn != upper.Dn || data.OktaUserID != "00u_upper" {
+			t.Errorf("StateStore[%s].Get [DnCase]wrong: %v, %v, %v", backend, data, ok, err)
+		}
+		if state, _ := store.List(); len(state) != 2 {
+			t.Errorf("StateStore[%s].List [DnCase]wrong: %v", backend, state)
+		}
+		store.Delete(upper.Dn)
+		if _, ok, _ := store.Get(testAccounts[2].Dn); ok {
+			t.Errorf("StateStore[%s].Delete [DnCase]not deleted", backend)
+		}
+		store.Upsert(AccountState{Account: testAccounts[2], OktaUserID: "00uc"})
+
+		// Pattern: [Rollback] fnがエラーを返した場合は更新しない
+		err = store.Transaction(func(tx StateTx) error {
+			if err := ReplaceState(tx, State{}); err != nil {
+				return err
+			}
+			return errors.New("abort")
+		})
+		if err == nil {
+			t.Errorf("StateStore[%s].Transaction error not returned", backend)
+		}
+		if state, _ := store.List(); len(state) != 2 {
+			t.Errorf("StateStore[%s].Transaction not rolled back: %v", backend, state)
+		}
+
+		// Pattern: [Meta] アカウント以外の状態（空の場合は削除）
+		if err := store.SetMeta(metaWatermark, "deleted"); err != nil {
+			t.Fatalf("StateStore[%s].SetMeta failed: %v", backend, err)
+		}
+		store.SetMeta(metaWatermark, "")
+		store.SetMeta("test.key", "test value")
+		if value, err := store.Meta(metaWatermark); err != nil || value != "" {
+			t.Errorf("StateStore[%s].SetMeta not deleted: %s, %v", backend, value, err)
+		}
+
+		// Pattern: [Reopen] 開き直しても同じ状態を読み込める
+		if err := store.Backup(); err != nil {
+			t.Fatalf("StateStore[%s].Backup failed: %v", backend, err)
+		}
+		store.Close()
+		store, _ = NewStateStore(backend, path, 2, nil)
+		if err := store.Load(); err != nil {
+			t.Fatalf("StateStore[%s].Load reopen failed: %v", backend, err)
+		}
+		state, _ := store.List()
+		index := state.Index()
+		if len(state) != 2 || index[testAccounts[0].Dn].OktaUserID != "00u_updated" {
+			t.Errorf("StateStore[%s] reopen wrong: %v", backend, state)
+		}
+		if value, _ := store.Meta("test.key"); value != "test value" {
+			t.Errorf("StateStore[%s] reopen meta wrong: %s", backend, value)
+		}
+		if backups, _ := listBackups(path); len(backups) != 1 {
+			t.Errorf("StateStore[%s].Backup wrong: %v", backend, backups)
+		}
+		store.Close()
+	}
+
+	if _, err := NewStateStore("sqlite", "", 0, nil); err == nil {
+		t.Error("NewStateStore unknown backend error not returned")
+	}
+}
+
+func TestBoltStateStoreMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Pattern: [Raw Dn] DNそのままのキーのdb（version 1）はdnKeyのキーで書き直す
+	path := filepath.Join(dir, "state.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := AccountState{Account: testAccounts[0], OktaUserID: "00u_aaa"}
+	upper.Dn = strings.ToUpper(upper.Dn)
+	value, _ := json.Marshal(upper)
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucket(boltMetaBucket)
+		meta.Put(boltVersionKey, []byte(strconv.Itoa(boltVersionRawDn)))
+		accounts, _ := tx.CreateBucket(boltAccountsBucket)
+		return accounts.Put([]byte(upper.Dn), value)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &BoltStateStore{Path: path}
+	if err := store.Load(); err != nil {
+		t.Fatalf("BoltStateStore.Load [Raw Dn]failed: %v", err)
+	}
+	defer store.Close()
+	if data, ok, err := store.Get(testAccounts[0].Dn); err != nil || !ok || data.Dn != upper.Dn {
+		t.Errorf("BoltStateStore.Get [Raw Dn]wrong: %v, %v, %v", data, ok, err)
+	}
+	store.Delete(testAccounts[0].Dn)
+	if state, _ := store.List(); len(state) != 0 {
+		t.Errorf("BoltStateStore.Delete [Raw Dn]not deleted: %v", state)
+	}
+}
+
+func TestStateStoreEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := make([]*StateKey, 2)
+	for i := range keys {
+		value, err := GenerateStateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys[i], err = LoadStateKey(value, ""); err != nil {
+			t.Fatalf("LoadStateKey failed: %v", err)
+		}
+	}
+	if key, err := LoadStateKey("", ""); key != nil || err != nil {
+		t.Errorf("LoadStateKey [Empty]wrong: %v, %v", key, err)
+	}
+	if _, err := LoadStateKey("c2hvcnQ=", ""); err == nil {
+		t.Error("LoadStateKey [Short]error not returned")
+	}
+
+	open := func(backend, path string, key *StateKey) (StateStore, error) {
+		store, _ := NewStateStore(backend, path, 0, key)
+		return store, store.Load()
+	}
+	for _, backend := range []string{stateBackendJSON, stateBackendBolt} {
+		path := filepath.Join(dir, "state."+backend)
+
+		// Pattern: [Plain] 暗号化していない状態をキーを指定して書き出すと暗号化される
+		store, err := open(backend, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Upsert(AccountState{Account: testAccounts[0], OktaUserID: "00u_aaa"})
+		store.Close()
+		if store, err = open(backend, path, keys[0]); err != nil {
+			t.Fatalf("StateStore[%s] [Plain]load with key failed: %v", backend, err)
+		}
+		store.Upsert(AccountState{Account: testAccounts[1], OktaUserID: "00u_bbb"})
+		store.Close()
+		data, _ := ioutil.ReadFile(path)
+		if bytes.Contains(data, []byte(testAccounts[0].Email)) || bytes.Contains(data, []byte(testAccounts[1].Email)) {
+			t.Errorf("StateStore[%s] [Plain]not encrypted", backend)
+		}
+
+		// Pattern: [Wrong Key] キーがない、または違うキーはエラー
+		if _, err := open(backend, path, nil); err == nil {
+			t.Errorf("StateStore[%s] [Wrong Key]no key error not returned", backend)
+		}
+		if _, err := open(backend, path, keys[1]); err == nil {
+			t.Errorf("StateStore[%s] [Wrong Key]another key error not returned", backend)
+		}
+
+		// Pattern: [Rotate] 新しいキーでだけ読める
+		if store, err = open(backend, path, keys[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.RotateKey(keys[1]); err != nil {
+			t.Fatalf("StateStore[%s].RotateKey failed: %v", backend, err)
+		}
+		store.Close()
+		if _, err := open(backend, path, keys[0]); err == nil {
+			t.Errorf("StateStore[%s] [Rotate]old key error not returned", backend)
+		}
+		if store, err = open(backend, path, keys[1]); err != nil {
+			t.Fatalf("StateStore[%s] [Rotate]load with new key failed: %v", backend, err)
+		}
+		state, _ := store.List()
+		if len(state) != 2 || state.Index()[testAccounts[0].Dn].OktaUserID != "00u_aaa" {
+			t.Errorf("StateStore[%s] [Rotate]state wrong: %v", backend, state)
+		}
+		store.Close()
+	}
+}
+
+func TestJSONStateStoreLog(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	logPath := path + stateLogSuffix
+	key, _ := GenerateStateKey()
+	stateKey, err := LoadStateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pattern: [Append] 1件ずつは追記ログにだけ書き、状態ファイル全体は書き出さない
+	store := &JSONStateStore{File: StateFile{Path: path, Key: stateKey}}
+	if err := store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for i, account := range testAccounts {
+		if err := store.Upsert(AccountState{Account: account, OktaUserID: "00u" + string('a'+rune(i))}); err != nil {
+			t.Fatalf("Upsert failed: %v", err)
+		}
+	}
+	store.Delete(testAccounts[1].Dn)
+	store.SetMeta("test.key", "test value")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("[Append]state file written: %v", err)
+	}
+	data, _ := ioutil.ReadFile(logPath)
+	if len(bytes.Split(bytes.TrimSpace(data), []byte("\n"))) != len(testAccounts)+2 {
+		t.Errorf("[Append]log wrong: %s", data)
+	}
+	if bytes.Contains(data, []byte(testAccounts[0].Email)) {
+		t.Errorf("[Append]log not encrypted: %s", data)
+	}
+
+	// Pattern: [Replay] 終了しなかった実行の追記ログを読み込む（書き込み途中の最後の行は読み飛ばす）
+	file, _ := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"op":"upsert","data":{"dn":`)
+	file.Close()
+	replayed := &JSONStateStore{File: StateFile{Path: path, Key: stateKey}}
+	if err := replayed.Load(); err != nil {
+		t.Fatalf("[Replay]Load failed: %v", err)
+	}
+	state, _ := replayed.List()
+	if len(state) != len(testAccounts)-1 || state.Index()[testAccounts[0].Dn].OktaUserID != "00ua" {
+		t.Errorf("[Replay]state wrong: %v", state)
+	}
+	if value, _ := replayed.Meta("test.key"); value != "test value" {
+		t.Errorf("[Replay]meta wrong: %s", value)
+	}
+	if err := (&JSONStateStore{File: StateFile{Path: path}}).Load(); err == nil {
+		t.Error("[Replay]encrypted log without key error not returned")
+	}
+	if err := replayed.SetMeta("test.torn", "appended"); err != nil {
+		t.Fatalf("[Replay]append after the incomplete line failed: %v", err)
+	}
+	replayed.log.Close()
+	reloaded := &JSONStateStore{File: StateFile{Path: path, Key: stateKey}}
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("[Replay]incomplete line not truncated: %v", err)
+	}
+	if value, _ := reloaded.Meta("test.torn"); value != "appended" {
+		t.Errorf("[Replay]appended meta wrong: %s", value)
+	}
+
+	// Pattern: [Close] 追記した実行の終了時に状態ファイルにまとめる（読み込んだだけの実行はまとめない）
+	reloaded.Close()
+	if _, err := os.Stat(logPath); err != nil {
+		t.Errorf("[Close]log removed by a reader: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("[Close]failed: %v", err)
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("[Close]log not removed: %v", err)
+	}
+	if state, _, err := (StateFile{Path: path, Key: stateKey}).LoadWithMeta(); err != nil || len(state) != len(testAccounts)-1 {
+		t.Errorf("[Close]state file wrong: %v, %v", state, err)
+	}
+
+	// Pattern: [Compact] stateLogCompactEvery件ごとに状態ファイルにまとめる
+	store = &JSONStateStore{File: StateFile{Path: path}}
+	store.Load()
+	for i := 0; i < stateLogCompactEvery; i++ {
+		store.SetMeta("test.count", string(rune('a'+i%26)))
+	}
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("[Compact]log not removed: %v", err)
+	}
+	if _, meta, _ := (StateFile{Path: path}).LoadWithMeta(); meta["test.count"] == "" {
+		t.Errorf("[Compact]state file not written: %v", meta)
+	}
+	store.Close()
+
+	// Pattern: [Corrupted] 途中の行が読めない場合はエラー
+	ioutil.WriteFile(logPath, []byte("{broken\n{\"op\":\"delete\",\"dn\":\"x\"}\n"), 0600)
+	if err := (&JSONStateStore{File: StateFile{Path: path}}).Load(); err == nil {
+		t.Error("[Corrupted]error not returned")
+	}
+}
+
+func TestCopyState(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from, _ := NewStateStore(stateBackendJSON, filepath.Join(dir, "state.json"), 0, nil)
+	from.Load()
+	for _, account := range testAccounts {
+		from.Upsert(AccountState{Account: account, OktaUserID: "00u_" + account.UID})
+	}
+	from.SetMeta(metaWatermark, "20240101000000Z")
+	from.SetMeta("test.other", "not copied")
+
+	// Pattern: [Copy] アカウントと指定したmetaをbolt backendに複製する
+	to, _ := NewStateStore(stateBackendBolt, filepath.Join(dir, "state.db"), 0, nil)
+	if err := to.Load(); err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	if err := CopyState(from, to, []string{metaWatermark}); err != nil {
+		t.Fatalf("CopyState failed: %v", err)
+	}
+	state, _ := to.List()
+	if len(state) != len(testAccounts) || state.Index()[testAccounts[0].Dn].OktaUserID != "00u_"+testAccounts[0].UID {
+		t.Errorf("CopyState accounts wrong: %v", state)
+	}
+	if value, _ := to.Meta(metaWatermark); value != "20240101000000Z" {
+		t.Errorf("CopyState meta wrong: %s", value)
+	}
+	if value, _ := to.Meta("test.other"); value != "" {
+		t.Errorf("CopyState copied another meta: %s", value)
+	}
+
+	// Pattern: [Not Empty] 既にアカウントがある場合はエラー
+	if err := CopyState(from, to, nil); err == nil {
+		t.Error("CopyState to a non-empty state error not returned")
+	}
+}
+
+func TestStateStoreEncryptionBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys := make([]*StateKey, 2)
+	for i := range keys {
+		value, _ := GenerateStateKey()
+		keys[i], _ = LoadStateKey(value, "")
+	}
+	plaintext := func(path string) []string {
+		var found []string
+		files, _ := listBackups(path)
+		for _, file := range append(files, path) {
+			if data, _ := ioutil.ReadFile(file); bytes.Contains(data, []byte(testAccounts[0].Email)) {
+				found = append(found, file)
+			}
+		}
+		return found
+	}
+
+	for _, backend := range []string{stateBackendJSON, stateBackendBolt} {
+		path := filepath.Join(dir, "state."+backend)
+		store, _ := NewStateStore(backend, path, 3, nil)
+		store.Load()
+		store.Upsert(AccountState{Account: testAccounts[0], OktaUserID: "00u_aaa"})
+		store.Backup()
+		store.Upsert(AccountState{Account: testAccounts[1], OktaUserID: "00u_bbb"})
+		store.Close()
+
+		// Pattern: [Encrypt] 暗号化を始めると、平文のバックアップと空きページを残さない
+		store, _ = NewStateStore(backend, path, 3, keys[0])
+		if err := store.Load(); err != nil {
+			t.Fatalf("StateStore[%s] [Encrypt]load failed: %v", backend, err)
+		}
+		store.Backup()
+		store.Upsert(AccountState{Account: testAccounts[2], OktaUserID: "00u_ccc"})
+		store.Close()
+		if found := plaintext(path); len(found) != 0 {
+			t.Errorf("StateStore[%s] [Encrypt]plaintext remains: %v", backend, found)
+		}
+		backups, _ := listBackups(path)
+		if len(backups) != 2 {
+			t.Fatalf("StateStore[%s] [Encrypt]backups wrong: %v", backend, backups)
+		}
+
+		// Pattern: [Rotate] バックアップも新しいキーでだけ読める
+		store, _ = NewStateStore(backend, path, 3, keys[0])
+		store.Load()
+		store.RotateKey(keys[1])
+		store.Close()
+		if err := rekeyBackups(backend, path, keys[0], keys[1]); err != nil {
+			t.Fatalf("rekeyBackups[%s] failed: %v", backend, err)
+		}
+		for _, backup := range backups {
+			if old, _ := NewStateStore(backend, backup, 0, keys[0]); old.Load() == nil {
+				old.Close()
+				t.Errorf("StateStore[%s] [Rotate]backup %s readable with the old key", backend, backup)
+			}
+			restored, _ := NewStateStore(backend, backup, 0, keys[1])
+			if err := restored.Load(); err != nil {
+				t.Errorf("StateStore[%s] [Rotate]backup %s not readable with the new key: %v", backend, backup, err)
+			} else if state, _ := restored.List(); len(state) == 0 {
+				t.Errorf("StateStore[%s] [Rotate]backup %s lost the state", backend, backup)
+			}
+			restored.Close()
+		}
+	}
+}
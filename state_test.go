@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testStateFileNm = "tmp/test_state.json"
+
+func TestStateSaveAndLoad(t *testing.T) {
+	var account = Account{}
+
+	// 旧形式（LDAPの値のみ）のファイルも読めること
+	testData := testAccounts
+	if err := account.OutJSON(testStateFileNm, &testData); err != nil {
+		t.Fatalf("account.OutJSON exec failed: %v", err)
+	}
+	stateFile := StateFile{Path: testStateFileNm, Backups: 2}
+	state, err := stateFile.Load()
+	if err != nil {
+		t.Fatalf("stateFile.Load [legacy]exec failed: %v", err)
+	}
+	if len(state) != len(testAccounts) {
+		t.Fatalf("stateFile.Load [legacy]count wrong: %d", len(state))
+	}
+	for idx, data := range state {
+		if data.Dn != testAccounts[idx].Dn || data.OktaUserID != "" {
+			t.Errorf("stateFile.Load [legacy]data wrong: %v", data)
+		}
+	}
+
+	// Okta IDを含めて保存・読み込みできること
+	state[0].OktaUserID = "00u_aaa"
+	state[0].OktaGroupIDs = []string{"00g_001", "00g_002"}
+	state[0].ProfileHash = state[0].OktaProfile().Hash()
+	if err := stateFile.Save(state); err != nil {
+		t.Fatalf("stateFile.Save exec failed: %v", err)
+	}
+	loaded, err := stateFile.Load()
+	if err != nil {
+		t.Fatalf("stateFile.Load exec failed: %v", err)
+	}
+	index := loaded.Index()
+	data := index[testAccounts[0].Dn]
+	if data.OktaUserID != "00u_aaa" ||
+		len(data.OktaGroupIDs) != 2 ||
+		data.ProfileHash != testAccounts[0].OktaProfile().Hash() {
+		t.Errorf("stateFile.Load okta link wrong: %v", data)
+	}
+	if len(*loaded.Accounts()) != len(testAccounts) {
+		t.Errorf("state.Accounts count wrong: %d", len(*loaded.Accounts()))
+	}
+}
+
+func TestProfileHash(t *testing.T) {
+	a := testAccounts[0]
+	b := testAccounts[0]
+	if a.OktaProfile().Hash() != b.OktaProfile().Hash() {
+		t.Error("ProfileHash same account but different hash")
+	}
+	b.Email = "changed@example.com"
+	if a.OktaProfile().Hash() == b.OktaProfile().Hash() {
+		t.Error("ProfileHash changed account but same hash")
+	}
+}
+
+func TestStateFileBackupAndCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := StateFile{Path: filepath.Join(dir, "ldap_accounts.json"), Backups: 2}
+
+	// 保存するたびにバックアップされ、Backups件だけ残ること
+	for i := 0; i < 4; i++ {
+		state := State{{Account: testAccounts[0], OktaUserID: fmt.Sprintf("00u_%d", i)}}
+		if err := stateFile.Save(state); err != nil {
+			t.Fatalf("stateFile.Save exec failed: %v", err)
+		}
+	}
+	backups, err := listBackups(stateFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("stateFile.Save backup count wrong: %v", backups)
+	}
+	backup, err := StateFile{Path: backups[1]}.Load()
+	if err != nil || backup[0].OktaUserID != "00u_2" {
+		t.Errorf("stateFile.Save latest backup wrong: %v, %v", backup, err)
+	}
+	// 一時ファイルが残っていないこと
+	if tmpFiles, _ := filepath.Glob(filepath.Join(dir, ".*.tmp*")); len(tmpFiles) != 0 {
+		t.Errorf("stateFile.Save temp file remains: %v", tmpFiles)
+	}
+
+	// Pattern: [Modified] チェックサムが一致しない場合はエラー
+	data, err := ioutil.ReadFile(stateFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := bytes.Replace(data, []byte("00u_3"), []byte("00u_X"), 1)
+	if err := ioutil.WriteFile(stateFile.Path, modified, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateFile.Load(); err == nil {
+		t.Error("stateFile.Load [Modified]corruption not detected")
+	}
+
+	// Pattern: [Truncated] 途中で切れている場合はエラー
+	if err := ioutil.WriteFile(stateFile.Path, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateFile.Load(); err == nil {
+		t.Error("stateFile.Load [Truncated]corruption not detected")
+	}
+
+	// Pattern: [Missing] バックアップがあるのにファイルがない場合は初回実行にしない
+	os.Remove(stateFile.Path)
+	if _, err := stateFile.Load(); err == nil {
+		t.Error("stateFile.Load [Missing]error not returned")
+	}
+	bolt := &BoltStateStore{Path: filepath.Join(dir, "state.db")}
+	ioutil.WriteFile(bolt.Path+".20240101T000000Z.bak", []byte("backup"), 0600)
+	if err := bolt.Load(); err == nil {
+		bolt.Close()
+		t.Error("BoltStateStore.Load [Missing]error not returned")
+	}
+}
+
+func TestStateFileVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := StateFile{Path: filepath.Join(dir, "ldap_accounts.json")}
+
+	// Pattern: [First Run] ファイルが存在しない場合は空の状態
+	state, err := stateFile.Load()
+	if err != nil || len(state) != 0 {
+		t.Errorf("stateFile.Load [First Run]wrong: %v, %v", state, err)
+	}
+
+	// Pattern: [Empty] 空のファイルはエラー
+	if err := ioutil.WriteFile(stateFile.Path, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateFile.Load(); err == nil {
+		t.Error("stateFile.Load [Empty]error not returned")
+	}
+
+	// Pattern: [Version 2] versionのないチェックサム付きのファイル
+	accounts := `[{"dn":"uid=aaa_user,dc=example,dc=com","uid":"aaa_user","oktaUserId":"00u_aaa"}]`
+	v2 := fmt.Sprintf(`{"checksum": "%s", "accounts": %s}`, checksum([]byte(accounts)), accounts)
+	if err := ioutil.WriteFile(stateFile.Path, []byte(v2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err = stateFile.Load()
+	if err != nil || len(state) != 1 || state[0].OktaUserID != "00u_aaa" {
+		t.Fatalf("stateFile.Load [Version 2]wrong: %v, %v", state, err)
+	}
+
+	// Pattern: [Version 4] metaのないversion付きのファイル
+	v4 := fmt.Sprintf(`{"version": %d, "checksum": "%s", "accounts": %s}`, stateVersionEncrypted, checksum([]byte(accounts)), accounts)
+	if err := ioutil.WriteFile(stateFile.Path, []byte(v4), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if state, meta, err := stateFile.LoadWithMeta(); err != nil || len(state) != 1 || len(meta) != 0 {
+		t.Errorf("stateFile.Load [Version 4]wrong: %v, %v, %v", state, meta, err)
+	}
+
+	// Pattern: [Array] アカウントの配列のみのファイル（version 1）
+	if err := ioutil.WriteFile(stateFile.Path, []byte(accounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err = stateFile.Load()
+	if err != nil || len(state) != 1 || state[0].OktaUserID != "00u_aaa" {
+		t.Fatalf("stateFile.Load [Array]wrong: %v, %v", state, err)
+	}
+
+	// 保存すると現在のversionになる
+	if err := stateFile.Save(state); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(stateFile.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := decodeStateEnvelope(data)
+	if err != nil || envelope.Version != stateVersionCurrent {
+		t.Errorf("stateFile.Save version wrong: %v, %v", envelope, err)
+	}
+
+	// Pattern: [Newer] 未対応のversionはエラー
+	newer := bytes.Replace(data, []byte(fmt.Sprintf(`"version": %d`, stateVersionCurrent)), []byte(`"version": 99`), 1)
+	if err := ioutil.WriteFile(stateFile.Path, newer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stateFile.Load(); err == nil {
+		t.Error("stateFile.Load [Newer]error not returned")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Syncer LDAPの差分をOktaへ反映します
+type Syncer struct {
+	Okta   OktaClient
+	Groups []string // 全アカウントを所属させるOktaグループ名
+	// Store アカウント毎にOktaへの反映が成功する度に状態を保存します（nilの場合は保存しない）
+	Store StateStore
+	// Journal アカウント毎の反映結果を記録します（nilの場合は記録しない）
+	Journal *Journal
+	// Stop 閉じた場合は実行中のアカウントの反映が終わってから中断します（nilの場合は中断しない）
+	Stop <-chan struct{}
+}
+
+// errSyncStopped Stopで中断した（残りのアカウントは次回の実行で反映されます）
+var errSyncStopped = errors.New("stopped by a signal, the remaining accounts are applied on the next run")
+
+// SyncError Oktaへの反映に失敗したアカウント
+type SyncError struct {
+	Key string // CreateKey, UpdateKey, DeleteKey
+	Dn  string
+	Err error
+}
+
+func (e SyncError) Error() string {
+	return fmt.Sprintf("[%s]%s: %v", e.Key, e.Dn, e.Err)
+}
+
+// Apply diffをOktaへ反映し、Okta IDを記録した新しい状態を返します。
+// アカウント毎に、Oktaへの反映が成功した場合だけ状態を更新してStoreに保存します。
+// 失敗したアカウントは状態を更新せずにSyncErrorとして返すので、次回の実行で再度反映されます。
+// グループが見つからない、状態の保存に失敗したなど続行できない場合はerrorを返します。
+// Stopが閉じた場合は次のアカウントに進まずにerrSyncStoppedを返します。
+func (s Syncer) Apply(state State, diff DiffResult) (State, []SyncError, error) {
+
+	index := state.Index()
+	var created []Account
+	// 既存の並び順を保ったまま、作成分を末尾に追加した状態を作ります
+	current := func() State {
+		result := State{}
+		for _, data := range append(*state.Accounts(), created...) {
+			if current, ok := index[dnKey(data.Dn)]; ok {
+				result = append(result, current)
+			}
+		}
+		return result
+	}
+	upsert := func(data AccountState) error {
+		old, renamed := index[dnKey(data.Dn)]
+		index[dnKey(data.Dn)] = data
+		if s.Store == nil {
+			return nil
+		}
+		if renamed && old.Dn != data.Dn {
+			// DNの大文字小文字だけが変わった場合は前のDNの状態を置き換えます
+			if err := s.Store.Delete(old.Dn); err != nil {
+				return err
+			}
+		}
+		return s.Store.Upsert(data)
+	}
+
+	groupIDs, err := s.groupIDs()
+	if err != nil {
+		return state, nil, err
+	}
+
+	var failures []SyncError
+	for _, data := range diff.Accounts(CreateKey) {
+		if s.stopped() {
+			return current(), failures, errSyncStopped
+		}
+		syncer, requests := s.track(CreateKey, data)
+		result, err := syncer.create(data, groupIDs)
+		logAccount(CreateKey, data, result.OktaUserID, requests, err)
+		if jerr := s.record(CreateKey, data.Dn, result.OktaUserID, nil, nil, err); jerr != nil {
+			return current(), failures, jerr
+		}
+		if err != nil {
+			failures = append(failures, SyncError{Key: CreateKey, Dn: data.Dn, Err: err})
+			if result.OktaUserID == "" {
+				continue
+			}
+		}
+		// 作成後にグループへの追加が失敗した場合も、作成したユーザーのIDを保存して次回は更新にします
+		created = append(created, data)
+		if err := upsert(result); err != nil {
+			return current(), failures, err
+		}
+	}
+	for _, data := range diff[UpdateKey] {
+		if s.stopped() {
+			return current(), failures, errSyncStopped
+		}
+		old := index[dnKey(data.Dn)]
+		syncer, requests := s.track(UpdateKey, data.Account)
+		result, err := syncer.update(old, data.Account, groupIDs)
+		logAccount(UpdateKey, data.Account, result.OktaUserID, requests, err)
+		if jerr := s.record(UpdateKey, data.Dn, result.OktaUserID, data.Changes, &old, err); jerr != nil {
+			return current(), failures, jerr
+		}
+		if err != nil {
+			failures = append(failures, SyncError{Key: UpdateKey, Dn: data.Dn, Err: err})
+			if result.OktaUserID == "" || result.OktaUserID == old.OktaUserID {
+				continue
+			}
+		}
+		if err := upsert(result); err != nil {
+			return current(), failures, err
+		}
+	}
+	for _, data := range diff.Accounts(DeleteKey) {
+		if s.stopped() {
+			return current(), failures, errSyncStopped
+		}
+		old := index[dnKey(data.Dn)]
+		syncer, requests := s.track(DeleteKey, data)
+		err := syncer.delete(old)
+		logAccount(DeleteKey, data, old.OktaUserID, requests, err)
+		if jerr := s.record(DeleteKey, data.Dn, old.OktaUserID, nil, &old, err); jerr != nil {
+			return current(), failures, jerr
+		}
+		if err != nil {
+			failures = append(failures, SyncError{Key: DeleteKey, Dn: data.Dn, Err: err})
+			continue
+		}
+		delete(index, dnKey(data.Dn))
+		if s.Store != nil {
+			if err := s.Store.Delete(data.Dn); err != nil {
+				return current(), failures, err
+			}
+		}
+	}
+
+	return current(), failures, nil
+}
+
+// stopped Stopが閉じている場合はtrue
+func (s Syncer) stopped() bool {
+	select {
+	case <-s.Stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// track アカウントのOkta APIのリクエストをログに出力し、X-Okta-Request-Idを集めるSyncer
+func (s Syncer) track(operation string, account Account) (Syncer, *oktaRequests) {
+	client := *s.Okta.httpClient()
+	requests := &oktaRequests{base: client.Transport, attrs: accountLogAttrs(operation, account)}
+	client.Transport = requests
+	s.Okta.HTTPClient = &client
+	return s, requests
+}
+
+// logAccount アカウントの反映結果を出力します（失敗した場合はerror）
+func logAccount(operation string, account Account, oktaUserID string, requests *oktaRequests, err error) {
+	attrs := append(accountLogAttrs(operation, account), logKeyOktaUserID, oktaUserID, logKeyOktaRequestID, requests.IDs())
+	if err != nil {
+		slog.Error("account failed, retried on the next run", append(attrs, "error", err)...)
+		return
+	}
+	slog.Info("account synced", attrs...)
+}
+
+// record アカウントの反映結果をJournalに記録します
+func (s Syncer) record(operation, dn, oktaUserID string, changes []FieldChange, previous *AccountState, err error) error {
+	entry := JournalEntry{
+		Type:       journalAccount,
+		Operation:  operation,
+		Dn:         dn,
+		OktaUserID: oktaUserID,
+		Changes:    changes,
+		Previous:   previous,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return s.Journal.Record(entry)
+}
+
+// groupIDs Groupsのグループ名をOktaのグループIDに変換します
+func (s Syncer) groupIDs() ([]string, error) {
+	var ids []string
+	for _, name := range s.Groups {
+		group, err := s.Okta.SearchGroups(name)
+		if err != nil {
+			return nil, err
+		}
+		if group.ID == "" {
+			return nil, fmt.Errorf("Not Found Okta group: %s", name)
+		}
+		ids = append(ids, group.ID)
+	}
+	return ids, nil
+}
+
+// userID 状態に記録されたOktaユーザーIDを返します。未記録（旧形式の状態ファイル）の場合はloginで検索します
+func (s Syncer) userID(state AccountState) (string, error) {
+	if state.OktaUserID != "" {
+		return state.OktaUserID, nil
+	}
+	user, err := s.Okta.GetUserWithLogin(state.OktaProfile().Login)
+	if err != nil {
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// create ユーザーを作成してグループに追加します。
+// グループへの追加が失敗した場合は、作成したユーザーのIDとReconcileを付けた状態をerrorと一緒に返します（次の同期でグループを追加します）。
+func (s Syncer) create(account Account, groupIDs []string) (AccountState, error) {
+	profile := account.OktaProfile()
+	user, err := s.Okta.CreateUser(profile)
+	if err != nil {
+		return AccountState{}, err
+	}
+	for _, gid := range groupIDs {
+		if err := s.Okta.AddUserToGroup(gid, user.ID); err != nil {
+			return AccountState{Account: account, OktaUserID: user.ID, Reconcile: true}, err
+		}
+	}
+	return AccountState{
+		Account:      account,
+		OktaUserID:   user.ID,
+		OktaGroupIDs: groupIDs,
+		ProfileHash:  profile.Hash(),
+	}, nil
+}
+
+func (s Syncer) update(old AccountState, account Account, groupIDs []string) (AccountState, error) {
+	id, err := s.userID(old)
+	if err != nil {
+		return old, err
+	}
+	if id == "" {
+		// Okta側に存在しない場合は作り直す
+		return s.create(account, groupIDs)
+	}
+	// 変更のあったprofile属性だけを部分更新（adoptで紐付けたアカウントは全ての属性）
+	profile := account.OktaProfile()
+	attributes := make(map[string]string)
+	for _, change := range profileChanges(old.OktaProfile(), profile) {
+		attributes[change.Field] = change.New
+	}
+	if old.Reconcile {
+		attributes = map[string]string{
+			"login": profile.Login, "email": profile.Email, "firstName": profile.FirstName,
+			"lastName": profile.LastName, "employeeNumber": profile.EmployeeNumber,
+		}
+	}
+	if len(attributes) > 0 {
+		if _, err := s.Okta.UpdateUser(id, attributes); err != nil {
+			return old, err
+		}
+	}
+	for _, gid := range groupIDs {
+		if contains(old.OktaGroupIDs, gid) {
+			continue
+		}
+		if err := s.Okta.AddUserToGroup(gid, id); err != nil {
+			return old, err
+		}
+	}
+	return AccountState{
+		Account:      account,
+		OktaUserID:   id,
+		OktaGroupIDs: groupIDs,
+		ProfileHash:  profile.Hash(),
+	}, nil
+}
+
+func (s Syncer) delete(old AccountState) error {
+	id, err := s.userID(old)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		slog.Warn("okta user not found, nothing to delete", accountLogAttrs(DeleteKey, old.Account)...)
+		return nil
+	}
+	if err := s.Okta.DeleteUser(id); err != nil {
+		return err
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// fakeOkta テスト用のOkta API
+type fakeOkta struct {
+	mu     sync.Mutex
+	users  map[string]OktaUser // key: id
+	groups map[string][]string // key: group id, value: user ids
+	fail   map[string]bool     // 失敗させるlogin
+	// failGroups 追加、削除を失敗させるグループID
+	failGroups map[string]bool
+	// created ユーザーを作成した後に呼び出します（nilの場合は呼び出さない）
+	created func(user OktaUser)
+	calls   []string
+}
+
+func newFakeOkta() *fakeOkta {
+	return &fakeOkta{
+		users:      make(map[string]OktaUser),
+		groups:     make(map[string][]string),
+		fail:       make(map[string]bool),
+		failGroups: make(map[string]bool),
+	}
+}
+
+// start fakeOktaのサーバーを起動してOktaClientを返します
+func (f *fakeOkta) start() (*httptest.Server, OktaClient) {
+	srv := httptest.NewTLSServer(f)
+	return srv, OktaClient{
+		FQDN:       strings.TrimPrefix(srv.URL, "https://"),
+		APIKEY:     "test_apikey",
+		HTTPClient: srv.Client(),
+	}
+}
+
+func (f *fakeOkta) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+
+	switch {
+	case r.Method == "POST" && len(path) == 1 && path[0] == "users":
+		var req CreateUserRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if f.fail[req.Login] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		user := OktaUser{ID: "00u_" + req.FirstName, Status: "PROVISIONED", UserProfile: req.UserProfile}
+		f.users[user.ID] = user
+		if f.created != nil {
+			f.created(user)
+		}
+		json.NewEncoder(w).Encode(user)
+
+	case r.Method == "GET" && len(path) == 2 && path[0] == "users":
+		user, ok := f.users[path[1]]
+		if !ok {
+			for _, u := range f.users {
+				if u.Login == path[1] {
+					user, ok = u, true
+				}
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+
+	case r.Method == "POST" && len(path) == 2 && path[0] == "users":
+		user, ok := f.users[path[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var req UpdateUserRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if f.fail[user.Login] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		profile, _ := json.Marshal(req.Profile)
+		json.Unmarshal(profile, &user.UserProfile)
+		f.users[user.ID] = user
+		json.NewEncoder(w).Encode(user)
+
+	case r.Method == "POST" && len(path) == 4 && path[2] == "lifecycle":
+		user, ok := f.users[path[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if f.fail[user.Login] {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch path[3] {
+		case "deactivate":
+			user.Status = oktaStatusDeprovisioned
+		case "activate", "unsuspend":
+			user.Status = "ACTIVE"
+		}
+		f.users[user.ID] = user
+		w.Write([]byte("{}"))
+
+	case r.Method == "DELETE" && len(path) == 2 && path[0] == "users":
+		if _, ok := f.users[path[1]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.users, path[1])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "GET" && len(path) == 3 && path[0] == "users" && path[2] == "groups":
+		var groups []OktaGroup
+		for gid, members := range f.groups {
+			if contains(members, path[1]) {
+				groups = append(groups, OktaGroup{ID: gid})
+			}
+		}
+		json.NewEncoder(w).Encode(groups)
+
+	case r.Method == "GET" && len(path) == 1 && path[0] == "groups":
+		name := r.URL.Query().Get("q")
+		json.NewEncoder(w).Encode([]OktaGroup{{ID: "00g_" + name, GroupProfile: GroupProfile{Name: name}}})
+
+	case len(path) == 4 && path[0] == "groups" && path[2] == "users":
+		gid, uid := path[1], path[3]
+		if f.failGroups[gid] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var members []string
+		for _, member := range f.groups[gid] {
+			if member != uid {
+				members = append(members, member)
+			}
+		}
+		if r.Method == "PUT" {
+			members = append(members, uid)
+		}
+		f.groups[gid] = members
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSyncerApply(t *testing.T) {
+	okta := newFakeOkta()
+	srv, oktaClient := okta.start()
+	defer srv.Close()
+	okta.fail["bbb_user@example.com"] = true
+
+	dir, err := ioutil.TempDir("tmp", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &recordingStore{StateStore: &JSONStateStore{File: StateFile{Path: filepath.Join(dir, "state.json")}}}
+	syncer := Syncer{
+		Okta:   oktaClient,
+		Groups: []string{"everyone"},
+		Store:  store,
+	}
+
+	// Pattern: [Create] 失敗したアカウントは状態に追加しない
+	diff, err := DefaultMapping().Diff(&[]Account{}, &testAccounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, failures, err := syncer.Apply(State{}, diff)
+	if err != nil {
+		t.Fatalf("Syncer.Apply [Create]exec failed: %v", err)
+	}
+	if len(failures) != 1 || failures[0].Dn != testAccounts[1].Dn || failures[0].Key != CreateKey {
+		t.Errorf("Syncer.Apply [Create]failures wrong: %v", failures)
+	}
+	if len(state) != 2 || len(store.upserts) != 2 {
+		t.Fatalf("Syncer.Apply [Create]state or upsert count wrong: %d, %d", len(state), len(store.upserts))
+	}
+	if store.upserts[0].Dn != testAccounts[0].Dn {
+		t.Errorf("Syncer.Apply [Create]first upsert wrong: %v", store.upserts[0])
+	}
+	index := state.Index()
+	if index[testAccounts[0].Dn].OktaUserID != "00u_aaa_user" ||
+		len(index[testAccounts[0].Dn].OktaGroupIDs) != 1 || index[testAccounts[0].Dn].OktaGroupIDs[0] != "00g_everyone" {
+		t.Errorf("Syncer.Apply [Create]okta link wrong: %v", index[testAccounts[0].Dn])
+	}
+	if !contains(okta.groups["00g_everyone"], "00u_ccc_user") {
+		t.Errorf("Syncer.Apply [Create]group member not added: %v", okta.groups)
+	}
+
+	// Pattern: [Retry] 失敗したアカウントは次回の差分で再度作成される
+	delete(okta.fail, "bbb_user@example.com")
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &testAccounts)
+	if len(diff[CreateKey]) != 1 || diff[CreateKey][0].Dn != testAccounts[1].Dn {
+		t.Fatalf("Syncer.Apply [Retry]diff wrong: %v", diff)
+	}
+	state, failures, err = syncer.Apply(state, diff)
+	if err != nil || len(failures) != 0 || len(state) != 3 {
+		t.Fatalf("Syncer.Apply [Retry]wrong: %v, %v, %d", err, failures, len(state))
+	}
+
+	// Pattern: [Update Delete] 状態に記録したIDで更新、削除する
+	newAccounts := []Account{testAccounts[0], testAccounts[1]}
+	newAccounts[0].Email = "aaa_new@example.com"
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &newAccounts)
+	okta.calls = nil
+	state, failures, err = syncer.Apply(state, diff)
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Syncer.Apply [Update Delete]exec failed: %v, %v", err, failures)
+	}
+	if len(state) != 2 || state.Index()[testAccounts[0].Dn].Email != "aaa_new@example.com" {
+		t.Errorf("Syncer.Apply [Update Delete]state wrong: %v", state)
+	}
+	if okta.users["00u_aaa_user"].Login != "aaa_new@example.com" {
+		t.Errorf("Syncer.Apply [Update Delete]okta user not updated: %v", okta.users["00u_aaa_user"])
+	}
+	if _, ok := okta.users["00u_ccc_user"]; ok {
+		t.Error("Syncer.Apply [Update Delete]okta user not deleted")
+	}
+	for _, call := range okta.calls {
+		if strings.HasPrefix(call, "GET /api/v1/users/") {
+			t.Errorf("Syncer.Apply [Update Delete]user looked up by login: %s", call)
+		}
+	}
+	stored, _ := store.List()
+	if len(stored) != len(state) {
+		t.Errorf("Syncer.Apply [Update Delete]stored state wrong: %v", stored)
+	}
+
+	// Pattern: [DnCase] DNの大文字小文字だけが変わった場合は削除と作成ではなく更新し、前のDNの状態を残さない
+	renamed := []Account{newAccounts[0], testAccounts[1]}
+	renamed[0].Dn = strings.ToUpper(renamed[0].Dn)
+	renamed[0].Email = "aaa_case@example.com"
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &renamed)
+	if len(diff[CreateKey]) != 0 || len(diff[DeleteKey]) != 0 || len(diff[UpdateKey]) != 1 {
+		t.Fatalf("Mapping.Diff [DnCase]diff wrong: %v", diff)
+	}
+	if state, _, err = syncer.Apply(state, diff); err != nil {
+		t.Fatalf("Syncer.Apply [DnCase]exec failed: %v", err)
+	}
+	stored, _ = store.List()
+	if len(state) != 2 || len(stored) != 2 || state.Index()[dnKey(renamed[0].Dn)].Dn != renamed[0].Dn {
+		t.Errorf("Syncer.Apply [DnCase]state wrong: %v, %v", state, stored)
+	}
+
+	// Pattern: [Store Error] 状態を保存できない場合は中断する
+	store.err = errors.New("disk full")
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &testAccounts)
+	if _, _, err := syncer.Apply(state, diff); err == nil {
+		t.Error("Syncer.Apply [Store Error]error not returned")
+	}
+}
+
+func TestSyncerApplyGroupError(t *testing.T) {
+	okta := newFakeOkta()
+	srv, oktaClient := okta.start()
+	defer srv.Close()
+	okta.failGroups["00g_everyone"] = true
+
+	dir, err := ioutil.TempDir("tmp", "sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &JSONStateStore{File: StateFile{Path: filepath.Join(dir, "state.json")}}
+	journal, err := OpenJournal(filepath.Join(dir, "journal.jsonl"), "run_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if err := journal.Record(JournalEntry{Type: journalRunStart}); err != nil {
+		t.Fatal(err)
+	}
+	syncer := Syncer{Okta: oktaClient, Groups: []string{"everyone"}, Store: store, Journal: journal}
+
+	// Pattern: [Group Error] 作成後にグループへの追加が失敗した場合は、作成したユーザーのIDを保存して失敗にする
+	accounts := []Account{testAccounts[0]}
+	diff, _ := DefaultMapping().Diff(&[]Account{}, &accounts)
+	state, failures, err := syncer.Apply(State{}, diff)
+	if err != nil {
+		t.Fatalf("Syncer.Apply [Group Error]exec failed: %v", err)
+	}
+	if len(failures) != 1 || failures[0].Key != CreateKey {
+		t.Errorf("Syncer.Apply [Group Error]failures wrong: %v", failures)
+	}
+	stored, _, _ := store.Get(testAccounts[0].Dn)
+	if len(state) != 1 || state[0].OktaUserID != "00u_aaa_user" || len(state[0].OktaGroupIDs) != 0 || !state[0].Reconcile ||
+		stored.OktaUserID != "00u_aaa_user" {
+		t.Fatalf("Syncer.Apply [Group Error]state wrong: %v, %v", state, stored)
+	}
+	entries, err := ReadJournal(journal.Path, "run_1")
+	if err != nil || len(entries) != 2 || entries[1].OktaUserID != "00u_aaa_user" || entries[1].Error == "" {
+		t.Fatalf("Syncer.Apply [Group Error]journal wrong: %v, %v", entries, err)
+	}
+	actions, err := PlanRollback(entries, state)
+	if err != nil || len(actions) != 1 || actions[0].Action != rollbackDeleteUser || actions[0].OktaUserID != "00u_aaa_user" {
+		t.Errorf("PlanRollback [Group Error]wrong: %v, %v", actions, err)
+	}
+
+	// Pattern: [Group Retry] 次の同期は作成ではなく更新でグループだけ追加する
+	delete(okta.failGroups, "00g_everyone")
+	diff, _ = DefaultMapping().Diff(state.Accounts(), &accounts)
+	diff = ReconcileDiff(diff, state, &accounts)
+	if len(diff[CreateKey]) != 0 || len(diff[UpdateKey]) != 1 {
+		t.Fatalf("Syncer.Apply [Group Retry]diff wrong: %v", diff)
+	}
+	okta.calls = nil
+	state, failures, err = syncer.Apply(state, diff)
+	if err != nil || len(failures) != 0 {
+		t.Fatalf("Syncer.Apply [Group Retry]exec failed: %v, %v", err, failures)
+	}
+	if len(state) != 1 || state[0].OktaUserID != "00u_aaa_user" || len(state[0].OktaGroupIDs) != 1 || state[0].Reconcile {
+		t.Errorf("Syncer.Apply [Group Retry]state wrong: %v", state)
+	}
+	if !contains(okta.groups["00g_everyone"], "00u_aaa_user") || contains(okta.calls, "POST /api/v1/users") {
+		t.Errorf("Syncer.Apply [Group Retry]okta calls wrong: %v, %v", okta.groups, okta.calls)
+	}
+}
+
+func TestSyncerApplyStop(t *testing.T) {
+	// 子プロセス: 最初のアカウントの作成中にSIGTERMを受け取る
+	if os.Getenv("PERMAN_TEST_STOP") != "" {
+		okta := newFakeOkta()
+		srv, oktaClient := okta.start()
+		defer srv.Close()
+		stop := stopSignal()
+		okta.created = func(user OktaUser) {
+			fmt.Println("created")
+			<-stop
+		}
+		diff, _ := DefaultMapping().Diff(&[]Account{}, &testAccounts)
+		state, failures, err := Syncer{Okta: oktaClient, Groups: []string{"everyone"}, Stop: stop}.Apply(State{}, diff)
+		fmt.Printf("%d %d %v\n", len(state), len(failures), err)
+		return
+	}
+
+	// Pattern: [Signal] SIGTERMを受け取った子プロセスは実行中のアカウントを反映してから中断する
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSyncerApplyStop$")
+	cmd.Env = append(os.Environ(), "PERMAN_TEST_STOP=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(stdout)
+	if !lines.Scan() || lines.Text() != "created" {
+		cmd.Process.Kill()
+		t.Fatalf("Syncer.Apply [Signal]child not started: %q", lines.Text())
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	lines.Scan()
+	result := lines.Text()
+	for lines.Scan() {
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Syncer.Apply [Signal]child failed: %v", err)
+	}
+	if expected := fmt.Sprintf("1 0 %v", errSyncStopped); result != expected {
+		t.Errorf("Syncer.Apply [Signal]wrong: %q, expected %q", result, expected)
+	}
+}
+
+// recordingStore Upsertされた状態を記録するStateStore
+type recordingStore struct {
+	StateStore
+	upserts []AccountState
+	err     error
+}
+
+func (s *recordingStore) Upsert(data AccountState) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.upserts = append(s.upserts, data)
+	return s.StateStore.Upsert(data)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	// defaultWatchBatchDelay 最初の変更を受け取ってから反映するまでの待ち時間（その間の変更をまとめて反映します）
+	defaultWatchBatchDelay = 2 * time.Second
+	// watchRetryDelay 反映に失敗したアカウントを全件取得で反映し直すまでの待ち時間
+	watchRetryDelay = 5 * time.Minute
+	// watchReconnectDelay 接続が切れた場合に接続し直すまでの最大の待ち時間
+	watchReconnectDelay = time.Minute
+	// metaSyncreplCookie 検索毎のsyncreplのcookieを保存するStateMetaのキー
+	metaSyncreplCookie = "ldap.syncrepl."
+)
+
+// watchEvent 検索（Watcher.Searchesの添字）毎のSyncEvent
+type watchEvent struct {
+	search int
+	SyncEvent
+	err        error  // 検索が終了した（接続し直します）
+	previousDn string // modrdnの前のDN（分かった場合だけ）
+}
+
+// Watcher syncreplで受け取ったLDAPの変更をまとめてOktaに反映します。
+// 起動時とFullInterval毎に全件取得して突き合わせ、削除の通知漏れや反映に失敗したアカウントを反映します。
+type Watcher struct {
+	Searches     []LdapSearch
+	Connect      func() (*SyncreplConn, error) // LDAPサーバーに接続してbindします
+	Cookies      map[int][]byte                // 検索毎の再開位置（状態に保存したもの）
+	BatchDelay   time.Duration
+	FullInterval time.Duration
+	// Apply 変更を反映してcookiesを保存します（okがfalseの場合は一部のアカウントが失敗、
+	// reconcileがtrueの場合は前のDNが分からないmodrdnがあったため全件取得で突き合わせます）
+	Apply func(events []watchEvent, cookies map[int][]byte) (ok, reconcile bool)
+	// Reconcile 全件取得して突き合わせます（falseの場合は一部のアカウントが失敗）
+	Reconcile func() bool
+
+	uuids map[string]string // entryUUIDと最後に受け取ったDN（modrdnの前のDNを調べるため）
+}
+
+// Run ctxが終了するまで変更を受け取って反映します（反映中の変更は反映し終わってから終了します）
+func (w *Watcher) Run(ctx context.Context) error {
+	if !w.Reconcile() {
+		slog.Warn("watch: some accounts failed", logAttrs(logOpWatch, "retry", watchRetryDelay)...)
+	}
+
+	w.uuids = map[string]string{}
+	events := make(chan watchEvent)
+	sessionCtx, stop := context.WithCancel(context.Background())
+	defer stop()
+	for i := range w.Searches {
+		go w.session(sessionCtx, i, events)
+	}
+
+	full := time.NewTimer(w.FullInterval)
+	defer full.Stop()
+	var batchC <-chan time.Time
+	var pending []watchEvent
+	cookies := map[int][]byte{}
+	needFull := false
+
+	apply := func() {
+		if len(pending) > 0 || len(cookies) > 0 {
+			ok, reconcile := w.Apply(pending, cookies)
+			if !ok {
+				slog.Warn("watch: some accounts failed", logAttrs(logOpWatch, "retry", watchRetryDelay)...)
+				full.Reset(watchRetryDelay)
+			}
+			if reconcile {
+				slog.Info("watch: renamed entries with an unknown previous dn, reconciling", logAttrs(logOpWatch)...)
+				needFull = true
+			}
+		}
+		pending, cookies = nil, map[int][]byte{}
+		batchC = nil
+		if needFull {
+			needFull = false
+			w.reconcile(full)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			apply()
+			slog.Info("watch: stopped", logAttrs(logOpWatch)...)
+			return nil
+
+		case event := <-events:
+			switch {
+			case event.err == errSyncRefreshRequired:
+				slog.Warn("watch failed", logAttrs(logOpWatch, "search", w.Searches[event.search].String(), "error", event.err)...)
+				cookies[event.search] = nil
+				needFull = true
+			case event.err != nil:
+				slog.Warn("watch failed, reconnecting", logAttrs(logOpWatch, "search", w.Searches[event.search].String(), "error", event.err)...)
+				continue
+			case event.State == syncStateAdd || event.State == syncStateModify || event.State == syncStateDelete:
+				w.rename(&event)
+				pending = append(pending, event)
+			case event.State == syncStatePresent:
+				w.rename(&event)
+			}
+			if event.Cookie != nil {
+				cookies[event.search] = event.Cookie
+			}
+			if event.UnknownDeletes {
+				needFull = true
+			}
+			if event.RefreshDone {
+				slog.Debug("watch: refresh done", logAttrs(logOpWatch, "search", w.Searches[event.search].String())...)
+			}
+			if batchC == nil {
+				batchC = time.After(w.BatchDelay)
+			}
+
+		case <-batchC:
+			apply()
+
+		case <-full.C:
+			w.reconcile(full)
+		}
+	}
+}
+
+// rename entryUUIDの前のDNと異なる場合（modrdn）はpreviousDnを設定します
+func (w *Watcher) rename(event *watchEvent) {
+	if event.UUID == "" {
+		return
+	}
+	if event.State == syncStateDelete {
+		delete(w.uuids, event.UUID)
+		return
+	}
+	if previous, ok := w.uuids[event.UUID]; ok && dnKey(previous) != dnKey(event.DN) {
+		event.previousDn = previous
+	}
+	w.uuids[event.UUID] = event.DN
+}
+
+func (w *Watcher) reconcile(full *time.Timer) {
+	full.Stop()
+	if w.Reconcile() {
+		full.Reset(w.FullInterval)
+		return
+	}
+	slog.Warn("watch: some accounts failed", logAttrs(logOpWatch, "retry", watchRetryDelay)...)
+	full.Reset(watchRetryDelay)
+}
+
+// session 検索を1つ実行し、受け取った変更をeventsに送ります。接続が切れた場合は最後のcookieから再開します
+func (w *Watcher) session(ctx context.Context, search int, events chan<- watchEvent) {
+	cookie := w.Cookies[search]
+	delay := time.Second
+	send := func(event watchEvent) bool {
+		select {
+		case events <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for ctx.Err() == nil {
+		conn, err := w.Connect()
+		if err == nil {
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+			err = conn.Watch(w.Searches[search], cookie, func(event SyncEvent) error {
+				delay = time.Second
+				if event.Cookie != nil {
+					cookie = event.Cookie
+				}
+				if !send(watchEvent{search: search, SyncEvent: event}) {
+					return ctx.Err()
+				}
+				return nil
+			})
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errSyncRefreshRequired {
+			cookie = nil
+		}
+		if !send(watchEvent{search: search, SyncEvent: SyncEvent{State: syncStateInfo}, err: err}) {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > watchReconnectDelay {
+			delay = watchReconnectDelay
+		}
+	}
+}
+
+// EventsDiff 受け取った変更を状態と比較した差分（同じDNは検索毎に最後の変更を使い、複数の検索の変更は最初の検索を使います）。
+// modrdnは前のDNの削除と新しいDNの追加にします。
+// 削除（検索の範囲外になった場合を含む）は、変更のなかった他の検索の範囲に含まれる場合はlookupで取得し直し、
+// 他の検索のfilterにまだ一致する場合は削除しません。
+// 状態にないDNの変更（前のDNが分からないmodrdn）があった場合はreconcileにtrueを返します。
+func EventsDiff(mapping Mapping, state State, searches []LdapSearch, events []watchEvent,
+	lookup func(dn string, search LdapSearch) (*ldap.Entry, error)) (diff DiffResult, reconcile bool, err error) {
+
+	index := state.Index()
+	latest := map[string]map[int]watchEvent{} // key: dnKey, 検索毎の最後の変更
+	var dns []string
+	add := func(event watchEvent) {
+		if _, ok := latest[dnKey(event.DN)]; !ok {
+			latest[dnKey(event.DN)] = map[int]watchEvent{}
+			dns = append(dns, dnKey(event.DN))
+		}
+		latest[dnKey(event.DN)][event.search] = event
+	}
+	for _, event := range events {
+		if event.previousDn != "" {
+			add(watchEvent{search: event.search, SyncEvent: SyncEvent{State: syncStateDelete, DN: event.previousDn}})
+		} else if _, ok := index[dnKey(event.DN)]; !ok && event.State == syncStateModify && latest[dnKey(event.DN)] == nil {
+			reconcile = true
+		}
+		add(event)
+	}
+
+	localData := []Account{}
+	serverData := []Account{}
+	for _, dn := range dns {
+		data, ok := index[dn]
+		if ok {
+			localData = append(localData, data.Account)
+		}
+		entry, search := presentEntry(latest[dn], len(searches))
+		if entry == nil && ok {
+			// 削除の前に他の検索のfilterにまだ一致するか確認します
+			if entry, search, err = lookupEntry(data.Dn, latest[dn], searches, lookup); err != nil {
+				return nil, false, err
+			}
+		}
+		if entry != nil {
+			serverData = append(serverData, ConvertEntries([]*ldap.Entry{entry}, searches[search].AttributeMap())...)
+		}
+	}
+	diff, err = mapping.Diff(&localData, &serverData)
+	return diff, reconcile, err
+}
+
+// presentEntry 検索毎の最後の変更のうち、最初の検索の追加、変更のエントリ（全ての検索が削除の場合はnil）
+func presentEntry(events map[int]watchEvent, searches int) (*ldap.Entry, int) {
+	for i := 0; i < searches; i++ {
+		if event, ok := events[i]; ok && event.State != syncStateDelete && event.Entry != nil {
+			return event.Entry, i
+		}
+	}
+	return nil, 0
+}
+
+// lookupEntry 変更のなかった検索のうち、範囲にdnを含む検索でdnを取得します（どの検索にも一致しない場合はnil）
+func lookupEntry(dn string, events map[int]watchEvent, searches []LdapSearch,
+	lookup func(dn string, search LdapSearch) (*ldap.Entry, error)) (*ldap.Entry, int, error) {
+
+	for i, search := range searches {
+		if _, ok := events[i]; ok || !search.InScope(dn) {
+			continue
+		}
+		entry, err := lookup(dn, search)
+		if err != nil {
+			return nil, 0, fmt.Errorf("ldap: %s: %v", search, err)
+		}
+		if entry != nil {
+			slog.Debug("watch: deleted from a search but still matched by another", logAttrs(logOpWatch, logKeyDn, dn, "search", search.String())...)
+			return entry, i, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// syncreplCookieKey 検索条件毎のcookieのキー（検索条件を変えた場合は最初から同期し直します）
+func syncreplCookieKey(search LdapSearch) string {
+	sum := checksum([]byte(fmt.Sprintf("%s\n%s\n%s", search.BaseDn, search.Scope, search.Filter)))
+	return metaSyncreplCookie + strings.TrimPrefix(sum, "sha256:")[:16]
+}
+
+// LoadSyncreplCookies 状態に保存した検索毎のcookie
+func LoadSyncreplCookies(state StateReader, searches []LdapSearch) (map[int][]byte, error) {
+	cookies := map[int][]byte{}
+	for i, search := range searches {
+		value, err := state.Meta(syncreplCookieKey(search))
+		if err != nil {
+			return nil, err
+		}
+		if value == "" {
+			continue
+		}
+		if cookies[i], err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("invalid syncrepl cookie for %s in the state: %v", search, err)
+		}
+	}
+	return cookies, nil
+}
+
+// SaveSyncreplCookies 検索毎のcookieを状態に保存します（nilの場合は削除）
+func SaveSyncreplCookies(tx StateTx, searches []LdapSearch, cookies map[int][]byte) error {
+	for i, cookie := range cookies {
+		if err := tx.SetMeta(syncreplCookieKey(searches[i]), base64.StdEncoding.EncodeToString(cookie)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
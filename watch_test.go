@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestEventsDiff(t *testing.T) {
+	state := State{
+		{Account: Account{Dn: "uid=aaa_user,dc=example,dc=com", UID: "aaa_user", Email: "aaa_user@example.com"}},
+		{Account: Account{Dn: "uid=bbb_user,dc=example,dc=com", UID: "bbb_user", Email: "bbb_user@example.com"}},
+		{Account: Account{Dn: "uid=ccc_user,dc=example,dc=com", UID: "ccc_user", Email: "ccc_user@example.com"}},
+	}
+	searches := []LdapSearch{
+		{BaseDn: "dc=example,dc=com", Filter: "(uid=*)"},
+		{BaseDn: "ou=partners,dc=example,dc=com", Filter: "(uid=*)", Attributes: map[string]string{"email": "mail"}},
+	}
+	entry := func(uid, attribute, email string) *ldap.Entry {
+		return ldap.NewEntry("uid="+uid+",dc=example,dc=com", map[string][]string{"uid": {uid}, attribute: {email}})
+	}
+	event := func(search, state int, dn string, entry *ldap.Entry) watchEvent {
+		return watchEvent{search: search, SyncEvent: SyncEvent{State: state, DN: dn, Entry: entry}}
+	}
+	events := []watchEvent{
+		// Pattern: [Update] 同じDNは最後の変更を使う
+		event(0, syncStateModify, "uid=aaa_user,dc=example,dc=com", entry("aaa_user", "email", "old@example.com")),
+		event(0, syncStateModify, "uid=aaa_user,dc=example,dc=com", entry("aaa_user", "email", "new@example.com")),
+		// Pattern: [Delete]
+		event(0, syncStateDelete, "uid=bbb_user,dc=example,dc=com", nil),
+		// Pattern: [Create] 検索毎の属性名で変換する
+		event(1, syncStateAdd, "uid=ddd_user,dc=example,dc=com", entry("ddd_user", "mail", "ddd_user@example.com")),
+		// Pattern: [NoChange] 変更のないエントリ（refreshのadd）
+		event(0, syncStateAdd, "uid=ccc_user,dc=example,dc=com", entry("ccc_user", "email", "ccc_user@example.com")),
+		// Pattern: [DnCase] DNの大文字小文字の違いは同じアカウント
+		event(0, syncStateAdd, "UID=ccc_user,DC=example,DC=com",
+			ldap.NewEntry("UID=ccc_user,DC=example,DC=com", map[string][]string{"uid": {"ccc_user"}, "email": {"ccc_user@example.com"}})),
+	}
+	lookup := func(dn string, search LdapSearch) (*ldap.Entry, error) {
+		t.Errorf("EventsDiff lookup called: %s, %s", dn, search)
+		return nil, nil
+	}
+	diff, reconcile, err := EventsDiff(DefaultMapping(), state, searches, events, lookup)
+	if err != nil || reconcile {
+		t.Fatalf("EventsDiff failed: %v, %v", err, reconcile)
+	}
+	if len(diff[UpdateKey]) != 1 || diff[UpdateKey][0].Email != "new@example.com" {
+		t.Errorf("EventsDiff [Update]wrong: %+v", diff[UpdateKey])
+	}
+	if len(diff[DeleteKey]) != 1 || diff[DeleteKey][0].UID != "bbb_user" {
+		t.Errorf("EventsDiff [Delete]wrong: %+v", diff[DeleteKey])
+	}
+	if len(diff[CreateKey]) != 1 || diff[CreateKey][0].Email != "ddd_user@example.com" {
+		t.Errorf("EventsDiff [Create]wrong: %+v", diff[CreateKey])
+	}
+}
+
+func TestEventsDiffSearches(t *testing.T) {
+	partner := func(uid string) string {
+		return "uid=" + uid + ",ou=partners,dc=example,dc=com"
+	}
+	state := State{
+		{Account: Account{Dn: partner("aaa_user"), UID: "aaa_user", Email: "aaa_user@example.com"}},
+		{Account: Account{Dn: partner("bbb_user"), UID: "bbb_user", Email: "bbb_user@example.com"}},
+		{Account: Account{Dn: "uid=eee_user,dc=example,dc=com", UID: "eee_user", Email: "eee_user@example.com"}},
+	}
+	searches := []LdapSearch{
+		{BaseDn: "dc=example,dc=com", Filter: "(&(uid=*)(employeeType=staff))"},
+		{BaseDn: "ou=partners,dc=example,dc=com", Scope: scopeOne, Filter: "(uid=*)", Attributes: map[string]string{"email": "mail"}},
+	}
+	entries := map[string]*ldap.Entry{
+		partner("aaa_user"): ldap.NewEntry(partner("aaa_user"), map[string][]string{"uid": {"aaa_user"}, "mail": {"aaa_user@example.com"}}),
+	}
+	var lookups []string
+	lookup := func(dn string, search LdapSearch) (*ldap.Entry, error) {
+		lookups = append(lookups, dn+" "+search.String())
+		return entries[dn], nil
+	}
+	event := func(state int, dn, uid string) watchEvent {
+		var entry *ldap.Entry
+		if state != syncStateDelete {
+			entry = ldap.NewEntry(dn, map[string][]string{"uid": {uid}, "email": {uid + "@example.com"}})
+		}
+		return watchEvent{search: 0, SyncEvent: SyncEvent{State: state, DN: dn, Entry: entry}}
+	}
+
+	// Pattern: [Other Search] 削除されても他の検索のfilterに一致する場合は削除しない
+	// Pattern: [Out Of Scope] どの検索にも一致しない場合は削除する
+	// Pattern: [Modrdn] 前のDNの削除と新しいDNの作成
+	renamed := event(syncStateModify, "uid=fff_user,dc=example,dc=com", "fff_user")
+	renamed.previousDn = "uid=eee_user,dc=example,dc=com"
+	events := []watchEvent{
+		event(syncStateDelete, partner("aaa_user"), ""),
+		event(syncStateDelete, partner("bbb_user"), ""),
+		renamed,
+	}
+	diff, reconcile, err := EventsDiff(DefaultMapping(), state, searches, events, lookup)
+	if err != nil || reconcile {
+		t.Fatalf("EventsDiff failed: %v, %v", err, reconcile)
+	}
+	if len(lookups) != 2 || lookups[0] != partner("aaa_user")+" "+searches[1].String() {
+		t.Errorf("EventsDiff [Other Search]lookups wrong: %v", lookups)
+	}
+	if len(diff[DeleteKey]) != 2 || diff[DeleteKey][0].UID != "bbb_user" || diff[DeleteKey][1].UID != "eee_user" {
+		t.Errorf("EventsDiff [Out Of Scope]deletes wrong: %+v", diff[DeleteKey])
+	}
+	if len(diff[CreateKey]) != 1 || diff[CreateKey][0].Dn != "uid=fff_user,dc=example,dc=com" || len(diff[UpdateKey]) != 0 {
+		t.Errorf("EventsDiff [Modrdn]wrong: %+v", diff)
+	}
+
+	// Pattern: [Reconcile] 状態にないDNの変更（前のDNが分からないmodrdn）は全件取得で突き合わせる
+	events = []watchEvent{event(syncStateModify, "uid=ggg_user,dc=example,dc=com", "ggg_user")}
+	diff, reconcile, err = EventsDiff(DefaultMapping(), state, searches, events, lookup)
+	if err != nil || !reconcile || len(diff[CreateKey]) != 1 {
+		t.Errorf("EventsDiff [Reconcile]wrong: %v, %v, %+v", err, reconcile, diff)
+	}
+	events = []watchEvent{
+		event(syncStateAdd, "uid=ggg_user,dc=example,dc=com", "ggg_user"),
+		event(syncStateModify, "uid=ggg_user,dc=example,dc=com", "ggg_user"),
+	}
+	if _, reconcile, _ = EventsDiff(DefaultMapping(), state, searches, events, lookup); reconcile {
+		t.Errorf("EventsDiff [Reconcile]add and modify wrong: %v", reconcile)
+	}
+
+	// Pattern: [Lookup Error] 他の検索を確認できない場合はエラー
+	events = []watchEvent{event(syncStateDelete, partner("bbb_user"), "")}
+	_, _, err = EventsDiff(DefaultMapping(), state, searches, events, func(dn string, search LdapSearch) (*ldap.Entry, error) {
+		return nil, errors.New("connection refused")
+	})
+	if err == nil {
+		t.Errorf("EventsDiff [Lookup Error]error not returned")
+	}
+}
+
+func TestWatcherRename(t *testing.T) {
+	w := &Watcher{uuids: map[string]string{}}
+	event := func(state int, dn string) watchEvent {
+		event := watchEvent{SyncEvent: SyncEvent{State: state, DN: dn, UUID: "uuid-1"}}
+		w.rename(&event)
+		return event
+	}
+	// Pattern: [Modrdn] 同じentryUUIDのDNが変わった場合は前のDN
+	event(syncStateAdd, "uid=aaa_user,dc=example,dc=com")
+	if renamed := event(syncStateModify, "uid=aaa_user2,dc=example,dc=com"); renamed.previousDn != "uid=aaa_user,dc=example,dc=com" {
+		t.Errorf("Watcher.rename [Modrdn]wrong: %q", renamed.previousDn)
+	}
+	// Pattern: [Same] DNが変わらない（大文字小文字だけ）場合は設定しない
+	if modified := event(syncStateModify, "UID=aaa_user2,DC=example,DC=com"); modified.previousDn != "" {
+		t.Errorf("Watcher.rename [Same]wrong: %q", modified.previousDn)
+	}
+	// Pattern: [Delete] 削除したentryUUIDは忘れる
+	event(syncStateDelete, "uid=aaa_user2,dc=example,dc=com")
+	if added := event(syncStateAdd, "uid=aaa_user3,dc=example,dc=com"); added.previousDn != "" || len(w.uuids) != 1 {
+		t.Errorf("Watcher.rename [Delete]wrong: %q, %v", added.previousDn, w.uuids)
+	}
+}
+
+func TestSyncreplCookies(t *testing.T) {
+	dir, err := ioutil.TempDir("tmp", "syncrepl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	searches := []LdapSearch{
+		{BaseDn: "ou=people,dc=example,dc=com", Filter: "(uid=*)"},
+		{BaseDn: "ou=partners,dc=example,dc=com", Filter: "(uid=*)"},
+	}
+	store := &JSONStateStore{File: StateFile{Path: filepath.Join(dir, "state.json")}}
+	if err := store.Transaction(func(tx StateTx) error {
+		return SaveSyncreplCookies(tx, searches, map[int][]byte{0: []byte("rid=001,csn=20240101"), 1: []byte("rid=002")})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cookies, err := LoadSyncreplCookies(store, searches)
+	if err != nil || string(cookies[0]) != "rid=001,csn=20240101" || string(cookies[1]) != "rid=002" {
+		t.Errorf("LoadSyncreplCookies wrong: %v, %v", cookies, err)
+	}
+
+	// Pattern: [Clear] nilのcookieは削除する（最初から同期し直す）
+	if err := store.Transaction(func(tx StateTx) error {
+		return SaveSyncreplCookies(tx, searches, map[int][]byte{1: nil})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cookies, _ := LoadSyncreplCookies(store, searches); len(cookies) != 1 || cookies[1] != nil {
+		t.Errorf("LoadSyncreplCookies [Clear]wrong: %v", cookies)
+	}
+
+	// Pattern: [Search] 検索条件を変えた場合は保存したcookieを使わない
+	searches[0].Filter = "(&(uid=*)(objectClass=person))"
+	if cookies, _ := LoadSyncreplCookies(store, searches); len(cookies) != 0 {
+		t.Errorf("LoadSyncreplCookies [Search]wrong: %v", cookies)
+	}
+}